@@ -0,0 +1,186 @@
+package sockethook
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of log entries
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Logger of access entries, nil if access logging is disabled. Access entries are written regardless of the
+// log level and sampling.
+var accessLogger *log.Logger
+
+// Kinds of access entries
+const (
+	accessRequest    = "request"
+	accessHook       = "hook"
+	accessConnect    = "connect"
+	accessStream     = "stream"
+	accessDisconnect = "disconnect"
+)
+
+// logFormatter returns the formatter of a log format
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case logFormatText:
+		return &log.TextFormatter{}, nil
+	case logFormatJSON:
+		return &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+}
+
+// newAccessLogger creates a logger writing access entries to a file, or to standard output if path is -
+func newAccessLogger(path string, formatter log.Formatter) (*log.Logger, error) {
+	logger := log.New()
+	logger.Formatter = formatter
+	if path == "-" {
+		logger.Out = os.Stdout
+		return logger, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Out = file
+	return logger, nil
+}
+
+type accessKey struct{}
+
+// accessEntry records the response to a request for its access entry, handlers adding what they know about it
+type accessEntry struct {
+	http.ResponseWriter
+	status  int
+	written int64
+
+	kind     string
+	endpoint string
+	id       string
+	// Size and SHA-256 of the hook's body and number of clients it was broadcast to
+	size       int
+	bodySHA256 string
+	clients    int
+}
+
+func (e *accessEntry) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *accessEntry) Write(data []byte) (int, error) {
+	if e.status == 0 {
+		e.status = 200
+	}
+	n, err := e.ResponseWriter.Write(data)
+	e.written += int64(n)
+	return n, err
+}
+
+// Flush lets event streams flush through the entry
+func (e *accessEntry) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades take over the connection through the entry
+func (e *accessEntry) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := e.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	e.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// logAccess wraps a handler to write an access entry for every request once it's answered
+func logAccess(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if accessLogger == nil {
+			handler(w, r)
+			return
+		}
+
+		start := time.Now()
+		entry := &accessEntry{ResponseWriter: w, kind: accessRequest}
+		handler(entry, r.WithContext(context.WithValue(r.Context(), accessKey{}, entry)))
+		if entry.status == 0 {
+			entry.status = 200
+		}
+
+		fields := log.Fields{
+			"event":       entry.kind,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      entry.status,
+			"bytes":       entry.written,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_ip":   remoteIP(r),
+		}
+		if entry.endpoint != "" {
+			fields["endpoint"] = entry.endpoint
+		}
+		if entry.id != "" {
+			fields["id"] = entry.id
+		}
+		if entry.kind == accessHook {
+			fields["size"] = entry.size
+			fields["clients"] = entry.clients
+			if entry.bodySHA256 != "" {
+				fields["body_sha256"] = entry.bodySHA256
+			}
+		}
+		accessLogger.WithFields(fields).Infoln("Access")
+	}
+}
+
+// accessFor returns the access entry of a request, nil if access logging is disabled
+func accessFor(r *http.Request) *accessEntry {
+	entry, _ := r.Context().Value(accessKey{}).(*accessEntry)
+	return entry
+}
+
+// record sets what a handler knows about a request, doing nothing if access logging is disabled
+func (e *accessEntry) record(kind string, endpoint string, id string) {
+	if e == nil {
+		return
+	}
+	e.kind, e.endpoint, e.id = kind, endpoint, id
+}
+
+// broadcast sets the size and SHA-256 of a hook's body and the number of clients it was broadcast to
+func (e *accessEntry) broadcast(size int, bodySHA256 string, clients int) {
+	if e == nil {
+		return
+	}
+	e.size, e.bodySHA256, e.clients = size, bodySHA256, clients
+}
+
+// logDisconnect writes the access entry of a websocket client disconnecting, with how long it was connected
+func logDisconnect(c *client) {
+	if accessLogger == nil {
+		return
+	}
+	accessLogger.WithFields(log.Fields{
+		"event":       accessDisconnect,
+		"endpoint":    c.endpoint,
+		"id":          c.id,
+		"remote_ip":   c.ip,
+		"duration_ms": float64(time.Since(c.connected)) / float64(time.Millisecond),
+	}).Infoln("Access")
+}
@@ -0,0 +1,217 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Endpoints or patterns whose messages must be acknowledged by websocket clients
+var ackEndpoints []string
+
+// How long a client has to acknowledge a message before it's sent again, doubling with every retry
+var ackTimeout = 5 * time.Second
+
+// Number of times an unacknowledged message is sent again before it's dead-lettered
+var ackMaxRetries = 5
+
+// URL dead-lettered messages are POSTed to, they're only logged if empty
+var deadLetterURL string
+
+// AckFrame is sent by clients to acknowledge the message with the given ID
+type AckFrame struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// DeadLetter describes a message which couldn't be delivered to a client or forward target
+type DeadLetter struct {
+	Endpoint     string  `json:"endpoint"`
+	ConnectionID string  `json:"connection_id,omitempty"`
+	Reason       string  `json:"reason"`
+	Attempts     int     `json:"attempts"`
+	Message      Message `json:"message"`
+	// URL a forwarded hook couldn't be delivered to
+	Target string `json:"target,omitempty"`
+}
+
+// pendingAck is a message written to a client which hasn't acknowledged it yet
+type pendingAck struct {
+	msg   Message
+	timer *time.Timer
+}
+
+type ackKey struct {
+	c  *client
+	id string
+}
+
+// Messages waiting for acknowledgement, per client and message ID
+var pendingAcks = struct {
+	sync.Mutex
+	waiting map[ackKey]*pendingAck
+}{waiting: make(map[ackKey]*pendingAck)}
+
+// setAckEndpoints parses the endpoints whose messages must be acknowledged
+func setAckEndpoints(endpoints []string) {
+	for _, endpoint := range endpoints {
+		ackEndpoints = append(ackEndpoints, strings.TrimRight(endpoint, "/"))
+	}
+}
+
+// ackRequired checks if messages on an endpoint must be acknowledged
+func ackRequired(endpoint string) bool {
+	for _, ack := range ackEndpoints {
+		if ack == endpoint || (isPattern(ack) && patternCovers(ack, endpoint)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ackClient checks if a client can acknowledge messages, which event streams can't as they are one-way
+func ackClient(c *client) bool {
+	_, ok := c.conn.(*websocket.Conn)
+	return ok
+}
+
+// expectAck waits for a client to acknowledge a message it has been sent, sending it again with backoff if the
+// acknowledgement doesn't arrive in time
+func expectAck(c *client, msg Message) {
+	key := ackKey{c, msg.ID}
+	timeout := ackTimeout << uint(attempts(msg)-1)
+
+	pendingAcks.Lock()
+	defer pendingAcks.Unlock()
+	pending := &pendingAck{msg: msg}
+	pending.timer = time.AfterFunc(timeout, func() { retryAck(key, pending) })
+	pendingAcks.waiting[key] = pending
+}
+
+// retryAck sends an unacknowledged message again, or dead-letters it once it has been retried too often
+func retryAck(key ackKey, pending *pendingAck) {
+	pendingAcks.Lock()
+	if pendingAcks.waiting[key] != pending {
+		pendingAcks.Unlock()
+		return
+	}
+	delete(pendingAcks.waiting, key)
+	pendingAcks.Unlock()
+
+	msg := pending.msg
+	if attempts(msg) > ackMaxRetries {
+		deadLetter(key.c, msg, "not acknowledged", attempts(msg))
+		return
+	}
+
+	// Clients which were removed while the timer ran have had their other messages dead-lettered already
+	hub.mu.Lock()
+	closed := key.c.closed
+	hub.mu.Unlock()
+	if closed {
+		deadLetter(key.c, msg, "client disconnected", attempts(msg))
+		return
+	}
+
+	log.WithFields(log.Fields{"endpoint": msg.Endpoint, "id": msg.ID, "attempt": attempts(msg) + 1}).Debugln("Resending unacknowledged message")
+	msg.Attempt = attempts(msg) + 1
+	if !key.c.queue(msg) {
+		deadLetter(key.c, msg, "client too slow", attempts(msg))
+	}
+}
+
+// attempts returns the number of times a message has been sent to a client
+func attempts(msg Message) int {
+	if msg.Attempt == 0 {
+		return 1
+	}
+	return msg.Attempt
+}
+
+// handleAckFrame stops waiting for the acknowledgement of a message
+func handleAckFrame(c *client, id string) {
+	pendingAcks.Lock()
+	pending, ok := pendingAcks.waiting[ackKey{c, id}]
+	delete(pendingAcks.waiting, ackKey{c, id})
+	pendingAcks.Unlock()
+
+	if !ok {
+		log.WithField("endpoint", c.endpoint).WithField("id", id).Debugln("Ignoring acknowledgement for unknown message")
+		return
+	}
+	pending.timer.Stop()
+	recordClientDelivery(c, pending.msg, deliveryAcknowledged, "")
+}
+
+// dropAcks dead-letters the messages a removed client never acknowledged
+func dropAcks(c *client) {
+	dropped := []*pendingAck{}
+	pendingAcks.Lock()
+	for key, pending := range pendingAcks.waiting {
+		if key.c == c {
+			pending.timer.Stop()
+			delete(pendingAcks.waiting, key)
+			dropped = append(dropped, pending)
+		}
+	}
+	pendingAcks.Unlock()
+
+	for _, pending := range dropped {
+		deadLetter(c, pending.msg, "client disconnected", attempts(pending.msg))
+	}
+}
+
+// deadLetter logs a message which couldn't be delivered and POSTs it to the dead letter URL, if any
+func deadLetter(c *client, msg Message, reason string, attempts int) {
+	log.WithFields(log.Fields{
+		"endpoint": msg.Endpoint,
+		"id":       msg.ID,
+		"client":   c.id,
+		"reason":   reason,
+		"attempts": attempts,
+	}).Warnln("Message dead-lettered")
+	recordClientDelivery(c, msg, deliveryDeadLettered, reason)
+	exportEvent(otlpSeverityWarn, "message.dead_lettered", "Message dead-lettered", map[string]interface{}{
+		"endpoint":      msg.Endpoint,
+		"message.id":    msg.ID,
+		"connection.id": c.id,
+		"reason":        reason,
+		"attempts":      attempts,
+	})
+
+	postDeadLetter(DeadLetter{
+		Endpoint:     msg.Endpoint,
+		ConnectionID: c.id,
+		Reason:       reason,
+		Attempts:     attempts,
+		Message:      msg,
+	})
+}
+
+// Dead letters are posted on goroutines of their own, so a URL which doesn't answer mustn't keep them forever
+var deadLetterClient = &http.Client{Timeout: 10 * time.Second}
+
+// postDeadLetter POSTs a dead letter to the dead letter URL, if any
+func postDeadLetter(letter DeadLetter) {
+	if deadLetterURL == "" {
+		return
+	}
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+	go func() {
+		resp, err := deadLetterClient.Post(deadLetterURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.WithField("url", deadLetterURL).Warnln("Failed to send dead letter:", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,157 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// deadLetterServer sets the dead letter URL to a server passing on the letters posted to it, returning a
+// function restoring the URL
+func deadLetterServer(t *testing.T) (chan DeadLetter, func()) {
+	letters := make(chan DeadLetter, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var letter DeadLetter
+		if err := json.NewDecoder(r.Body).Decode(&letter); err != nil {
+			t.Errorf("invalid dead letter: %v", err)
+		}
+		letters <- letter
+	}))
+	previous := deadLetterURL
+	deadLetterURL = server.URL
+	return letters, func() {
+		deadLetterURL = previous
+		server.Close()
+	}
+}
+
+// nextDeadLetter waits for a dead letter to be posted
+func nextDeadLetter(t *testing.T, letters chan DeadLetter) DeadLetter {
+	t.Helper()
+	select {
+	case letter := <-letters:
+		return letter
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter posted")
+		return DeadLetter{}
+	}
+}
+
+// nextFrame waits for a frame to be queued for a client which has no writer
+func nextFrame(t *testing.T, c *client) interface{} {
+	t.Helper()
+	select {
+	case v := <-c.send:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame queued")
+		return nil
+	}
+}
+
+func TestAckRequired(t *testing.T) {
+	defer func(previous []string) { ackEndpoints = previous }(ackEndpoints)
+	ackEndpoints = nil
+	setAckEndpoints([]string{"/orders/", "/payments/*"})
+
+	for endpoint, required := range map[string]bool{"/orders": true, "/orders/eu": false, "/payments/eu": true, "/payments": false, "/invoices": false} {
+		if ackRequired(endpoint) != required {
+			t.Errorf("ackRequired(%s) = %v, expected %v", endpoint, !required, required)
+		}
+	}
+}
+
+func TestAckRetriesThenDeadLetters(t *testing.T) {
+	letters, restore := deadLetterServer(t)
+	defer restore()
+	defer func(timeout time.Duration, retries int) { ackTimeout, ackMaxRetries = timeout, retries }(ackTimeout, ackMaxRetries)
+	ackTimeout, ackMaxRetries = 10*time.Millisecond, 2
+
+	endpoint := uniqueEndpoint("/test/ack")
+	c := newClient(&fakeConn{}, endpoint)
+	msg := Message{ID: "m1", Endpoint: endpoint}
+	expectAck(c, msg)
+
+	// Unacknowledged messages are sent again with their attempt, as the writer expects their acknowledgement anew
+	for attempt := 2; attempt <= 3; attempt++ {
+		start := time.Now()
+		resent, ok := nextFrame(t, c).(Message)
+		if !ok || resent.ID != "m1" || resent.Attempt != attempt {
+			t.Fatalf("queued %+v, expected m1 as attempt %d", resent, attempt)
+		}
+		// The timeout doubles with every attempt
+		if waited := time.Since(start); attempt == 3 && waited < 15*time.Millisecond {
+			t.Errorf("attempt %d resent after %v", attempt, waited)
+		}
+		expectAck(c, resent)
+	}
+
+	letter := nextDeadLetter(t, letters)
+	if letter.Endpoint != endpoint || letter.Reason != "not acknowledged" || letter.Attempts != 3 || letter.Message.ID != "m1" || letter.ConnectionID != c.id {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if frames := queuedFrames(c); len(frames) != 0 {
+		t.Errorf("dead-lettered message queued again: %+v", frames)
+	}
+}
+
+func TestAckStopsRetries(t *testing.T) {
+	defer func(timeout time.Duration) { ackTimeout = timeout }(ackTimeout)
+	ackTimeout = 10 * time.Millisecond
+
+	endpoint := uniqueEndpoint("/test/ack")
+	c := newClient(&fakeConn{}, endpoint)
+	expectAck(c, Message{ID: "m1", Endpoint: endpoint})
+	expectAck(c, Message{ID: "m2", Endpoint: endpoint})
+	handleAckFrame(c, "m1")
+	// Acknowledgements of other messages or from other clients are ignored
+	handleAckFrame(c, "unknown")
+	handleAckFrame(newClient(&fakeConn{}, endpoint), "m2")
+
+	if resent := nextFrame(t, c).(Message); resent.ID != "m2" {
+		t.Errorf("resent %s, expected m2", resent.ID)
+	}
+	time.Sleep(5 * ackTimeout)
+	if frames := queuedFrames(c); len(frames) != 0 {
+		t.Errorf("acknowledged message resent: %+v", frames)
+	}
+	dropAcks(c)
+}
+
+func TestAckDeadLettersForDisconnectedClients(t *testing.T) {
+	letters, restore := deadLetterServer(t)
+	defer restore()
+	defer func(timeout time.Duration) { ackTimeout = timeout }(ackTimeout)
+
+	// Messages a removed client never acknowledged are dead-lettered right away
+	ackTimeout = time.Hour
+	endpoint := uniqueEndpoint("/test/ack")
+	c := newClient(&fakeConn{}, endpoint)
+	expectAck(c, Message{ID: "m1", Endpoint: endpoint})
+	expectAck(c, Message{ID: "m2", Endpoint: endpoint, Attempt: 2})
+	dropAcks(c)
+	attempts := map[string]int{}
+	for i := 0; i < 2; i++ {
+		letter := nextDeadLetter(t, letters)
+		if letter.Reason != "client disconnected" {
+			t.Errorf("unexpected dead letter %+v", letter)
+		}
+		attempts[letter.Message.ID] = letter.Attempts
+	}
+	if attempts["m1"] != 1 || attempts["m2"] != 2 {
+		t.Errorf("dead-lettered after attempts %v, expected m1 after 1 and m2 after 2", attempts)
+	}
+
+	// As are those whose timeout ends after the client closed
+	ackTimeout = 10 * time.Millisecond
+	c = newClient(&fakeConn{}, endpoint)
+	expectAck(c, Message{ID: "m3", Endpoint: endpoint})
+	hub.mu.Lock()
+	c.closed = true
+	hub.mu.Unlock()
+	if letter := nextDeadLetter(t, letters); letter.Reason != "client disconnected" || letter.Message.ID != "m3" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
@@ -0,0 +1,321 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Time the server started, reported as its uptime
+var startTime = time.Now()
+
+// AdminStatus is an overview of the running server served at /admin/status
+type AdminStatus struct {
+	Version    string `json:"version"`
+	InstanceID string `json:"instance_id"`
+	// Current time of the server, when it started and how long ago that was, for checking clock skew
+	ServerTime    string  `json:"server_time"`
+	StartedAt     string  `json:"started_at"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Clients       int     `json:"clients"`
+	Endpoints     int     `json:"endpoints"`
+	// Messages kept for replay and waiting for delivery, over all endpoints
+	Buffered    int  `json:"buffered"`
+	Queued      int  `json:"queued"`
+	Maintenance bool `json:"maintenance"`
+	// Goroutine and queue limits and their utilization
+	Concurrency ConcurrencyStatus `json:"concurrency"`
+}
+
+// EndpointStatus describes an endpoint which is declared or has clients, buffered or queued messages
+type EndpointStatus struct {
+	Endpoint  string `json:"endpoint"`
+	Clients   int    `json:"clients"`
+	Buffered  int    `json:"buffered"`
+	Queued    int    `json:"queued"`
+	Seq       uint64 `json:"seq"`
+	Evictions uint64 `json:"evictions"`
+	// Where the endpoint was declared, option, config or admin, if it was
+	DeclaredBy string `json:"declared_by,omitempty"`
+	// Who to contact about the endpoint, if known
+	Ownership *EndpointOwnership `json:"ownership,omitempty"`
+	// Set if the endpoint is archived
+	Archive *EndpointArchive `json:"archive,omitempty"`
+}
+
+// handleAdmin serves the admin API, which shows the state of the running server and lets operators manage it:
+//
+//	GET    /admin/status
+//	GET    /admin/endpoints
+//	PUT    /admin/endpoints/<endpoint>
+//	DELETE /admin/endpoints/<endpoint>
+//	DELETE /admin/endpoints/<endpoint>/buffer
+//	POST   /admin/endpoints/<endpoint>/secret
+//	POST   /admin/endpoints/<endpoint>/token
+//	GET    /admin/rotations
+//	GET    /admin/archived
+//	POST   /admin/endpoints/<endpoint>/archive
+//	POST   /admin/endpoints/<endpoint>/restore
+//	POST   /admin/endpoints/<endpoint>/purge
+//	GET    /admin/clients[?endpoint=<endpoint>]
+//	DELETE /admin/clients/<id>
+//	GET    /admin/clients/<id>/liveness
+//	GET    /admin/recordings
+//	POST   /admin/recordings/<endpoint>/replay
+//	GET    /admin/export/<endpoint>[?from=&to=&format=ndjson|csv&fields=]
+//	POST   /admin/import/<endpoint>[?broadcast=true&rate=]
+//	GET    /admin/quarantine[?endpoint=<endpoint>]
+//	POST   /admin/quarantine/replay[?endpoint=<endpoint>]
+//	POST   /admin/quarantine/promote?endpoint=<endpoint>
+//	GET    /admin/quarantine/<id>
+//	DELETE /admin/quarantine/<id>
+//	POST   /admin/quarantine/<id>/replay
+//	GET    /admin/messages/<id>/deliveries
+//	GET    /admin/dead-letters[?endpoint=<endpoint>&target=<url>]
+//	POST   /admin/dead-letters/requeue[?endpoint=<endpoint>&target=<url>]
+//	GET    /admin/dead-letters/<id>
+//	DELETE /admin/dead-letters/<id>
+//	POST   /admin/dead-letters/<id>/requeue
+//	GET    /admin/blocklist
+//	POST   /admin/blocklist
+//	DELETE /admin/blocklist/<id>
+//	GET    /admin/temporary
+//	POST   /admin/temporary
+//	DELETE /admin/temporary/<id>
+//	POST   /admin/preview/<endpoint>
+//	GET    /admin/short-urls
+//	POST   /admin/short-urls
+//	DELETE /admin/short-urls/<code>
+//	POST   /admin/short-urls/<code>/rotate
+//	GET    /admin/topology
+//	GET    /admin/standby
+//	POST   /admin/standby/sync
+//	POST   /admin/standby/promote
+func handleAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	switch {
+	case path == "" || path == "/status":
+		allowMethod(w, r, "GET", func() { writeJSON(w, adminStatus()) })
+	case path == "/endpoints":
+		allowMethod(w, r, "GET", func() { writeJSON(w, endpointStatuses()) })
+	case strings.HasPrefix(path, "/endpoints/") && strings.HasSuffix(path, "/buffer"):
+		endpoint := strings.TrimSuffix(strings.TrimPrefix(path, "/endpoints"), "/buffer")
+		allowMethod(w, r, "DELETE", func() {
+			purged := replayBuffer.Purge(endpoint)
+			log.WithField("endpoint", endpoint).WithField("purged", purged).Warnln("Replay buffer purged")
+			writeJSON(w, map[string]interface{}{"endpoint": endpoint, "purged": purged})
+		})
+	case strings.HasPrefix(path, "/endpoints/") && (strings.HasSuffix(path, "/secret") || strings.HasSuffix(path, "/token")):
+		kind := path[strings.LastIndex(path, "/")+1:]
+		endpoint := strings.TrimSuffix(strings.TrimPrefix(path, "/endpoints"), "/"+kind)
+		allowMethod(w, r, "POST", func() { handleRotation(w, r, endpoint, kind) })
+	case path == "/rotations":
+		allowMethod(w, r, "GET", func() { writeJSON(w, endpointRotations()) })
+	case path == "/archived":
+		allowMethod(w, r, "GET", func() { writeJSON(w, archivedEndpoints()) })
+	case strings.HasPrefix(path, "/endpoints/") && (strings.HasSuffix(path, "/archive") || strings.HasSuffix(path, "/restore") || strings.HasSuffix(path, "/purge")):
+		action := path[strings.LastIndex(path, "/")+1:]
+		handleArchive(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/endpoints"), "/"+action), action)
+	case strings.HasPrefix(path, "/endpoints/"):
+		handleDeclaration(w, r, strings.TrimPrefix(path, "/endpoints"))
+	case path == "/clients":
+		allowMethod(w, r, "GET", func() { writeJSON(w, clientReports(r.URL.Query().Get("endpoint"))) })
+	case strings.HasPrefix(path, "/clients/") && strings.HasSuffix(path, "/liveness"):
+		allowMethod(w, r, "GET", func() {
+			id := strings.TrimSuffix(strings.TrimPrefix(path, "/clients/"), "/liveness")
+			hub.mu.Lock()
+			c := hub.client(id)
+			var report ClientLiveness
+			if c != nil {
+				report = c.report()
+			}
+			hub.mu.Unlock()
+
+			if c == nil {
+				http.Error(w, "no connected client with ID "+id, 404)
+				return
+			}
+			writeJSON(w, report)
+		})
+	case recorder != nil && path == "/recordings":
+		allowMethod(w, r, "GET", func() {
+			statuses, err := recorder.Statuses()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			writeJSON(w, statuses)
+		})
+	case recorder != nil && strings.HasPrefix(path, "/recordings/") && strings.HasSuffix(path, "/replay"):
+		endpoint := strings.TrimSuffix(strings.TrimPrefix(path, "/recordings"), "/replay")
+		allowMethod(w, r, "POST", func() { handleRecordingReplay(w, r, endpoint) })
+	case strings.HasPrefix(path, "/export/"):
+		allowMethod(w, r, "GET", func() { handleExport(w, r, strings.TrimPrefix(path, "/export")) })
+	case strings.HasPrefix(path, "/import/"):
+		allowMethod(w, r, "POST", func() { handleImport(w, r, strings.TrimPrefix(path, "/import")) })
+	case path == "/quarantine" || strings.HasPrefix(path, "/quarantine/"):
+		handleQuarantine(w, r, strings.TrimPrefix(path, "/quarantine"))
+	case strings.HasPrefix(path, "/messages/") && strings.HasSuffix(path, "/deliveries"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/messages/"), "/deliveries")
+		allowMethod(w, r, "GET", func() { handleMessageDeliveries(w, r, id) })
+	case path == "/dead-letters" || strings.HasPrefix(path, "/dead-letters/"):
+		handleDeadLetters(w, r, strings.TrimPrefix(path, "/dead-letters"))
+	case path == "/blocklist" || strings.HasPrefix(path, "/blocklist/"):
+		handleBlocklist(w, r, strings.TrimPrefix(path, "/blocklist"))
+	case path == "/topology":
+		allowMethod(w, r, "GET", func() { writeJSON(w, clusterTopology()) })
+	case path == "/standby" || strings.HasPrefix(path, "/standby/"):
+		handleStandby(w, r, strings.TrimPrefix(path, "/standby"))
+	case path == "/short-urls" || strings.HasPrefix(path, "/short-urls/"):
+		handleShortURLs(w, r, strings.TrimPrefix(path, "/short-urls"))
+	case path == "/temporary" || strings.HasPrefix(path, "/temporary/"):
+		handleTemporary(w, r, strings.TrimPrefix(path, "/temporary"))
+	case strings.HasPrefix(path, "/preview/"):
+		allowMethod(w, r, "POST", func() { handlePreview(w, r, strings.TrimPrefix(path, "/preview")) })
+	case strings.HasPrefix(path, "/clients/"):
+		allowMethod(w, r, "DELETE", func() {
+			id := strings.TrimPrefix(path, "/clients/")
+			hub.mu.Lock()
+			c := hub.client(id)
+			hub.mu.Unlock()
+
+			if c == nil {
+				http.Error(w, "no connected client with ID "+id, 404)
+				return
+			}
+			log.WithField("endpoint", c.endpoint).WithField("id", id).Warnln("Disconnecting client on admin request")
+			hub.evict(c.endpoint, c)
+			w.WriteHeader(204)
+		})
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// allowMethod runs a handler if the request has the given method, answering 405 otherwise
+func allowMethod(w http.ResponseWriter, r *http.Request, method string, handle func()) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		w.WriteHeader(405)
+		return
+	}
+	handle()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminStatus returns an overview of the running server
+func adminStatus() AdminStatus {
+	now := time.Now()
+	status := AdminStatus{
+		Version:       version,
+		InstanceID:    instanceID,
+		ServerTime:    now.UTC().Format(time.RFC3339Nano),
+		StartedAt:     startTime.UTC().Format(time.RFC3339Nano),
+		UptimeSeconds: now.Sub(startTime).Seconds(),
+	}
+	status.Maintenance, _ = inMaintenance()
+
+	hub.mu.Lock()
+	seen := make(map[*client]bool)
+	for _, conns := range hub.clients {
+		for _, c := range conns {
+			seen[c] = true
+		}
+	}
+	hub.mu.Unlock()
+	status.Clients = len(seen)
+
+	endpoints := endpointStatuses()
+	status.Endpoints = len(endpoints)
+	for _, endpoint := range endpoints {
+		status.Buffered += endpoint.Buffered
+		status.Queued += endpoint.Queued
+	}
+	status.Concurrency = concurrencyStatus()
+	return status
+}
+
+// endpointStatuses returns every endpoint which is declared or has clients, buffered or queued messages, sorted
+// by endpoint
+func endpointStatuses() []EndpointStatus {
+	statuses := make(map[string]*EndpointStatus)
+	status := func(endpoint string) *EndpointStatus {
+		if _, ok := statuses[endpoint]; !ok {
+			statuses[endpoint] = &EndpointStatus{Endpoint: endpoint}
+		}
+		return statuses[endpoint]
+	}
+
+	hub.mu.Lock()
+	for endpoint, conns := range hub.clients {
+		if len(conns) > 0 {
+			s := status(endpoint)
+			s.Clients = len(conns)
+			s.Evictions = hub.evictions[endpoint]
+		}
+	}
+	hub.mu.Unlock()
+	for endpoint, count := range replayBuffer.Counts() {
+		status(endpoint).Buffered = count
+	}
+	for endpoint, length := range queueLengths() {
+		status(endpoint).Queued = length
+	}
+	for _, endpoint := range declaredEndpoints() {
+		status(endpoint).DeclaredBy = declaredBy(endpoint)
+	}
+	for _, archive := range archivedEndpoints() {
+		status(archive.Endpoint)
+	}
+
+	list := make([]EndpointStatus, 0, len(statuses))
+	for endpoint, s := range statuses {
+		s.Seq = currentSequence(endpoint)
+		s.Ownership = ownershipOf(endpoint)
+		s.Archive = archiveOf(endpoint)
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Endpoint < list[j].Endpoint })
+	return list
+}
+
+// clientReports returns the liveness of all connected clients, or of those subscribed to an endpoint, sorted
+// by when they connected
+func clientReports(endpoint string) []ClientLiveness {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	seen := make(map[*client]bool)
+	clients := []*client{}
+	for subscription, conns := range hub.clients {
+		if endpoint != "" && subscription != endpoint {
+			continue
+		}
+		for _, c := range conns {
+			if !seen[c] {
+				seen[c] = true
+				clients = append(clients, c)
+			}
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].connected.Before(clients[j].connected) })
+
+	reports := make([]ClientLiveness, len(clients))
+	for i, c := range clients {
+		reports[i] = c.report()
+	}
+	return reports
+}
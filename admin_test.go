@@ -0,0 +1,37 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminStatusReportsTimes(t *testing.T) {
+	adminToken = "admin"
+	defer func() { adminToken = "" }()
+
+	before := time.Now()
+	r := httptest.NewRequest("GET", "/admin/status", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	handleAdmin(w, r, "/status")
+	after := time.Now()
+
+	var status AdminStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %q: %v", w.Body.String(), err)
+	}
+	serverTime, err := time.Parse(time.RFC3339Nano, status.ServerTime)
+	if err != nil || serverTime.Before(before) || serverTime.After(after) {
+		t.Errorf("server time %q, expected between %v and %v", status.ServerTime, before, after)
+	}
+	startedAt, err := time.Parse(time.RFC3339Nano, status.StartedAt)
+	if err != nil || !startedAt.Equal(startTime) {
+		t.Errorf("started at %q, expected %v", status.StartedAt, startTime)
+	}
+	// Uptime is measured with the monotonic clock, which may drift slightly from the wall clock
+	if uptime := serverTime.Sub(startedAt).Seconds(); status.UptimeSeconds < uptime-0.001 || status.UptimeSeconds > uptime+0.001 {
+		t.Errorf("uptime %v, expected %v", status.UptimeSeconds, uptime)
+	}
+}
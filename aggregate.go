@@ -0,0 +1,243 @@
+package sockethook
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of messages collected into one summary, later ones in the window only being counted
+var maxAggregateMessages = 1000
+
+// Aggregation modes
+const (
+	// The summary holds the number of messages in the window
+	aggregateCount = "count"
+	// The summary holds the messages of the window in an array
+	aggregateCollect = "collect"
+	// The summary holds the sum, minimum, maximum or average of a number in the messages
+	aggregateSum = "sum"
+	aggregateMin = "min"
+	aggregateMax = "max"
+	aggregateAvg = "avg"
+)
+
+// Aggregations of endpoints given on the command line
+var aggregations = newAggregator(nil)
+
+// aggregation is the window and mode an endpoint or pattern's messages are aggregated with
+type aggregation struct {
+	window time.Duration
+	mode   string
+	// Path of the number reduced by sum, min, max and avg, such as data.bytes
+	path []string
+}
+
+// aggregator collects the messages of aggregated endpoints in windows, broadcasting a single summary message
+// per endpoint when a window ends. A window starts with the first message after the previous one ended, so
+// quiet endpoints don't get empty summaries.
+type aggregator struct {
+	rules map[string]aggregation
+
+	mu      sync.Mutex
+	windows map[string]*aggregateWindow
+}
+
+// aggregateWindow is the state of an endpoint's current window
+type aggregateWindow struct {
+	rule      aggregation
+	start     time.Time
+	timer     *time.Timer
+	count     int
+	messages  []interface{}
+	truncated bool
+	// Numbers found at the path of reducing aggregations
+	numbers       int
+	sum, min, max float64
+}
+
+// AggregateSummary is the data of the message summarizing a window
+type AggregateSummary struct {
+	Aggregate   string        `json:"aggregate"`
+	WindowStart string        `json:"window_start"`
+	WindowEnd   string        `json:"window_end"`
+	Count       int           `json:"count"`
+	Messages    []interface{} `json:"messages,omitempty"`
+	Truncated   bool          `json:"truncated,omitempty"`
+	Path        string        `json:"path,omitempty"`
+	Value       *float64      `json:"value,omitempty"`
+	// Number of messages in which the path held a number
+	Values int `json:"values,omitempty"`
+}
+
+func newAggregator(rules map[string]aggregation) *aggregator {
+	return &aggregator{rules: rules, windows: make(map[string]*aggregateWindow)}
+}
+
+// parseAggregations parses aggregations of the form /endpoint=window:mode, where the mode is count, collect or
+// sum, min, max or avg followed by the path of a number, such as /telemetry=10s:avg:data.temperature
+func parseAggregations(rules []string) (map[string]aggregation, error) {
+	aggregations := make(map[string]aggregation)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid aggregation %q, expected /endpoint=window:mode", rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		if isReserved(endpoint) {
+			return nil, fmt.Errorf("invalid aggregation %q, endpoint is reserved", rule)
+		}
+
+		spec := strings.SplitN(parts[1], ":", 3)
+		if len(spec) < 2 {
+			return nil, fmt.Errorf("invalid aggregation %q, expected /endpoint=window:mode", rule)
+		}
+		window, err := time.ParseDuration(spec[0])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid aggregation window %q", spec[0])
+		}
+
+		a := aggregation{window: window, mode: spec[1]}
+		switch a.mode {
+		case aggregateCount, aggregateCollect:
+			if len(spec) != 2 {
+				return nil, fmt.Errorf("invalid aggregation %q, %s takes no path", rule, a.mode)
+			}
+		case aggregateSum, aggregateMin, aggregateMax, aggregateAvg:
+			if len(spec) != 3 {
+				return nil, fmt.Errorf("invalid aggregation %q, %s needs the path of a number", rule, a.mode)
+			}
+			a.path = strings.Split(spec[2], ".")
+			if a.path[0] != "data" && a.path[0] != "metadata" {
+				return nil, fmt.Errorf("invalid aggregation path %q, expected it to start with data or metadata", spec[2])
+			}
+		default:
+			return nil, fmt.Errorf("invalid aggregation mode %q, expected count, collect, sum, min, max or avg", a.mode)
+		}
+		aggregations[endpoint] = a
+	}
+	return aggregations, nil
+}
+
+// rule returns the aggregation of an endpoint, an exact rule taking precedence over patterns
+func (a *aggregator) rule(endpoint string) (aggregation, bool) {
+	if rule, ok := a.rules[endpoint]; ok {
+		return rule, true
+	}
+	for pattern, rule := range a.rules {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return rule, true
+		}
+	}
+	return aggregation{}, false
+}
+
+// Add adds a message to the current window of its endpoint, returning false if the endpoint isn't aggregated
+func (a *aggregator) Add(msg Message) bool {
+	if len(a.rules) == 0 || isReserved(msg.Endpoint) {
+		return false
+	}
+	rule, ok := a.rule(msg.Endpoint)
+	if !ok {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w, ok := a.windows[msg.Endpoint]
+	if !ok {
+		endpoint := msg.Endpoint
+		w = &aggregateWindow{rule: rule, start: time.Now()}
+		w.timer = time.AfterFunc(rule.window, func() { a.flush(endpoint) })
+		a.windows[endpoint] = w
+	}
+
+	w.count++
+	switch rule.mode {
+	case aggregateCollect:
+		if len(w.messages) < maxAggregateMessages {
+			w.messages = append(w.messages, msg.encode(schemaV1))
+		} else {
+			w.truncated = true
+		}
+	case aggregateSum, aggregateMin, aggregateMax, aggregateAvg:
+		root := msg.Data
+		if rule.path[0] == "metadata" {
+			root = map[string]interface{}(msg.Metadata)
+		}
+		value, ok := lookupPath(root, rule.path[1:])
+		if number, isNumber := value.(float64); ok && isNumber {
+			if w.numbers == 0 {
+				w.min, w.max = number, number
+			}
+			w.numbers++
+			w.sum += number
+			w.min, w.max = math.Min(w.min, number), math.Max(w.max, number)
+		}
+	}
+	return true
+}
+
+// flush ends the current window of an endpoint and broadcasts its summary
+func (a *aggregator) flush(endpoint string) {
+	a.mu.Lock()
+	w, ok := a.windows[endpoint]
+	delete(a.windows, endpoint)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	w.timer.Stop()
+
+	end := time.Now()
+	summary := AggregateSummary{
+		Aggregate:   w.rule.mode,
+		WindowStart: w.start.UTC().Format(time.RFC3339Nano),
+		WindowEnd:   end.UTC().Format(time.RFC3339Nano),
+		Count:       w.count,
+		Messages:    w.messages,
+		Truncated:   w.truncated,
+	}
+	if w.rule.path != nil {
+		summary.Path = strings.Join(w.rule.path, ".")
+		summary.Values = w.numbers
+		if w.numbers > 0 {
+			value := map[string]float64{
+				aggregateSum: w.sum,
+				aggregateMin: w.min,
+				aggregateMax: w.max,
+				aggregateAvg: w.sum / float64(w.numbers),
+			}[w.rule.mode]
+			summary.Value = &value
+		}
+	}
+
+	log.WithFields(log.Fields{"endpoint": endpoint, "aggregate": w.rule.mode, "count": w.count}).Debugln("Broadcasting aggregate")
+	hub.Broadcast(Message{
+		Headers:     map[string]string{},
+		Endpoint:    endpoint,
+		Data:        summary,
+		ContentType: "application/json",
+		received:    end,
+		summary:     true,
+	})
+}
+
+// FlushAll ends all windows right away, such as when shutting down
+func (a *aggregator) FlushAll() {
+	a.mu.Lock()
+	endpoints := make([]string, 0, len(a.windows))
+	for endpoint := range a.windows {
+		endpoints = append(endpoints, endpoint)
+	}
+	a.mu.Unlock()
+
+	for _, endpoint := range endpoints {
+		a.flush(endpoint)
+	}
+}
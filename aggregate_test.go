@@ -0,0 +1,111 @@
+package sockethook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	defer func(max int) { maxAggregateMessages = max }(maxAggregateMessages)
+	maxAggregateMessages = 2
+	defer replayBuffer.SetOverrides(nil)
+
+	number := func(n interface{}) map[string]interface{} {
+		return map[string]interface{}{"reading": map[string]interface{}{"n": n}}
+	}
+	value := func(v float64) *float64 { return &v }
+	tests := []struct {
+		mode     string
+		messages []Message
+		expected AggregateSummary
+	}{
+		{"count", []Message{{}, {}, {}}, AggregateSummary{Count: 3}},
+		// Collected messages beyond the maximum are only counted
+		{"collect", []Message{{ID: "1"}, {ID: "2"}, {ID: "3"}}, AggregateSummary{Count: 3, Truncated: true}},
+		// Messages without a number at the path are counted but not reduced
+		{"sum:data.reading.n", []Message{{Data: number(2.0)}, {Data: number("3")}, {Data: number(5.0)}, {Data: "text"}}, AggregateSummary{Count: 4, Path: "data.reading.n", Value: value(7), Values: 2}},
+		{"min:data.reading.n", []Message{{Data: number(2.0)}, {Data: number(-1.5)}, {Data: number(5.0)}}, AggregateSummary{Count: 3, Path: "data.reading.n", Value: value(-1.5), Values: 3}},
+		{"max:data.reading.n", []Message{{Data: number(-2.0)}, {Data: number(-7.0)}}, AggregateSummary{Count: 2, Path: "data.reading.n", Value: value(-2), Values: 2}},
+		{"avg:metadata.n", []Message{{Metadata: map[string]interface{}{"n": 1.0}}, {Metadata: map[string]interface{}{"n": 4.0}}}, AggregateSummary{Count: 2, Path: "metadata.n", Value: value(2.5), Values: 2}},
+		{"avg:data.reading.n", []Message{{Data: number(nil)}}, AggregateSummary{Count: 1, Path: "data.reading.n"}},
+	}
+	for _, test := range tests {
+		endpoint := uniqueEndpoint("/test/aggregate")
+		rules, err := parseAggregations([]string{endpoint + "=1h:" + test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayBuffer.SetOverrides(map[string]int{endpoint: 10})
+		a := newAggregator(rules)
+		for _, msg := range test.messages {
+			msg.Endpoint = endpoint
+			if !a.Add(msg) {
+				t.Fatalf("%s: message not aggregated", test.mode)
+			}
+		}
+		// Aggregated messages aren't delivered on their own, only the summary once the window ends
+		if delivered := replayBuffer.After(map[string]uint64{endpoint: 0}); len(delivered) != 0 {
+			t.Errorf("%s: %d messages delivered before the window ended", test.mode, len(delivered))
+		}
+		a.FlushAll()
+
+		messages := waitForBuffered(t, endpoint, 0, 1)
+		summary, ok := messages[0].Data.(AggregateSummary)
+		if !ok {
+			t.Fatalf("%s: summary data %T", test.mode, messages[0].Data)
+		}
+		if summary.Aggregate != rules[endpoint].mode {
+			t.Errorf("%s: aggregate %q", test.mode, summary.Aggregate)
+		}
+		if summary.Count != test.expected.Count || summary.Truncated != test.expected.Truncated || summary.Path != test.expected.Path || summary.Values != test.expected.Values {
+			t.Errorf("%s: summary %+v, expected %+v", test.mode, summary, test.expected)
+		}
+		if (summary.Value == nil) != (test.expected.Value == nil) || (summary.Value != nil && *summary.Value != *test.expected.Value) {
+			t.Errorf("%s: value %v, expected %v", test.mode, summary.Value, test.expected.Value)
+		}
+		if test.mode == "collect" && len(summary.Messages) != 2 {
+			t.Errorf("collected %d messages, expected 2", len(summary.Messages))
+		}
+	}
+}
+
+func TestAggregateWindow(t *testing.T) {
+	endpoint := uniqueEndpoint("/test/aggregate/window")
+	rules, err := parseAggregations([]string{"/test/aggregate/window/*=50ms:count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayBuffer.SetOverrides(map[string]int{endpoint: 10})
+	defer replayBuffer.SetOverrides(nil)
+	a := newAggregator(rules)
+	if a.Add(Message{Endpoint: "/test/aggregate/other"}) {
+		t.Error("aggregated an endpoint without aggregation")
+	}
+
+	a.Add(Message{Endpoint: endpoint})
+	a.Add(Message{Endpoint: endpoint})
+	messages := waitForBuffered(t, endpoint, 0, 1)
+	summary := messages[0].Data.(AggregateSummary)
+	start, _ := time.Parse(time.RFC3339Nano, summary.WindowStart)
+	end, _ := time.Parse(time.RFC3339Nano, summary.WindowEnd)
+	if summary.Count != 2 || end.Sub(start) < 50*time.Millisecond {
+		t.Errorf("summary %+v, expected 2 messages in a window of 50ms", summary)
+	}
+
+	// The next message starts a new window
+	a.Add(Message{Endpoint: endpoint})
+	if messages := waitForBuffered(t, endpoint, messages[0].Seq, 1); messages[0].Data.(AggregateSummary).Count != 1 {
+		t.Errorf("second summary %+v, expected 1 message", messages[0].Data)
+	}
+}
+
+func TestParseAggregations(t *testing.T) {
+	for _, rule := range []string{
+		"orders=1s:count", "/orders", "/orders=1s", "/orders=soon:count", "/orders=-1s:count", "/orders=1s:median",
+		"/orders=1s:count:data.n", "/orders=1s:sum", "/orders=1s:sum:headers.n",
+	} {
+		if _, err := parseAggregations([]string{rule}); err == nil {
+			t.Errorf("expected %q to be invalid", rule)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reserved endpoint on which alerts are broadcasted
+const alertsEndpoint = "/sockethook/alerts"
+
+// Alert describes an anomaly detected in the traffic of an endpoint
+type Alert struct {
+	Type        string  `json:"type"`
+	Endpoint    string  `json:"endpoint"`
+	Description string  `json:"description"`
+	Count       int     `json:"count"`
+	Baseline    float64 `json:"baseline"`
+	Time        string  `json:"time"`
+	// Who to contact about the endpoint, if known
+	Ownership *EndpointOwnership `json:"ownership,omitempty"`
+}
+
+// AlertDetector compares the number of hooks per endpoint in each window against a moving baseline, and likewise
+// the number of hooks and clients failing authentication
+type AlertDetector struct {
+	mu sync.Mutex
+
+	// Length of each observation window
+	window time.Duration
+	// Number of times above the baseline which counts as a spike
+	spikeFactor float64
+	// Minimum number of hooks in a window before spikes are reported
+	minCount int
+	// Number of empty windows after which an active endpoint counts as silent
+	silenceWindows int
+	// URLs to which alerts are POSTed as JSON, in addition to the reserved endpoint
+	sinks []string
+
+	counts    map[string]int
+	baselines map[string]float64
+	silent    map[string]int
+	// Authentication failures per endpoint in the current window and their baselines
+	failures         map[string]int
+	failureBaselines map[string]float64
+}
+
+func newAlertDetector(window time.Duration, spikeFactor float64, minCount int, silenceWindows int, sinks []string) *AlertDetector {
+	return &AlertDetector{
+		window:           window,
+		spikeFactor:      spikeFactor,
+		minCount:         minCount,
+		silenceWindows:   silenceWindows,
+		sinks:            sinks,
+		counts:           make(map[string]int),
+		baselines:        make(map[string]float64),
+		silent:           make(map[string]int),
+		failures:         make(map[string]int),
+		failureBaselines: make(map[string]float64),
+	}
+}
+
+// Observe records a hook received on an endpoint
+func (d *AlertDetector) Observe(endpoint string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.counts[endpoint]++
+	d.mu.Unlock()
+}
+
+// ObserveAuthFailure records a hook with an invalid signature or a client with a missing or invalid token on an
+// endpoint
+func (d *AlertDetector) ObserveAuthFailure(endpoint string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.failures[endpoint]++
+	d.mu.Unlock()
+}
+
+// Run evaluates every window until the process exits
+func (d *AlertDetector) Run() {
+	for range time.Tick(d.window) {
+		for _, alert := range d.evaluate() {
+			d.emit(alert)
+		}
+	}
+}
+
+// evaluate closes the current window and returns any alerts it triggered
+func (d *AlertDetector) evaluate() []Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	alerts := []Alert{}
+
+	// Endpoints which either received hooks in this window or have a baseline from earlier ones
+	endpoints := make(map[string]bool)
+	for endpoint := range d.counts {
+		endpoints[endpoint] = true
+	}
+	for endpoint := range d.baselines {
+		endpoints[endpoint] = true
+	}
+
+	for endpoint := range endpoints {
+		count := d.counts[endpoint]
+		baseline, seen := d.baselines[endpoint]
+
+		if seen && count >= d.minCount && float64(count) > baseline*d.spikeFactor {
+			alerts = append(alerts, Alert{
+				Type:        "rate_spike",
+				Endpoint:    endpoint,
+				Description: "Hook rate is far above the usual level",
+				Count:       count,
+				Baseline:    baseline,
+				Time:        now,
+			})
+		}
+
+		if count == 0 {
+			d.silent[endpoint]++
+			if d.silent[endpoint] == d.silenceWindows && baseline >= 1 {
+				alerts = append(alerts, Alert{
+					Type:        "silence",
+					Endpoint:    endpoint,
+					Description: "Endpoint has stopped receiving hooks",
+					Count:       count,
+					Baseline:    baseline,
+					Time:        now,
+				})
+			}
+		} else {
+			d.silent[endpoint] = 0
+		}
+
+		// Update exponential moving average, forgetting endpoints which have gone quiet for good
+		if seen {
+			baseline = 0.8*baseline + 0.2*float64(count)
+		} else {
+			baseline = float64(count)
+		}
+		if baseline < 0.01 {
+			delete(d.baselines, endpoint)
+			delete(d.silent, endpoint)
+		} else {
+			d.baselines[endpoint] = baseline
+		}
+	}
+
+	d.counts = make(map[string]int)
+
+	// Authentication failures surge when they are far above their baseline, or are frequent where there were none
+	failing := make(map[string]bool)
+	for endpoint := range d.failures {
+		failing[endpoint] = true
+	}
+	for endpoint := range d.failureBaselines {
+		failing[endpoint] = true
+	}
+	for endpoint := range failing {
+		count := d.failures[endpoint]
+		baseline, seen := d.failureBaselines[endpoint]
+
+		if count >= d.minCount && (!seen || float64(count) > baseline*d.spikeFactor) {
+			alerts = append(alerts, Alert{
+				Type:        "auth_failure_surge",
+				Endpoint:    endpoint,
+				Description: "Hooks or clients are failing authentication far more often than usual",
+				Count:       count,
+				Baseline:    baseline,
+				Time:        now,
+			})
+		}
+
+		if seen {
+			baseline = 0.8*baseline + 0.2*float64(count)
+		} else {
+			baseline = float64(count)
+		}
+		if baseline < 0.01 {
+			delete(d.failureBaselines, endpoint)
+		} else {
+			d.failureBaselines[endpoint] = baseline
+		}
+	}
+
+	d.failures = make(map[string]int)
+	return alerts
+}
+
+// Alerts are sent on goroutines of their own, so a sink which doesn't answer mustn't keep them forever
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// emit broadcasts an alert on the reserved endpoint and sends it to all sinks
+func (d *AlertDetector) emit(alert Alert) {
+	alert.Ownership = ownershipOf(alert.Endpoint)
+	log.WithFields(log.Fields{
+		"endpoint": alert.Endpoint,
+		"type":     alert.Type,
+		"count":    alert.Count,
+	}).Warnln("Traffic anomaly detected")
+
+	hub.Broadcast(Message{
+		Headers:  map[string]string{},
+		Endpoint: alertsEndpoint,
+		Data:     alert,
+	})
+
+	body, _ := json.Marshal(alert)
+	for _, sink := range d.sinks {
+		go func(sink string) {
+			resp, err := alertClient.Post(sink, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.WithField("sink", sink).Warnln("Failed to send alert:", err)
+				return
+			}
+			resp.Body.Close()
+		}(sink)
+	}
+}
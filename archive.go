@@ -0,0 +1,269 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the messages of an endpoint archived through the admin API are kept before it's purged
+var archiveGrace = 7 * 24 * time.Hour
+
+// EndpointArchive describes an archived endpoint, which rejects hooks and clients while its messages are kept
+type EndpointArchive struct {
+	Endpoint string `json:"endpoint"`
+	// Where the endpoint was archived, config or admin
+	ArchivedBy string `json:"archived_by"`
+	ArchivedAt string `json:"archived_at,omitempty"`
+	// When the endpoint is purged, endpoints archived in the configuration file being kept until they're removed
+	PurgeAt string `json:"purge_at,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ArchiveRequest is the optional body of a request archiving an endpoint
+type ArchiveRequest struct {
+	Reason string `json:"reason"`
+	// How long the endpoint's messages are kept, such as 72h, --archive-grace if empty
+	Grace string `json:"grace"`
+}
+
+// Endpoints archived through the admin API, with the timers purging them once their grace period is over.
+// Endpoints archived in the configuration file are archived through configured.endpoints.
+var archives = struct {
+	sync.Mutex
+	endpoints map[string]*archivedEndpoint
+}{endpoints: make(map[string]*archivedEndpoint)}
+
+type archivedEndpoint struct {
+	archive EndpointArchive
+	timer   *time.Timer
+}
+
+// archiveOf returns the archive of an endpoint, archived itself or covered by an archived pattern, nil if it isn't
+// archived
+func archiveOf(endpoint string) *EndpointArchive {
+	archives.Lock()
+	a, ok := archives.endpoints[endpoint]
+	if !ok {
+		for pattern, archived := range archives.endpoints {
+			if isPattern(pattern) && patternCovers(pattern, endpoint) {
+				a, ok = archived, true
+				break
+			}
+		}
+	}
+	archives.Unlock()
+	if ok {
+		archive := a.archive
+		return &archive
+	}
+
+	configured.RLock()
+	defer configured.RUnlock()
+	for pattern, settings := range configured.endpoints {
+		if settings.archived && (pattern == endpoint || (isPattern(pattern) && patternCovers(pattern, endpoint))) {
+			return &EndpointArchive{Endpoint: pattern, ArchivedBy: declaredByConfig}
+		}
+	}
+	return nil
+}
+
+// archivedEndpoints returns the archived endpoints and patterns, sorted
+func archivedEndpoints() []EndpointArchive {
+	list := []EndpointArchive{}
+	archives.Lock()
+	for _, a := range archives.endpoints {
+		list = append(list, a.archive)
+	}
+	archives.Unlock()
+	configured.RLock()
+	for endpoint, settings := range configured.endpoints {
+		if settings.archived {
+			list = append(list, EndpointArchive{Endpoint: endpoint, ArchivedBy: declaredByConfig})
+		}
+	}
+	configured.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Endpoint < list[j].Endpoint })
+	return list
+}
+
+// archiveEndpoint archives an endpoint through the admin API, disconnecting its clients. It's purged once the
+// grace period is over unless it's restored before.
+func archiveEndpoint(endpoint string, reason string, grace time.Duration) EndpointArchive {
+	now := time.Now()
+	archive := EndpointArchive{
+		Endpoint:   endpoint,
+		ArchivedBy: declaredByAdmin,
+		ArchivedAt: now.UTC().Format(time.RFC3339Nano),
+		PurgeAt:    now.Add(grace).UTC().Format(time.RFC3339Nano),
+		Reason:     reason,
+	}
+	archives.Lock()
+	if previous, ok := archives.endpoints[endpoint]; ok {
+		previous.timer.Stop()
+	}
+	archives.endpoints[endpoint] = &archivedEndpoint{
+		archive: archive,
+		timer:   time.AfterFunc(grace, func() { purgeArchived(endpoint) }),
+	}
+	archives.Unlock()
+	disconnected := disconnectEndpoint(endpoint)
+
+	log.WithFields(log.Fields{
+		"endpoint":     endpoint,
+		"purge_at":     archive.PurgeAt,
+		"disconnected": disconnected,
+	}).Warnln("Endpoint archived")
+	publishEvent("endpoint_archived", map[string]interface{}{"endpoint": endpoint, "reason": reason, "purge_at": archive.PurgeAt})
+	return archive
+}
+
+// restoreEndpoint lifts the archive of an endpoint archived through the admin API, returning whether it was
+func restoreEndpoint(endpoint string) bool {
+	archives.Lock()
+	a, ok := archives.endpoints[endpoint]
+	if ok {
+		a.timer.Stop()
+		delete(archives.endpoints, endpoint)
+	}
+	archives.Unlock()
+
+	if ok {
+		log.WithField("endpoint", endpoint).Warnln("Endpoint restored")
+		publishEvent("endpoint_restored", map[string]interface{}{"endpoint": endpoint})
+	}
+	return ok
+}
+
+// purgeArchived drops the messages of an archived endpoint, or of every endpoint an archived pattern covers, and
+// its admin declaration, after which it's gone
+func purgeArchived(endpoint string) {
+	archives.Lock()
+	if a, ok := archives.endpoints[endpoint]; ok {
+		a.timer.Stop()
+		delete(archives.endpoints, endpoint)
+	}
+	archives.Unlock()
+
+	declarations.Lock()
+	if declarations.endpoints[endpoint] == declaredByAdmin {
+		delete(declarations.endpoints, endpoint)
+		setOwnership(endpoint, EndpointOwnership{})
+	}
+	declarations.Unlock()
+	purged := purgeMessages(endpoint)
+
+	log.WithField("endpoint", endpoint).WithField("purged", purged).Warnln("Archived endpoint purged")
+	publishEvent("endpoint_purged", map[string]interface{}{"endpoint": endpoint})
+}
+
+// disconnectEndpoint evicts the clients of an endpoint, or of every endpoint a pattern covers, returning how many
+// there were
+func disconnectEndpoint(endpoint string) int {
+	hub.mu.Lock()
+	seen := make(map[*client]bool)
+	clients := []*client{}
+	for subscription, conns := range hub.clients {
+		if subscription == endpoint || (isPattern(endpoint) && patternCovers(endpoint, subscription)) {
+			for _, c := range conns {
+				if !seen[c] {
+					seen[c] = true
+					clients = append(clients, c)
+				}
+			}
+		}
+	}
+	hub.mu.Unlock()
+	for _, c := range clients {
+		hub.evict(c.endpoint, c)
+	}
+	return len(clients)
+}
+
+// purgeMessages drops the buffered messages, history and eviction counts of an endpoint, or of every endpoint a
+// pattern covers, returning the number of buffered messages dropped
+func purgeMessages(endpoint string) int {
+	purged := 0
+	for buffered := range replayBuffer.Counts() {
+		if buffered == endpoint || (isPattern(endpoint) && patternCovers(endpoint, buffered)) {
+			purged += replayBuffer.Purge(buffered)
+			writeBudget.Forget(buffered)
+		}
+	}
+	if err := historyLog.Purge(endpoint); err != nil {
+		log.WithField("endpoint", endpoint).Errorln("Failed to purge history:", err)
+	}
+	hub.mu.Lock()
+	for evicted := range hub.evictions {
+		if evicted == endpoint || (isPattern(endpoint) && patternCovers(endpoint, evicted)) {
+			delete(hub.evictions, evicted)
+		}
+	}
+	hub.mu.Unlock()
+	return purged
+}
+
+// readArchiveRequest reads the optional body of a request archiving an endpoint
+func readArchiveRequest(r *http.Request) (ArchiveRequest, time.Duration, error) {
+	var req ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, 0, fmt.Errorf("invalid body: %v", err)
+	}
+	grace := archiveGrace
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace <= 0 {
+			return req, 0, fmt.Errorf("invalid grace %q, expected a duration such as 72h", req.Grace)
+		}
+	}
+	return req, grace, nil
+}
+
+// handleArchive archives, restores or purges an endpoint through the admin API. Endpoints archived in the
+// configuration file stay archived until the file changes, but can be purged.
+func handleArchive(w http.ResponseWriter, r *http.Request, endpoint string, action string) {
+	endpoint, err := parseDeclaration(endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	allowMethod(w, r, "POST", func() {
+		switch action {
+		case "archive":
+			req, grace, err := readArchiveRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if a := archiveOf(endpoint); a != nil && a.ArchivedBy == declaredByConfig {
+				http.Error(w, "endpoint is archived by the config", 409)
+				return
+			}
+			writeJSON(w, archiveEndpoint(endpoint, req.Reason, grace))
+		case "restore":
+			if restoreEndpoint(endpoint) {
+				writeJSON(w, map[string]interface{}{"endpoint": endpoint})
+				return
+			}
+			if a := archiveOf(endpoint); a != nil && a.ArchivedBy == declaredByConfig {
+				http.Error(w, "endpoint is archived by the config and can't be restored through the admin API", 409)
+				return
+			}
+			http.Error(w, "endpoint isn't archived", 404)
+		case "purge":
+			if a := archiveOf(endpoint); a == nil || a.Endpoint != endpoint {
+				http.Error(w, "endpoint isn't archived, archive it before purging it", 409)
+				return
+			}
+			purgeArchived(endpoint)
+			writeJSON(w, map[string]interface{}{"endpoint": endpoint})
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package sockethook
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Endpoints each socket token grants access to, keyed by the token's SHA-256 so that lookups don't leak how
+// much of a guessed token is right. An empty endpoint grants access to all of them.
+var socketTokens = make(map[string][]string)
+
+// socketAuthEnabled checks if socket clients have to present a token
+func socketAuthEnabled() bool {
+	configured.RLock()
+	defer configured.RUnlock()
+	return len(socketTokens) > 0 || len(configured.tokens) > 0
+}
+
+// addSocketTokens parses rules of the form "token" or "/endpoint=token"
+func addSocketTokens(rules []string) error {
+	for _, rule := range rules {
+		endpoint, token := "", rule
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid socket token %q, expected token or /endpoint=token", rule)
+			}
+			endpoint, token = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+		if token == "" {
+			return fmt.Errorf("invalid socket token %q, token is empty", rule)
+		}
+		grantToken(token, endpoint)
+	}
+	return nil
+}
+
+// loadSocketTokens reads a file with one token per line followed by the endpoints it grants access to, all
+// endpoints if none are listed. Empty lines and lines starting with # are skipped.
+func loadSocketTokens(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) == 1 {
+			grantToken(fields[0], "")
+		}
+		for _, endpoint := range fields[1:] {
+			if !strings.HasPrefix(endpoint, "/") {
+				return fmt.Errorf("%s:%d: invalid endpoint %q", path, line, endpoint)
+			}
+			grantToken(fields[0], strings.TrimRight(endpoint, "/"))
+		}
+	}
+	return scanner.Err()
+}
+
+// grantToken gives a token access to an endpoint, or all endpoints if empty
+func grantToken(token string, endpoint string) {
+	key := hashToken(token)
+	socketTokens[key] = append(socketTokens[key], endpoint)
+}
+
+// hashToken returns the key under which a token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestToken returns the token of a socket request, from a bearer Authorization header or the token query
+// parameter, which browsers have to use as they can't set headers on websockets
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorized checks if a token grants access to an endpoint. The endpoint may be a pattern, which is only
+// granted if the token's endpoints cover everything the pattern matches. Temporary endpoints are only granted to
+// their own token, and reserved endpoints, which carry server events and alerts, only to the admin token.
+// Endpoints whose token was rotated through the admin API are granted to the rotated token, and to the tokens
+// it replaced until its window ends.
+func authorized(token string, endpoint string) bool {
+	if isReserved(endpoint) {
+		return isAdminToken(token)
+	}
+	if temporaryOf(endpoint) != nil {
+		return temporaryAuthorized(token, endpoint)
+	}
+	key := hashToken(token)
+	if granted, decided := rotatedTokenGrant(key, endpoint); decided {
+		return granted
+	}
+	if !socketAuthEnabled() {
+		return true
+	}
+	configured.RLock()
+	grants := append(socketTokens[key][:len(socketTokens[key]):len(socketTokens[key])], configured.tokens[key]...)
+	configured.RUnlock()
+	for _, granted := range grants {
+		if granted == "" || granted == endpoint || patternCovers(granted, endpoint) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package sockethook
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorized(t *testing.T) {
+	defer func(tokens map[string][]string, admin string) { socketTokens, adminToken = tokens, admin }(socketTokens, adminToken)
+
+	tests := []struct {
+		name     string
+		tokens   []string
+		token    string
+		endpoint string
+		granted  bool
+	}{
+		{"no tokens configured", nil, "", "/orders", true},
+		{"token for all endpoints", []string{"all"}, "all", "/orders", true},
+		{"wrong token", []string{"all"}, "other", "/orders", false},
+		{"missing token", []string{"all"}, "", "/orders", false},
+		{"token for the endpoint", []string{"/orders=secret"}, "secret", "/orders", true},
+		{"token for another endpoint", []string{"/orders=secret"}, "secret", "/users", false},
+		{"token for a pattern", []string{"/orders/*=secret"}, "secret", "/orders/42", true},
+		{"pattern covered by the token's pattern", []string{"/orders/**=secret"}, "secret", "/orders/*", true},
+		{"pattern wider than the token's endpoint", []string{"/orders/42=secret"}, "secret", "/orders/*", false},
+		{"token granting several endpoints", []string{"/orders=secret", "/users=secret"}, "secret", "/users", true},
+		{"reserved endpoint without admin token", nil, "", "/sockethook/events", false},
+		{"reserved endpoint with token for all endpoints", []string{"all"}, "all", "/sockethook/events", false},
+		{"reserved endpoint with admin token", nil, "admin", "/sockethook/events", true},
+	}
+	for _, test := range tests {
+		socketTokens = make(map[string][]string)
+		adminToken = "admin"
+		if err := addSocketTokens(test.tokens); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if granted := authorized(test.token, test.endpoint); granted != test.granted {
+			t.Errorf("%s: authorized(%q, %q) = %v, expected %v", test.name, test.token, test.endpoint, granted, test.granted)
+		}
+	}
+}
+
+func TestAddSocketTokensRejectsInvalidRules(t *testing.T) {
+	defer func(tokens map[string][]string) { socketTokens = tokens }(socketTokens)
+	socketTokens = make(map[string][]string)
+
+	for _, rule := range []string{"", "/orders", "/orders="} {
+		if err := addSocketTokens([]string{rule}); err == nil {
+			t.Errorf("expected socket token %q to be rejected", rule)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		header   string
+		expected string
+	}{
+		{"bearer header", "/socket/orders", "Bearer secret", "secret"},
+		{"query parameter", "/socket/orders?token=secret", "", "secret"},
+		{"header before query parameter", "/socket/orders?token=query", "Bearer header", "header"},
+		{"other authorization scheme", "/socket/orders", "Basic c2VjcmV0", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if token := requestToken(r); token != test.expected {
+			t.Errorf("%s: requestToken = %q, expected %q", test.name, token, test.expected)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockedClient is an entry of the blocklist, refusing clients connecting from an IP or network, or with a
+// token, identified by its fingerprint
+type BlockedClient struct {
+	ID string `json:"id"`
+	// IP address or CIDR network, or fingerprint of a token
+	IP    string `json:"ip,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Connection the entry was made from, when a connected client was blocked by its ID
+	Client    string `json:"client,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	BlockedAt string `json:"blocked_at"`
+}
+
+// BlockRequest is the body of a request adding to the blocklist, naming one of an IP, a token fingerprint or a
+// connected client, which is blocked by its token if it has one and its IP otherwise
+type BlockRequest struct {
+	IP     string `json:"ip"`
+	Token  string `json:"token"`
+	Client string `json:"client"`
+	Reason string `json:"reason"`
+}
+
+// Clients refused from connecting, kept in a file if one is given so that they stay blocked after a restart
+var blocklist = struct {
+	sync.RWMutex
+	path    string
+	entries []BlockedClient
+}{}
+
+// tokenFingerprint identifies a token in the admin API and the blocklist without revealing it
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	return hashToken(token)[:16]
+}
+
+// loadBlocklist reads the blocklist from a file, which is written whenever the blocklist changes. A missing file
+// is an empty blocklist.
+func loadBlocklist(path string) error {
+	blocklist.Lock()
+	defer blocklist.Unlock()
+
+	blocklist.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []BlockedClient
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid blocklist %s: %v", path, err)
+	}
+	for _, entry := range entries {
+		if entry.IP != "" && !validBlockedIP(entry.IP) {
+			return fmt.Errorf("invalid blocklist %s: invalid IP %q", path, entry.IP)
+		}
+	}
+	blocklist.entries = entries
+	return nil
+}
+
+// saveBlocklist writes the blocklist to its file, through a temporary file so that a crash doesn't lose it. Must
+// be called with the blocklist locked.
+func saveBlocklist() error {
+	if blocklist.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(blocklist.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := blocklist.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, blocklist.path)
+}
+
+func validBlockedIP(value string) bool {
+	if strings.Contains(value, "/") {
+		_, _, err := net.ParseCIDR(value)
+		return err == nil
+	}
+	return net.ParseIP(value) != nil
+}
+
+// matches checks if an entry blocks a client connecting from an IP with a token
+func (b BlockedClient) matches(ip string, token string) bool {
+	if b.Token != "" {
+		return b.Token == tokenFingerprint(token)
+	}
+	if _, network, err := net.ParseCIDR(b.IP); err == nil {
+		parsed := net.ParseIP(ip)
+		return parsed != nil && network.Contains(parsed)
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.Equal(net.ParseIP(b.IP))
+}
+
+// blockedClient returns the entry blocking a client connecting from an IP with a token, if any
+func blockedClient(ip string, token string) (BlockedClient, bool) {
+	blocklist.RLock()
+	defer blocklist.RUnlock()
+
+	for _, entry := range blocklist.entries {
+		if entry.matches(ip, token) {
+			return entry, true
+		}
+	}
+	return BlockedClient{}, false
+}
+
+// blockClient adds an entry to the blocklist and disconnects the clients it matches, returning the entry
+func blockClient(req BlockRequest) (BlockedClient, error) {
+	entry := BlockedClient{IP: req.IP, Token: req.Token, Reason: req.Reason, BlockedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	set := 0
+	for _, value := range []string{req.IP, req.Token, req.Client} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return BlockedClient{}, fmt.Errorf("expected one of ip, token or client")
+	}
+	if req.IP != "" && !validBlockedIP(req.IP) {
+		return BlockedClient{}, fmt.Errorf("invalid IP %q, expected an address or CIDR network", req.IP)
+	}
+	if req.Client != "" {
+		hub.mu.Lock()
+		c := hub.client(req.Client)
+		if c != nil {
+			entry.Client = c.id
+			if entry.Token = tokenFingerprint(c.token); entry.Token == "" {
+				entry.IP = c.ip
+			}
+		}
+		hub.mu.Unlock()
+		if c == nil {
+			return BlockedClient{}, fmt.Errorf("no connected client with ID %s", req.Client)
+		}
+	}
+	entry.ID = idGenerator.NewID()
+
+	blocklist.Lock()
+	blocklist.entries = append(blocklist.entries, entry)
+	err := saveBlocklist()
+	blocklist.Unlock()
+	if err != nil {
+		log.WithField("path", blocklist.path).Errorln("Failed to save blocklist:", err)
+	}
+
+	disconnected := disconnectBlocked(entry)
+	log.WithFields(log.Fields{
+		"id":           entry.ID,
+		"ip":           entry.IP,
+		"token":        entry.Token,
+		"reason":       entry.Reason,
+		"disconnected": disconnected,
+	}).Warnln("Blocked clients")
+	publishEvent("client_blocked", map[string]interface{}{"id": entry.ID, "ip": entry.IP, "token": entry.Token, "disconnected": disconnected})
+	return entry, nil
+}
+
+// unblockClient removes an entry from the blocklist, returning whether it was there
+func unblockClient(id string) bool {
+	blocklist.Lock()
+	defer blocklist.Unlock()
+
+	for i, entry := range blocklist.entries {
+		if entry.ID == id {
+			blocklist.entries = append(blocklist.entries[:i:i], blocklist.entries[i+1:]...)
+			if err := saveBlocklist(); err != nil {
+				log.WithField("path", blocklist.path).Errorln("Failed to save blocklist:", err)
+			}
+			log.WithField("id", id).Warnln("Unblocked clients")
+			return true
+		}
+	}
+	return false
+}
+
+// disconnectBlocked disconnects the connected clients an entry blocks, returning how many there were
+func disconnectBlocked(entry BlockedClient) int {
+	hub.mu.Lock()
+	seen := make(map[*client]bool)
+	blocked := []*client{}
+	for _, conns := range hub.clients {
+		for _, c := range conns {
+			if !seen[c] && entry.matches(c.ip, c.token) {
+				seen[c] = true
+				blocked = append(blocked, c)
+			}
+		}
+	}
+	hub.mu.Unlock()
+
+	for _, c := range blocked {
+		hub.evict(c.endpoint, c)
+	}
+	return len(blocked)
+}
+
+// handleBlocklist serves the blocklist below /admin/blocklist: listing it, blocking clients and unblocking them
+func handleBlocklist(w http.ResponseWriter, r *http.Request, path string) {
+	if path != "" {
+		allowMethod(w, r, "DELETE", func() {
+			if !unblockClient(strings.TrimPrefix(path, "/")) {
+				http.Error(w, "no blocklist entry with that ID", 404)
+				return
+			}
+			w.WriteHeader(204)
+		})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		blocklist.RLock()
+		entries := append([]BlockedClient{}, blocklist.entries...)
+		blocklist.RUnlock()
+		writeJSON(w, entries)
+	case "POST":
+		var req BlockRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), 400)
+			return
+		}
+		entry, err := blockClient(req)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(entry)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(405)
+	}
+}
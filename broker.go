@@ -0,0 +1,294 @@
+package sockethook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Broker relays messages between instances, so that hooks received by any instance reach the clients connected
+// to all of them. Payloads are opaque to brokers.
+type Broker interface {
+	// Publish sends a payload to all instances, including this one
+	Publish(payload []byte) error
+	// Subscribe calls handle with every published payload until the broker is closed
+	Subscribe(handle func(payload []byte))
+	// Ready returns why the broker can't relay messages at the moment, nil if it can
+	Ready() error
+	Close() error
+}
+
+// Broker shared with other instances, nil when running standalone
+var broker Broker
+
+// Run as a read replica, only serving clients with the messages writer instances publish to the broker and
+// rejecting hooks
+var readReplica = false
+
+// Number of messages waiting to be published before new ones are only delivered locally
+var brokerQueueSize = 1024
+
+// ID of this instance, used to skip its own messages when they come back from the broker
+var instanceID = idGenerator.NewID()
+
+// Number of messages from other instances remembered to skip those relayed more than once
+var brokerDedupSize = 10000
+
+// How long messages are collected into one payload before publishing them, and how many at most, so that links
+// between regions carry few large payloads rather than one per message. A window of 0 publishes every message on
+// its own.
+var brokerBatchWindow time.Duration
+var brokerBatchSize = 100
+
+// Compress payloads published to the broker with gzip
+var brokerCompress = false
+
+// How often publishing a payload is attempted before its messages are only delivered locally, and the longest
+// wait between attempts
+var brokerPublishAttempts = 5
+var brokerMaxBackoff = 30 * time.Second
+
+// Largest payload accepted from the broker once decompressed
+const maxBrokerPayload = 64 << 20
+
+// Messages waiting to be published to the broker
+var brokerQueue chan Message
+
+// brokerEnvelope is a message, or a batch of messages, as published to the broker, tagged with the instance which
+// received the hooks. Single messages are published in the message field so that instances which don't batch can
+// still read them.
+type brokerEnvelope struct {
+	Instance string    `json:"instance"`
+	Message  *Message  `json:"message,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	// Set instead of messages when the instance announces itself to the others, or forwards a message to the
+	// owner of its endpoint
+	Heartbeat *nodeHeartbeat   `json:"heartbeat,omitempty"`
+	Forward   *endpointForward `json:"forward,omitempty"`
+}
+
+// Messages delivered from the broker recently, by origin instance and message ID, so that a message reaching this
+// instance over several paths, such as brokers relaying to each other in a mesh, is only delivered once
+var brokerSeen = struct {
+	sync.Mutex
+	keys  map[string]bool
+	order []string
+}{keys: make(map[string]bool)}
+
+// seenFromBroker remembers a message from another instance, returning whether it was already delivered
+func seenFromBroker(instance string, id string) bool {
+	if brokerDedupSize <= 0 || id == "" {
+		return false
+	}
+	key := instance + "/" + id
+
+	brokerSeen.Lock()
+	defer brokerSeen.Unlock()
+	if brokerSeen.keys[key] {
+		return true
+	}
+	brokerSeen.keys[key] = true
+	brokerSeen.order = append(brokerSeen.order, key)
+	for len(brokerSeen.order) > brokerDedupSize {
+		delete(brokerSeen.keys, brokerSeen.order[0])
+		brokerSeen.order = brokerSeen.order[1:]
+	}
+	return false
+}
+
+// startBroker publishes messages to a broker and delivers those published by other instances. Returns a function
+// which stops publishing and closes the broker.
+func startBroker(b Broker) func() {
+	broker = b
+	brokerQueue = make(chan Message, brokerQueueSize)
+	stopped := make(chan struct{})
+	announced := make(chan struct{})
+	go publishMessages(b, brokerQueue, stopped)
+	go func() {
+		defer close(announced)
+		announceNode(b, stopped)
+	}()
+	b.Subscribe(handleBrokerPayload)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopped)
+			// Heartbeats describe the configuration of the process, which may change once the broker is stopped
+			<-announced
+			if err := b.Close(); err != nil {
+				log.Warnln("Failed to close broker:", err)
+			}
+		})
+	}
+}
+
+// publishToBroker queues a message for the other instances, without blocking if the broker can't keep up. Server
+// events and other reserved endpoints are specific to an instance and aren't published.
+func publishToBroker(msg Message) {
+	if broker == nil || isReserved(msg.Endpoint) {
+		return
+	}
+
+	select {
+	case brokerQueue <- msg:
+	default:
+		log.WithField("endpoint", msg.Endpoint).WithField("id", msg.ID).Warnln("Broker queue full, only delivering message locally")
+	}
+}
+
+// publishMessages publishes queued messages one payload at a time, so their order is kept, until stopped
+func publishMessages(b Broker, queue chan Message, stopped chan struct{}) {
+	for {
+		var msg Message
+		select {
+		case msg = <-queue:
+		case <-stopped:
+			return
+		}
+		batch := []Message{msg}
+		if brokerBatchWindow > 0 {
+			batch = collectBatch(queue, batch)
+		}
+		payload, err := encodeBrokerPayload(batch)
+		if err != nil {
+			log.WithField("endpoint", msg.Endpoint).Errorln("Failed to encode messages for broker:", err)
+			continue
+		}
+		publishPayload(b, payload, batch)
+	}
+}
+
+// collectBatch adds the messages queued within the batch window to a batch, up to the batch size
+func collectBatch(queue chan Message, batch []Message) []Message {
+	window := time.NewTimer(brokerBatchWindow)
+	defer window.Stop()
+	for len(batch) < brokerBatchSize {
+		select {
+		case msg := <-queue:
+			batch = append(batch, msg)
+		case <-window.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// publishPayload publishes a payload, retrying with backoff while the broker reconnects. Messages are kept in the
+// queue meanwhile, new ones only being delivered locally once it's full.
+func publishPayload(b Broker, payload []byte, batch []Message) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := b.Publish(payload)
+		if err == nil {
+			return
+		}
+		logger := log.WithField("endpoint", batch[0].Endpoint).WithField("id", batch[0].ID).WithField("messages", len(batch))
+		if err == errBrokerClosed || attempt >= brokerPublishAttempts {
+			logger.Warnln("Failed to publish messages to broker:", err)
+			return
+		}
+		logger.WithField("retry", backoff).Warnln("Failed to publish messages to broker, retrying:", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > brokerMaxBackoff {
+			backoff = brokerMaxBackoff
+		}
+	}
+}
+
+// encodeBrokerPayload encodes messages as published to the broker, compressed if enabled
+func encodeBrokerPayload(batch []Message) ([]byte, error) {
+	envelope := brokerEnvelope{Instance: instanceID}
+	if len(batch) == 1 {
+		envelope.Message = &batch[0]
+	} else {
+		envelope.Messages = batch
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil || !brokerCompress {
+		return payload, err
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// decodeBrokerPayload decodes a payload published to the broker, compressed or not, returning its envelope with
+// a single message moved into its messages
+func decodeBrokerPayload(payload []byte) (brokerEnvelope, error) {
+	var envelope brokerEnvelope
+	// Payloads starting with the gzip magic number are compressed, JSON never does
+	if len(payload) > 1 && payload[0] == 0x1f && payload[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return envelope, err
+		}
+		if payload, err = ioutil.ReadAll(io.LimitReader(r, maxBrokerPayload+1)); err != nil {
+			return envelope, err
+		}
+		if len(payload) > maxBrokerPayload {
+			return envelope, errors.New("payload too large")
+		}
+	}
+
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return envelope, err
+	}
+	if envelope.Message != nil {
+		envelope.Messages = append(envelope.Messages, *envelope.Message)
+		envelope.Message = nil
+	}
+	return envelope, nil
+}
+
+// handleBrokerPayload delivers the messages published by another instance to the clients of this one
+func handleBrokerPayload(payload []byte) {
+	envelope, err := decodeBrokerPayload(payload)
+	if err != nil {
+		log.Warnln("Ignoring invalid message from broker:", err)
+		return
+	}
+	instance := envelope.Instance
+	if instance == instanceID {
+		return
+	}
+	if envelope.Heartbeat != nil {
+		observeHeartbeat(instance, *envelope.Heartbeat)
+	}
+	if envelope.Forward != nil {
+		handleForward(*envelope.Forward)
+	}
+
+	for _, msg := range envelope.Messages {
+		if seenFromBroker(instance, msg.ID) {
+			log.WithField("endpoint", msg.Endpoint).WithField("id", msg.ID).Debugln("Skipping message already delivered from broker")
+			metrics.broadcasts.Inc("duplicate")
+			continue
+		}
+		if received, err := time.Parse(time.RFC3339Nano, msg.ReceivedAt); err == nil {
+			msg.received = received
+			observeRelayLag(instance, received)
+		}
+		followOwner(msg)
+
+		if dispatch(msg) {
+			metrics.broadcasts.Inc("success")
+		} else {
+			metrics.broadcasts.Inc("failure")
+		}
+	}
+}
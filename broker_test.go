@@ -0,0 +1,114 @@
+package sockethook
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSeenFromBroker(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		id       string
+		seen     bool
+	}{
+		{"first delivery", "a", "1", false},
+		{"relayed again", "a", "1", true},
+		{"same ID from another origin", "b", "1", false},
+		{"another message", "a", "2", false},
+		{"without ID", "a", "", false},
+		{"without ID again", "a", "", false},
+	}
+	for _, test := range tests {
+		if seen := seenFromBroker(test.instance, test.id); seen != test.seen {
+			t.Errorf("%s: seenFromBroker(%q, %q) = %v, expected %v", test.name, test.instance, test.id, seen, test.seen)
+		}
+	}
+}
+
+func TestSeenFromBrokerForgetsOldest(t *testing.T) {
+	defer func(size int) { brokerDedupSize = size }(brokerDedupSize)
+	brokerDedupSize = 2
+
+	for _, id := range []string{"x1", "x2", "x3"} {
+		seenFromBroker("c", id)
+	}
+	if seenFromBroker("c", "x1") {
+		t.Errorf("expected the oldest message to be forgotten")
+	}
+	if !seenFromBroker("c", "x3") {
+		t.Errorf("expected the newest message to be remembered")
+	}
+}
+
+func TestBrokerPayloadRoundTrip(t *testing.T) {
+	defer func(compress bool) { brokerCompress = compress }(brokerCompress)
+
+	one := []Message{{ID: "1", Endpoint: "/a", Data: "first"}}
+	three := []Message{{ID: "1", Endpoint: "/a"}, {ID: "2", Endpoint: "/b"}, {ID: "3", Endpoint: "/a"}}
+	tests := []struct {
+		name     string
+		batch    []Message
+		compress bool
+	}{
+		{"single message", one, false},
+		{"single compressed message", one, true},
+		{"batch", three, false},
+		{"compressed batch", three, true},
+	}
+	for _, test := range tests {
+		brokerCompress = test.compress
+		payload, err := encodeBrokerPayload(test.batch)
+		if err != nil {
+			t.Fatalf("%s: encoding: %v", test.name, err)
+		}
+		if compressed := payload[0] == 0x1f; compressed != test.compress {
+			t.Errorf("%s: compressed = %v, expected %v", test.name, compressed, test.compress)
+		}
+		envelope, err := decodeBrokerPayload(payload)
+		if err != nil {
+			t.Fatalf("%s: decoding: %v", test.name, err)
+		}
+		if envelope.Instance != instanceID {
+			t.Errorf("%s: instance = %q, expected %q", test.name, envelope.Instance, instanceID)
+		}
+		messages := envelope.Messages
+		if len(messages) != len(test.batch) {
+			t.Fatalf("%s: decoded %d messages, expected %d", test.name, len(messages), len(test.batch))
+		}
+		for i, msg := range messages {
+			if msg.ID != test.batch[i].ID || msg.Endpoint != test.batch[i].Endpoint {
+				t.Errorf("%s: message %d = %s on %s, expected %s on %s", test.name, i, msg.ID, msg.Endpoint, test.batch[i].ID, test.batch[i].Endpoint)
+			}
+		}
+	}
+}
+
+func TestDecodeInvalidBrokerPayload(t *testing.T) {
+	for _, payload := range []string{"", "not json", "\x1f\x8bnot gzip"} {
+		if _, err := decodeBrokerPayload([]byte(payload)); err == nil {
+			t.Errorf("expected decoding %q to fail", payload)
+		}
+	}
+}
+
+func TestReadReplicaRejectsHooks(t *testing.T) {
+	defer func(replica bool) { readReplica = replica }(readReplica)
+
+	tests := []struct {
+		replica bool
+		status  int
+	}{
+		{false, 200},
+		{true, 421},
+	}
+	for _, test := range tests {
+		readReplica = test.replica
+		w := httptest.NewRecorder()
+		handleHook(w, httptest.NewRequest("POST", "/hook/replica", strings.NewReader(`{}`)), "", "/replica")
+		if w.Code != test.status {
+			t.Errorf("read replica %v: status %d, expected %d", test.replica, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package sockethook
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Error budget for writes to clients, nil if disabled in which case slow clients are evicted right away
+var writeBudget *WriteBudget
+
+// Remediations applied when a client or endpoint exceeds its error budget
+const (
+	remediationReduceBuffer = "reduce_buffer"
+	remediationDisconnect   = "disconnect"
+	remediationOpenCircuit  = "open_circuit"
+)
+
+// WriteBudget tracks the fraction of failed writes per client and per endpoint over a window, failures being
+// messages which couldn't be written or didn't fit in a client's buffer. Clients over budget first have their
+// buffer reduced, so that they use less memory and fail faster, and are disconnected if they stay over budget.
+// Endpoints over budget have their circuit opened for a cooldown, during which messages are only recorded for
+// replay and not delivered.
+type WriteBudget struct {
+	// Fraction of writes which may fail, e.g. 0.05
+	budget float64
+	// Length of the window failures are counted over
+	window time.Duration
+	// Number of writes in a window before the failure rate is judged
+	minWrites uint64
+	// How long an endpoint's circuit stays open
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	endpoints map[string]*budgetCounter
+	// Time until which the circuit of an endpoint is open
+	circuits map[string]time.Time
+}
+
+// budgetCounter counts the writes and failures of a client or endpoint in the current window
+type budgetCounter struct {
+	start  time.Time
+	writes uint64
+	failed uint64
+	// Number of remediations applied to a client, which escalate while it stays over budget
+	level int
+}
+
+func newWriteBudget(budget float64, window time.Duration, minWrites int, cooldown time.Duration) (*WriteBudget, error) {
+	if budget <= 0 || budget >= 1 {
+		return nil, fmt.Errorf("invalid write error budget %v, expected a fraction between 0 and 1", budget)
+	}
+	if window <= 0 || cooldown <= 0 || minWrites < 1 {
+		return nil, fmt.Errorf("invalid write error budget window, cooldown or minimum writes")
+	}
+	return &WriteBudget{
+		budget:    budget,
+		window:    window,
+		minWrites: uint64(minWrites),
+		cooldown:  cooldown,
+		endpoints: make(map[string]*budgetCounter),
+		circuits:  make(map[string]time.Time),
+	}, nil
+}
+
+// record counts a write and returns true if the counter exceeded the budget, starting a new window if the
+// current one is over. Must be called with the lock guarding the counter held.
+func (b *WriteBudget) record(counter *budgetCounter, ok bool, now time.Time) bool {
+	if now.Sub(counter.start) > b.window {
+		counter.start, counter.writes, counter.failed = now, 0, 0
+	}
+	counter.writes++
+	if !ok {
+		counter.failed++
+	}
+	return !ok && counter.writes >= b.minWrites && float64(counter.failed)/float64(counter.writes) > b.budget
+}
+
+// Observe records the outcome of writing a message on an endpoint to a client and applies remediations if
+// either exceeded its budget. Returns false if the client was disconnected.
+func (b *WriteBudget) Observe(c *client, endpoint string, ok bool) bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	b.ObserveEndpoint(endpoint, ok)
+
+	c.budgetMu.Lock()
+	if c.budget.start.IsZero() {
+		c.budget.start = now
+	}
+	exceeded := b.record(&c.budget, ok, now)
+	level := c.budget.level
+	if exceeded {
+		c.budget.level++
+		c.budget.start, c.budget.writes, c.budget.failed = now, 0, 0
+	}
+	c.budgetMu.Unlock()
+
+	if !exceeded {
+		return true
+	}
+	if level == 0 {
+		limit := cap(c.send) / 4
+		if limit < 1 {
+			limit = 1
+		}
+		atomic.StoreInt64(&c.bufferLimit, int64(limit))
+		remediate(remediationReduceBuffer, endpoint, c, log.Fields{"buffer": limit})
+		return true
+	}
+	remediate(remediationDisconnect, endpoint, c, nil)
+	hub.evict(endpoint, c)
+	return false
+}
+
+// ObserveEndpoint records the outcome of a write on an endpoint only, e.g. for clients whose connection broke
+// and which are evicted anyway, opening its circuit if it exceeded its budget
+func (b *WriteBudget) ObserveEndpoint(endpoint string, ok bool) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+
+	b.mu.Lock()
+	counter, found := b.endpoints[endpoint]
+	if !found {
+		counter = &budgetCounter{start: now}
+		b.endpoints[endpoint] = counter
+	}
+	if !b.record(counter, ok, now) || now.Before(b.circuits[endpoint]) {
+		b.mu.Unlock()
+		return
+	}
+	b.circuits[endpoint] = now.Add(b.cooldown)
+	counter.start, counter.writes, counter.failed = now, 0, 0
+	b.mu.Unlock()
+
+	remediate(remediationOpenCircuit, endpoint, nil, log.Fields{"cooldown": b.cooldown.String()})
+}
+
+// CircuitOpen checks if the circuit of an endpoint is open, in which case its messages aren't delivered
+func (b *WriteBudget) CircuitOpen(endpoint string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.circuits[endpoint]
+	if ok && time.Now().After(until) {
+		delete(b.circuits, endpoint)
+		log.WithField("endpoint", endpoint).Infoln("Circuit closed")
+		return false
+	}
+	return ok
+}
+
+// openCircuits returns the number of endpoints whose circuit is open
+func (b *WriteBudget) openCircuits() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	open := 0
+	now := time.Now()
+	for _, until := range b.circuits {
+		if now.Before(until) {
+			open++
+		}
+	}
+	return open
+}
+
+// remediate logs, counts and publishes a remediation applied to an endpoint or one of its clients
+func remediate(action string, endpoint string, c *client, fields log.Fields) {
+	details := map[string]interface{}{"action": action, "endpoint": endpoint}
+	if c != nil {
+		details["client"] = c.id
+		details["remote_addr"] = c.conn.RemoteAddr().String()
+	}
+	for k, v := range fields {
+		details[k] = v
+	}
+
+	log.WithFields(log.Fields(details)).Warnln("Write error budget exceeded, remediating")
+	metrics.remediations.Inc(action)
+	publishEvent("remediation", details)
+}
+
+// Forget drops the counter of an endpoint which is no longer used
+func (b *WriteBudget) Forget(endpoint string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	delete(b.endpoints, endpoint)
+	b.mu.Unlock()
+}
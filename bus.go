@@ -0,0 +1,235 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Publisher publishes hooks to an event bus such as NATS or Kafka, alongside them being broadcasted. Publishers
+// are created from URLs by the factory registered for the URL's scheme, and should only connect once used.
+type Publisher interface {
+	// Publish sends a payload to a subject or topic, returning once the bus accepted it
+	Publish(subject string, payload []byte) error
+	Close() error
+}
+
+// PublisherFactory creates the publisher of an event bus URL
+type PublisherFactory func(u *url.URL) (Publisher, error)
+
+// Factories of event bus publishers per URL scheme, see WithPublisher for adding others
+var publisherFactories = map[string]PublisherFactory{
+	"nats": newNATSPublisher,
+	"tls":  newNATSPublisher,
+}
+
+// Event bus URLs hooks are published to per endpoint or pattern, given on the command line
+var busTargets = make(map[string][]string)
+
+// Number of hooks waiting to be published per event bus before new ones are dead-lettered
+var busQueueSize = 1024
+
+// Publishers per event bus URL, started on the first hook published to them
+var busPublishers = struct {
+	sync.Mutex
+	targets map[string]*busPublisher
+}{targets: make(map[string]*busPublisher)}
+
+// busPublisher publishes the hooks of an event bus URL from a queue of its own, in order, so that a slow or
+// unreachable bus holds up neither the hooks nor other buses
+type busPublisher struct {
+	// URL without credentials, used in logs and dead letters
+	target string
+	// Prefix of the subjects published to, from the URL's path
+	prefix    string
+	publisher Publisher
+	queue     chan Message
+}
+
+// parseBusTargets parses event bus targets of the form /endpoint=URL, where the endpoint may be a pattern
+func parseBusTargets(rules []string) (map[string][]string, error) {
+	targets := make(map[string][]string)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid event bus %q, expected /endpoint=URL", rule)
+		}
+		if err := checkBusURL(parts[1]); err != nil {
+			return nil, err
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		targets[endpoint] = append(targets[endpoint], parts[1])
+	}
+	return targets, nil
+}
+
+// checkBusURL checks that an event bus URL has a scheme with a registered publisher
+func checkBusURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid event bus URL %q", target)
+	}
+	if _, ok := publisherFactories[u.Scheme]; !ok {
+		return fmt.Errorf("invalid event bus URL %q, unsupported scheme %q", target, u.Scheme)
+	}
+	return nil
+}
+
+// busTargetsFor returns the event bus URLs hooks to an endpoint are published to, from the configuration file
+// and the options, each once
+func busTargetsFor(endpoint string) []string {
+	targets := []string{}
+	seen := make(map[string]bool)
+	add := func(urls []string) {
+		for _, target := range urls {
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	if settings := settingsFor(endpoint); settings != nil {
+		add(settings.busURLs)
+	}
+	for pattern, urls := range busTargets {
+		if pattern == endpoint || (isPattern(pattern) && patternCovers(pattern, endpoint)) {
+			add(urls)
+		}
+	}
+	return targets
+}
+
+// busSubject derives the subject or topic of an endpoint, its segments joined with dots after the prefix, e.g.
+// hooks.orders.created for /orders/created with the prefix hooks
+func busSubject(prefix string, endpoint string) string {
+	subject := strings.Join(segments(endpoint), ".")
+	if prefix != "" {
+		subject = prefix + "." + subject
+	}
+	return subject
+}
+
+// publishToBus queues a hook to be published to the event buses of its endpoint
+func publishToBus(msg Message) {
+	msg.Type = frameData
+	for _, target := range busTargetsFor(msg.Endpoint) {
+		p, err := busPublisherFor(target)
+		if err != nil {
+			log.WithField("endpoint", msg.Endpoint).Errorln("Failed to create event bus publisher:", err)
+			continue
+		}
+		select {
+		case p.queue <- msg:
+		default:
+			p.fail(msg, "event bus queue full", 0)
+		}
+	}
+}
+
+// busPublisherFor returns the publisher of an event bus URL, creating and starting it if needed
+func busPublisherFor(target string) (*busPublisher, error) {
+	busPublishers.Lock()
+	defer busPublishers.Unlock()
+
+	if p, ok := busPublishers.targets[target]; ok {
+		return p, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	factory, ok := publisherFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported event bus scheme %q", u.Scheme)
+	}
+	publisher, err := factory(u)
+	if err != nil {
+		return nil, err
+	}
+
+	redacted := *u
+	redacted.User = nil
+	p := &busPublisher{
+		target:    redacted.String(),
+		prefix:    strings.Replace(strings.Trim(u.Path, "/"), "/", ".", -1),
+		publisher: publisher,
+		queue:     make(chan Message, busQueueSize),
+	}
+	busPublishers.targets[target] = p
+	go p.run()
+	return p, nil
+}
+
+// run publishes queued hooks, retrying failed ones like forwarded hooks before dead-lettering them
+func (p *busPublisher) run() {
+	for msg := range p.queue {
+		subject := busSubject(p.prefix, msg.Endpoint)
+		logEntry := log.WithFields(log.Fields{"endpoint": msg.Endpoint, "id": msg.ID, "target": p.target, "subject": subject})
+		payload, err := json.Marshal(msg.encode(schemaV1))
+		if err != nil {
+			p.fail(msg, err.Error(), 0)
+			continue
+		}
+
+		backoff := forwardBackoff
+		for attempt := 1; ; attempt++ {
+			err := p.publisher.Publish(subject, payload)
+			if err == nil {
+				metrics.busPublishes.Inc("success")
+				logEntry.WithField("attempt", attempt).Debugln("Hook published to event bus")
+				break
+			}
+			if attempt > forwardRetries {
+				p.fail(msg, err.Error(), attempt)
+				break
+			}
+
+			metrics.busPublishes.Inc("retry")
+			logEntry.WithField("attempt", attempt).WithField("backoff", backoff).Infoln("Publishing hook to event bus failed, retrying:", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxForwardBackoff {
+				backoff = maxForwardBackoff
+			}
+		}
+	}
+}
+
+// fail logs, publishes and dead-letters a hook which couldn't be published to the event bus
+func (p *busPublisher) fail(msg Message, reason string, attempts int) {
+	metrics.busPublishes.Inc("failure")
+	log.WithFields(log.Fields{
+		"endpoint": msg.Endpoint,
+		"id":       msg.ID,
+		"target":   p.target,
+		"reason":   reason,
+		"attempts": attempts,
+	}).Warnln("Publishing hook to event bus failed")
+	publishEvent("event_bus_failed", map[string]interface{}{
+		"endpoint": msg.Endpoint,
+		"id":       msg.ID,
+		"target":   p.target,
+		"reason":   reason,
+	})
+	postDeadLetter(DeadLetter{
+		Endpoint: msg.Endpoint,
+		Target:   p.target,
+		Reason:   reason,
+		Attempts: attempts,
+		Message:  msg,
+	})
+}
+
+// closeBusPublishers closes the connections of all event bus publishers
+func closeBusPublishers() {
+	busPublishers.Lock()
+	defer busPublishers.Unlock()
+	for _, p := range busPublishers.targets {
+		p.publisher.Close()
+	}
+}
@@ -0,0 +1,41 @@
+package sockethook
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cancelled when the drain timeout of a shutdown has passed, making hooks still in flight give up rather than
+// being cut off halfway through by the process exiting
+var shutdownHooks, cancelHooks = context.WithCancel(context.Background())
+
+// hookContext returns the context a hook is handled in, which is done once the publisher disconnects or shutdown
+// gives up on it
+func hookContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-shutdownHooks.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// abandoned checks if a hook's context is done, logging and counting it per stage of handling if so. Nothing can
+// be answered to an abandoned hook, its publisher either being gone or the server about to exit.
+func abandoned(ctx context.Context, stage string, logEntry *log.Entry) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	reason := "publisher disconnected"
+	if shutdownHooks.Err() != nil {
+		reason = "shutting down"
+	}
+	metrics.abandonedHooks.Inc(stage)
+	logEntry.WithField("stage", stage).Warnln("Abandoned hook,", reason)
+	return true
+}
@@ -0,0 +1,113 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChaosSettings describe failures injected into deliveries when chaos mode is enabled
+type ChaosSettings struct {
+	// Artificial delay before every write to a client, e.g. "200ms"
+	WriteLatency string `json:"write_latency"`
+	// Probability of disconnecting a client instead of delivering to it
+	DisconnectRate float64 `json:"disconnect_rate"`
+	// Probability of silently dropping a delivery
+	DropRate float64 `json:"drop_rate"`
+}
+
+// Chaos injection state, only used when chaos mode is enabled
+var chaos = struct {
+	sync.Mutex
+	enabled  bool
+	settings ChaosSettings
+	latency  time.Duration
+}{}
+
+// chaosEnabled checks if chaos mode was enabled at startup
+func chaosEnabled() bool {
+	chaos.Lock()
+	defer chaos.Unlock()
+	return chaos.enabled
+}
+
+// chaosBeforeWrite applies injected failures to a delivery, returning false if it shouldn't be written
+func chaosBeforeWrite(c *client, endpoint string) bool {
+	chaos.Lock()
+	if !chaos.enabled {
+		chaos.Unlock()
+		return true
+	}
+	settings, latency := chaos.settings, chaos.latency
+	chaos.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	if rand.Float64() < settings.DisconnectRate {
+		log.WithField("endpoint", endpoint).Infoln("Chaos: disconnecting client")
+		// The read loop notices the closed connection and removes the client
+		c.conn.Close()
+		return false
+	}
+
+	if rand.Float64() < settings.DropRate {
+		log.WithField("endpoint", endpoint).Infoln("Chaos: dropping message")
+		return false
+	}
+
+	return true
+}
+
+// handleChaos shows (GET), replaces (POST/PUT) or clears (DELETE) the injected failures. Only admins may use
+// it, as injected failures affect every client.
+func handleChaos(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	chaos.Lock()
+	defer chaos.Unlock()
+
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var settings ChaosSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		latency := time.Duration(0)
+		if settings.WriteLatency != "" {
+			var err error
+			if latency, err = time.ParseDuration(settings.WriteLatency); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		chaos.settings, chaos.latency = settings, latency
+		log.WithFields(log.Fields{
+			"write_latency":   latency,
+			"disconnect_rate": settings.DisconnectRate,
+			"drop_rate":       settings.DropRate,
+		}).Warnln("Chaos settings changed")
+	case "DELETE":
+		chaos.settings, chaos.latency = ChaosSettings{}, 0
+		log.Warnln("Chaos settings cleared")
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chaos.settings)
+}
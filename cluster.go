@@ -0,0 +1,177 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often an instance announces itself and its clients to the others through the broker. Instances which
+// haven't been heard from for three intervals are no longer counted as members of the cluster.
+var clusterHeartbeatInterval = 5 * time.Second
+
+// nodeHeartbeat announces an instance to the other instances sharing its broker
+type nodeHeartbeat struct {
+	ReadReplica bool `json:"read_replica,omitempty"`
+	// Whether the instance takes part in endpoint ownership
+	EndpointOwnership bool `json:"endpoint_ownership,omitempty"`
+	Clients           int  `json:"clients"`
+	// Number of clients per endpoint
+	Endpoints map[string]int `json:"endpoints,omitempty"`
+	SentAt    string         `json:"sent_at"`
+}
+
+// Other instances heard from through the broker, by instance ID
+var peers = struct {
+	sync.Mutex
+	nodes map[string]*peer
+}{nodes: make(map[string]*peer)}
+
+// peer is another instance of the cluster as last heard from
+type peer struct {
+	heartbeat nodeHeartbeat
+	lastSeen  time.Time
+	// Time from the instance receiving a hook to its message arriving here, for the latest message relayed
+	relayLag time.Duration
+}
+
+// Topology describes the instances sharing this instance's broker, as far as it has heard from them
+type Topology struct {
+	Instance string       `json:"instance"`
+	Nodes    []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus describes an instance of the cluster
+type NodeStatus struct {
+	Instance    string         `json:"instance"`
+	Self        bool           `json:"self,omitempty"`
+	ReadReplica bool           `json:"read_replica,omitempty"`
+	Clients     int            `json:"clients"`
+	Endpoints   map[string]int `json:"endpoints,omitempty"`
+	// When another instance was last heard from, and how long its latest message took to get here
+	LastSeen        string  `json:"last_seen,omitempty"`
+	RelayLagSeconds float64 `json:"relay_lag_seconds"`
+}
+
+// announceNode publishes a heartbeat of this instance every interval until stopped
+func announceNode(b Broker, stopped chan struct{}) {
+	ticker := time.NewTicker(clusterHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		payload, err := json.Marshal(brokerEnvelope{Instance: instanceID, Heartbeat: localHeartbeat()})
+		if err == nil {
+			err = b.Publish(payload)
+		}
+		if err != nil && err != errBrokerClosed {
+			log.Debugln("Failed to announce instance to broker:", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// localHeartbeat returns the heartbeat announcing this instance
+func localHeartbeat() *nodeHeartbeat {
+	heartbeat := &nodeHeartbeat{
+		ReadReplica:       readReplica,
+		EndpointOwnership: endpointOwnership,
+		Endpoints:         make(map[string]int),
+		SentAt:            time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	counted := make(map[*client]bool)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for endpoint, conns := range hub.clients {
+		if isReserved(endpoint) {
+			continue
+		}
+		heartbeat.Endpoints[endpoint] = len(conns)
+		// Clients subscribed to several endpoints are counted once
+		for _, c := range conns {
+			counted[c] = true
+		}
+	}
+	heartbeat.Clients = len(counted)
+	return heartbeat
+}
+
+// observeHeartbeat records the heartbeat of another instance, adding it to the cluster if it's new
+func observeHeartbeat(instance string, heartbeat nodeHeartbeat) {
+	peers.Lock()
+	defer peers.Unlock()
+	p := peers.nodes[instance]
+	if p == nil {
+		log.WithField("instance", instance).Infoln("Instance joined the cluster")
+		p = &peer{}
+		peers.nodes[instance] = p
+	}
+	p.heartbeat, p.lastSeen = heartbeat, time.Now()
+}
+
+// observeRelayLag records how long a message another instance received took to get here
+func observeRelayLag(instance string, received time.Time) {
+	peers.Lock()
+	defer peers.Unlock()
+	if p := peers.nodes[instance]; p != nil {
+		p.relayLag = time.Since(received)
+	}
+}
+
+// clusterPeers returns the other instances heard from within three heartbeat intervals, forgetting those
+// which weren't
+func clusterPeers() map[string]peer {
+	peers.Lock()
+	defer peers.Unlock()
+	members := make(map[string]peer, len(peers.nodes))
+	for instance, p := range peers.nodes {
+		if time.Since(p.lastSeen) > 3*clusterHeartbeatInterval {
+			log.WithField("instance", instance).Warnln("Instance left the cluster")
+			delete(peers.nodes, instance)
+			continue
+		}
+		members[instance] = *p
+	}
+	return members
+}
+
+// clusterTopology returns this instance followed by the other members of the cluster, ordered by ID
+func clusterTopology() Topology {
+	self := localHeartbeat()
+	topology := Topology{
+		Instance: instanceID,
+		Nodes: []NodeStatus{{
+			Instance:    instanceID,
+			Self:        true,
+			ReadReplica: self.ReadReplica,
+			Clients:     self.Clients,
+			Endpoints:   self.Endpoints,
+		}},
+	}
+
+	members := clusterPeers()
+	instances := make([]string, 0, len(members))
+	for instance := range members {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		p := members[instance]
+		topology.Nodes = append(topology.Nodes, NodeStatus{
+			Instance:        instance,
+			ReadReplica:     p.heartbeat.ReadReplica,
+			Clients:         p.heartbeat.Clients,
+			Endpoints:       p.heartbeat.Endpoints,
+			LastSeen:        p.lastSeen.UTC().Format(time.RFC3339Nano),
+			RelayLagSeconds: p.relayLag.Seconds(),
+		})
+	}
+	return topology
+}
@@ -0,0 +1,59 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClusterTopology(t *testing.T) {
+	defer func() {
+		peers.Lock()
+		peers.nodes = make(map[string]*peer)
+		peers.Unlock()
+	}()
+
+	publish := func(envelope brokerEnvelope) {
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleBrokerPayload(payload)
+	}
+	heartbeat := &nodeHeartbeat{ReadReplica: true, Clients: 3, Endpoints: map[string]int{"/orders": 3}}
+	publish(brokerEnvelope{Instance: "peer-b", Heartbeat: heartbeat})
+	publish(brokerEnvelope{Instance: "peer-a", Heartbeat: &nodeHeartbeat{Clients: 1}})
+	endpoint := uniqueEndpoint("/test/cluster")
+	// Instances skip messages they saw before, so the message has an ID of its own
+	publish(brokerEnvelope{Instance: "peer-b", Message: &Message{
+		ID:         "relayed" + endpoint,
+		Endpoint:   endpoint,
+		ReceivedAt: time.Now().Add(-2 * time.Second).UTC().Format(time.RFC3339Nano),
+	}})
+	// Heartbeats of this instance coming back from the broker don't make it a peer
+	publish(brokerEnvelope{Instance: instanceID, Heartbeat: localHeartbeat()})
+
+	topology := clusterTopology()
+	if len(topology.Nodes) != 3 || !topology.Nodes[0].Self || topology.Nodes[0].Instance != instanceID {
+		t.Fatalf("unexpected nodes %+v", topology.Nodes)
+	}
+	a, b := topology.Nodes[1], topology.Nodes[2]
+	if a.Instance != "peer-a" || a.Clients != 1 || a.RelayLagSeconds != 0 {
+		t.Errorf("unexpected node %+v", a)
+	}
+	if b.Instance != "peer-b" || !b.ReadReplica || b.Clients != 3 || b.Endpoints["/orders"] != 3 {
+		t.Errorf("unexpected node %+v", b)
+	}
+	if b.RelayLagSeconds < 2 || b.RelayLagSeconds > 3 {
+		t.Errorf("relay lag %vs, expected about 2s", b.RelayLagSeconds)
+	}
+
+	// Instances which stopped announcing themselves leave the cluster
+	peers.Lock()
+	peers.nodes["peer-a"].lastSeen = time.Now().Add(-3*clusterHeartbeatInterval - time.Second)
+	peers.Unlock()
+	topology = clusterTopology()
+	if len(topology.Nodes) != 2 || topology.Nodes[1].Instance != "peer-b" {
+		t.Errorf("unexpected nodes after peer-a left %+v", topology.Nodes)
+	}
+}
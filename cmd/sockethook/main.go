@@ -0,0 +1,8 @@
+// Command sockethook runs the webhook to websocket relay, see the sockethook package
+package main
+
+import "github.com/corollari/sockethook"
+
+func main() {
+	sockethook.Main()
+}
@@ -0,0 +1,62 @@
+package sockethook
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Size in bytes from which frames are compressed for websocket clients which negotiated permessage-deflate.
+// Smaller ones are sent as they are, as compressing them costs more than it saves.
+var compressionThreshold int64 = 1 << 10
+
+// Compression level of permessage-deflate, from flate.HuffmanOnly (-2) to flate.BestCompression (9)
+var compressionLevel = flate.BestSpeed
+
+// setCompression enables negotiating permessage-deflate with websocket clients, checking the compression level
+func setCompression(enabled bool) error {
+	if compressionLevel < flate.HuffmanOnly || compressionLevel > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d, expected -2 to 9", compressionLevel)
+	}
+	upgrader.EnableCompression = enabled
+	return nil
+}
+
+// negotiatesCompression checks if a websocket client will use permessage-deflate, which is the case if
+// compression is enabled and the client offered it when connecting
+func negotiatesCompression(r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, extensions := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(extensions, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFrame writes a frame as JSON to a client, compressing it if the client negotiated compression and the
+// frame is at least the threshold
+func writeFrame(c *client, v interface{}) error {
+	conn, ok := c.conn.(*websocket.Conn)
+	if !ok || !c.compressed {
+		return c.conn.WriteJSON(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeCompressed(conn, websocket.TextMessage, data)
+}
+
+// writeCompressed writes a data frame to a connection which negotiated compression, compressing it only if it's
+// at least the threshold
+func writeCompressed(conn *websocket.Conn, messageType int, data []byte) error {
+	conn.EnableWriteCompression(int64(len(data)) >= compressionThreshold)
+	return conn.WriteMessage(messageType, data)
+}
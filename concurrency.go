@@ -0,0 +1,177 @@
+package sockethook
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// LimitsConfig is the limits section of the configuration file, setting the goroutine and queue limits which are
+// also available as command-line options. Zero values leave the option's default.
+type LimitsConfig struct {
+	MaxInflightHooks      int    `yaml:"max_inflight_hooks"`
+	HookQueueTimeout      string `yaml:"hook_queue_timeout"`
+	MaxDispatchers        int    `yaml:"max_dispatchers"`
+	DispatcherIdleTimeout string `yaml:"dispatcher_idle_timeout"`
+	EndpointQueueSize     int    `yaml:"endpoint_queue_size"`
+	ClientBuffer          int    `yaml:"client_buffer"`
+	ForwardQueueSize      int    `yaml:"forward_queue_size"`
+	BusQueueSize          int    `yaml:"bus_queue_size"`
+	BrokerQueueSize       int    `yaml:"broker_queue_size"`
+	HistoryQueueSize      int    `yaml:"history_queue_size"`
+	OTLPQueueSize         int    `yaml:"otlp_queue_size"`
+	LifecycleQueueSize    int    `yaml:"lifecycle_queue_size"`
+}
+
+// QueueUtilization reports how full a bounded queue is, or a set of queues of the same size such as those of
+// every dispatcher
+type QueueUtilization struct {
+	// Number of queues, omitted for single queues
+	Queues int `json:"queues,omitempty"`
+	// Capacity of each queue
+	Size int `json:"size"`
+	// Items waiting over all queues, and in the fullest one
+	Queued  int `json:"queued"`
+	Fullest int `json:"fullest"`
+	// Fullest relative to the size, from 0 to 1
+	Utilization float64 `json:"utilization"`
+}
+
+// HookUtilization reports how many hooks are being handled against --max-inflight-hooks
+type HookUtilization struct {
+	InFlight int64 `json:"in_flight"`
+	// Hooks waiting for a free slot
+	Queued       int64  `json:"queued"`
+	Limit        int    `json:"limit"`
+	QueueTimeout string `json:"queue_timeout"`
+}
+
+// ConcurrencyStatus reports the goroutine and queue limits and how much of them is in use, so that they can be
+// tuned to a workload. Queues of features which aren't enabled are omitted.
+type ConcurrencyStatus struct {
+	Goroutines int             `json:"goroutines"`
+	Hooks      HookUtilization `json:"hooks"`
+	// Limit of running dispatchers, 0 for unlimited, and the number of endpoints waiting for a slot
+	MaxDispatchers     int              `json:"max_dispatchers"`
+	WaitingDispatchers int              `json:"waiting_dispatchers"`
+	Dispatchers        QueueUtilization `json:"dispatchers"`
+	// Frames buffered per connected client
+	ClientBuffers QueueUtilization  `json:"client_buffers"`
+	Forwarders    QueueUtilization  `json:"forwarders"`
+	Bus           QueueUtilization  `json:"bus"`
+	Broker        *QueueUtilization `json:"broker,omitempty"`
+	History       *QueueUtilization `json:"history,omitempty"`
+	OTLP          *QueueUtilization `json:"otlp,omitempty"`
+	// Server events waiting per lifecycle webhook
+	Lifecycle *QueueUtilization `json:"lifecycle,omitempty"`
+}
+
+// validateLimits checks the goroutine and queue limits, as queues have to hold at least one item for anything
+// to get through them
+func validateLimits() error {
+	for name, size := range map[string]int{
+		"endpoint-queue-size":  endpointQueueSize,
+		"client-buffer":        clientBufferSize,
+		"forward-queue-size":   forwardQueueSize,
+		"bus-queue-size":       busQueueSize,
+		"broker-queue-size":    brokerQueueSize,
+		"history-queue-size":   historyQueueSize,
+		"otlp-queue-size":      otlpQueueSize,
+		"lifecycle-queue-size": lifecycleQueueSize,
+	} {
+		if size < 1 {
+			return fmt.Errorf("invalid --%s %d, expected at least 1", name, size)
+		}
+	}
+	if maxDispatchers < 0 {
+		return fmt.Errorf("invalid --max-dispatchers %d, expected 0 for unlimited or more", maxDispatchers)
+	}
+	if dispatcherIdleTimeout <= 0 {
+		return fmt.Errorf("invalid --dispatcher-idle-timeout %s, expected a positive duration", dispatcherIdleTimeout)
+	}
+	return nil
+}
+
+// add adds the length of a queue to those of the same size
+func (u *QueueUtilization) add(length int) {
+	u.Queues++
+	u.Queued += length
+	if length > u.Fullest {
+		u.Fullest = length
+	}
+	if u.Size > 0 {
+		u.Utilization = float64(u.Fullest) / float64(u.Size)
+	}
+}
+
+// singleQueue reports the utilization of a single queue
+func singleQueue(length int, size int) *QueueUtilization {
+	u := &QueueUtilization{Size: size, Queued: length, Fullest: length}
+	if size > 0 {
+		u.Utilization = float64(length) / float64(size)
+	}
+	return u
+}
+
+// concurrencyStatus returns the goroutine and queue limits and their current utilization
+func concurrencyStatus() ConcurrencyStatus {
+	status := ConcurrencyStatus{
+		Goroutines: runtime.NumGoroutine(),
+		Hooks: HookUtilization{
+			InFlight:     atomic.LoadInt64(&hooksInFlight),
+			Queued:       atomic.LoadInt64(&hooksQueued),
+			Limit:        cap(hookSlots),
+			QueueTimeout: hookQueueTimeout.String(),
+		},
+		MaxDispatchers:     maxDispatchers,
+		WaitingDispatchers: waitingCount(),
+		Dispatchers:        QueueUtilization{Size: endpointQueueSize},
+		ClientBuffers:      QueueUtilization{Size: clientBufferSize},
+		Forwarders:         QueueUtilization{Size: forwardQueueSize},
+		Bus:                QueueUtilization{Size: busQueueSize},
+	}
+
+	for _, length := range queueLengths() {
+		status.Dispatchers.add(length)
+	}
+
+	hub.mu.Lock()
+	seen := make(map[*client]bool)
+	for _, conns := range hub.clients {
+		for _, c := range conns {
+			if !seen[c] {
+				seen[c] = true
+				status.ClientBuffers.add(len(c.send))
+			}
+		}
+	}
+	hub.mu.Unlock()
+
+	forwarders.Lock()
+	for _, f := range forwarders.targets {
+		status.Forwarders.add(len(f.queue))
+	}
+	forwarders.Unlock()
+	busPublishers.Lock()
+	for _, p := range busPublishers.targets {
+		status.Bus.add(len(p.queue))
+	}
+	busPublishers.Unlock()
+
+	if brokerQueue != nil {
+		status.Broker = singleQueue(len(brokerQueue), brokerQueueSize)
+	}
+	if historyLog != nil {
+		status.History = singleQueue(len(historyLog.queue), cap(historyLog.queue))
+	}
+	if otlpExporter != nil {
+		status.OTLP = singleQueue(len(otlpExporter.records), cap(otlpExporter.records))
+	}
+	if len(lifecycleWebhooks) > 0 {
+		status.Lifecycle = &QueueUtilization{Size: lifecycleQueueSize}
+		for _, webhook := range lifecycleWebhooks {
+			status.Lifecycle.add(len(webhook.queue))
+		}
+	}
+	return status
+}
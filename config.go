@@ -0,0 +1,359 @@
+package sockethook
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a configuration file. Options given on the command line take precedence over it.
+type Config struct {
+	// Version of the file format, older versions being migrated when they're loaded, see migrateConfig
+	Version     int    `yaml:"version"`
+	Address     string `yaml:"address"`
+	Port        int    `yaml:"port"`
+	HookAddress string `yaml:"hook_address"`
+	HookPort    int    `yaml:"hook_port"`
+	BasePath    string `yaml:"base_path"`
+	TLS         struct {
+		Cert            string   `yaml:"cert"`
+		Key             string   `yaml:"key"`
+		AutocertDomains []string `yaml:"autocert_domains"`
+		AutocertEmail   string   `yaml:"autocert_email"`
+		AutocertCache   string   `yaml:"autocert_cache"`
+	} `yaml:"tls"`
+	// Origins browsers may connect and send requests from, see --allowed-origins
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Small responses served at paths, as content or @file, see --static-response
+	StaticResponses map[string]string `yaml:"static_responses"`
+	// Goroutine and queue limits, see --max-inflight-hooks and the options following it
+	Limits LimitsConfig `yaml:"limits"`
+	// Webhooks server events are sent to, see --lifecycle-webhook
+	LifecycleWebhooks []LifecycleWebhookConfig `yaml:"lifecycle_webhooks"`
+	// Any other command-line option by name, e.g. "max-clients: 100"
+	Options map[string]string `yaml:"options"`
+	// Settings per endpoint, which are reloaded on SIGHUP
+	Endpoints map[string]EndpointConfig `yaml:"endpoints"`
+}
+
+// EndpointConfig holds the settings of a single endpoint
+type EndpointConfig struct {
+	// Verifications of hook signatures as provider:secret, see --verify
+	Secrets []string `yaml:"secrets"`
+	// Whether hooks failing verification are accepted and marked as unverified, see --allow-unverified
+	AllowUnverified bool `yaml:"allow_unverified"`
+	// Tokens granting socket clients access to the endpoint
+	Tokens []string `yaml:"tokens"`
+	// Origins websocket and event stream clients may connect from, those allowed for all endpoints if empty
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Number of messages kept for reconnecting clients, see --replay-buffer
+	ReplayBuffer *int `yaml:"replay_buffer"`
+	// Hooks accepted from all sources and from each source IP
+	RateLimit   RateLimitConfig `yaml:"rate_limit"`
+	IPRateLimit RateLimitConfig `yaml:"ip_rate_limit"`
+	// URL hooks are POSTed to before they're broadcasted, only being broadcasted if it answers with 2xx
+	ValidationURL string `yaml:"validation_url"`
+	// URLs hooks are forwarded to alongside being broadcasted
+	Forward []string `yaml:"forward"`
+	// URLs of event buses hooks are published to, see --event-bus
+	EventBus []string `yaml:"event_bus"`
+	// Where messages published by clients go, broadcast or a callback URL
+	ClientPublish string `yaml:"client_publish"`
+	// Transformation of the data of JSON hooks, as template:... or jq:..., see --transform
+	Transform string `yaml:"transform"`
+	// Who is responsible for the endpoint, how to reach them and what it's for
+	Owner       string `yaml:"owner"`
+	Contact     string `yaml:"contact"`
+	Description string `yaml:"description"`
+	// Whether the endpoint is archived, rejecting hooks and clients while its messages are kept
+	Archived bool `yaml:"archived"`
+}
+
+// RateLimitConfig is a rate limit of the configuration file
+type RateLimitConfig struct {
+	// Hooks accepted per second, 0 for unlimited
+	Rate float64 `yaml:"rate"`
+	// Hooks which may be accepted at once above the rate, defaults to one second's worth
+	Burst int `yaml:"burst"`
+}
+
+// endpointSettings are the settings of an endpoint loaded from the configuration file
+type endpointSettings struct {
+	verifiers     []verifier
+	secretHeaders []string
+	unverifiedOK  bool
+	origins       []string
+	limiter       *limiterSet
+	ipLimiters    *limiterSet
+	validationURL string
+	forwardURLs   []string
+	busURLs       []string
+	publishTarget string
+	transform     *transformer
+	ownership     EndpointOwnership
+	archived      bool
+}
+
+// Settings loaded from the configuration file, replaced as a whole when it's reloaded
+var configured = struct {
+	sync.RWMutex
+	endpoints map[string]*endpointSettings
+	// Endpoints each socket token grants access to, keyed like socketTokens
+	tokens map[string][]string
+}{}
+
+// loadConfig reads a YAML configuration file, rejecting unknown keys so that typos don't go unnoticed. Files of
+// older versions are migrated, with a warning for every change so that they can be updated.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, from, changes, err := migrateConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if from != configVersion {
+		logEntry := log.WithField("path", path).WithField("version", from)
+		for _, change := range changes {
+			logEntry.Warnln("Migrated configuration:", change)
+		}
+		logEntry.Warnf("Configuration is of an older version and was migrated to version %d, run sockethook migrate-config -w %s to update it", configVersion, path)
+	}
+
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// applyConfigFlags sets the command-line options given in the configuration file, unless they were also given
+// on the command line
+func applyConfigFlags(cfg *Config) error {
+	options := make(map[string][]string)
+	for name, value := range cfg.Options {
+		options[name] = []string{value}
+	}
+	set := func(name string, value string) {
+		if value != "" && value != "0" {
+			options[name] = append(options[name], value)
+		}
+	}
+	set("address", cfg.Address)
+	set("port", strconv.Itoa(cfg.Port))
+	set("hook-address", cfg.HookAddress)
+	set("hook-port", strconv.Itoa(cfg.HookPort))
+	set("base-path", cfg.BasePath)
+	set("tls-cert", cfg.TLS.Cert)
+	set("tls-key", cfg.TLS.Key)
+	for _, domain := range cfg.TLS.AutocertDomains {
+		set("autocert-domain", domain)
+	}
+	set("autocert-email", cfg.TLS.AutocertEmail)
+	set("autocert-cache", cfg.TLS.AutocertCache)
+	for _, origin := range cfg.AllowedOrigins {
+		set("allowed-origins", origin)
+	}
+	for path, content := range cfg.StaticResponses {
+		set("static-response", path+"="+content)
+	}
+	for _, webhook := range cfg.LifecycleWebhooks {
+		if len(webhook.Events) > 0 {
+			set("lifecycle-webhook", strings.Join(webhook.Events, ",")+"="+webhook.URL)
+		} else {
+			set("lifecycle-webhook", webhook.URL)
+		}
+	}
+	set("max-inflight-hooks", strconv.Itoa(cfg.Limits.MaxInflightHooks))
+	set("hook-queue-timeout", cfg.Limits.HookQueueTimeout)
+	set("max-dispatchers", strconv.Itoa(cfg.Limits.MaxDispatchers))
+	set("dispatcher-idle-timeout", cfg.Limits.DispatcherIdleTimeout)
+	set("endpoint-queue-size", strconv.Itoa(cfg.Limits.EndpointQueueSize))
+	set("client-buffer", strconv.Itoa(cfg.Limits.ClientBuffer))
+	set("forward-queue-size", strconv.Itoa(cfg.Limits.ForwardQueueSize))
+	set("bus-queue-size", strconv.Itoa(cfg.Limits.BusQueueSize))
+	set("broker-queue-size", strconv.Itoa(cfg.Limits.BrokerQueueSize))
+	set("history-queue-size", strconv.Itoa(cfg.Limits.HistoryQueueSize))
+	set("otlp-queue-size", strconv.Itoa(cfg.Limits.OTLPQueueSize))
+	set("lifecycle-queue-size", strconv.Itoa(cfg.Limits.LifecycleQueueSize))
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for name, values := range options {
+		if given[name] {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q in configuration file", name)
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value %q for option %q in configuration file: %v", value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyEndpointConfig replaces the endpoint settings with those of the configuration file
+func applyEndpointConfig(cfg *Config) error {
+	endpoints := make(map[string]*endpointSettings)
+	tokens := make(map[string][]string)
+	replaySizes := make(map[string]int)
+
+	configured.RLock()
+	previous := configured.endpoints
+	configured.RUnlock()
+
+	for endpoint, ec := range cfg.Endpoints {
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("invalid endpoint %q in configuration file, expected it to start with /", endpoint)
+		}
+		endpoint = strings.TrimRight(endpoint, "/")
+		settings := &endpointSettings{}
+
+		for _, secret := range ec.Secrets {
+			v, secretHeader, err := parseVerifier(secret)
+			if err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.verifiers = append(settings.verifiers, v)
+			if secretHeader != "" {
+				settings.secretHeaders = append(settings.secretHeaders, secretHeader)
+			}
+		}
+		settings.unverifiedOK = ec.AllowUnverified
+
+		for _, token := range ec.Tokens {
+			if token == "" {
+				return fmt.Errorf("endpoint %s: token is empty", endpoint)
+			}
+			key := hashToken(token)
+			tokens[key] = append(tokens[key], endpoint)
+		}
+
+		origins, err := parseOrigins(ec.AllowedOrigins)
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %v", endpoint, err)
+		}
+		settings.origins = origins
+
+		if ec.ReplayBuffer != nil {
+			if *ec.ReplayBuffer < 0 {
+				return fmt.Errorf("endpoint %s: invalid replay buffer size %d", endpoint, *ec.ReplayBuffer)
+			}
+			replaySizes[endpoint] = *ec.ReplayBuffer
+		}
+
+		if ec.RateLimit.Rate < 0 || ec.RateLimit.Burst < 0 || ec.IPRateLimit.Rate < 0 || ec.IPRateLimit.Burst < 0 {
+			return fmt.Errorf("endpoint %s: invalid rate limit", endpoint)
+		}
+		// Limits which didn't change keep their buckets, so that a reload doesn't refill them
+		old := previous[endpoint]
+		if ec.RateLimit.Rate > 0 {
+			limit := newRateLimit(ec.RateLimit.Rate, ec.RateLimit.Burst)
+			if old != nil && old.limiter != nil && old.limiter.limit == limit {
+				settings.limiter = old.limiter
+			} else {
+				settings.limiter = newLimiterSet("config", limit)
+			}
+		}
+		if ec.IPRateLimit.Rate > 0 {
+			limit := newRateLimit(ec.IPRateLimit.Rate, ec.IPRateLimit.Burst)
+			if old != nil && old.ipLimiters != nil && old.ipLimiters.limit == limit {
+				settings.ipLimiters = old.ipLimiters
+			} else {
+				settings.ipLimiters = newLimiterSet("config-ip"+endpoint, limit)
+			}
+		}
+
+		if ec.ValidationURL != "" {
+			if err := checkValidationURL(ec.ValidationURL); err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.validationURL = ec.ValidationURL
+		}
+
+		for _, target := range ec.Forward {
+			if err := checkForwardURL(target); err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.forwardURLs = append(settings.forwardURLs, target)
+		}
+
+		for _, target := range ec.EventBus {
+			if err := checkBusURL(target); err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.busURLs = append(settings.busURLs, target)
+		}
+
+		if ec.ClientPublish != "" {
+			if err := checkPublishTarget(ec.ClientPublish); err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.publishTarget = ec.ClientPublish
+		}
+
+		if ec.Transform != "" {
+			t, err := parseTransform(ec.Transform)
+			if err != nil {
+				return fmt.Errorf("endpoint %s: %v", endpoint, err)
+			}
+			settings.transform = t
+		}
+
+		settings.ownership = EndpointOwnership{Owner: ec.Owner, Contact: ec.Contact, Description: ec.Description}
+		settings.archived = ec.Archived
+
+		endpoints[endpoint] = settings
+	}
+
+	configured.Lock()
+	configured.endpoints, configured.tokens = endpoints, tokens
+	configured.Unlock()
+	replayBuffer.SetOverrides(replaySizes)
+	return nil
+}
+
+// watchConfig reloads the endpoint settings of the configuration file on SIGHUP. Other options are only read
+// on startup.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			err = applyEndpointConfig(cfg)
+		}
+		if err != nil {
+			log.WithField("path", path).Errorln("Failed to reload configuration, keeping the previous one:", err)
+			publishEvent("config_reload_failed", map[string]interface{}{"path": path, "error": err.Error()})
+			continue
+		}
+		log.WithField("path", path).WithField("endpoints", len(cfg.Endpoints)).Infoln("Configuration reloaded")
+		publishEvent("config_reloaded", map[string]interface{}{"path": path, "endpoints": len(cfg.Endpoints)})
+	}
+}
+
+// settingsFor returns the configured settings of an endpoint, nil if it has none
+func settingsFor(endpoint string) *endpointSettings {
+	configured.RLock()
+	defer configured.RUnlock()
+	return configured.endpoints[endpoint]
+}
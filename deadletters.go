@@ -0,0 +1,180 @@
+package sockethook
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of hooks which couldn't be forwarded kept to be requeued through the admin API, 0 to keep none
+var deadLetterStoreSize = 1000
+
+// StoredDeadLetter is a hook which couldn't be forwarded to a target, kept so that it can be requeued once the
+// target is fixed
+type StoredDeadLetter struct {
+	ID       string `json:"id"`
+	FailedAt string `json:"failed_at"`
+	DeadLetter
+
+	job forwardJob
+}
+
+// DeadLetterRequeue is the outcome of requeueing a stored dead letter
+type DeadLetterRequeue struct {
+	ID       string `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Target   string `json:"target"`
+	Requeued bool   `json:"requeued"`
+	// Why the dead letter couldn't be requeued, in which case it's kept
+	Error string `json:"error,omitempty"`
+}
+
+// Dead letters of forwards, oldest first and bounded by deadLetterStoreSize
+var deadLetters = struct {
+	sync.Mutex
+	letters []StoredDeadLetter
+}{}
+
+// storeDeadLetter keeps a hook which couldn't be forwarded, dropping the oldest dead letter when full
+func storeDeadLetter(letter DeadLetter, job forwardJob) {
+	if deadLetterStoreSize <= 0 {
+		return
+	}
+
+	stored := StoredDeadLetter{
+		ID:         idGenerator.NewID(),
+		FailedAt:   time.Now().UTC().Format(time.RFC3339Nano),
+		DeadLetter: letter,
+		job:        job,
+	}
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	deadLetters.letters = append(deadLetters.letters, stored)
+	if len(deadLetters.letters) > deadLetterStoreSize {
+		dropped := len(deadLetters.letters) - deadLetterStoreSize
+		deadLetters.letters = append([]StoredDeadLetter{}, deadLetters.letters[dropped:]...)
+	}
+}
+
+// storedDeadLetters returns the dead letters of an endpoint and target, or of all of them if empty, newest first
+func storedDeadLetters(endpoint string, target string) []StoredDeadLetter {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	letters := []StoredDeadLetter{}
+	for i := len(deadLetters.letters) - 1; i >= 0; i-- {
+		letter := deadLetters.letters[i]
+		if (endpoint == "" || letter.Endpoint == endpoint) && (target == "" || letter.Target == target) {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+// findDeadLetter returns a stored dead letter by ID
+func findDeadLetter(id string) (StoredDeadLetter, bool) {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	for _, letter := range deadLetters.letters {
+		if letter.ID == id {
+			return letter, true
+		}
+	}
+	return StoredDeadLetter{}, false
+}
+
+// removeDeadLetter removes a dead letter from the store, returning whether it was there
+func removeDeadLetter(id string) bool {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	for i, letter := range deadLetters.letters {
+		if letter.ID == id {
+			deadLetters.letters = append(deadLetters.letters[:i:i], deadLetters.letters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// requeueDeadLetter queues a dead letter to be forwarded to its target again, with a fresh set of retries.
+// Dead letters which are requeued leave the store, those whose target's queue is full stay.
+func requeueDeadLetter(letter StoredDeadLetter) DeadLetterRequeue {
+	result := DeadLetterRequeue{ID: letter.ID, Endpoint: letter.Endpoint, Target: letter.Target}
+	if !removeDeadLetter(letter.ID) {
+		result.Error = "dead letter was already requeued or discarded"
+		return result
+	}
+
+	select {
+	case forwarderFor(letter.Target).queue <- letter.job:
+		result.Requeued = true
+		metrics.forwards.Inc("requeued")
+	default:
+		result.Error = "forward queue full"
+		storeDeadLetter(letter.DeadLetter, letter.job)
+	}
+	log.WithFields(log.Fields{
+		"endpoint": letter.Endpoint,
+		"id":       letter.Message.ID,
+		"target":   letter.Target,
+		"requeued": result.Requeued,
+	}).Warnln("Requeued dead letter")
+	return result
+}
+
+// handleDeadLetters serves the API of stored dead letters below /admin/dead-letters: listing them, showing,
+// requeueing and discarding single dead letters, and requeueing all of an endpoint or target once it's fixed
+func handleDeadLetters(w http.ResponseWriter, r *http.Request, path string) {
+	endpoint := strings.TrimRight(r.URL.Query().Get("endpoint"), "/")
+	target := r.URL.Query().Get("target")
+
+	switch {
+	case path == "":
+		allowMethod(w, r, "GET", func() { writeJSON(w, storedDeadLetters(endpoint, target)) })
+	case path == "/requeue":
+		allowMethod(w, r, "POST", func() {
+			letters := storedDeadLetters(endpoint, target)
+			results := make([]DeadLetterRequeue, 0, len(letters))
+			// Requeue oldest first, in the order the hooks were received
+			for i := len(letters) - 1; i >= 0; i-- {
+				results = append(results, requeueDeadLetter(letters[i]))
+			}
+			writeJSON(w, results)
+		})
+	case strings.HasSuffix(path, "/requeue"):
+		allowMethod(w, r, "POST", func() {
+			letter, ok := findDeadLetter(strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/requeue"))
+			if !ok {
+				http.Error(w, "no dead letter with that ID", 404)
+				return
+			}
+			writeJSON(w, requeueDeadLetter(letter))
+		})
+	default:
+		id := strings.TrimPrefix(path, "/")
+		switch r.Method {
+		case "GET":
+			letter, ok := findDeadLetter(id)
+			if !ok {
+				http.Error(w, "no dead letter with that ID", 404)
+				return
+			}
+			writeJSON(w, letter)
+		case "DELETE":
+			if !removeDeadLetter(id) {
+				http.Error(w, "no dead letter with that ID", 404)
+				return
+			}
+			log.WithField("id", id).Warnln("Discarded dead letter")
+			w.WriteHeader(204)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(405)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package sockethook
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery attempts of the last messages, nil if disabled
+var deliveryLog *DeliveryLog
+
+// Number of messages whose delivery attempts are kept, 0 to keep none
+var deliveryHistorySize = 10000
+
+// Outcomes of delivery attempts
+const (
+	// Written to a client, or accepted by a forward target
+	deliveryDelivered = "delivered"
+	// Acknowledged by a client
+	deliveryAcknowledged = "acknowledged"
+	// Not written to a client, which was too slow, exceeded the latency budget or lost it to chaos mode
+	deliveryDropped = "dropped"
+	// Writing to a client or forwarding to a target failed
+	deliveryFailed = "failed"
+	// Given up on and dead-lettered
+	deliveryDeadLettered = "dead_lettered"
+)
+
+// DeliveryAttempt is an attempt at delivering a message to a client or a forward target
+type DeliveryAttempt struct {
+	MessageID string    `json:"message_id"`
+	Endpoint  string    `json:"endpoint"`
+	At        time.Time `json:"at"`
+	// Connection ID and address of the client, or URL of the forward target
+	ConnectionID string `json:"connection_id,omitempty"`
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	Target       string `json:"target,omitempty"`
+	// Number of the attempt, counting retries of forwards and resends of unacknowledged messages
+	Attempt int    `json:"attempt"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Time since the hook was received, or how long the forward target took to answer
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// DeliveryLog keeps the delivery attempts of the last messages in memory, loaded from and appended to a file in
+// the history directory if there is one so that they survive restarts. Attempts are written from a goroutine of
+// their own, so that recording them never holds up delivery.
+type DeliveryLog struct {
+	// Number of messages whose attempts are kept
+	size int
+	// File attempts are appended to, empty if they're only kept in memory
+	path string
+
+	mu       sync.Mutex
+	attempts map[string][]DeliveryAttempt
+	// IDs of the messages with attempts, oldest first
+	order []string
+	f     *os.File
+	// Number of attempts in the file, which is compacted once it holds far more than are kept
+	written int
+	kept    int
+
+	queue   chan DeliveryAttempt
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newDeliveryLog creates the delivery log, loading and compacting the attempts left in dir by previous runs. dir
+// is empty to keep attempts in memory only.
+func newDeliveryLog(size int, dir string) (*DeliveryLog, error) {
+	d := &DeliveryLog{
+		size:     size,
+		attempts: make(map[string][]DeliveryAttempt),
+		queue:    make(chan DeliveryAttempt, historyQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if dir == "" {
+		return d, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	d.path = filepath.Join(dir, "deliveries.ndjson")
+
+	f, err := os.Open(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var attempt DeliveryAttempt
+			// Lines cut off by a crash are skipped
+			if json.Unmarshal(scanner.Bytes(), &attempt) == nil {
+				d.add(attempt)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := d.rewrite(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Record queues a delivery attempt to be kept, dropping it if the queue is full
+func (d *DeliveryLog) Record(attempt DeliveryAttempt) {
+	if d == nil || attempt.MessageID == "" || isReserved(attempt.Endpoint) {
+		return
+	}
+	attempt.At = time.Now().UTC()
+	select {
+	case d.queue <- attempt:
+	default:
+		log.WithField("endpoint", attempt.Endpoint).Warnln("Delivery history queue full, attempt not recorded")
+	}
+}
+
+// Run keeps queued attempts until the log is closed
+func (d *DeliveryLog) Run() {
+	defer close(d.stopped)
+	for {
+		select {
+		case attempt := <-d.queue:
+			d.write(attempt)
+		case <-d.done:
+			for len(d.queue) > 0 {
+				d.write(<-d.queue)
+			}
+			return
+		}
+	}
+}
+
+// Close writes the queued attempts and closes the file, waiting at most until the timeout
+func (d *DeliveryLog) Close(timeout time.Duration) {
+	close(d.done)
+	select {
+	case <-d.stopped:
+	case <-time.After(timeout):
+		log.Warnln("Timed out writing delivery history")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f != nil {
+		d.f.Sync()
+		d.f.Close()
+		d.f = nil
+	}
+}
+
+// Deliveries returns the attempts at delivering a message, oldest first, and whether any are kept
+func (d *DeliveryLog) Deliveries(id string) ([]DeliveryAttempt, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	attempts, ok := d.attempts[id]
+	return append([]DeliveryAttempt{}, attempts...), ok
+}
+
+// write keeps an attempt and appends it to the file, logging errors
+func (d *DeliveryLog) write(attempt DeliveryAttempt) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(attempt)
+	if d.f == nil {
+		return
+	}
+
+	var err error
+	if d.written > 2*d.kept+d.size {
+		err = d.rewrite()
+	} else if line, merr := json.Marshal(attempt); merr == nil {
+		if _, err = d.f.Write(append(line, '\n')); err == nil {
+			d.written++
+		}
+	}
+	if err != nil {
+		log.WithField("endpoint", attempt.Endpoint).Errorln("Failed to write delivery history:", err)
+	}
+}
+
+// add keeps an attempt in memory, dropping the attempts of the oldest message once too many are kept. Must be
+// called with d.mu held, or before the log is shared.
+func (d *DeliveryLog) add(attempt DeliveryAttempt) {
+	if _, ok := d.attempts[attempt.MessageID]; !ok {
+		d.order = append(d.order, attempt.MessageID)
+		if len(d.order) > d.size {
+			d.kept -= len(d.attempts[d.order[0]])
+			delete(d.attempts, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+	d.attempts[attempt.MessageID] = append(d.attempts[attempt.MessageID], attempt)
+	d.kept++
+}
+
+// rewrite replaces the file with the attempts kept, oldest message first. Must be called with d.mu held, or
+// before the log is shared.
+func (d *DeliveryLog) rewrite() error {
+	if d.f != nil {
+		d.f.Close()
+		d.f = nil
+	}
+
+	// Write to a temporary file first, so that a crash while compacting doesn't lose the attempts
+	tmp := d.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	written := 0
+	for _, id := range d.order {
+		for _, attempt := range d.attempts[id] {
+			line, err := json.Marshal(attempt)
+			if err != nil {
+				continue
+			}
+			w.Write(append(line, '\n'))
+			written++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+
+	if d.f, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	d.written = written
+	return nil
+}
+
+// recordClientDelivery records an attempt at delivering a message to a client
+func recordClientDelivery(c *client, msg Message, outcome string, reason string) {
+	if deliveryLog == nil {
+		return
+	}
+	attempt := DeliveryAttempt{
+		MessageID:    msg.ID,
+		Endpoint:     msg.Endpoint,
+		ConnectionID: c.id,
+		RemoteAddr:   c.ip,
+		Attempt:      attempts(msg),
+		Outcome:      outcome,
+		Error:        reason,
+	}
+	if !msg.received.IsZero() {
+		attempt.LatencyMs = float64(time.Since(msg.received)) / float64(time.Millisecond)
+	}
+	deliveryLog.Record(attempt)
+}
+
+// recordForwardDelivery records an attempt at forwarding a hook to a target, which took latency
+func recordForwardDelivery(target string, msg Message, attempt int, outcome string, err error, latency time.Duration) {
+	if deliveryLog == nil {
+		return
+	}
+	recorded := DeliveryAttempt{
+		MessageID: msg.ID,
+		Endpoint:  msg.Endpoint,
+		Target:    target,
+		Attempt:   attempt,
+		Outcome:   outcome,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+	}
+	if err != nil {
+		recorded.Error = err.Error()
+	}
+	deliveryLog.Record(recorded)
+}
+
+// handleMessageDeliveries serves the delivery attempts of a message, to clients and forward targets
+func handleMessageDeliveries(w http.ResponseWriter, r *http.Request, id string) {
+	if deliveryLog == nil {
+		http.Error(w, "delivery history is disabled", 404)
+		return
+	}
+	attempts, ok := deliveryLog.Deliveries(id)
+	if !ok {
+		http.Error(w, "no delivery attempts of that message are kept", 404)
+		return
+	}
+	writeJSON(w, attempts)
+}
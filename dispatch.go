@@ -0,0 +1,414 @@
+package sockethook
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of messages which may be queued per endpoint before new ones are dropped
+var endpointQueueSize = 256
+
+// Maximum number of dispatchers running at the same time, each being a goroutine, 0 for unlimited. While the
+// limit is reached endpoints wait for a slot in turn, every running dispatcher handing its slot to the endpoint
+// which waited longest after delivering dispatchQuantum messages. Server events aren't limited.
+var maxDispatchers = 0
+
+// Number of messages a dispatcher delivers before handing its slot to an endpoint waiting for one
+var dispatchQuantum = 32
+
+// How long a dispatcher without messages is kept around before it's stopped
+var dispatcherIdleTimeout = time.Minute
+
+// States of a dispatcher's goroutine
+const (
+	dispatcherIdle = iota
+	dispatcherWaiting
+	dispatcherRunning
+)
+
+// dispatcher delivers the messages of a single endpoint from a bounded queue on its own goroutine, so that
+// a flood, slow consumer or panic on one endpoint doesn't affect delivery on others. The queue has a lane per
+// priority, queued messages of a higher priority being delivered first. Dispatchers are kept while their
+// endpoint exists, so that its numbering continues, and only run while they have messages to deliver.
+type dispatcher struct {
+	endpoint string
+
+	// Guards the endpoint's numbering, queue and state, so that messages are numbered in the order they're queued
+	mu sync.Mutex
+	// Last sequence number reserved on the endpoint
+	seq    uint64
+	lanes  [priorityLanes][]Message
+	queued int
+	state  int
+	// Set once the endpoint was collected, so that messages are queued with a new dispatcher instead
+	forgotten bool
+	// Number of messages delivered since the dispatcher got its slot, only used by its goroutine
+	delivered int
+	// Signalled when a message is queued, and when an endpoint starts waiting for a slot so that an idle
+	// dispatcher hands its slot over
+	notify chan struct{}
+	yield  chan struct{}
+}
+
+// Dispatchers per endpoint
+var dispatchers = struct {
+	sync.RWMutex
+	endpoints map[string]*dispatcher
+}{endpoints: make(map[string]*dispatcher)}
+
+// Endpoints waiting for a dispatcher slot in the order they'll get one, and the number of running dispatchers
+// counted against the limit, which are all but those of server events
+var slots = struct {
+	sync.Mutex
+	waiting []*dispatcher
+	running int
+}{}
+
+// dispatch reserves the next sequence number of the endpoint for a message and queues it in the lane of its
+// priority for delivery by the endpoint's dispatcher, starting it if needed or making it wait for a slot if
+// too many are running. Returns false if the queue is full and the message was dropped.
+func dispatch(msg Message) bool {
+	touchEndpoint(msg.Endpoint)
+	d := lockDispatcher(msg.Endpoint)
+	if d.queued >= endpointQueueSize {
+		d.mu.Unlock()
+		log.WithField("endpoint", msg.Endpoint).Warnln("Dispatch queue full, dropping message")
+		return false
+	}
+	d.seq++
+	seq := d.seq
+	lane := msg.priority.lane()
+	d.lanes[lane] = append(d.lanes[lane], msg)
+	d.queued++
+	atomic.AddInt64(&undelivered, 1)
+	idle := d.state == dispatcherIdle
+	if idle {
+		d.state = dispatcherWaiting
+	}
+	d.mu.Unlock()
+
+	if idle {
+		d.schedule()
+	}
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+	// The first message of an endpoint, or the first since its state was collected as idle, creates it
+	if seq == 1 && !isReserved(msg.Endpoint) {
+		publishEvent("endpoint_created", map[string]interface{}{"endpoint": msg.Endpoint, "by": "message"})
+	}
+	return true
+}
+
+// dispatcherFor returns the dispatcher of an endpoint, creating it if there's none
+func dispatcherFor(endpoint string) *dispatcher {
+	dispatchers.RLock()
+	d := dispatchers.endpoints[endpoint]
+	dispatchers.RUnlock()
+	if d != nil {
+		return d
+	}
+
+	dispatchers.Lock()
+	defer dispatchers.Unlock()
+	if d = dispatchers.endpoints[endpoint]; d == nil {
+		d = &dispatcher{endpoint: endpoint, notify: make(chan struct{}, 1), yield: make(chan struct{}, 1)}
+		dispatchers.endpoints[endpoint] = d
+	}
+	return d
+}
+
+// lockDispatcher returns the dispatcher of an endpoint with its lock held, creating it if there's none
+func lockDispatcher(endpoint string) *dispatcher {
+	for {
+		d := dispatcherFor(endpoint)
+		d.mu.Lock()
+		if !d.forgotten {
+			return d
+		}
+		d.mu.Unlock()
+	}
+}
+
+// lookupDispatcher returns the dispatcher of an endpoint, nil if it has none
+func lookupDispatcher(endpoint string) *dispatcher {
+	dispatchers.RLock()
+	defer dispatchers.RUnlock()
+	return dispatchers.endpoints[endpoint]
+}
+
+// schedule starts a waiting dispatcher if a slot is free, otherwise it waits for one
+func (d *dispatcher) schedule() {
+	slots.Lock()
+	defer slots.Unlock()
+
+	if isReserved(d.endpoint) {
+		d.start()
+		return
+	}
+	if maxDispatchers > 0 && slots.running >= maxDispatchers {
+		log.WithField("endpoint", d.endpoint).WithField("max", maxDispatchers).Debugln("Too many dispatchers, waiting for a slot")
+		slots.waiting = append(slots.waiting, d)
+		wakeIdleDispatcher()
+		return
+	}
+	slots.running++
+	d.start()
+}
+
+// start runs the dispatcher's goroutine. Must be called with slots locked.
+func (d *dispatcher) start() {
+	d.mu.Lock()
+	d.state, d.delivered = dispatcherRunning, 0
+	d.mu.Unlock()
+	go d.run()
+}
+
+// wakeIdleDispatcher tells a running dispatcher with an empty queue to hand its slot to a waiting endpoint. Must
+// be called with slots locked.
+func wakeIdleDispatcher() {
+	dispatchers.RLock()
+	defer dispatchers.RUnlock()
+
+	for endpoint, d := range dispatchers.endpoints {
+		d.mu.Lock()
+		idle := d.state == dispatcherRunning && d.queued == 0
+		d.mu.Unlock()
+		if idle && !isReserved(endpoint) {
+			select {
+			case d.yield <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// handOff gives the dispatcher's slot to the endpoint which waited longest for one, if any, returning whether
+// it did. The dispatcher waits for another turn if messages are still queued and goes idle otherwise.
+func (d *dispatcher) handOff() bool {
+	slots.Lock()
+	defer slots.Unlock()
+
+	if len(slots.waiting) == 0 || isReserved(d.endpoint) {
+		d.delivered = 0
+		return false
+	}
+	next := slots.waiting[0]
+	slots.waiting = slots.waiting[1:]
+	d.mu.Lock()
+	if d.queued > 0 {
+		d.state = dispatcherWaiting
+		slots.waiting = append(slots.waiting, d)
+	} else {
+		d.state = dispatcherIdle
+	}
+	d.mu.Unlock()
+	next.start()
+	return true
+}
+
+// stop makes a dispatcher without queued messages idle, handing its slot to a waiting endpoint or freeing it.
+// Returns false if a message was queued in the meantime.
+func (d *dispatcher) stop() bool {
+	slots.Lock()
+	defer slots.Unlock()
+
+	d.mu.Lock()
+	if d.queued > 0 {
+		d.mu.Unlock()
+		return false
+	}
+	d.state = dispatcherIdle
+	d.mu.Unlock()
+
+	if isReserved(d.endpoint) {
+		return true
+	}
+	if len(slots.waiting) > 0 {
+		next := slots.waiting[0]
+		slots.waiting = slots.waiting[1:]
+		next.start()
+	} else {
+		slots.running--
+	}
+	return true
+}
+
+// runningDispatchers returns the number of running dispatchers counted against the limit
+func runningDispatchers() int {
+	slots.Lock()
+	defer slots.Unlock()
+	return slots.running
+}
+
+// waitingCount returns the number of endpoints waiting for a dispatcher slot
+func waitingCount() int {
+	slots.Lock()
+	defer slots.Unlock()
+	return len(slots.waiting)
+}
+
+// currentSequence returns the sequence number of the last message queued on an endpoint
+func currentSequence(endpoint string) uint64 {
+	d := lookupDispatcher(endpoint)
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// advanceSequence raises the last sequence number of an endpoint to at least seq, so that the numbering of
+// imported messages is continued
+func advanceSequence(endpoint string, seq uint64) {
+	d := lockDispatcher(endpoint)
+	defer d.mu.Unlock()
+	if seq > d.seq {
+		d.seq = seq
+	}
+}
+
+// sequences returns the last sequence number of every endpoint
+func sequences() map[string]uint64 {
+	dispatchers.RLock()
+	defer dispatchers.RUnlock()
+
+	sequences := make(map[string]uint64, len(dispatchers.endpoints))
+	for endpoint, d := range dispatchers.endpoints {
+		d.mu.Lock()
+		sequences[endpoint] = d.seq
+		d.mu.Unlock()
+	}
+	return sequences
+}
+
+// forgetSequence drops the dispatcher of an endpoint, and with it its numbering, unless it's running or waiting
+// for a slot. Returns whether it was dropped.
+func forgetSequence(endpoint string) bool {
+	dispatchers.Lock()
+	defer dispatchers.Unlock()
+
+	d := dispatchers.endpoints[endpoint]
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != dispatcherIdle {
+		return false
+	}
+	d.forgotten = true
+	delete(dispatchers.endpoints, endpoint)
+	return true
+}
+
+// queueLengths returns the number of messages waiting for delivery per endpoint with a running or waiting
+// dispatcher
+func queueLengths() map[string]int {
+	dispatchers.RLock()
+	defer dispatchers.RUnlock()
+
+	lengths := make(map[string]int)
+	for endpoint, d := range dispatchers.endpoints {
+		d.mu.Lock()
+		if d.state != dispatcherIdle {
+			lengths[endpoint] = d.queued
+		}
+		d.mu.Unlock()
+	}
+	return lengths
+}
+
+// queueLength returns the number of messages waiting for delivery on an endpoint
+func queueLength(endpoint string) int {
+	d := lookupDispatcher(endpoint)
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queued
+}
+
+// run delivers queued messages, highest priority first, until the dispatcher has been idle for a while
+func (d *dispatcher) run() {
+	idle := time.NewTimer(dispatcherIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		// A dispatcher which used up its turn lets endpoints waiting for a slot go first, and one with nothing to
+		// deliver doesn't hold on to its slot while they wait
+		if d.delivered >= dispatchQuantum && d.handOff() {
+			return
+		}
+		msg, ok := d.take()
+		if !ok && d.handOff() {
+			return
+		}
+		if !ok {
+			select {
+			case <-d.notify:
+			case <-d.yield:
+			case <-idle.C:
+				// Only stop if no message was queued in the meantime
+				if d.stop() {
+					return
+				}
+				idle.Reset(dispatcherIdleTimeout)
+			}
+			continue
+		}
+
+		d.deliver(msg)
+		d.delivered++
+		atomic.AddInt64(&undelivered, -1)
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(dispatcherIdleTimeout)
+	}
+}
+
+// take removes the queued message of the highest priority, returning false if there's none. It's given the
+// lowest of the sequence numbers reserved for queued messages, so that messages are numbered in the order
+// they're delivered in even when higher priorities overtake others.
+func (d *dispatcher) take() (Message, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, lane := range d.lanes {
+		if len(lane) == 0 {
+			continue
+		}
+		msg := lane[0]
+		lane[0] = Message{}
+		d.lanes[i] = lane[1:]
+		if len(d.lanes[i]) == 0 {
+			d.lanes[i] = nil
+		}
+		d.queued--
+		msg.Seq = d.seq - uint64(d.queued)
+		return msg, true
+	}
+	return Message{}, false
+}
+
+// deliver sends a message to all clients, recovering from panics so the dispatcher keeps running
+func (d *dispatcher) deliver(msg Message) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.WithField("endpoint", d.endpoint).WithField("id", msg.ID).Errorln("Panic while delivering message:", err)
+		}
+	}()
+
+	if msg.publishNumbered {
+		publishToBroker(msg)
+	}
+	hub.deliver(msg)
+}
@@ -0,0 +1,281 @@
+package sockethook
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain creates the replay buffer before any dispatcher runs, so that tests can observe the order messages
+// are delivered in by buffering the endpoints they use
+func TestMain(m *testing.M) {
+	replayBuffer, _ = newReplayBuffer(nil, 0)
+	os.Exit(m.Run())
+}
+
+// waitForBuffered waits until n messages of an endpoint numbered after seq were delivered into the replay buffer
+func waitForBuffered(t *testing.T, endpoint string, seq uint64, n int) []Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var messages []Message
+		for _, msg := range replayBuffer.After(map[string]uint64{endpoint: seq}) {
+			if msg.Endpoint == endpoint {
+				messages = append(messages, msg)
+			}
+		}
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages of %s were delivered", len(messages), n, endpoint)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Number of endpoints made unique, across runs of the tests
+var uniqueEndpoints int64
+
+// uniqueEndpoint returns an endpoint under prefix which no earlier run of a test used, for tests which need an
+// endpoint without a dispatcher
+func uniqueEndpoint(prefix string) string {
+	return fmt.Sprintf("%s/%d", prefix, atomic.AddInt64(&uniqueEndpoints, 1))
+}
+
+// holdDispatcher returns the dispatcher of an endpoint marked as waiting for a slot, so that it isn't started
+// when messages are queued
+func holdDispatcher(endpoint string) *dispatcher {
+	d := dispatcherFor(endpoint)
+	d.mu.Lock()
+	d.state = dispatcherWaiting
+	d.mu.Unlock()
+	return d
+}
+
+func TestDispatchSequencing(t *testing.T) {
+	tests := []struct {
+		name       string
+		publishers int
+		messages   int
+	}{
+		{"one publisher", 1, 50},
+		{"concurrent publishers", 8, 25},
+	}
+	overrides := make(map[string]int)
+	for i := range tests {
+		overrides[fmt.Sprintf("/test/dispatch/%d", i)] = 1000
+	}
+	replayBuffer.SetOverrides(overrides)
+	defer replayBuffer.SetOverrides(nil)
+
+	for i, test := range tests {
+		endpoint := fmt.Sprintf("/test/dispatch/%d", i)
+		start := currentSequence(endpoint)
+		var wg sync.WaitGroup
+		for p := 0; p < test.publishers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for m := 0; m < test.messages; m++ {
+					if !dispatch(Message{ID: fmt.Sprintf("%d-%d", p, m), Endpoint: endpoint}) {
+						t.Errorf("%s: message dropped", test.name)
+					}
+				}
+			}(p)
+		}
+		wg.Wait()
+
+		total := test.publishers * test.messages
+		if seq := currentSequence(endpoint); seq != start+uint64(total) {
+			t.Errorf("%s: current sequence %d, expected %d", test.name, seq, start+uint64(total))
+		}
+		// Messages are delivered in the order of their sequence numbers, which have no gaps
+		for n, msg := range waitForBuffered(t, endpoint, start, total) {
+			if msg.Seq != start+uint64(n+1) {
+				t.Errorf("%s: message %d delivered with sequence number %d", test.name, start+uint64(n+1), msg.Seq)
+				break
+			}
+		}
+	}
+}
+
+func TestAdvanceSequence(t *testing.T) {
+	endpoint := "/test/dispatch/advance"
+	start := currentSequence(endpoint)
+	tests := []struct {
+		advance  uint64
+		expected uint64
+	}{
+		{10, 10},
+		// Sequence numbers never go back
+		{5, 10},
+		{12, 12},
+	}
+	for _, test := range tests {
+		advanceSequence(endpoint, start+test.advance)
+		if seq := currentSequence(endpoint); seq != start+test.expected {
+			t.Errorf("after advancing to %d, current sequence %d, expected %d", start+test.advance, seq, start+test.expected)
+		}
+	}
+
+	dispatch(Message{ID: "next", Endpoint: endpoint})
+	if seq := currentSequence(endpoint); seq != start+13 {
+		t.Errorf("after dispatching, current sequence %d, expected numbering to continue at %d", seq, start+13)
+	}
+}
+
+func TestDispatchLimitsDispatchers(t *testing.T) {
+	defer func(max int) { maxDispatchers = max }(maxDispatchers)
+
+	if !dispatch(Message{ID: "running", Endpoint: "/test/dispatch/running"}) {
+		t.Fatal("message dropped without a limit")
+	}
+	maxDispatchers = runningDispatchers()
+
+	// Endpoints without a dispatcher wait for a slot instead of having their messages dropped
+	tests := []struct {
+		name     string
+		endpoint string
+		running  bool
+	}{
+		{"endpoint with a running dispatcher", "/test/dispatch/running", true},
+		{"endpoint without a dispatcher", "/test/dispatch/limited", false},
+		{"server events", eventsEndpoint, true},
+	}
+	for _, test := range tests {
+		running := false
+		if d := lookupDispatcher(test.endpoint); d != nil {
+			d.mu.Lock()
+			running = d.state == dispatcherRunning
+			d.mu.Unlock()
+		}
+		if !dispatch(Message{ID: test.name, Endpoint: test.endpoint}) {
+			t.Errorf("%s: message dropped", test.name)
+		}
+		if test.endpoint != "/test/dispatch/limited" && running != test.running {
+			t.Errorf("%s: running = %v, expected %v", test.name, running, test.running)
+		}
+	}
+
+	// An idle dispatcher hands its slot over, so the waiting endpoint is delivered eventually
+	replayBuffer.SetOverrides(map[string]int{"/test/dispatch/limited": 10})
+	defer replayBuffer.SetOverrides(nil)
+	dispatch(Message{ID: "limited", Endpoint: "/test/dispatch/limited"})
+	waitForBuffered(t, "/test/dispatch/limited", currentSequence("/test/dispatch/limited")-1, 1)
+}
+
+func TestDispatchHandsSlotsOverInTurn(t *testing.T) {
+	first, second := uniqueEndpoint("/test/dispatch/turns/a"), uniqueEndpoint("/test/dispatch/turns/b")
+
+	c := newClient(&fakeConn{}, first)
+	hub.mu.Lock()
+	hub.attach(c, first)
+	hub.attach(c, second)
+	hub.mu.Unlock()
+	defer hub.unregister(first, c)
+
+	// Both endpoints have a backlog, the first one's dispatcher running and the second one waiting for its slot
+	a, b := holdDispatcher(first), holdDispatcher(second)
+	for i := 1; i <= 2*dispatchQuantum; i++ {
+		dispatch(Message{ID: fmt.Sprintf("a%d", i), Endpoint: first})
+		dispatch(Message{ID: fmt.Sprintf("b%d", i), Endpoint: second})
+	}
+	slots.Lock()
+	slots.waiting = append(slots.waiting, b)
+	slots.running++
+	a.start()
+	slots.Unlock()
+
+	// Each dispatcher delivers a turn's worth of messages before the other one gets its slot
+	var expected []string
+	for turn := 0; turn < 2; turn++ {
+		for _, prefix := range []string{"a", "b"} {
+			for i := 1; i <= dispatchQuantum; i++ {
+				expected = append(expected, fmt.Sprintf("%s%d", prefix, turn*dispatchQuantum+i))
+			}
+		}
+	}
+	var delivered []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(delivered) < len(expected) && time.Now().Before(deadline) {
+		for _, frame := range queuedFrames(c) {
+			delivered = append(delivered, frame.(Message).ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprint(delivered) != fmt.Sprint(expected) {
+		t.Errorf("delivered %v, expected %v", delivered, expected)
+	}
+}
+
+func TestDispatchDeliversHigherPrioritiesFirst(t *testing.T) {
+	endpoint := uniqueEndpoint("/test/dispatch/priorities")
+	replayBuffer.SetOverrides(map[string]int{endpoint: 100})
+	defer replayBuffer.SetOverrides(nil)
+
+	// The dispatcher is only started once all messages are queued, so that they're taken by priority
+	d := holdDispatcher(endpoint)
+	start := currentSequence(endpoint)
+	queued := []struct {
+		id       string
+		priority priority
+	}{
+		{"low 1", priorityLow},
+		{"normal 1", priorityNormal},
+		{"high 1", priorityHigh},
+		{"low 2", priorityLow},
+		{"high 2", priorityHigh},
+		{"normal 2", priorityNormal},
+	}
+	for _, m := range queued {
+		if !dispatch(Message{ID: m.id, Endpoint: endpoint, priority: m.priority}) {
+			t.Fatalf("message %s dropped", m.id)
+		}
+	}
+	slots.Lock()
+	slots.running++
+	d.start()
+	slots.Unlock()
+
+	expected := []string{"high 1", "high 2", "normal 1", "normal 2", "low 1", "low 2"}
+	for n, msg := range waitForBuffered(t, endpoint, start, len(expected)) {
+		// Messages are numbered in the order they're delivered in
+		if msg.ID != expected[n] || msg.Seq != start+uint64(n+1) {
+			t.Errorf("message %d is %s with sequence number %d, expected %s with %d", n, msg.ID, msg.Seq, expected[n], start+uint64(n+1))
+		}
+	}
+}
+
+// BenchmarkDispatch queues messages for delivery and waits for them to be delivered, on a single endpoint and on
+// one endpoint per goroutine
+func BenchmarkDispatch(b *testing.B) {
+	defer func(size int) { endpointQueueSize = size }(endpointQueueSize)
+	wait := func(endpoint string) {
+		for queueLength(endpoint) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	b.Run("single endpoint", func(b *testing.B) {
+		endpointQueueSize = b.N
+		endpoint := uniqueEndpoint("/bench/dispatch")
+		for i := 0; i < b.N; i++ {
+			dispatch(Message{ID: "bench", Endpoint: endpoint})
+		}
+		wait(endpoint)
+	})
+	b.Run("endpoint per goroutine", func(b *testing.B) {
+		endpointQueueSize = b.N
+		b.RunParallel(func(pb *testing.PB) {
+			endpoint := uniqueEndpoint("/bench/dispatch")
+			for pb.Next() {
+				dispatch(Message{ID: "bench", Endpoint: endpoint})
+			}
+			wait(endpoint)
+		})
+	})
+}
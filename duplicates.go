@@ -0,0 +1,162 @@
+package sockethook
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Endpoints whose consecutive messages with the same payload are collapsed, given on the command line
+var duplicates = newDuplicateCollapser(nil)
+
+// duplicateCollapser suppresses messages repeating the payload of the previous message on their endpoint, for
+// providers which resend unchanged state. The first message of a run is delivered right away. Repeats within
+// the window are suppressed, the last of them being delivered with their number once the window ends or a
+// different payload arrives, after which a new window starts.
+type duplicateCollapser struct {
+	windows map[string]time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*duplicateRun
+}
+
+// duplicateRun is a run of messages with the same payload on an endpoint
+type duplicateRun struct {
+	hash   string
+	window time.Duration
+	timer  *time.Timer
+	// Last of the messages suppressed since the run's last delivery, and their number
+	last    *Message
+	repeats int
+}
+
+func newDuplicateCollapser(windows map[string]time.Duration) *duplicateCollapser {
+	return &duplicateCollapser{windows: windows, runs: make(map[string]*duplicateRun)}
+}
+
+// parseDuplicateWindows parses duplicate windows of the form /endpoint=window, where the endpoint may be a
+// pattern
+func parseDuplicateWindows(rules []string) (map[string]time.Duration, error) {
+	windows := make(map[string]time.Duration)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid duplicate window %q, expected /endpoint=window", rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		if isReserved(endpoint) {
+			return nil, fmt.Errorf("invalid duplicate window %q, endpoint is reserved", rule)
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid duplicate window %q", parts[1])
+		}
+		windows[endpoint] = window
+	}
+	return windows, nil
+}
+
+// window returns the duplicate window of an endpoint, an exact window taking precedence over patterns
+func (d *duplicateCollapser) window(endpoint string) (time.Duration, bool) {
+	if window, ok := d.windows[endpoint]; ok {
+		return window, true
+	}
+	for pattern, window := range d.windows {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return window, true
+		}
+	}
+	return 0, false
+}
+
+// Collapse checks if a message repeats the payload of the previous one on its endpoint, returning true if it's
+// suppressed. A message with a different payload ends the previous run, whose report is returned to be
+// broadcast before it, if any.
+func (d *duplicateCollapser) Collapse(msg Message) (*Message, bool) {
+	if len(d.windows) == 0 || msg.BodySHA256 == "" || isReserved(msg.Endpoint) {
+		return nil, false
+	}
+	window, ok := d.window(msg.Endpoint)
+	if !ok {
+		return nil, false
+	}
+	endpoint := msg.Endpoint
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	run, ok := d.runs[endpoint]
+	if ok && run.hash == msg.BodySHA256 {
+		run.last = &msg
+		run.repeats++
+		metrics.duplicates.Inc("suppressed")
+		return nil, true
+	}
+
+	var report *Message
+	if ok {
+		run.timer.Stop()
+		report = run.report()
+	}
+	run = &duplicateRun{hash: msg.BodySHA256, window: window}
+	run.timer = time.AfterFunc(window, func() { d.expire(endpoint, run) })
+	d.runs[endpoint] = run
+	return report, false
+}
+
+// report returns the last suppressed message of a run with the number of repeats, nil if there were none
+func (r *duplicateRun) report() *Message {
+	if r.last == nil {
+		return nil
+	}
+	msg := *r.last
+	msg.Repeats = r.repeats
+	msg.repeat = true
+	// Suppressing is deliberate, so latency budgets count from the report
+	msg.received = time.Now()
+	metrics.duplicates.Inc("reported")
+	return &msg
+}
+
+// expire ends the window of a run, broadcasting its report and starting a new window if there were repeats
+func (d *duplicateCollapser) expire(endpoint string, run *duplicateRun) {
+	d.mu.Lock()
+	if d.runs[endpoint] != run {
+		d.mu.Unlock()
+		return
+	}
+	report := run.report()
+	if report == nil {
+		delete(d.runs, endpoint)
+	} else {
+		run.last, run.repeats = nil, 0
+		run.timer.Reset(run.window)
+	}
+	d.mu.Unlock()
+
+	if report != nil {
+		log.WithField("endpoint", endpoint).WithField("repeats", report.Repeats).Debugln("Broadcasting collapsed duplicates")
+		hub.Broadcast(*report)
+	}
+}
+
+// FlushAll broadcasts the reports of all runs right away, such as when shutting down
+func (d *duplicateCollapser) FlushAll() {
+	d.mu.Lock()
+	reports := []Message{}
+	for endpoint, run := range d.runs {
+		run.timer.Stop()
+		if report := run.report(); report != nil {
+			reports = append(reports, *report)
+		}
+		delete(d.runs, endpoint)
+	}
+	d.mu.Unlock()
+
+	for _, report := range reports {
+		hub.Broadcast(report)
+	}
+}
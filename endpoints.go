@@ -0,0 +1,264 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Whether hooks and clients are only accepted on declared endpoints, instead of endpoints coming into existence
+// when they're first used
+var declaredOnly bool
+
+// How long an endpoint without clients and hooks is kept before its state is dropped, 0 to keep it forever
+var endpointIdleTimeout time.Duration
+
+// Sources of endpoint declarations
+const (
+	declaredByOption = "option"
+	declaredByConfig = "config"
+	declaredByAdmin  = "admin"
+)
+
+// Endpoints and patterns declared with --declare-endpoint and through the admin API, with where they were
+// declared. Endpoints of the configuration file are declared through configured.endpoints.
+var declarations = struct {
+	sync.RWMutex
+	endpoints map[string]string
+}{endpoints: make(map[string]string)}
+
+// Time each endpoint last received a hook or lost its last client, tracked when idle endpoints are collected
+var endpointActivity = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// parseDeclaration checks an endpoint or pattern to be declared
+func parseDeclaration(endpoint string) (string, error) {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "/") || !validPattern(endpoint) {
+		return "", fmt.Errorf("invalid endpoint %q, expected /endpoint or a pattern", endpoint)
+	}
+	if isReserved(endpoint) {
+		return "", fmt.Errorf("endpoint %q is reserved", endpoint)
+	}
+	return endpoint, nil
+}
+
+// declareEndpoints declares the endpoints given as options
+func declareEndpoints(endpoints []string) error {
+	for _, endpoint := range endpoints {
+		endpoint, err := parseDeclaration(endpoint)
+		if err != nil {
+			return err
+		}
+		declarations.endpoints[endpoint] = declaredByOption
+	}
+	return nil
+}
+
+// declaredBy returns where an endpoint or pattern was declared, empty if it wasn't
+func declaredBy(endpoint string) string {
+	declarations.RLock()
+	by := declarations.endpoints[endpoint]
+	declarations.RUnlock()
+	if by != "" {
+		return by
+	}
+	if settingsFor(endpoint) != nil {
+		return declaredByConfig
+	}
+	return ""
+}
+
+// declared checks if hooks and clients are accepted on an endpoint. In declared mode the endpoint has to be
+// declared or covered by a declared pattern, and a pattern is only accepted if declarations cover everything
+// it matches. Reserved endpoints are always accepted.
+func declared(endpoint string) bool {
+	if !declaredOnly || isReserved(endpoint) || declaredBy(endpoint) != "" {
+		return true
+	}
+	for _, declaration := range declaredEndpoints() {
+		if declaration == endpoint || patternCovers(declaration, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredEndpoints returns all declared endpoints and patterns, sorted
+func declaredEndpoints() []string {
+	seen := make(map[string]bool)
+	declarations.RLock()
+	for endpoint := range declarations.endpoints {
+		seen[endpoint] = true
+	}
+	declarations.RUnlock()
+	configured.RLock()
+	for endpoint := range configured.endpoints {
+		seen[endpoint] = true
+	}
+	configured.RUnlock()
+
+	endpoints := make([]string, 0, len(seen))
+	for endpoint := range seen {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// declareByAdmin declares an endpoint through the admin API, returning whether it wasn't declared before
+func declareByAdmin(endpoint string) bool {
+	declarations.Lock()
+	_, exists := declarations.endpoints[endpoint]
+	if !exists {
+		declarations.endpoints[endpoint] = declaredByAdmin
+	}
+	declarations.Unlock()
+
+	if !exists {
+		log.WithField("endpoint", endpoint).Warnln("Endpoint declared")
+		publishEvent("endpoint_created", map[string]interface{}{"endpoint": endpoint, "by": declaredByAdmin})
+	}
+	return !exists
+}
+
+// handleDeclaration declares an endpoint with PUT and removes the declaration with DELETE. Only endpoints
+// declared through the admin API can be removed, the others being declared until the options or configuration
+// file change.
+func handleDeclaration(w http.ResponseWriter, r *http.Request, endpoint string) {
+	endpoint, err := parseDeclaration(endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	logEntry := log.WithField("endpoint", endpoint)
+
+	switch r.Method {
+	case "PUT":
+		ownership, hasOwnership, err := readOwnership(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		exists := !declareByAdmin(endpoint)
+		if hasOwnership {
+			setOwnership(endpoint, ownership)
+			logEntry.WithField("owner", ownership.Owner).Infoln("Endpoint ownership set")
+		}
+		response := map[string]interface{}{"endpoint": endpoint, "declared_by": declaredBy(endpoint)}
+		if o := ownershipOf(endpoint); o != nil {
+			response["ownership"] = o
+		}
+		if !exists {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(201)
+		}
+		writeJSON(w, response)
+	case "DELETE":
+		declarations.Lock()
+		by := declarations.endpoints[endpoint]
+		if by == declaredByAdmin {
+			delete(declarations.endpoints, endpoint)
+			setOwnership(endpoint, EndpointOwnership{})
+		}
+		declarations.Unlock()
+		if by == "" {
+			by = declaredBy(endpoint)
+		}
+
+		switch by {
+		case declaredByAdmin:
+			logEntry.Warnln("Endpoint declaration removed")
+			writeJSON(w, map[string]interface{}{"endpoint": endpoint})
+		case "":
+			http.Error(w, "endpoint isn't declared", 404)
+		case declaredByTemporary:
+			http.Error(w, "endpoint is temporary, expire it with DELETE /admin/temporary/<id>", 409)
+		default:
+			http.Error(w, "endpoint is declared by the "+by+" and can't be removed through the admin API", 409)
+		}
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		w.WriteHeader(405)
+	}
+}
+
+// touchEndpoint records activity on an endpoint, so that it isn't collected while in use
+func touchEndpoint(endpoint string) {
+	if endpointIdleTimeout <= 0 {
+		return
+	}
+	endpointActivity.Lock()
+	endpointActivity.last[endpoint] = time.Now()
+	endpointActivity.Unlock()
+}
+
+// collectIdleEndpoints drops the state of endpoints without activity for the idle timeout every interval, such
+// as their sequence numbers, eviction counts and replay buffers, so that endpoints created by typos or one-off
+// tests don't accumulate
+func collectIdleEndpoints(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		idle := make(map[string]time.Time)
+		endpointActivity.Lock()
+		for endpoint, at := range endpointActivity.last {
+			if now.Sub(at) >= endpointIdleTimeout {
+				idle[endpoint] = at
+			}
+		}
+		endpointActivity.Unlock()
+
+		collected := 0
+		for endpoint, at := range idle {
+			if forgetEndpoint(endpoint, at) {
+				collected++
+			}
+		}
+		if collected > 0 {
+			log.WithField("endpoints", collected).Infoln("Collected idle endpoints")
+		}
+	}
+}
+
+// forgetEndpoint drops the state of an endpoint unless it has clients, queued messages or was active since
+// the given time. Returns whether it was dropped.
+func forgetEndpoint(endpoint string, at time.Time) bool {
+	endpointActivity.Lock()
+	active := !endpointActivity.last[endpoint].Equal(at)
+	endpointActivity.Unlock()
+	// Archived endpoints keep their messages until they're purged
+	if active || archiveOf(endpoint) != nil {
+		return false
+	}
+
+	hub.mu.Lock()
+	if len(hub.clients[endpoint]) > 0 {
+		hub.mu.Unlock()
+		return false
+	}
+	delete(hub.evictions, endpoint)
+	hub.mu.Unlock()
+
+	// A running dispatcher has delivered or is about to deliver a message
+	if !forgetSequence(endpoint) {
+		return false
+	}
+
+	replayBuffer.Purge(endpoint)
+	writeBudget.Forget(endpoint)
+
+	endpointActivity.Lock()
+	if endpointActivity.last[endpoint].Equal(at) {
+		delete(endpointActivity.last, endpoint)
+	}
+	endpointActivity.Unlock()
+	log.WithField("endpoint", endpoint).Debugln("Collected idle endpoint")
+	return true
+}
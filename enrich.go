@@ -0,0 +1,114 @@
+package sockethook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Computed enrichment fields which can be added to message metadata
+var computedFields = map[string]func(r *http.Request, received time.Time) interface{}{
+	"received_at": func(r *http.Request, received time.Time) interface{} {
+		return received.UTC().Format(time.RFC3339Nano)
+	},
+	"source_ip": func(r *http.Request, received time.Time) interface{} {
+		return remoteIP(r)
+	},
+	"host": func(r *http.Request, received time.Time) interface{} {
+		return r.Host
+	},
+}
+
+// Enricher adds static and computed fields to the metadata of messages before broadcast
+type Enricher struct {
+	// Static fields added to messages on all endpoints
+	global map[string]string
+	// Static fields added to messages on specific endpoints, these take precedence over global ones
+	endpoints map[string]map[string]string
+	// Names of computed fields added to all messages
+	computed []string
+	// Optional GeoIP databases used to resolve the source of hooks
+	geoip *GeoIP
+}
+
+// newEnricher parses static rules of the form "key=value" or "/endpoint:key=value" and a list of computed field names
+func newEnricher(static []string, computed []string) (*Enricher, error) {
+	e := &Enricher{
+		global:    make(map[string]string),
+		endpoints: make(map[string]map[string]string),
+	}
+
+	for _, rule := range static {
+		endpoint := ""
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid enrichment rule %q, expected /endpoint:key=value", rule)
+			}
+			endpoint, rule = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid enrichment rule %q, expected key=value", rule)
+		}
+
+		if endpoint == "" {
+			e.global[kv[0]] = kv[1]
+			continue
+		}
+		if e.endpoints[endpoint] == nil {
+			e.endpoints[endpoint] = make(map[string]string)
+		}
+		e.endpoints[endpoint][kv[0]] = kv[1]
+	}
+
+	for _, name := range computed {
+		if name == "" {
+			continue
+		}
+		if _, ok := computedFields[name]; !ok {
+			return nil, fmt.Errorf("unknown computed enrichment field %q", name)
+		}
+		e.computed = append(e.computed, name)
+	}
+
+	return e, nil
+}
+
+// Enrich adds all configured fields for the message's endpoint to its metadata
+func (e *Enricher) Enrich(msg *Message, r *http.Request, received time.Time) {
+	if len(e.global) == 0 && len(e.endpoints[msg.Endpoint]) == 0 && len(e.computed) == 0 && e.geoip == nil {
+		return
+	}
+
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]interface{})
+	}
+
+	for _, name := range e.computed {
+		msg.Metadata[name] = computedFields[name](r, received)
+	}
+	if e.geoip != nil {
+		if info := e.geoip.Lookup(remoteIP(r)); info != nil {
+			msg.Metadata["geoip"] = info
+		}
+	}
+	for k, v := range e.global {
+		msg.Metadata[k] = v
+	}
+	for k, v := range e.endpoints[msg.Endpoint] {
+		msg.Metadata[k] = v
+	}
+}
+
+// remoteIP returns the IP address of the client which sent the request, without port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,44 @@
+package sockethook
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reserved endpoint on which server lifecycle and operational events are broadcasted
+const eventsEndpoint = "/sockethook/events"
+
+// Event describes something which happened to the server itself
+type Event struct {
+	Type    string                 `json:"type"`
+	Time    string                 `json:"time"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// publishEvent broadcasts a server event to all clients subscribed to the events endpoint and sends it to the
+// lifecycle webhooks
+func publishEvent(eventType string, details map[string]interface{}) {
+	log.WithField("type", eventType).Debugln("Publishing server event")
+	msg := eventMessage(eventType, details)
+	hub.Broadcast(msg)
+	notifyLifecycle(msg.Data.(Event))
+}
+
+// eventMessage wraps a server event in a message for the events endpoint
+func eventMessage(eventType string, details map[string]interface{}) Message {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	return Message{
+		Type:       frameData,
+		ID:         idGenerator.NewID(),
+		Headers:    map[string]string{},
+		Endpoint:   eventsEndpoint,
+		ReceivedAt: now,
+		Data: Event{
+			Type:    eventType,
+			Time:    now,
+			Details: details,
+		},
+	}
+}
@@ -0,0 +1,231 @@
+package sockethook
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields of exported messages written as CSV columns unless the request selects its own
+var defaultExportFields = []string{"id", "seq", "endpoint", "received_at", "content_type", "data"}
+
+// exportField is a column of an export, a path into the message like those of filters
+type exportField struct {
+	name string
+	path pathNode
+}
+
+// handleExport streams the logged or recorded messages of an endpoint as NDJSON or CSV, for offline analysis of
+// an endpoint's traffic. Messages are those logged from the from query parameter until the to parameter, in
+// RFC3339. With fields, only the given paths of each message are exported, such as id,data.action. The export is
+// gzipped for clients which accept it.
+func handleExport(w http.ResponseWriter, r *http.Request, endpoint string) {
+	logEntry := log.WithField("endpoint", endpoint)
+	if isPattern(endpoint) || endpoint == "" {
+		http.Error(w, "expected an endpoint", 400)
+		return
+	}
+
+	// The history log takes precedence as it keeps the messages of an endpoint since they were first logged
+	var source *HistoryLog
+	if historyLog.Enabled(endpoint) {
+		source = historyLog
+	} else if rec := recorder.find(endpoint); rec != nil {
+		source = rec.log
+	} else {
+		http.Error(w, "endpoint isn't logged or recorded", 404)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		http.Error(w, fmt.Sprintf("invalid format %q, expected ndjson or csv", format), 400)
+		return
+	}
+	var from, to time.Time
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		if *bound.t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s %q, expected RFC3339", bound.name, value), 400)
+			return
+		}
+	}
+	names := defaultExportFields
+	if value := query.Get("fields"); value != "" {
+		names = strings.Split(value, ",")
+	} else if format == "ndjson" {
+		names = nil
+	}
+	fields, err := parseExportFields(names)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	schema, ok := connectSchema(w, r, logEntry)
+	if !ok {
+		return
+	}
+
+	// Messages are written as they're read, the response being started with the first one so that a log which
+	// can't be read is still answered with 500
+	var export *exportWriter
+	var gz *gzip.Writer
+	var buffered *bufio.Writer
+	start := func() {
+		if export != nil {
+			return
+		}
+		filename := strings.Replace(strings.Trim(endpoint, "/"), "/", "-", -1) + "." + format
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		buffered = bufio.NewWriter(out)
+		export = newExportWriter(buffered, format, fields, schema)
+	}
+
+	messages := 0
+	err = source.Each(endpoint, from, to, func(entry historyEntry) error {
+		start()
+		messages++
+		return export.Write(entry)
+	})
+	if err != nil && export == nil {
+		logEntry.Errorln("Failed to read messages for export:", err)
+		w.WriteHeader(500)
+		return
+	}
+	start()
+	export.Flush()
+	buffered.Flush()
+	if gz != nil {
+		gz.Close()
+	}
+	if err != nil {
+		logEntry.WithField("messages", messages).Errorln("Export cut off:", err)
+		return
+	}
+	logEntry.WithField("format", format).WithField("messages", messages).Infoln("Messages exported")
+}
+
+// parseExportFields parses the paths of the fields selected for an export
+func parseExportFields(names []string) ([]exportField, error) {
+	fields := []exportField{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		f, err := parseFilter(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %v", name, err)
+		}
+		path, ok := f.root.(pathNode)
+		if !ok {
+			return nil, fmt.Errorf("invalid field %q, expected a path such as data.action", name)
+		}
+		fields = append(fields, exportField{name: name, path: path})
+	}
+	return fields, nil
+}
+
+// exportDocument returns a message as it's exported in a schema, decoded from JSON for fields to be selected
+func exportDocument(msg Message, schema int) interface{} {
+	data, err := json.Marshal(msg.encode(schema))
+	if err != nil {
+		return nil
+	}
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+	return doc
+}
+
+// exportWriter writes exported messages one at a time. As NDJSON each message is a line, either whole or as an
+// object of the selected fields. As CSV a header row of the fields is followed by a row per message, strings
+// being written as they are, missing values as empty cells and other values as JSON.
+type exportWriter struct {
+	fields []exportField
+	schema int
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+// newExportWriter starts an export in a format, writing the header row of CSV exports
+func newExportWriter(w io.Writer, format string, fields []exportField, schema int) *exportWriter {
+	export := &exportWriter{fields: fields, schema: schema}
+	if format != "csv" {
+		export.json = json.NewEncoder(w)
+		return export
+	}
+
+	export.csv = csv.NewWriter(w)
+	row := make([]string, len(fields))
+	for i, field := range fields {
+		row[i] = field.name
+	}
+	export.csv.Write(row)
+	return export
+}
+
+// Write writes a message to the export, returning an error once the export can't be written anymore
+func (e *exportWriter) Write(entry historyEntry) error {
+	if e.json != nil {
+		if len(e.fields) == 0 {
+			return e.json.Encode(entry.Message.encode(e.schema))
+		}
+		doc := exportDocument(entry.Message, e.schema)
+		selected := make(map[string]interface{}, len(e.fields))
+		for _, field := range e.fields {
+			selected[field.name] = field.path.eval(doc)
+		}
+		return e.json.Encode(selected)
+	}
+
+	doc := exportDocument(entry.Message, e.schema)
+	row := make([]string, len(e.fields))
+	for i, field := range e.fields {
+		switch value := field.path.eval(doc).(type) {
+		case nil:
+			row[i] = ""
+		case string:
+			row[i] = value
+		default:
+			cell, _ := json.Marshal(value)
+			row[i] = string(cell)
+		}
+	}
+	return e.csv.Write(row)
+}
+
+// Flush writes any buffered rows of a CSV export
+func (e *exportWriter) Flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+}
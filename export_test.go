@@ -0,0 +1,122 @@
+package sockethook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportLog exports the logged messages of an endpoint like handleExport does
+func exportLog(t *testing.T, h *HistoryLog, endpoint string, format string, names []string, from, to time.Time) string {
+	t.Helper()
+	fields, err := parseExportFields(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	export := newExportWriter(&out, format, fields, schemaV1)
+	if err := h.Each(endpoint, from, to, export.Write); err != nil {
+		t.Fatal(err)
+	}
+	export.Flush()
+	return out.String()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockethook-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := newHistoryLog(dir, []string{"/**"}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	original := []string{
+		`{"id":"m1","seq":1,"received_at":"` + start.Format(time.RFC3339Nano) + `","headers":{"X-Tag":"a"},"data":{"action":"opened","number":1}}`,
+		`{"id":"m2","seq":2,"received_at":"` + start.Add(time.Minute).Format(time.RFC3339Nano) + `","data":{"action":"closed","number":1}}`,
+		`{"id":"m3","seq":5,"received_at":"` + start.Add(2*time.Minute).Format(time.RFC3339Nano) + `","data":"aGVsbG8=","encoding":"base64"}`,
+	}
+	entries, err := readImport(strings.NewReader(strings.Join(original, "\n")), "/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := h.Import("/source", entries); err != nil || imported != 3 {
+		t.Fatalf("Import = %d, %v, expected 3 messages", imported, err)
+	}
+
+	// Exported messages are imported into another endpoint as they were logged
+	exported := exportLog(t, h, "/source", "ndjson", nil, time.Time{}, time.Time{})
+	reimported, err := readImport(strings.NewReader(exported), "/copy")
+	if err != nil {
+		t.Fatalf("reading export: %v\n%s", err, exported)
+	}
+	if imported, err := h.Import("/copy", reimported); err != nil || imported != 3 {
+		t.Fatalf("Import of export = %d, %v, expected 3 messages", imported, err)
+	}
+	copied, err := h.Between("/copy", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != len(entries) {
+		t.Fatalf("copied %d messages, expected %d", len(copied), len(entries))
+	}
+	for i, entry := range copied {
+		want := entries[i].Message
+		want.Endpoint = "/copy"
+		if !reflect.DeepEqual(entry.Message, want) || !entry.At.Equal(entries[i].At) {
+			t.Errorf("message %d copied as %+v at %v, expected %+v at %v", i, entry.Message, entry.At, want, entries[i].At)
+		}
+	}
+	// Importing the same messages again skips them
+	if imported, err := h.Import("/copy", reimported); err != nil || imported != 0 {
+		t.Errorf("Import of messages already logged = %d, %v, expected none", imported, err)
+	}
+
+	tests := []struct {
+		name     string
+		format   string
+		fields   []string
+		from, to time.Time
+		expected string
+	}{
+		{
+			"selected fields", "ndjson", []string{"id", "data.action"}, time.Time{}, time.Time{},
+			`{"data.action":"opened","id":"m1"}` + "\n" + `{"data.action":"closed","id":"m2"}` + "\n" + `{"data.action":null,"id":"m3"}` + "\n",
+		},
+		{
+			"CSV", "csv", []string{"id", "seq", "data.number", "headers.X-Tag"}, time.Time{}, time.Time{},
+			"id,seq,data.number,headers.X-Tag\nm1,1,1,a\nm2,2,1,\nm3,5,,\n",
+		},
+		{
+			"window", "csv", []string{"id"}, start.Add(time.Minute), start.Add(time.Minute),
+			"id\nm2\n",
+		},
+	}
+	for _, test := range tests {
+		if exported := exportLog(t, h, "/source", test.format, test.fields, test.from, test.to); exported != test.expected {
+			t.Errorf("%s: exported\n%s\nexpected\n%s", test.name, exported, test.expected)
+		}
+	}
+}
+
+func TestReadImportRejectsInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not JSON", `{"id":"m1"`},
+		{"invalid time of receipt", `{"id":"m1","received_at":"yesterday"}`},
+	}
+	for _, test := range tests {
+		if _, err := readImport(strings.NewReader(test.body), "/orders"); err == nil {
+			t.Errorf("%s: expected the import to be rejected", test.name)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum length of a filter expression
+var maxFilterLength = 1024
+
+// filter is an expression evaluated against the JSON of a message, such as data.action == "opened", which
+// decides if a subscription receives the message. Paths start at the message's fields, e.g. data, headers,
+// endpoint or metadata, and index into objects with .key or ["key"] and into arrays with [0]. Values are
+// compared with ==, !=, <, <=, > and >= and combined with &&, || and !. A path on its own is true if it exists
+// and isn't false, null, 0 or empty.
+type filter struct {
+	source string
+	root   filterNode
+}
+
+// filterNode is a node of a parsed filter expression
+type filterNode interface {
+	eval(doc interface{}) interface{}
+}
+
+// parseFilter parses a filter expression
+func parseFilter(source string) (*filter, error) {
+	if len(source) > maxFilterLength {
+		return nil, fmt.Errorf("filter is longer than %d characters", maxFilterLength)
+	}
+	tokens, err := tokenizeFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return &filter{source: source, root: root}, nil
+}
+
+// Match checks if a message, decoded from JSON into doc, passes the filter
+func (f *filter) Match(doc interface{}) bool {
+	return truthy(f.root.eval(doc))
+}
+
+// connectFilter parses the filter given when connecting in the filter query parameter, rejecting the request
+// with 400 if it's invalid
+func connectFilter(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (*filter, bool) {
+	source := r.URL.Query().Get("filter")
+	if source == "" {
+		return nil, true
+	}
+	f, err := parseFilter(source)
+	if err != nil {
+		logEntry.WithField("filter", source).Warnln("Rejected client, invalid filter:", err)
+		rejectClient(w, 400, "invalid_filter", err.Error())
+		return nil, false
+	}
+	return f, true
+}
+
+// filterDocument decodes the JSON of a message for filters to be evaluated against
+func filterDocument(msg Message) interface{} {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+	return doc
+}
+
+type filterTokenKind int
+
+const (
+	tokenIdent filterTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+// tokenizeFilter splits a filter or transformation expression into identifiers, literals and operators
+func tokenizeFilter(source string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			// Strings are quoted like JSON strings, single quotes being accepted for use in URLs and shells
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			raw := string(runes[i+1 : j])
+			if r == '\'' {
+				raw = strings.Replace(strings.Replace(raw, `\'`, `'`, -1), `"`, `\"`, -1)
+			}
+			value, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in filter", string(runes[i:j+1]))
+			}
+			tokens = append(tokens, filterToken{tokenString, value})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokenNumber, string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, string(runes[i:j])})
+			i = j
+		default:
+			operator := ""
+			for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ".", "{", "}", ":", ",", "|"} {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q in filter", string(r))
+			}
+			tokens = append(tokens, filterToken{tokenOperator, operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser for filter expressions
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it's the given operator
+func (p *filterParser) accept(operator string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator && p.tokens[p.pos].text == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return comparisonNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case tokenString:
+		return literalNode{token.text}, nil
+	case tokenNumber:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in filter", token.text)
+		}
+		return literalNode{value}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		return p.parsePath(token.text)
+	}
+	return nil, fmt.Errorf("unexpected %q in filter", token.text)
+}
+
+// parsePath parses the keys and indices following the first key of a path
+func (p *filterParser) parsePath(first string) (filterNode, error) {
+	path := pathNode{first}
+	for {
+		switch {
+		case p.accept("."):
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenIdent {
+				return nil, fmt.Errorf("expected a key after . in filter")
+			}
+			path = append(path, p.tokens[p.pos].text)
+			p.pos++
+		case p.accept("["):
+			if p.pos >= len(p.tokens) || (p.tokens[p.pos].kind != tokenString && p.tokens[p.pos].kind != tokenNumber) {
+				return nil, fmt.Errorf("expected a key or index after [ in filter")
+			}
+			path = append(path, p.tokens[p.pos].text)
+			p.pos++
+			if !p.accept("]") {
+				return nil, fmt.Errorf("missing ] in filter")
+			}
+		default:
+			return path, nil
+		}
+	}
+}
+
+// pathNode looks up a value in the message, evaluating to nil if it doesn't exist
+type pathNode []string
+
+func (n pathNode) eval(doc interface{}) interface{} {
+	value := doc
+	for _, key := range n {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(doc interface{}) interface{} {
+	return n.value
+}
+
+type notNode struct {
+	operand filterNode
+}
+
+func (n notNode) eval(doc interface{}) interface{} {
+	return !truthy(n.operand.eval(doc))
+}
+
+type logicalNode struct {
+	or          bool
+	left, right filterNode
+}
+
+func (n logicalNode) eval(doc interface{}) interface{} {
+	if n.or {
+		return truthy(n.left.eval(doc)) || truthy(n.right.eval(doc))
+	}
+	return truthy(n.left.eval(doc)) && truthy(n.right.eval(doc))
+}
+
+// comparisonNode compares two values. Values of different types are never equal, and only numbers and strings
+// are ordered.
+type comparisonNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n comparisonNode) eval(doc interface{}) interface{} {
+	left, right := n.left.eval(doc), n.right.eval(doc)
+
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		cmp = compareFloats(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// equal compares JSON scalars, objects and arrays never being equal to anything
+func equal(a interface{}, b interface{}) bool {
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	switch b.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return a == b
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// truthy checks if a value counts as true, which all but false, null, 0 and empty strings do
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{
+		"endpoint": "/orders",
+		"headers": {"X-Event": "push"},
+		"data": {
+			"action": "opened", "n": 3, "zero": 0, "empty": "", "draft": false, "nothing": null,
+			"labels": ["bug", "ui"], "a key": {"it's": "quoted"}, "user": {"login": "octo"}
+		}
+	}`), &doc)
+
+	tests := []struct {
+		source string
+		match  bool
+	}{
+		{`data.action == "opened"`, true},
+		{`data.action != "opened"`, false},
+		{`headers["X-Event"] == 'push'`, true},
+		// && binds tighter than ||, and ! applies to the comparison after it
+		{`data.n == 1 || data.n == 3 && data.action == "closed"`, false},
+		{`data.n == 3 || data.n == 1 && data.action == "closed"`, true},
+		{`(data.n == 3 || data.n == 1) && data.action == "closed"`, false},
+		{`!data.n == 1`, true},
+		{`!data.n == 3`, false},
+		{`!(data.n == 3) || !!data.user`, true},
+		{`!data.draft && !data.nothing && !data.zero && !data.empty && !data.missing`, true},
+		{`data.user && data.labels && data.action`, true},
+		// Paths index into objects with brackets, into arrays by number, and missing ones are null
+		{`data.labels[1] == "ui"`, true},
+		{`data["labels"][0] == "bug"`, true},
+		{`data.labels[2] == null && data.missing.deeper == null && data.action.length == null`, true},
+		{`data["a key"]['it\'s'] == "quoted"`, true},
+		{`data.nothing == null && data.draft == false`, true},
+		// Numbers and strings are ordered, values of different types are neither equal nor ordered
+		{`data.n >= 3 && data.n < 3.5 && data.n > -1 && data.n <= 3e0`, true},
+		{`data.action > "close" && data.action < "opens"`, true},
+		{`data.n == "3"`, false},
+		{`data.n != "3"`, true},
+		{`data.n < "4" || data.n >= "0"`, false},
+		{`data.action > 1 || data.action <= 1`, false},
+		{`data.draft < true || data.nothing >= null`, false},
+		{`data.labels == data.labels || data.user == data.user`, false},
+		{`data.zero == false || data.empty == null`, false},
+	}
+	for _, test := range tests {
+		f, err := parseFilter(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if match := f.Match(doc); match != test.match {
+			t.Errorf("%s: match = %v, expected %v", test.source, match, test.match)
+		}
+	}
+}
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		source string
+		tokens []filterToken
+	}{
+		{`data.a>=-1.5e3`, []filterToken{{tokenIdent, "data"}, {tokenOperator, "."}, {tokenIdent, "a"}, {tokenOperator, ">="}, {tokenNumber, "-1.5e3"}}},
+		{`x-id<=2||!y`, []filterToken{{tokenIdent, "x-id"}, {tokenOperator, "<="}, {tokenNumber, "2"}, {tokenOperator, "||"}, {tokenOperator, "!"}, {tokenIdent, "y"}}},
+		{`a["b c"][0]`, []filterToken{{tokenIdent, "a"}, {tokenOperator, "["}, {tokenString, "b c"}, {tokenOperator, "]"}, {tokenOperator, "["}, {tokenNumber, "0"}, {tokenOperator, "]"}}},
+		// Single-quoted strings take the escapes of double-quoted ones, escaped single quotes and plain double quotes
+		{`'it\'s "x"\té'`, []filterToken{{tokenString, "it's \"x\"\té"}}},
+		{`"say \"hi\"" 'a\\'`, []filterToken{{tokenString, `say "hi"`}, {tokenString, `a\`}}},
+		{` `, []filterToken{}},
+	}
+	for _, test := range tests {
+		tokens, err := tokenizeFilter(test.source)
+		if err != nil || !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("tokenizeFilter(%s) = %v, %v, expected %v", test.source, tokens, err, test.tokens)
+		}
+	}
+
+	for _, source := range []string{`"unterminated`, `'unterminated\'`, `'\q'`, `"\x"`, `data.a # comment`, `a = 1`, `a & b`} {
+		if _, err := tokenizeFilter(source); err == nil {
+			t.Errorf("expected tokenizeFilter(%s) to fail", source)
+		}
+	}
+}
+
+func TestParseFilterRejectsMalformedFilters(t *testing.T) {
+	for _, source := range []string{
+		"", "data.a ==", "== 1", "data.a == == 1", "(data.a", "data.a)", "data.", "data..a", "data[", "data[a]",
+		`data["a"`, "data.a == 1 2", "!", "data.a && ", "|| data.a", "1.2.3", "data{", `data.a == 'x`,
+	} {
+		if _, err := parseFilter(source); err == nil {
+			t.Errorf("expected %q to be invalid", source)
+		}
+	}
+
+	source := `data.a == "` + strings.Repeat("x", maxFilterLength) + `"`
+	if _, err := parseFilter(source); err == nil {
+		t.Errorf("accepted a filter of %d characters", len(source))
+	}
+	source = `data.a == "` + strings.Repeat("x", maxFilterLength-len(`data.a == ""`)) + `"`
+	if _, err := parseFilter(source); err != nil {
+		t.Errorf("rejected a filter of %d characters: %v", len(source), err)
+	}
+}
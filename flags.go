@@ -0,0 +1,15 @@
+package sockethook
+
+import "strings"
+
+// stringList is a flag.Value which may be given multiple times, collecting every value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
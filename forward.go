@@ -0,0 +1,284 @@
+package sockethook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// URLs hooks are forwarded to per endpoint or pattern, given on the command line
+var forwardTargets = make(map[string][]string)
+
+// Number of times a failed forward is retried, with the delay before each retry doubling from forwardBackoff
+// up to maxForwardBackoff. Each delay is jittered down to half of it, so targets coming back aren't hit by every
+// queued retry at once.
+var forwardRetries = 5
+var forwardBackoff = time.Second
+var maxForwardBackoff = time.Minute
+
+// How long a forward target has to answer
+var forwardTimeout = 10 * time.Second
+
+// Number of hooks waiting to be forwarded per target before new ones are dead-lettered
+var forwardQueueSize = 256
+
+// Secrets hooks forwarded to targets are re-signed with, as URL=secret
+var forwardSecrets []string
+
+// Forwarders per target URL, started on the first hook forwarded to them
+var forwarders = struct {
+	sync.Mutex
+	targets map[string]*forwarder
+}{targets: make(map[string]*forwarder)}
+
+// Headers holding the publisher's credentials, which aren't passed on to third-party targets
+var forwardCredentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// forwarder delivers the hooks forwarded to a target from a queue of its own, in order, so that a slow or
+// failing target holds up neither the hooks nor other targets
+type forwarder struct {
+	target string
+	client *http.Client
+	queue  chan forwardJob
+}
+
+// forwardJob is a hook waiting to be forwarded
+type forwardJob struct {
+	msg    Message
+	method string
+	header http.Header
+	body   []byte
+}
+
+// parseForwardTargets parses forward targets of the form /endpoint=URL, where the endpoint may be a pattern
+func parseForwardTargets(rules []string) (map[string][]string, error) {
+	targets := make(map[string][]string)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid forward target %q, expected /endpoint=URL", rule)
+		}
+		if err := checkForwardURL(parts[1]); err != nil {
+			return nil, err
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		targets[endpoint] = append(targets[endpoint], parts[1])
+	}
+	return targets, nil
+}
+
+// checkForwardURL checks that a forward target is an absolute http:// or https:// URL
+func checkForwardURL(target string) error {
+	if err := checkValidationURL(target); err != nil {
+		return fmt.Errorf("invalid forward target %q, expected an http:// or https:// URL", target)
+	}
+	return nil
+}
+
+// parseForwardSecrets checks secrets of the form URL=secret. As both URLs and secrets may contain =, they're only
+// split once the URL of a target is known, see forwardSecretFor.
+func parseForwardSecrets(rules []string) ([]string, error) {
+	for _, rule := range rules {
+		if !strings.Contains(rule, "=") || (!strings.HasPrefix(rule, "http://") && !strings.HasPrefix(rule, "https://")) {
+			return nil, fmt.Errorf("invalid forward secret %q, expected URL=secret", rule)
+		}
+	}
+	return rules, nil
+}
+
+// forwardSecretFor returns the secret hooks forwarded to a target are re-signed with, empty if they aren't
+func forwardSecretFor(target string) string {
+	for _, rule := range forwardSecrets {
+		if strings.HasPrefix(rule, target+"=") {
+			return rule[len(target)+1:]
+		}
+	}
+	return ""
+}
+
+// forwardTargetsFor returns the URLs hooks to an endpoint are forwarded to, from the configuration file and
+// the options, each once
+func forwardTargetsFor(endpoint string) []string {
+	targets := []string{}
+	seen := make(map[string]bool)
+	add := func(urls []string) {
+		for _, target := range urls {
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	if settings := settingsFor(endpoint); settings != nil {
+		add(settings.forwardURLs)
+	}
+	for pattern, urls := range forwardTargets {
+		if pattern == endpoint || (isPattern(pattern) && patternCovers(pattern, endpoint)) {
+			add(urls)
+		}
+	}
+	return targets
+}
+
+// forwardHook queues a hook to be forwarded to the targets of its endpoint, with its original method, headers
+// and body so that targets can verify signatures. Hop-by-hop headers and the publisher's credentials are left out.
+func forwardHook(r *http.Request, msg Message, body []byte) {
+	targets := forwardTargetsFor(msg.Endpoint)
+	if len(targets) == 0 {
+		return
+	}
+
+	header := make(http.Header)
+	for name, values := range r.Header {
+		if !hopHeaders[name] && !forwardCredentialHeaders[name] {
+			header[name] = values
+		}
+	}
+	header.Set("X-Sockethook-Endpoint", msg.Endpoint)
+	header.Set("X-Sockethook-Id", msg.ID)
+	header.Add("X-Forwarded-For", remoteIP(r))
+	job := forwardJob{msg: msg, method: r.Method, header: header, body: body}
+
+	for _, target := range targets {
+		f := forwarderFor(target)
+		select {
+		case f.queue <- job:
+		default:
+			f.fail(job, "forward queue full", 0)
+		}
+	}
+}
+
+// forwarderFor returns the forwarder of a target, starting it if needed
+func forwarderFor(target string) *forwarder {
+	forwarders.Lock()
+	defer forwarders.Unlock()
+
+	f, ok := forwarders.targets[target]
+	if !ok {
+		f = &forwarder{
+			target: target,
+			client: &http.Client{Timeout: forwardTimeout},
+			queue:  make(chan forwardJob, forwardQueueSize),
+		}
+		forwarders.targets[target] = f
+		go f.run()
+	}
+	return f
+}
+
+// run forwards queued hooks, retrying failed ones with jittered exponential backoff before dead-lettering them
+func (f *forwarder) run() {
+	for job := range f.queue {
+		logEntry := log.WithFields(log.Fields{"endpoint": job.msg.Endpoint, "id": job.msg.ID, "target": f.target})
+		backoff := forwardBackoff
+		for attempt := 1; ; attempt++ {
+			started := time.Now()
+			retry, err := f.send(job)
+			outcome := deliveryDelivered
+			if err != nil {
+				outcome = deliveryFailed
+			}
+			recordForwardDelivery(f.target, job.msg, attempt, outcome, err, time.Since(started))
+			if err == nil {
+				metrics.forwards.Inc("success")
+				logEntry.WithField("attempt", attempt).Debugln("Hook forwarded")
+				break
+			}
+			if !retry || attempt > forwardRetries {
+				f.fail(job, err.Error(), attempt)
+				break
+			}
+
+			metrics.forwards.Inc("retry")
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			logEntry.WithField("attempt", attempt).WithField("backoff", delay).Infoln("Forwarding hook failed, retrying:", err)
+			time.Sleep(delay)
+			if backoff *= 2; backoff > maxForwardBackoff {
+				backoff = maxForwardBackoff
+			}
+		}
+	}
+}
+
+// send forwards a hook once, returning whether a failure is worth retrying. Targets answering with 5xx, 429 or
+// not at all are retried, other statuses besides 2xx are treated as the target refusing the hook.
+func (f *forwarder) send(job forwardJob) (bool, error) {
+	req, err := http.NewRequest(job.method, f.target, bytes.NewReader(job.body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range job.header {
+		req.Header[name] = values
+	}
+	// Re-signed hooks carry a GitHub compatible signature instead of the provider's, which targets can't verify
+	if secret := forwardSecretFor(f.target); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(job.body)
+		req.Header.Del("X-Hub-Signature")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// fail logs, publishes and dead-letters a hook which couldn't be forwarded, keeping it to be requeued
+func (f *forwarder) fail(job forwardJob, reason string, attempts int) {
+	metrics.forwards.Inc("failure")
+	log.WithFields(log.Fields{
+		"endpoint": job.msg.Endpoint,
+		"id":       job.msg.ID,
+		"target":   f.target,
+		"reason":   reason,
+		"attempts": attempts,
+	}).Warnln("Forwarding hook failed")
+	exportEvent(otlpSeverityWarn, "hook.forward_failed", "Forwarding hook failed", map[string]interface{}{
+		"endpoint":   job.msg.Endpoint,
+		"message.id": job.msg.ID,
+		"target":     f.target,
+		"reason":     reason,
+		"attempts":   attempts,
+	})
+	publishEvent("forward_failed", map[string]interface{}{
+		"endpoint": job.msg.Endpoint,
+		"id":       job.msg.ID,
+		"target":   f.target,
+		"reason":   reason,
+	})
+	letter := DeadLetter{
+		Endpoint: job.msg.Endpoint,
+		Target:   f.target,
+		Reason:   reason,
+		Attempts: attempts,
+		Message:  job.msg,
+	}
+	recordForwardDelivery(f.target, job.msg, attempts, deliveryDeadLettered, fmt.Errorf("%s", reason), 0)
+	storeDeadLetter(letter, job)
+	postDeadLetter(letter)
+}
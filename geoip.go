@@ -0,0 +1,93 @@
+package sockethook
+
+import (
+	"net"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP resolves source IPs against MaxMind country and ASN databases
+type GeoIP struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Subset of the GeoLite2/GeoIP2 country and city database records
+type geoCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Subset of the GeoLite2 ASN database records
+type geoASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoInfo is the result of a GeoIP lookup, added to message metadata
+type GeoInfo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// openGeoIP opens the MaxMind databases at the given paths, either of which may be empty
+func openGeoIP(countryPath string, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{}
+	var err error
+
+	if countryPath != "" {
+		if g.country, err = maxminddb.Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// Lookup resolves an IP address, returning nil if nothing is known about it
+func (g *GeoIP) Lookup(ip string) *GeoInfo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+
+	info := GeoInfo{}
+	if g.country != nil {
+		var record geoCountryRecord
+		if g.country.Lookup(parsed, &record) == nil {
+			info.Country = record.Country.ISOCode
+		}
+	}
+	if g.asn != nil {
+		var record geoASNRecord
+		if g.asn.Lookup(parsed, &record) == nil {
+			info.ASN = record.Number
+			info.ASOrg = record.Organization
+		}
+	}
+
+	if info == (GeoInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+// countryLabel returns the country of an IP as a metric label, unknown if it can't be resolved, or empty if no
+// country database is open
+func countryLabel(ip string) string {
+	g := enricher.geoip
+	if g == nil || g.country == nil {
+		return ""
+	}
+	if info := g.Lookup(ip); info != nil && info.Country != "" {
+		return info.Country
+	}
+	return "unknown"
+}
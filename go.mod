@@ -1,10 +1,15 @@
+// +heroku install ./cmd/sockethook
+
 module github.com/corollari/sockethook
 
 go 1.12
 
 require (
 	github.com/gorilla/websocket v1.2.0
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/sirupsen/logrus v1.0.5
-	golang.org/x/crypto v0.0.0-20180613224733-37a17fe027db
-	golang.org/x/sys v0.0.0-20180614134839-8883426083c0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,416 @@
+package sockethook
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Full name of the Subscribe method of the Sockethook service, see sockethook.proto
+const grpcSubscribeMethod = "/sockethook.v1.Sockethook/Subscribe"
+
+// Maximum size of a subscribe request
+const maxGRPCRequest = 64 << 10
+
+// Status codes of gRPC used by the server
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcResourceExhaust  = 8
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// grpcConn streams messages to a gRPC client as the responses of a Subscribe call. Only messages are streamed,
+// control frames such as the welcome frame have no equivalent in the stream, and HTTP/2 keeps it alive itself.
+type grpcConn struct {
+	mu         sync.Mutex
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	remoteAddr sseAddr
+	// Closed once the stream may not be written to anymore and its handler can return
+	closed     chan struct{}
+	closedOnce sync.Once
+}
+
+// SubscribeRequest is the request of a Subscribe call
+type SubscribeRequest struct {
+	// Endpoint or pattern subscribed to
+	Endpoint string
+	// Filter expression messages have to match, like the filter query parameter
+	Filter string
+	// ID of the last message received before, to resume after it from the replay buffer
+	LastMessageID string
+}
+
+// WriteJSON writes a message as the next response of the stream, skipping control frames
+func (g *grpcConn) WriteJSON(v interface{}) error {
+	msg, ok := v.(Message)
+	if !ok {
+		return nil
+	}
+	return g.write(encodeGRPCMessage(msg))
+}
+
+// WriteControl does nothing, as pings and closing are part of HTTP/2
+func (g *grpcConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+// Close ends the stream, after which nothing is written to it anymore
+func (g *grpcConn) Close() error {
+	g.closedOnce.Do(func() { close(g.closed) })
+	return nil
+}
+
+// RemoteAddr returns the address of the client
+func (g *grpcConn) RemoteAddr() net.Addr {
+	return g.remoteAddr
+}
+
+// write sends a length-prefixed, uncompressed gRPC message
+func (g *grpcConn) write(message []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.closed:
+		return errStreamClosed
+	default:
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := g.w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	g.flusher.Flush()
+	return nil
+}
+
+// grpcStatusWriter turns the error statuses written by the checks shared with websocket clients into gRPC
+// statuses, as gRPC responses always have status 200 and carry the outcome in grpc-status
+type grpcStatusWriter struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (g *grpcStatusWriter) WriteHeader(status int) {
+	if status != 200 {
+		g.failed = true
+		setGRPCStatus(g.Header(), grpcCode(status), http.StatusText(status))
+		status = 200
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+// Write drops the bodies of errors, which gRPC clients don't read
+func (g *grpcStatusWriter) Write(data []byte) (int, error) {
+	if g.failed {
+		return len(data), nil
+	}
+	return g.ResponseWriter.Write(data)
+}
+
+// grpcCode maps the HTTP statuses clients are rejected with to gRPC status codes
+func grpcCode(status int) int {
+	switch status {
+	case 400:
+		return grpcInvalidArgument
+	case 401:
+		return grpcUnauthenticated
+	case 403:
+		return grpcPermissionDenied
+	case 404, 410:
+		return grpcNotFound
+	case 429:
+		return grpcResourceExhaust
+	case 503:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// setGRPCStatus sets the status of a response which ends without any messages
+func setGRPCStatus(header http.Header, code int, message string) {
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		header.Set("Grpc-Message", message)
+	}
+}
+
+// grpcError ends a call with an error status before any message was sent
+func grpcError(w http.ResponseWriter, code int, message string) {
+	setGRPCStatus(w.Header(), code, message)
+	w.WriteHeader(200)
+}
+
+// grpcRouter serves the gRPC service on its own listener, which has to speak HTTP/2
+func grpcRouter() http.HandlerFunc {
+	return logAccess(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			w.WriteHeader(415)
+			return
+		}
+		if r.URL.Path != grpcSubscribeMethod {
+			grpcError(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+		handleSubscribe(w, r)
+	})
+}
+
+// handleSubscribe streams the messages of an endpoint to a gRPC client, which are admitted like websocket
+// clients, presenting their token as authorization metadata
+func handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.ProtoMajor != 2 {
+		grpcError(w, grpcInternal, "gRPC requires HTTP/2")
+		return
+	}
+	req, err := readSubscribeRequest(r.Body)
+	if err != nil {
+		grpcError(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	namespace, ok := hostNamespace(r)
+	if !ok {
+		grpcError(w, grpcNotFound, "unknown host")
+		return
+	}
+	endpoint := strings.TrimRight(req.Endpoint, "/")
+	if !strings.HasPrefix(endpoint, "/") || !validPattern(endpoint) {
+		grpcError(w, grpcInvalidArgument, fmt.Sprintf("invalid endpoint %q", req.Endpoint))
+		return
+	}
+	endpoint = namespace + endpoint
+	logEntry := log.WithField("endpoint", endpoint)
+
+	var f *filter
+	if req.Filter != "" {
+		if f, err = parseFilter(req.Filter); err != nil {
+			logEntry.WithField("filter", req.Filter).Warnln("Rejected gRPC client, invalid filter:", err)
+			grpcError(w, grpcInvalidArgument, err.Error())
+			return
+		}
+	}
+	statusWriter := &grpcStatusWriter{ResponseWriter: w}
+	token, ok := admitClient(statusWriter, r, endpoint, logEntry)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	conn := &grpcConn{w: w, flusher: flusher, remoteAddr: sseAddr(r.RemoteAddr), closed: make(chan struct{})}
+	c := newClient(conn, endpoint)
+	c.replayLimiter = replayLimiter(replayRate)
+	c.token = token
+	c.host = r.Host
+	c.ip = remoteIP(r)
+	c.country = countryLabel(c.ip)
+	c.namespace = namespace
+	if f != nil {
+		c.filters[endpoint] = f
+	}
+	count := hub.Register(c, welcomeFrame(c), resumePoint{lastEventID: req.LastMessageID})
+	go c.writePump()
+	accessFor(r).record(accessStream, endpoint, c.id)
+
+	logEntry.WithField("clients", count).WithField("id", c.id).Infoln("gRPC subscriber connected")
+
+	code, message := grpcOK, ""
+	select {
+	case <-r.Context().Done():
+		hub.Unregister(endpoint, c)
+	case <-conn.closed:
+		// Evicted or shutting down, so the client should subscribe again
+		code, message = grpcUnavailable, "subscription closed by server"
+	}
+	conn.Close()
+
+	// Wait for a write in progress to finish before the trailers are written
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
+
+// readSubscribeRequest reads the single, uncompressed request message of a Subscribe call
+func readSubscribeRequest(body io.Reader) (SubscribeRequest, error) {
+	var req SubscribeRequest
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		return req, errors.New("missing request message")
+	}
+	if prefix[0] != 0 {
+		return req, errors.New("compressed requests aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCRequest {
+		return req, errors.New("request message too large")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(size)))
+	if err != nil || len(data) != int(size) {
+		return req, errors.New("incomplete request message")
+	}
+
+	err = decodeProto(data, func(field int, value []byte) {
+		switch field {
+		case 1:
+			req.Endpoint = string(value)
+		case 2:
+			req.Filter = string(value)
+		case 3:
+			req.LastMessageID = string(value)
+		}
+	})
+	return req, err
+}
+
+// encodeGRPCMessage encodes a message as the Message of sockethook.proto
+func encodeGRPCMessage(msg Message) []byte {
+	var b protoBuffer
+	b.string(1, msg.Type)
+	b.string(2, msg.ID)
+	b.uint64(3, msg.Seq)
+	b.string(4, msg.Endpoint)
+	for name, value := range msg.Headers {
+		var entry protoBuffer
+		entry.string(1, name)
+		entry.string(2, value)
+		b.bytes(5, entry)
+	}
+	if body, ok := rawBody(msg); ok {
+		b.bytes(7, body)
+	} else if data, err := json.Marshal(msg.Data); err == nil {
+		b.bytes(6, data)
+	}
+	b.string(8, msg.ContentType)
+	if len(msg.Metadata) > 0 {
+		if metadata, err := json.Marshal(msg.Metadata); err == nil {
+			b.bytes(9, metadata)
+		}
+	}
+	b.string(10, msg.ReceivedAt)
+	b.string(11, msg.BodySHA256)
+	b.uint64(12, uint64(msg.Attempt))
+	b.string(13, msg.ConnectionID)
+	b.uint64(14, uint64(msg.Collapsed))
+	b.uint64(15, uint64(msg.Repeats))
+	if d := msg.Delivery; d != nil {
+		var delivery protoBuffer
+		delivery.string(1, d.Provider)
+		delivery.string(2, d.ID)
+		delivery.uint64(3, uint64(d.Attempt))
+		if d.Retry {
+			delivery.uint64(4, 1)
+		}
+		delivery.string(5, d.Reason)
+		b.bytes(16, delivery)
+	}
+	if v := msg.Verification; v != nil {
+		var verification protoBuffer
+		if v.Verified {
+			verification.uint64(1, 1)
+		}
+		verification.string(2, v.Provider)
+		verification.string(3, v.KeyID)
+		verification.string(4, v.Signer)
+		b.bytes(17, verification)
+	}
+	return b
+}
+
+// protoBuffer encodes protocol buffers, leaving out fields with default values like proto3 does
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+// decodeProto calls handle with the number and contents of every length-delimited field of a protocol buffer,
+// skipping fields of other types
+func decodeProto(data []byte, handle func(field int, value []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid request message")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid request message")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errors.New("invalid request message")
+			}
+			data = data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New("invalid request message")
+			}
+			handle(field, data[n:n+int(size)])
+			data = data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("invalid request message")
+			}
+			data = data[4:]
+		default:
+			return errors.New("invalid request message")
+		}
+	}
+	return nil
+}
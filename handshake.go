@@ -0,0 +1,112 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider handshakes which can be answered automatically, by name
+var handshakes = map[string]func(w http.ResponseWriter, r *http.Request, body []byte) bool{
+	"slack": slackHandshake,
+	"sns":   snsHandshake,
+	"graph": graphHandshake,
+}
+
+// Handshake providers enabled per endpoint
+var endpointHandshakes = make(map[string][]string)
+
+// setHandshakes parses rules of the form "/endpoint=provider"
+func setHandshakes(rules []string) error {
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return fmt.Errorf("invalid handshake %q, expected /endpoint=provider", rule)
+		}
+		if _, ok := handshakes[parts[1]]; !ok {
+			return fmt.Errorf("unknown handshake provider %q, expected slack, sns or graph", parts[1])
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		endpointHandshakes[endpoint] = append(endpointHandshakes[endpoint], parts[1])
+	}
+	return nil
+}
+
+// answerHandshake responds to a provider verification request if one is enabled for the endpoint and the request
+// is one. Returns true if the request was answered and shouldn't be broadcasted.
+func answerHandshake(w http.ResponseWriter, r *http.Request, endpoint string, body []byte) bool {
+	for _, provider := range endpointHandshakes[endpoint] {
+		if handshakes[provider](w, r, body) {
+			log.WithField("endpoint", endpoint).WithField("provider", provider).Infoln("Answered verification handshake")
+			return true
+		}
+	}
+	return false
+}
+
+// slackHandshake echoes the challenge of Slack url_verification requests
+func slackHandshake(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var payload struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}
+	if json.Unmarshal(body, &payload) != nil || payload.Type != "url_verification" {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(payload.Challenge))
+	return true
+}
+
+// snsHandshake confirms AWS SNS subscriptions by visiting their SubscribeURL
+func snsHandshake(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if r.Header.Get("X-Amz-Sns-Message-Type") != "SubscriptionConfirmation" {
+		return false
+	}
+
+	var payload struct {
+		SubscribeURL string `json:"SubscribeURL"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid subscription confirmation", 400)
+		return true
+	}
+
+	// Only follow confirmation links pointing at SNS itself
+	subscribe, err := url.Parse(payload.SubscribeURL)
+	if err != nil || subscribe.Scheme != "https" || !strings.HasPrefix(subscribe.Host, "sns.") || !strings.HasSuffix(subscribe.Host, ".amazonaws.com") {
+		http.Error(w, "invalid SubscribeURL", 400)
+		return true
+	}
+
+	resp, err := http.Get(subscribe.String())
+	if err != nil {
+		log.Warnln("Failed to confirm SNS subscription:", err)
+		w.WriteHeader(502)
+		return true
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.WithField("status", resp.StatusCode).Warnln("SNS rejected subscription confirmation")
+		w.WriteHeader(502)
+	}
+	return true
+}
+
+// graphHandshake echoes the validationToken of Microsoft Graph subscription validation requests
+func graphHandshake(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	token := r.URL.Query().Get("validationToken")
+	if token == "" {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+	return true
+}
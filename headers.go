@@ -0,0 +1,51 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ResponseHeaders holds extra headers set on hook responses, for all or specific endpoints
+type ResponseHeaders struct {
+	global    http.Header
+	endpoints map[string]http.Header
+}
+
+// newResponseHeaders parses headers of the form "Name: value" or "/endpoint:Name: value"
+func newResponseHeaders(rules []string) (*ResponseHeaders, error) {
+	h := &ResponseHeaders{global: http.Header{}, endpoints: make(map[string]http.Header)}
+
+	for _, rule := range rules {
+		target := h.global
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid response header %q, expected /endpoint:Name: value", rule)
+			}
+			endpoint := strings.TrimRight(parts[0], "/")
+			if h.endpoints[endpoint] == nil {
+				h.endpoints[endpoint] = http.Header{}
+			}
+			target, rule = h.endpoints[endpoint], parts[1]
+		}
+
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid response header %q, expected Name: value", rule)
+		}
+		target.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return h, nil
+}
+
+// Apply sets the configured headers for an endpoint on a response, endpoint headers replacing global ones
+func (h *ResponseHeaders) Apply(w http.ResponseWriter, endpoint string) {
+	for name, values := range h.global {
+		w.Header()[name] = values
+	}
+	for name, values := range h.endpoints[endpoint] {
+		w.Header()[name] = values
+	}
+}
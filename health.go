@@ -0,0 +1,97 @@
+package sockethook
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Whether the probes are served on a listener of their own rather than next to the other routes
+var separateProbes bool
+
+// Servers which have to be listening for the instance to be ready
+var probedServers []*http.Server
+
+// Servers which have bound their address, set by listenAndServe
+var listening sync.Map
+
+var errShuttingDown = errors.New("shutting down")
+var errNotListening = errors.New("not listening")
+var errStandby = errors.New("standby, not promoted")
+
+// Readiness reports whether the instance can accept hooks and clients, and the result of each check
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// Result of each check, ok or why it failed
+	Checks map[string]string `json:"checks"`
+}
+
+// handleProbes serves the liveness probe at /healthz, which passes as long as the server answers, and the
+// readiness probe at /readyz, which fails while shutting down, on standbys or while the listeners, broker, history
+// log or recordings aren't working. Returns false if the path isn't a probe.
+func handleProbes(w http.ResponseWriter, r *http.Request, path string) bool {
+	switch path {
+	case "/healthz":
+		allowMethod(w, r, "GET", func() { writeJSON(w, map[string]string{"status": "ok"}) })
+	case "/readyz":
+		allowMethod(w, r, "GET", func() {
+			readiness := checkReadiness()
+			if !readiness.Ready {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(503)
+			}
+			writeJSON(w, readiness)
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// probeRouter serves the probes on their own listener, outside of the base path
+func probeRouter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !handleProbes(w, r, r.URL.Path) {
+			w.WriteHeader(404)
+		}
+	}
+}
+
+// checkReadiness runs the checks of the readiness probe, only those of enabled features being included
+func checkReadiness() Readiness {
+	readiness := Readiness{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			readiness.Ready = false
+			readiness.Checks[name] = err.Error()
+		} else {
+			readiness.Checks[name] = "ok"
+		}
+	}
+
+	if isDraining() {
+		check("shutdown", errShuttingDown)
+	} else {
+		check("shutdown", nil)
+	}
+	for _, server := range probedServers {
+		if _, ok := listening.Load(server); ok {
+			check("listener "+server.Addr, nil)
+		} else {
+			check("listener "+server.Addr, errNotListening)
+		}
+	}
+	if isStandby() {
+		check("standby", errStandby)
+	}
+	if broker != nil {
+		check("broker", broker.Ready())
+	}
+	if historyLog != nil {
+		check("history", historyLog.Ready())
+	}
+	if recorder != nil {
+		check("recordings", recorder.Ready())
+	}
+	return readiness
+}
@@ -0,0 +1,634 @@
+package sockethook
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Persistent log of messages, nil if disabled
+var historyLog *HistoryLog
+
+// Number of messages waiting to be written to the history log before new ones are dropped
+var historyQueueSize = 4096
+
+// Maximum number of messages returned by one history request
+var maxHistoryLimit = 1000
+
+// HistoryLog writes the messages of endpoints to an append-only file per endpoint in a directory, so that they
+// can be fetched from /history even after a restart. Messages are written from a goroutine of its own, so that
+// disk latency never holds up delivery. Files are compacted periodically, dropping messages older than the
+// retention or beyond the maximum number kept per endpoint. The offset of every entry is kept in memory, so
+// that reads seek to the entries they need without holding up writes.
+type HistoryLog struct {
+	dir string
+	// Endpoints or patterns whose messages are logged, all if empty
+	endpoints []string
+	// How long messages are kept, 0 to keep them until they're pushed out
+	retention time.Duration
+	// Number of messages kept per endpoint
+	maxMessages int
+
+	mu    sync.Mutex
+	files map[string]*historyFile
+	// Error of the last write, nil if it succeeded
+	failed error
+
+	queue chan Message
+	// Closed to make the writer write what is queued and stop, after which stopped is closed
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// historyFile is the open log file of an endpoint, its size and the offsets of the entries in it, oldest first
+type historyFile struct {
+	f     historyWriter
+	size  int64
+	index []historyOffset
+	// Set when a write failed partway, so that the next entry starts on a line of its own
+	partial bool
+}
+
+// historyWriter is a log file opened for appending entries
+type historyWriter interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// historyOffset locates an entry in a log file
+type historyOffset struct {
+	id     string
+	at     time.Time
+	offset int64
+}
+
+// historyEntry is a line of a log file
+type historyEntry struct {
+	At      time.Time `json:"at"`
+	Message Message   `json:"message"`
+}
+
+// HistoryPage is a page of logged messages served by /history
+type HistoryPage struct {
+	Endpoint string        `json:"endpoint"`
+	Messages []interface{} `json:"messages"`
+	// Set if the message given as since isn't logged anymore, so messages may have been lost
+	ResumeGap bool `json:"resume_gap,omitempty"`
+	// Set if there are more messages after the last one, which are fetched with it as since
+	More bool `json:"more,omitempty"`
+}
+
+// newHistoryLog opens the history log in a directory, compacting the files left by previous runs
+func newHistoryLog(dir string, endpoints []string, retention time.Duration, maxMessages int) (*HistoryLog, error) {
+	if maxMessages < 1 {
+		return nil, fmt.Errorf("invalid maximum number of history messages %d", maxMessages)
+	}
+	for i, endpoint := range endpoints {
+		if !strings.HasPrefix(endpoint, "/") || !validPattern(endpoint) {
+			return nil, fmt.Errorf("invalid history endpoint %q", endpoint)
+		}
+		endpoints[i] = strings.TrimRight(endpoint, "/")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	h := &HistoryLog{
+		dir:         dir,
+		endpoints:   endpoints,
+		retention:   retention,
+		maxMessages: maxMessages,
+		files:       make(map[string]*historyFile),
+		queue:       make(chan Message, historyQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	logged, err := h.loggedEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range logged {
+		h.mu.Lock()
+		err = h.compact(endpoint)
+		h.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Enabled checks if the messages of an endpoint are logged
+func (h *HistoryLog) Enabled(endpoint string) bool {
+	if h == nil || isReserved(endpoint) {
+		return false
+	}
+	if len(h.endpoints) == 0 {
+		return true
+	}
+	for _, logged := range h.endpoints {
+		if logged == endpoint || (isPattern(logged) && patternCovers(logged, endpoint)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record queues a message to be written to the log, dropping it if the queue is full
+func (h *HistoryLog) Record(msg Message) {
+	if !h.Enabled(msg.Endpoint) {
+		return
+	}
+	select {
+	case h.queue <- msg:
+	default:
+		log.WithField("endpoint", msg.Endpoint).Warnln("History queue full, message not logged")
+	}
+}
+
+// Run writes queued messages to the log and compacts it every interval, until the log is closed
+func (h *HistoryLog) Run(interval time.Duration) {
+	defer close(h.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-h.queue:
+			h.write(msg)
+		case <-h.done:
+			for len(h.queue) > 0 {
+				h.write(<-h.queue)
+			}
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			for endpoint := range h.files {
+				if err := h.compact(endpoint); err != nil {
+					log.WithField("endpoint", endpoint).Errorln("Failed to compact history:", err)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// write appends a message to the log, logging errors
+func (h *HistoryLog) write(msg Message) {
+	h.mu.Lock()
+	err := h.append(msg)
+	h.failed = err
+	h.mu.Unlock()
+	if err != nil {
+		log.WithField("endpoint", msg.Endpoint).Errorln("Failed to write message to history:", err)
+	}
+}
+
+// Ready checks if messages can be written to the log, failing if the last write failed or the directory is gone
+func (h *HistoryLog) Ready() error {
+	h.mu.Lock()
+	failed := h.failed
+	h.mu.Unlock()
+	if failed != nil {
+		return failed
+	}
+	_, err := os.Stat(h.dir)
+	return err
+}
+
+// Close writes the queued messages and closes the log files, waiting at most until the timeout. Messages
+// recorded afterwards are dropped.
+func (h *HistoryLog) Close(timeout time.Duration) {
+	close(h.done)
+	select {
+	case <-h.stopped:
+	case <-time.After(timeout):
+		log.Warnln("Timed out writing history")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, file := range h.files {
+		file.f.Sync()
+		file.f.Close()
+	}
+	h.files = make(map[string]*historyFile)
+}
+
+// Purge removes the logs of an endpoint, or of every endpoint a pattern covers
+func (h *HistoryLog) Purge(endpoint string) error {
+	if h == nil {
+		return nil
+	}
+	logged, err := h.loggedEndpoints()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range logged {
+		if l == endpoint || (isPattern(endpoint) && patternCovers(endpoint, l)) {
+			if err := h.rewrite(l, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loggedEndpoints returns the endpoints which have a log file in the directory
+func (h *HistoryLog) loggedEndpoints() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(h.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []string{}
+	for _, path := range paths {
+		endpoint, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), ".log"))
+		if err == nil && strings.HasPrefix(endpoint, "/") {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// path returns the log file of an endpoint
+func (h *HistoryLog) path(endpoint string) string {
+	return filepath.Join(h.dir, url.PathEscape(endpoint)+".log")
+}
+
+// append writes a message to the log file of its endpoint, compacting the file once it holds far more entries
+// than are kept. Must be called with h.mu held.
+func (h *HistoryLog) append(msg Message) error {
+	file, ok := h.files[msg.Endpoint]
+	if !ok {
+		// A file left without being open is compacted first, which indexes its entries
+		if err := h.compact(msg.Endpoint); err != nil {
+			return err
+		}
+		file, ok = h.files[msg.Endpoint]
+	}
+	if !ok {
+		f, err := os.OpenFile(h.path(msg.Endpoint), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		file = &historyFile{f: f}
+		h.files[msg.Endpoint] = file
+	}
+
+	entry := historyEntry{At: time.Now().UTC(), Message: msg}
+	line, err := encodeHistoryEntry(entry)
+	if err != nil {
+		return err
+	}
+	// A line left partly written by a failed write is ended first, so that it's skipped as undecodable when
+	// reading rather than running into this one
+	var start int64
+	if file.partial {
+		line, start = append([]byte{'\n'}, line...), 1
+	}
+	n, err := file.f.Write(append(line, '\n'))
+	file.size += int64(n)
+	if err != nil {
+		// The line is left partly written unless the write got no further than ending the previous one
+		file.partial = n > int(start) || (file.partial && n == 0)
+		return err
+	}
+	file.partial = false
+	file.index = append(file.index, historyOffset{id: msg.ID, at: entry.At, offset: file.size - int64(n) + start})
+	if len(file.index) > 2*h.maxMessages {
+		return h.compact(msg.Endpoint)
+	}
+	return nil
+}
+
+// compact rewrites the log file of an endpoint with only the entries which are kept. Must be called with h.mu
+// held.
+func (h *HistoryLog) compact(endpoint string) error {
+	entries, err := h.read(endpoint)
+	if err != nil {
+		return err
+	}
+	return h.rewrite(endpoint, entries)
+}
+
+// rewrite replaces the log file of an endpoint with entries, removing it if there are none. Must be called with
+// h.mu held.
+func (h *HistoryLog) rewrite(endpoint string, entries []historyEntry) error {
+	if file, ok := h.files[endpoint]; ok {
+		file.f.Close()
+		delete(h.files, endpoint)
+	}
+	if len(entries) == 0 {
+		if err := os.Remove(h.path(endpoint)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// Write to a temporary file first, so that a crash while compacting doesn't lose the log
+	tmp := h.path(endpoint) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	index := make([]historyOffset, 0, len(entries))
+	var size int64
+	for _, entry := range entries {
+		line, err := encodeHistoryEntry(entry)
+		if err != nil {
+			continue
+		}
+		index = append(index, historyOffset{id: entry.Message.ID, at: entry.At, offset: size})
+		w.Write(append(line, '\n'))
+		size += int64(len(line) + 1)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, h.path(endpoint)); err != nil {
+		return err
+	}
+
+	f, err = os.OpenFile(h.path(endpoint), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	h.files[endpoint] = &historyFile{f: f, size: size, index: index}
+	return nil
+}
+
+// snapshot opens the log file of an endpoint for reading and returns the offsets of the entries which are kept,
+// oldest first. The file stays readable as it was even if it's compacted meanwhile, so its entries are read
+// without holding h.mu. Returns no file if the endpoint has no entries.
+func (h *HistoryLog) snapshot(endpoint string) (*os.File, []historyOffset, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	file, ok := h.files[endpoint]
+	if !ok || len(file.index) == 0 {
+		return nil, nil, nil
+	}
+	f, err := os.Open(h.path(endpoint))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kept := file.index
+	if h.retention > 0 {
+		for len(kept) > 0 && time.Since(kept[0].at) > h.retention {
+			kept = kept[1:]
+		}
+	}
+	if len(kept) > h.maxMessages {
+		kept = kept[len(kept)-h.maxMessages:]
+	}
+	return f, append([]historyOffset(nil), kept...), nil
+}
+
+// readEntries decodes the entries of a log file at the given offsets, which must be in order, calling fn with
+// each until it returns an error
+func readEntries(f *os.File, offsets []historyOffset, fn func(historyEntry) error) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	if _, err := f.Seek(offsets[0].offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	position := offsets[0].offset
+	for len(offsets) > 0 {
+		line, err := reader.ReadBytes('\n')
+		if position == offsets[0].offset {
+			offsets = offsets[1:]
+			if entry, err := decodeHistoryLine(line); err == nil {
+				if err := fn(entry); err != nil {
+					return err
+				}
+			}
+		}
+		position += int64(len(line))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read returns the entries of an endpoint which are kept, oldest first. Must be called with h.mu held.
+func (h *HistoryLog) read(endpoint string) ([]historyEntry, error) {
+	f, err := os.Open(h.path(endpoint))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []historyEntry{}
+	undecryptable := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			// Lines which can't be decoded, such as one cut off by a crash, are skipped. Encrypted lines which
+			// can't be decrypted fail the read when no line can, so that compacting with the wrong key or none
+			// doesn't drop the log.
+			entry, derr := decodeHistoryLine(line)
+			if derr == errHistoryKeyMissing {
+				return nil, fmt.Errorf("%s: %v", h.path(endpoint), derr)
+			} else if derr == errHistoryUndecryptable {
+				undecryptable++
+			} else if derr == nil && (h.retention <= 0 || time.Since(entry.At) <= h.retention) {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if undecryptable > 0 && len(entries) == 0 {
+		return nil, fmt.Errorf("%s: %v", h.path(endpoint), errHistoryUndecryptable)
+	}
+	if len(entries) > h.maxMessages {
+		entries = entries[len(entries)-h.maxMessages:]
+	}
+	return entries, nil
+}
+
+// Since returns at most limit logged messages of an endpoint received after the one with the given ID, or from
+// the oldest one if the ID is empty. If the message isn't logged anymore, messages from the oldest one are
+// returned and found is false. More is true if there are messages after those returned.
+func (h *HistoryLog) Since(endpoint string, id string, limit int) (messages []Message, found bool, more bool, err error) {
+	f, offsets, err := h.snapshot(endpoint)
+	if err != nil || f == nil {
+		return nil, id == "", false, err
+	}
+	defer f.Close()
+
+	start := 0
+	if id != "" {
+		for i, offset := range offsets {
+			if offset.id == id {
+				start, found = i+1, true
+				break
+			}
+		}
+	}
+	offsets = offsets[start:]
+	if len(offsets) > limit {
+		offsets, more = offsets[:limit], true
+	}
+	err = readEntries(f, offsets, func(entry historyEntry) error {
+		messages = append(messages, entry.Message)
+		return nil
+	})
+	if err != nil {
+		return nil, false, false, err
+	}
+	return messages, found || id == "", more, nil
+}
+
+// Import adds messages logged elsewhere to the log of an endpoint, such as those of another relay, merging them
+// with the logged ones by the time they were logged. Messages which are already logged, older than the retention
+// or pushed out by newer ones are skipped. Returns the number of messages imported.
+func (h *HistoryLog) Import(endpoint string, imported []historyEntry) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries, err := h.read(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	logged := make(map[string]bool, len(entries)+len(imported))
+	for _, entry := range entries {
+		logged[entry.Message.ID] = true
+	}
+	added := make(map[string]bool, len(imported))
+	for _, entry := range imported {
+		if logged[entry.Message.ID] || (h.retention > 0 && time.Since(entry.At) > h.retention) {
+			continue
+		}
+		logged[entry.Message.ID], added[entry.Message.ID] = true, true
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	if len(entries) > h.maxMessages {
+		entries = entries[len(entries)-h.maxMessages:]
+	}
+	count := 0
+	for _, entry := range entries {
+		if added[entry.Message.ID] {
+			count++
+		}
+	}
+	return count, h.rewrite(endpoint, entries)
+}
+
+// Between returns the logged entries of an endpoint logged from since until until, oldest first. A zero time
+// leaves the window open on that side.
+func (h *HistoryLog) Between(endpoint string, since time.Time, until time.Time) ([]historyEntry, error) {
+	entries := []historyEntry{}
+	err := h.Each(endpoint, since, until, func(entry historyEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Each calls fn with the logged entries of an endpoint like those returned by Between, one at a time as they're
+// read, so that they don't all have to be held in memory. Stops at the first error returned by fn.
+func (h *HistoryLog) Each(endpoint string, since time.Time, until time.Time, fn func(historyEntry) error) error {
+	f, offsets, err := h.snapshot(endpoint)
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	window := []historyOffset{}
+	for _, offset := range offsets {
+		if (since.IsZero() || !offset.at.Before(since)) && (until.IsZero() || !offset.at.After(until)) {
+			window = append(window, offset)
+		}
+	}
+	return readEntries(f, window, fn)
+}
+
+// handleHistory serves the logged messages of an endpoint to clients with a token for it and to operators with
+// the admin token, after the message given in the since query parameter
+func handleHistory(w http.ResponseWriter, r *http.Request, endpoint string) {
+	logEntry := log.WithField("endpoint", endpoint)
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if isPattern(endpoint) || endpoint == "" {
+		http.Error(w, "expected an endpoint", 400)
+		return
+	}
+	if !adminAuthorized(r) && !authorized(requestToken(r), endpoint) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+	if !historyLog.Enabled(endpoint) {
+		http.Error(w, "endpoint isn't logged", 404)
+		return
+	}
+
+	schema, ok := connectSchema(w, r, logEntry)
+	if !ok {
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("invalid limit %q, expected 1 to %d", value, maxHistoryLimit), 400)
+			return
+		}
+	}
+
+	messages, found, more, err := historyLog.Since(endpoint, r.URL.Query().Get("since"), limit)
+	if err != nil {
+		logEntry.Errorln("Failed to read history:", err)
+		w.WriteHeader(500)
+		return
+	}
+	page := HistoryPage{Endpoint: endpoint, Messages: []interface{}{}, ResumeGap: !found, More: more}
+	for _, msg := range messages {
+		page.Messages = append(page.Messages, msg.encode(schema))
+	}
+	writeJSON(w, page)
+}
@@ -0,0 +1,153 @@
+package sockethook
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testHistoryLog opens a history log in a temporary directory, returning a function removing it
+func testHistoryLog(t *testing.T, maxMessages int) (*HistoryLog, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sockethook-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHistoryLog(dir, nil, 0, maxMessages)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return h, func() {
+		closeHistoryFiles(h)
+		os.RemoveAll(dir)
+	}
+}
+
+// closeHistoryFiles closes the open log files of a history log which isn't running
+func closeHistoryFiles(h *HistoryLog) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, file := range h.files {
+		file.f.Close()
+	}
+	h.files = make(map[string]*historyFile)
+}
+
+// failingWriter writes only the first bytes of the next write to a log file and fails it
+type failingWriter struct {
+	historyWriter
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	n, _ := w.historyWriter.Write(p[:w.written])
+	return n, errors.New("disk full")
+}
+
+func TestHistorySinceAfterCompaction(t *testing.T) {
+	h, cleanup := testHistoryLog(t, 3)
+	defer cleanup()
+
+	// The file is compacted once it holds more than twice the messages kept
+	for i := 1; i <= 7; i++ {
+		h.write(Message{ID: fmt.Sprintf("m%d", i), Endpoint: "/orders"})
+	}
+	h.mu.Lock()
+	indexed := len(h.files["/orders"].index)
+	h.mu.Unlock()
+	if indexed != 3 {
+		t.Fatalf("%d entries indexed after compaction, expected 3", indexed)
+	}
+	h.write(Message{ID: "m8", Endpoint: "/orders"})
+
+	messages, found, more, err := h.Since("/orders", "m6", 10)
+	if ids := messageIDs(messages); err != nil || !found || more || !reflect.DeepEqual(ids, []string{"m7", "m8"}) {
+		t.Errorf("Since(m6) = %v, %v, %v, %v, expected [m7 m8]", ids, found, more, err)
+	}
+	messages, found, more, err = h.Since("/orders", "", 2)
+	if ids := messageIDs(messages); err != nil || !found || !more || !reflect.DeepEqual(ids, []string{"m6", "m7"}) {
+		t.Errorf("Since() = %v, %v, %v, %v, expected [m6 m7] and more", ids, found, more, err)
+	}
+}
+
+func TestHistorySinceUnloggedMessage(t *testing.T) {
+	h, cleanup := testHistoryLog(t, 2)
+	defer cleanup()
+
+	for i := 1; i <= 4; i++ {
+		h.write(Message{ID: fmt.Sprintf("m%d", i), Endpoint: "/orders"})
+	}
+	// A message pushed out of the log resumes from the oldest one kept, which /history reports as a resume gap
+	for _, id := range []string{"m1", "unknown"} {
+		messages, found, _, err := h.Since("/orders", id, 10)
+		if ids := messageIDs(messages); err != nil || found || !reflect.DeepEqual(ids, []string{"m3", "m4"}) {
+			t.Errorf("Since(%s) = %v, %v, %v, expected [m3 m4] not found", id, ids, found, err)
+		}
+	}
+	if messages, found, _, err := h.Since("/missing", "m1", 10); err != nil || found || len(messages) != 0 {
+		t.Errorf("Since on an endpoint without log = %v, %v, %v", messageIDs(messages), found, err)
+	}
+}
+
+func TestHistoryAppendAfterPartialWrite(t *testing.T) {
+	for _, written := range []int{0, 1, 10} {
+		h, cleanup := testHistoryLog(t, 100)
+
+		h.write(Message{ID: "m1", Endpoint: "/orders"})
+		h.mu.Lock()
+		file := h.files["/orders"]
+		file.f = &failingWriter{historyWriter: file.f, written: written}
+		err := h.append(Message{ID: "lost", Endpoint: "/orders"})
+		file.f = file.f.(*failingWriter).historyWriter
+		h.mu.Unlock()
+		if err == nil {
+			t.Fatalf("%d bytes written: append succeeded", written)
+		}
+		h.write(Message{ID: "m2", Endpoint: "/orders"})
+		h.write(Message{ID: "m3", Endpoint: "/orders"})
+
+		// Entries after a partly written line are read both through the index and when compacting
+		for _, stage := range []string{"indexed", "compacted"} {
+			messages, found, _, err := h.Since("/orders", "m1", 10)
+			if ids := messageIDs(messages); err != nil || !found || !reflect.DeepEqual(ids, []string{"m2", "m3"}) {
+				t.Errorf("%d bytes written, %s: Since(m1) = %v, %v, %v, expected [m2 m3]", written, stage, ids, found, err)
+			}
+			h.mu.Lock()
+			err = h.compact("/orders")
+			h.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestHistoryReindexesAfterRestart(t *testing.T) {
+	h, cleanup := testHistoryLog(t, 100)
+	defer cleanup()
+
+	h.write(Message{ID: "m1", Endpoint: "/orders"})
+	h.write(Message{ID: "m2", Endpoint: "/orders"})
+	h.write(Message{ID: "i1", Endpoint: "/invoices"})
+	closeHistoryFiles(h)
+
+	reopened, err := newHistoryLog(h.dir, nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeHistoryFiles(reopened)
+	reopened.write(Message{ID: "m3", Endpoint: "/orders"})
+	messages, found, _, err := reopened.Since("/orders", "m1", 10)
+	if ids := messageIDs(messages); err != nil || !found || !reflect.DeepEqual(ids, []string{"m2", "m3"}) {
+		t.Errorf("Since(m1) after restart = %v, %v, %v, expected [m2 m3]", ids, found, err)
+	}
+	messages, found, _, err = reopened.Since("/invoices", "", 10)
+	if ids := messageIDs(messages); err != nil || !found || !reflect.DeepEqual(ids, []string{"i1"}) {
+		t.Errorf("Since() after restart = %v, %v, %v, expected [i1]", ids, found, err)
+	}
+}
@@ -0,0 +1,134 @@
+package sockethook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Whether entries are compressed when they're written to history logs. Entries are read whether they're
+// compressed or not, so logs are converted as they're compacted.
+var historyCompress bool
+
+// Cipher entries of history logs are encrypted with, AES-256-GCM with the key of --history-key-file, nil to
+// write them in plain text. Like compression, logs are converted as they're compacted.
+var historyCipher cipher.AEAD
+
+// Prefix of compressed entries, which are the base64 encoded gzip of the JSON entry so that they stay a line
+var historyCompressedPrefix = []byte("z:")
+
+// Prefix of encrypted entries, which are the base64 encoded nonce and sealed JSON or gzip of the entry, the
+// first byte of the plain text telling which
+var historyEncryptedPrefix = []byte("e:")
+
+var errHistoryKeyMissing = errors.New("history log is encrypted but no --history-key-file is given")
+var errHistoryUndecryptable = errors.New("history entry can't be decrypted with the key of --history-key-file")
+
+// loadHistoryKey reads the hex encoded 32 byte key history logs are encrypted with from a file
+func loadHistoryKey(path string) (cipher.AEAD, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid history key %s, expected 64 hex digits", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeHistoryEntry returns the line of a log file holding an entry, without its newline
+func encodeHistoryEntry(entry historyEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil || (!historyCompress && historyCipher == nil) {
+		return data, err
+	}
+
+	prefix := historyCompressedPrefix
+	if historyCompress {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		data = compressed.Bytes()
+	}
+	if historyCipher != nil {
+		kind := byte('j')
+		if historyCompress {
+			kind = 'z'
+		}
+		nonce := make([]byte, historyCipher.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		data = historyCipher.Seal(nonce, nonce, append([]byte{kind}, data...), nil)
+		prefix = historyEncryptedPrefix
+	}
+
+	line := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(len(data)))
+	copy(line, prefix)
+	base64.StdEncoding.Encode(line[len(prefix):], data)
+	return line, nil
+}
+
+// decodeHistoryLine decodes a line of a log file, failing if it was cut off or is otherwise corrupt. Encrypted
+// lines fail with errHistoryKeyMissing without a key, and errHistoryUndecryptable if the key doesn't open them.
+func decodeHistoryLine(line []byte) (historyEntry, error) {
+	var entry historyEntry
+	line = bytes.TrimRight(line, "\n")
+	compressed := false
+	switch {
+	case bytes.HasPrefix(line, historyEncryptedPrefix):
+		if historyCipher == nil {
+			return entry, errHistoryKeyMissing
+		}
+		sealed, err := decodeBase64Line(line[len(historyEncryptedPrefix):])
+		if err != nil || len(sealed) < historyCipher.NonceSize() {
+			return entry, fmt.Errorf("invalid encrypted history entry")
+		}
+		nonce, sealed := sealed[:historyCipher.NonceSize()], sealed[historyCipher.NonceSize():]
+		data, err := historyCipher.Open(nil, nonce, sealed, nil)
+		if err != nil || len(data) == 0 {
+			return entry, errHistoryUndecryptable
+		}
+		compressed, line = data[0] == 'z', data[1:]
+	case bytes.HasPrefix(line, historyCompressedPrefix):
+		data, err := decodeBase64Line(line[len(historyCompressedPrefix):])
+		if err != nil {
+			return entry, err
+		}
+		compressed, line = true, data
+	}
+	if compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(line))
+		if err != nil {
+			return entry, err
+		}
+		if line, err = ioutil.ReadAll(zr); err != nil {
+			return entry, err
+		}
+	}
+	err := json.Unmarshal(line, &entry)
+	return entry, err
+}
+
+func decodeBase64Line(encoded []byte) ([]byte, error) {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(data, encoded)
+	return data[:n], err
+}
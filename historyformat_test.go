@@ -0,0 +1,201 @@
+package sockethook
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHistoryKey writes a history key to a file in dir and loads it
+func testHistoryKey(t *testing.T, dir string, key string) cipher.AEAD {
+	t.Helper()
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := loadHistoryKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestHistoryLineRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockethook-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := testHistoryKey(t, dir, strings.Repeat("ab", 32))
+	defer func() { historyCompress, historyCipher = false, nil }()
+	entry := historyEntry{
+		At:      time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message: Message{ID: "m1", Endpoint: "/orders", Seq: 3, Data: map[string]interface{}{"note": strings.Repeat("verbose ", 100)}},
+	}
+
+	tests := []struct {
+		name     string
+		compress bool
+		cipher   cipher.AEAD
+		prefix   string
+	}{
+		{"plain", false, nil, "{"},
+		{"compressed", true, nil, "z:"},
+		{"encrypted", false, key, "e:"},
+		{"compressed and encrypted", true, key, "e:"},
+	}
+	for _, test := range tests {
+		historyCompress, historyCipher = test.compress, test.cipher
+		line, err := encodeHistoryEntry(entry)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.HasPrefix(line, []byte(test.prefix)) || bytes.Contains(line, []byte("\n")) {
+			t.Errorf("%s: line %.20q..., expected a single line starting with %q", test.name, line, test.prefix)
+		}
+		decoded, err := decodeHistoryLine(append(line, '\n'))
+		if err != nil || !reflect.DeepEqual(decoded, entry) {
+			t.Errorf("%s: decoded %+v, %v, expected %+v", test.name, decoded, err, entry)
+		}
+		// A line cut off by a crash is rejected, so that it's skipped
+		if _, err := decodeHistoryLine(line[:len(line)/2]); err == nil {
+			t.Errorf("%s: cut off line decoded", test.name)
+		}
+	}
+
+	// Encrypted entries don't reveal the payload, and can't be read without the key or with another one
+	historyCompress, historyCipher = false, key
+	encrypted, _ := encodeHistoryEntry(entry)
+	if bytes.Contains(encrypted, []byte("verbose")) {
+		t.Error("encrypted line holds the payload in plain text")
+	}
+	historyCipher = nil
+	if _, err := decodeHistoryLine(encrypted); err != errHistoryKeyMissing {
+		t.Errorf("decoding without a key: %v, expected %v", err, errHistoryKeyMissing)
+	}
+	historyCipher = testHistoryKey(t, dir, strings.Repeat("cd", 32))
+	if _, err := decodeHistoryLine(encrypted); err != errHistoryUndecryptable {
+		t.Errorf("decoding with another key: %v, expected %v", err, errHistoryUndecryptable)
+	}
+
+	historyCompress, historyCipher = false, nil
+	plain, _ := encodeHistoryEntry(entry)
+	historyCompress = true
+	compressed, _ := encodeHistoryEntry(entry)
+	if len(compressed) >= len(plain) {
+		t.Errorf("compressed line is %d bytes, plain line %d", len(compressed), len(plain))
+	}
+}
+
+func TestLoadHistoryKeyRejectsInvalidKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockethook-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, key := range []string{"", "abcd", strings.Repeat("ab", 16), strings.Repeat("zz", 32)} {
+		path := filepath.Join(dir, "key")
+		ioutil.WriteFile(path, []byte(key), 0600)
+		if _, err := loadHistoryKey(path); err == nil {
+			t.Errorf("loadHistoryKey accepted %q", key)
+		}
+	}
+	if _, err := loadHistoryKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loadHistoryKey accepted a missing file")
+	}
+}
+
+func TestHistoryLogKeepsUndecryptableLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockethook-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { historyCipher = nil }()
+
+	historyCipher = testHistoryKey(t, dir, strings.Repeat("ab", 32))
+	h, err := newHistoryLog(filepath.Join(dir, "log"), nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.write(Message{ID: "m1", Endpoint: "/orders"})
+	h.write(Message{ID: "m2", Endpoint: "/orders"})
+	h.mu.Lock()
+	// A line cut off by a crash is skipped
+	h.files["/orders"].f.Write([]byte("e:AAAA"))
+	entries, err := h.read("/orders")
+	h.mu.Unlock()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("read = %d entries, %v, expected 2", len(entries), err)
+	}
+	for _, file := range h.files {
+		file.f.Close()
+	}
+
+	// Opening the log without the key or with another one fails instead of compacting it away
+	for _, aead := range []cipher.AEAD{nil, testHistoryKey(t, dir, strings.Repeat("cd", 32))} {
+		historyCipher = aead
+		if _, err := newHistoryLog(filepath.Join(dir, "log"), nil, 0, 100); err == nil {
+			t.Errorf("opened encrypted log with key %v", aead)
+		}
+	}
+	historyCipher = testHistoryKey(t, dir, strings.Repeat("ab", 32))
+	reopened, err := newHistoryLog(filepath.Join(dir, "log"), nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _, _, err := reopened.Since("/orders", "", 10)
+	if ids := messageIDs(messages); err != nil || !reflect.DeepEqual(ids, []string{"m1", "m2"}) {
+		t.Errorf("Since after reopening = %v, %v, expected [m1 m2]", ids, err)
+	}
+	for _, file := range reopened.files {
+		file.f.Close()
+	}
+}
+
+func TestHistoryLogConvertsCompression(t *testing.T) {
+	defer func() { historyCompress = false }()
+	dir, err := ioutil.TempDir("", "sockethook-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := newHistoryLog(dir, nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.write(Message{ID: "m1", Endpoint: "/orders"})
+	historyCompress = true
+	h.write(Message{ID: "m2", Endpoint: "/orders"})
+
+	// Plain and compressed entries of the same file are both read, and compacting compresses all of them
+	for _, stage := range []string{"mixed", "compacted"} {
+		messages, found, _, err := h.Since("/orders", "", 10)
+		if ids := messageIDs(messages); err != nil || !found || !reflect.DeepEqual(ids, []string{"m1", "m2"}) {
+			t.Errorf("%s: Since = %v, %v, %v, expected [m1 m2]", stage, ids, found, err)
+		}
+		h.mu.Lock()
+		err = h.compact("/orders")
+		h.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(h.path("/orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte("\nz:"))+1 != bytes.Count(data, []byte("\n")) || !bytes.HasPrefix(data, []byte("z:")) {
+		t.Errorf("compacted log isn't compressed:\n%s", data)
+	}
+	for _, file := range h.files {
+		file.f.Close()
+	}
+}
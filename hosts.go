@@ -0,0 +1,42 @@
+package sockethook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Endpoint namespaces per hostname, "*" matching hosts without their own. Once any are configured, requests
+// for other hosts are rejected so that tenants can't reach each other's endpoints.
+var hostNamespaces = make(map[string]string)
+
+// setHostNamespaces parses rules of the form "host=/namespace", an empty namespace serving endpoints unchanged
+func setHostNamespaces(rules []string) error {
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || (parts[1] != "" && !strings.HasPrefix(parts[1], "/")) {
+			return fmt.Errorf("invalid host route %q, expected host=/namespace", rule)
+		}
+		hostNamespaces[strings.ToLower(parts[0])] = strings.TrimRight(parts[1], "/")
+	}
+	return nil
+}
+
+// hostNamespace returns the namespace prefixed to the endpoints of a request, based on its Host header.
+// Returns false if host routing is enabled and the host isn't routed.
+func hostNamespace(r *http.Request) (string, bool) {
+	if len(hostNamespaces) == 0 {
+		return "", true
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if namespace, ok := hostNamespaces[strings.ToLower(host)]; ok {
+		return namespace, true
+	}
+	namespace, ok := hostNamespaces["*"]
+	return namespace, ok
+}
@@ -0,0 +1,841 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of frames buffered per client before it's considered too slow and evicted
+var clientBufferSize = 256
+
+// Interval at which websocket pings are sent to clients, 0 disables them
+var pingInterval = 30 * time.Second
+
+// How long after a ping a client has to answer before it's considered dead
+var pongTimeout = 10 * time.Second
+
+// Hub keeps track of all connected clients and the endpoints they are subscribed to. Frames are handed to
+// every client's own writer goroutine, so a slow or broken client never holds up delivery to others.
+type Hub struct {
+	mu sync.Mutex
+
+	// Clients subscribed to every endpoint or pattern
+	clients map[string][]*client
+	// Wildcard patterns which have at least one subscriber
+	patterns *matcher
+	// Number of clients evicted per endpoint since startup
+	evictions map[string]uint64
+}
+
+// Hub holding all websocket clients
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{
+		clients:   make(map[string][]*client),
+		patterns:  newMatcher(),
+		evictions: make(map[string]uint64),
+	}
+}
+
+// client is a connected websocket client. Frames are queued on its send channel and only ever written to the
+// connection by its writer goroutine.
+type client struct {
+	id string
+	// Token the client authenticated with, if any
+	token string
+	// Origin the client connected from, if sent, and the host it connected to
+	origin string
+	host   string
+	// IP the client connected from, and its country as resolved by GeoIP for metrics
+	ip      string
+	country string
+	// Namespace of the hostname the client connected through, prefixed to endpoints it subscribes to
+	namespace string
+	// Endpoint the client connected to
+	endpoint string
+	conn     clientConn
+	send     chan interface{}
+	// Closed to stop the writer goroutine
+	done chan struct{}
+	// Closed once the writer goroutine has stopped
+	stopped chan struct{}
+	// Time the client connected and when it was last heard from and written to
+	connected time.Time
+	liveness  liveness
+	// Version of the message schema the client receives messages in, and whether it accepts large bodies as
+	// binary frames, which only websocket clients can
+	schema int
+	binary bool
+
+	// Endpoints the client is subscribed to, filters of those subscriptions which have one and whether it has
+	// been removed, guarded by hub.mu
+	subscriptions map[string]bool
+	filters       map[string]*filter
+	closed        bool
+	// Conditions given when connecting, applying to the endpoint the client connected to
+	where *where
+
+	// Writes and failures counted against the error budget, and the reduced buffer size if the client exceeded
+	// it, 0 for the full buffer
+	budgetMu    sync.Mutex
+	budget      budgetCounter
+	bufferLimit int64
+	// Number of published messages waiting for a callback
+	publishing int64
+	// Whether frames may be compressed, as the client negotiated permessage-deflate
+	compressed bool
+
+	// Limiter pacing the messages replayed when resuming, nil to queue them at once. While they're replayed live
+	// messages are held back, so that they still arrive after the replayed ones.
+	replayLimiter *rateLimiter
+	replayMu      sync.Mutex
+	replaying     bool
+	held          []Message
+
+	// Token of the client's session, empty if sessions are disabled, the session restored when connecting, if
+	// any, and the sequence numbers of the last messages written to it per endpoint, kept with its session
+	session  string
+	restored *session
+	cursorMu sync.Mutex
+	cursors  map[string]uint64
+	// Sequence number of the last message replayed per endpoint when the client registered, for messages which
+	// were recorded but not yet delivered at the time, guarded by hub.mu
+	replayed map[string]uint64
+	// Labels the client connected with, shown in the admin API
+	labels map[string]string
+}
+
+// clientConn is the transport frames are written to, a websocket connection or a server-sent event stream
+type clientConn interface {
+	WriteJSON(v interface{}) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// closeFrame makes a client's writer send a close frame and stop
+type closeFrame struct {
+	data     []byte
+	deadline time.Time
+}
+
+func newClient(conn clientConn, endpoint string) *client {
+	return &client{
+		id:            idGenerator.NewID(),
+		endpoint:      endpoint,
+		conn:          conn,
+		schema:        schemaV1,
+		send:          make(chan interface{}, clientBufferSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		connected:     time.Now(),
+		subscriptions: make(map[string]bool),
+		filters:       make(map[string]*filter),
+	}
+}
+
+// queue hands a frame to the client's writer without blocking, returning false if its buffer is full
+func (c *client) queue(v interface{}) bool {
+	if msg, ok := v.(Message); ok {
+		c.replayMu.Lock()
+		if c.replaying {
+			defer c.replayMu.Unlock()
+			if len(c.held) >= cap(c.send) {
+				return false
+			}
+			c.held = append(c.held, msg)
+			return true
+		}
+		c.replayMu.Unlock()
+	}
+	if limit := atomic.LoadInt64(&c.bufferLimit); limit > 0 && int64(len(c.send)) >= limit {
+		return false
+	}
+	select {
+	case c.send <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// replay queues the messages a resuming client missed as fast as its replay limiter allows, followed by the
+// live messages held back in the meantime, so that a client resuming after a long outage isn't flooded
+func (c *client) replay(missed []Message) {
+	for {
+		for _, msg := range missed {
+			for {
+				ok, wait := c.replayLimiter.Allow()
+				if ok {
+					break
+				}
+				select {
+				case <-time.After(wait):
+				case <-c.done:
+					return
+				}
+			}
+			select {
+			case c.send <- msg:
+			case <-c.done:
+				return
+			}
+		}
+
+		c.replayMu.Lock()
+		missed, c.held = c.held, nil
+		if len(missed) == 0 {
+			c.replaying = false
+			c.replayMu.Unlock()
+			return
+		}
+		c.replayMu.Unlock()
+	}
+}
+
+// writePump writes queued frames to the connection until the client is removed, evicting it if a write fails.
+// Pings are sent in between so that intermediaries keep idle connections open and dead ones are noticed.
+func (c *client) writePump() {
+	defer close(c.stopped)
+
+	var pings <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case <-pings:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongTimeout))
+			if err == nil {
+				c.liveness.pinged(time.Now())
+			}
+		case v := <-c.send:
+			switch frame := v.(type) {
+			case closeFrame:
+				if err := c.conn.WriteControl(websocket.CloseMessage, frame.data, frame.deadline); err != nil {
+					log.WithField("endpoint", c.endpoint).Debugln("Failed to send close frame:", err)
+				}
+				return
+			case Message:
+				// Messages which must be acknowledged are accounted for even when they're dropped, stale ones
+				// being dead-lettered and those lost to chaos mode retried like any other unacknowledged one
+				acked := ackRequired(frame.Endpoint) && ackClient(c)
+				if !latencyBudget.Allow(frame.Endpoint, frame.received) {
+					recordClientDelivery(c, frame, deliveryDropped, "latency budget exceeded")
+					if acked {
+						deadLetter(c, frame, "latency budget exceeded", attempts(frame))
+					}
+					continue
+				}
+				if !chaosBeforeWrite(c, frame.Endpoint) {
+					recordClientDelivery(c, frame, deliveryDropped, "chaos")
+					if acked {
+						expectAck(c, frame)
+					}
+					continue
+				}
+				err = writeMessage(c, frame)
+				observeDelivery(c, frame, err)
+				if err != nil {
+					recordClientDelivery(c, frame, deliveryFailed, err.Error())
+				} else {
+					recordClientDelivery(c, frame, deliveryDelivered, "")
+					c.advanceCursor(frame)
+				}
+				// Clients whose writes fail are evicted anyway, so only their endpoint is charged
+				if err != nil {
+					writeBudget.ObserveEndpoint(frame.Endpoint, false)
+				} else {
+					writeBudget.Observe(c, frame.Endpoint, true)
+					c.liveness.delivered(time.Now())
+				}
+				if acked {
+					if err != nil {
+						deadLetter(c, frame, "write failed", attempts(frame))
+					} else {
+						expectAck(c, frame)
+					}
+				}
+				if !frame.received.IsZero() {
+					profiler.ObserveLatency(time.Since(frame.received))
+				}
+			default:
+				err = writeFrame(c, frame)
+			}
+		}
+
+		if err != nil {
+			hub.evict(c.endpoint, c)
+			return
+		}
+	}
+}
+
+// keepAlive makes reads on the client's connection fail if no pong or other frame arrives within the ping
+// interval plus pong timeout, so the read loop reaps unresponsive clients even when no hooks are sent
+func (c *client) keepAlive() {
+	c.touch()
+	if ws, ok := c.conn.(*websocket.Conn); ok {
+		ws.SetPongHandler(func(string) error {
+			c.liveness.ponged(time.Now())
+			c.touch()
+			return nil
+		})
+	}
+}
+
+// touch extends the read deadline of a client which has shown it's alive
+func (c *client) touch() {
+	if ws, ok := c.conn.(*websocket.Conn); ok && pingInterval > 0 {
+		ws.SetReadDeadline(time.Now().Add(pingInterval + pongTimeout))
+	}
+}
+
+// Register subscribes a newly connected client to its endpoint and queues its welcome frame, filling in the
+// sequence number so that every message queued after the welcome frame has a higher one. When resuming after
+// the message with the given ID or sequence number, the buffered messages received since are queued right after
+// the welcome frame. Clients resuming from a sequence number whose missed messages can't all be replayed are
+// sent a reset frame instead. Returns the number of clients on the endpoint.
+func (h *Hub) Register(c *client, welcome WelcomeFrame, resume resumePoint) int {
+	count := h.register(c, welcome, resume)
+	// Clients of server events aren't reported, as every report would be delivered to them
+	if !isReserved(c.endpoint) {
+		publishEvent("client_connected", map[string]interface{}{
+			"endpoint":    c.endpoint,
+			"id":          c.id,
+			"remote_addr": c.ip,
+			"clients":     count,
+		})
+	}
+	return count
+}
+
+func (h *Hub) register(c *client, welcome WelcomeFrame, resume resumePoint) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.attach(c, c.endpoint)
+	if maxClients > 0 {
+		reserved[c.endpoint]--
+	}
+
+	// Messages are recorded before being delivered, so those recorded but not delivered yet may be replayed
+	// here, and are then skipped when they're delivered
+	var missed []Message
+	var reset *ResetFrame
+	welcome.Seq = currentSequence(c.endpoint)
+	if resume.bySeq && !isPattern(c.endpoint) {
+		missed, reset = resumeFrom(c.endpoint, resume.seq, cap(c.send)-2)
+		welcome.Replayed, welcome.ResumeGap = len(missed), reset != nil
+	} else if resume.lastEventID != "" && !isPattern(c.endpoint) {
+		var found bool
+		missed, found = replayBuffer.Since(c.endpoint, resume.lastEventID)
+		// Only the newest messages are replayed if they don't all fit in the client's buffer
+		limit := cap(c.send) - 1
+		if limit < 0 {
+			limit = 0
+		}
+		if len(missed) > limit {
+			missed, found = missed[len(missed)-limit:], false
+		}
+		welcome.Replayed, welcome.ResumeGap = len(missed), !found
+	}
+	c.markReplayed(c.endpoint, missed)
+	if len(missed) > 0 {
+		c.setCursor(c.endpoint, missed[0].Seq-1)
+	} else if !isPattern(c.endpoint) {
+		c.setCursor(c.endpoint, welcome.Seq)
+	}
+
+	replayed := []Message{}
+	for _, msg := range missed {
+		if c.where != nil && !c.where.Match(msg) {
+			continue
+		}
+		if f := c.filters[c.endpoint]; f == nil || f.Match(filterDocument(msg)) {
+			replayed = append(replayed, msg)
+		}
+	}
+
+	// Subscriptions of a restored session are resumed from their cursors like the endpoint connected to
+	resets := []ResetFrame{}
+	if reset != nil {
+		resets = append(resets, *reset)
+	}
+	welcome.SessionRestored = c.restored != nil
+	if c.restored != nil {
+		for _, endpoint := range sortedSubscriptions(c.restored.subscriptions) {
+			if c.subscriptions[endpoint] || (maxSubscriptions > 0 && len(c.subscriptions) >= maxSubscriptions) ||
+				(maxClients > 0 && len(h.clients[endpoint])+reserved[endpoint] >= maxClients) {
+				continue
+			}
+			h.attach(c, endpoint)
+			f := c.restored.subscriptions[endpoint]
+			if f != nil {
+				c.filters[endpoint] = f
+			}
+			welcome.Subscriptions = append(welcome.Subscriptions, endpoint)
+			if isPattern(endpoint) {
+				continue
+			}
+
+			seq, ok := c.restored.cursors[endpoint]
+			if !ok {
+				c.setCursor(endpoint, currentSequence(endpoint))
+				continue
+			}
+			c.setCursor(endpoint, seq)
+			missed, reset := resumeFrom(endpoint, seq, cap(c.send)-2-len(replayed)-len(resets))
+			if reset != nil {
+				resets = append(resets, *reset)
+			}
+			c.markReplayed(endpoint, missed)
+			for _, msg := range missed {
+				if f == nil || f.Match(filterDocument(msg)) {
+					replayed = append(replayed, msg)
+				}
+			}
+		}
+	}
+
+	c.queue(welcome)
+	for _, reset := range resets {
+		c.queue(reset)
+	}
+	// Paced replays hold back live messages from now on, so that they're queued after the replayed ones
+	if c.replayLimiter != nil && len(replayed) > 0 {
+		c.replaying = true
+		go c.replay(replayed)
+	} else {
+		for _, msg := range replayed {
+			c.queue(msg)
+		}
+	}
+	return len(h.clients[c.endpoint])
+}
+
+// markReplayed remembers the last of the messages of an endpoint replayed to a registering client, so that it
+// isn't written again when delivered. Must be called with h.mu held.
+func (c *client) markReplayed(endpoint string, missed []Message) {
+	if len(missed) == 0 {
+		return
+	}
+	if c.replayed == nil {
+		c.replayed = make(map[string]uint64)
+	}
+	c.replayed[endpoint] = missed[len(missed)-1].Seq
+}
+
+// withoutReplayed leaves out the clients a message was already replayed to when they registered, which happens
+// to messages recorded before a client registered but delivered after. Must be called with h.mu held.
+func withoutReplayed(conns []*client, msg Message) []*client {
+	kept := conns[:0]
+	for _, c := range conns {
+		if seq, ok := c.replayed[msg.Endpoint]; ok && msg.Seq != 0 {
+			if msg.Seq <= seq {
+				continue
+			}
+			// Later messages weren't recorded yet when the client registered
+			delete(c.replayed, msg.Endpoint)
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// resumeFrom returns the buffered messages of an endpoint received after a sequence number, or a reset frame if
+// they can't all be replayed within limit or the sequence number is ahead of the endpoint's. Must be called
+// with h.mu held.
+func resumeFrom(endpoint string, seq uint64, limit int) ([]Message, *ResetFrame) {
+	current := currentSequence(endpoint)
+	missed, complete := replayBuffer.SinceSeq(endpoint, seq)
+	switch {
+	case seq > current:
+		return nil, &ResetFrame{Type: frameReset, Endpoint: endpoint, Seq: current, Reason: resetAhead}
+	case seq < current && (!complete || len(missed) > limit):
+		return nil, &ResetFrame{Type: frameReset, Endpoint: endpoint, Seq: current, Reason: resetGap}
+	}
+	return missed, nil
+}
+
+// sortedSubscriptions returns the endpoints of a session's subscriptions in order, so they're restored in the
+// same order every time
+func sortedSubscriptions(subscriptions map[string]*filter) []string {
+	endpoints := make([]string, 0, len(subscriptions))
+	for endpoint := range subscriptions {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// Unregister closes clients and removes them from all their subscriptions, returning those which were
+// removed by this call. Clients which were already removed are skipped. The endpoint is the one on which the
+// clients failed and is used for eviction counts.
+func (h *Hub) Unregister(endpoint string, remove ...*client) []*client {
+	removed := h.unregister(endpoint, remove...)
+	for _, c := range removed {
+		if !isReserved(c.endpoint) {
+			publishEvent("client_disconnected", map[string]interface{}{
+				"endpoint":    c.endpoint,
+				"id":          c.id,
+				"remote_addr": c.ip,
+			})
+		}
+	}
+	return removed
+}
+
+func (h *Hub) unregister(endpoint string, remove ...*client) []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removed := []*client{}
+	for _, c := range remove {
+		if c.closed {
+			continue
+		}
+		c.closed = true
+		saveSession(c)
+		close(c.done)
+		c.conn.Close()
+		for subscription := range c.subscriptions {
+			h.detach(c, subscription)
+		}
+		go dropAcks(c)
+		removed = append(removed, c)
+	}
+
+	if len(removed) == 0 {
+		return removed
+	}
+
+	notifySlotFreed()
+
+	log.WithFields(log.Fields{
+		"endpoint": endpoint,
+		"clients":  len(h.clients[endpoint]),
+		"removed":  len(removed),
+	}).Infoln("Client disconnected")
+
+	return removed
+}
+
+// evict unregisters clients which failed, counting them as evictions of the endpoint, and publishes an event for
+// each of them
+func (h *Hub) evict(endpoint string, failed ...*client) {
+	removed := h.Unregister(endpoint, failed...)
+	if len(removed) > 0 {
+		h.mu.Lock()
+		h.evictions[endpoint] += uint64(len(removed))
+		h.mu.Unlock()
+	}
+	for _, c := range removed {
+		publishEvent("client_evicted", map[string]interface{}{
+			"endpoint":    endpoint,
+			"remote_addr": c.conn.RemoteAddr().String(),
+		})
+		exportEvent(otlpSeverityWarn, "client.evicted", "Client evicted", map[string]interface{}{
+			"endpoint":       endpoint,
+			"connection.id":  c.id,
+			"client.address": c.conn.RemoteAddr().String(),
+		})
+	}
+}
+
+// Broadcast queues a message for all clients listening to its endpoint and returns the number of clients
+func (h *Hub) Broadcast(msg Message) int {
+	msg.Type = frameData
+	if msg.ID == "" {
+		msg.ID = idGenerator.NewID()
+	}
+	if msg.ReceivedAt == "" {
+		msg.ReceivedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	// Messages of endpoints owned by another instance are handled by the owner, which broadcasts them to all
+	if forwardToOwner(msg) {
+		metrics.broadcasts.Inc("forwarded")
+		return h.subscriberCount(msg.Endpoint)
+	}
+
+	// Messages of aggregated endpoints are only delivered as part of their window's summary
+	if !msg.summary && aggregations.Add(msg) {
+		return h.subscriberCount(msg.Endpoint)
+	}
+	// Messages repeating the previous payload of their endpoint are suppressed, and counted in a later report
+	if !msg.summary && !msg.repeat {
+		report, suppressed := duplicates.Collapse(msg)
+		if report != nil {
+			h.Broadcast(*report)
+		}
+		if suppressed {
+			return h.subscriberCount(msg.Endpoint)
+		}
+	}
+	// Messages of debounced and throttled endpoints may be held back for a later delivery, or dropped
+	if !msg.summary && !msg.paced && pacing.Hold(msg) {
+		return h.subscriberCount(msg.Endpoint)
+	}
+	// Messages of endpoints outside their delivery window are held back until it opens
+	if !msg.windowed && deliveryWindows.Hold(msg) {
+		return h.subscriberCount(msg.Endpoint)
+	}
+
+	// Owners publish the messages of their endpoints once numbered, for the other instances to follow
+	msg.publishNumbered = ownershipActive()
+	result := "success"
+	if !dispatch(msg) {
+		result = "failure"
+	}
+	metrics.broadcasts.Inc(result)
+	if !msg.publishNumbered {
+		publishToBroker(msg)
+	}
+	count := h.subscriberCount(msg.Endpoint)
+
+	if !isReserved(msg.Endpoint) {
+		exportEvent(otlpSeverityInfo, "message.broadcast", "Message broadcast", map[string]interface{}{
+			"endpoint":   msg.Endpoint,
+			"message.id": msg.ID,
+			"clients":    count,
+			"result":     result,
+		})
+	}
+	return count
+}
+
+// deliver hands a message to the writers of all clients listening to its endpoint. Clients whose buffer is
+// full can't keep up and are evicted together afterwards, so every other client receives the message exactly
+// once and a slow client is evicted exactly once.
+func (h *Hub) deliver(msg Message) {
+	if metricsEnabled {
+		if data, err := json.Marshal(msg); err == nil {
+			msg.size = len(data)
+		}
+	}
+
+	// Messages are recorded before the clients are looked up, so clients registering in between are replayed
+	// the message and skipped below rather than missing it
+	replayBuffer.Record(msg)
+	if !msg.imported {
+		historyLog.Record(msg)
+	}
+	recorder.Record(msg)
+
+	h.mu.Lock()
+	if writeBudget.CircuitOpen(msg.Endpoint) {
+		h.mu.Unlock()
+		metrics.deliveries.Inc("circuit_open")
+		return
+	}
+	conns := withoutReplayed(h.subscribers(msg.Endpoint), msg)
+	filters := h.filtersFor(conns, msg.Endpoint)
+	wheres := h.wheresFor(conns, msg.Endpoint)
+	h.mu.Unlock()
+
+	// The message is only decoded for filters once, and only if a client has one
+	var doc interface{}
+	if len(filters) > 0 {
+		doc = filterDocument(msg)
+	}
+
+	slow := []*client{}
+	for _, c := range conns {
+		if c == msg.publisher {
+			continue
+		}
+		if w := wheres[c]; w != nil && !w.Match(msg) {
+			continue
+		}
+		if !passesFilters(filters[c], doc) {
+			continue
+		}
+		// Recorded before queueing, as the client may respond before queue returns
+		if respondEndpoints[msg.Endpoint] {
+			responseDelivered(msg.ID, c)
+		}
+		if !c.queue(msg) {
+			metrics.deliveries.Inc("failure")
+			observeDeliveryFailure(msg.Endpoint)
+			recordClientDelivery(c, msg, deliveryDropped, "client too slow")
+			if ackRequired(msg.Endpoint) && ackClient(c) {
+				deadLetter(c, msg, "client too slow", 1)
+			}
+			// With an error budget, slow clients only lose the message unless they exceed it
+			if writeBudget != nil {
+				writeBudget.Observe(c, msg.Endpoint, false)
+			} else {
+				slow = append(slow, c)
+			}
+		}
+	}
+
+	if len(slow) > 0 {
+		log.WithField("endpoint", msg.Endpoint).WithField("clients", len(slow)).Warnln("Evicting slow clients")
+		h.evict(msg.Endpoint, slow...)
+	}
+}
+
+// filtersFor returns the filters of the clients whose subscriptions matching an endpoint all have one, a message
+// on the endpoint being delivered to them if it passes any of their filters. Must be called with h.mu held.
+func (h *Hub) filtersFor(conns []*client, endpoint string) map[*client][]*filter {
+	filters := make(map[*client][]*filter)
+	for _, c := range conns {
+		if len(c.filters) == 0 {
+			continue
+		}
+		matching := []*filter{}
+		for subscription := range c.subscriptions {
+			if subscription != endpoint && !(isPattern(subscription) && patternCovers(subscription, endpoint)) {
+				continue
+			}
+			f := c.filters[subscription]
+			if f == nil {
+				matching = nil
+				break
+			}
+			matching = append(matching, f)
+		}
+		if matching != nil {
+			filters[c] = matching
+		}
+	}
+	return filters
+}
+
+// subscribedTo checks if a client is subscribed to an endpoint, directly or through a pattern. Must be called
+// with hub.mu held.
+func (c *client) subscribedTo(endpoint string) bool {
+	for subscription := range c.subscriptions {
+		if subscription == endpoint || (isPattern(subscription) && patternCovers(subscription, endpoint)) {
+			return true
+		}
+	}
+	return false
+}
+
+// passesFilters checks if a decoded message passes any of a client's filters, or if the client has none
+func passesFilters(filters []*filter, doc interface{}) bool {
+	if filters == nil {
+		return true
+	}
+	for _, f := range filters {
+		if f.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns every connected client once, even if it's subscribed to several endpoints
+func (h *Hub) all() []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := make(map[*client]bool)
+	all := []*client{}
+	for _, conns := range h.clients {
+		for _, c := range conns {
+			if !seen[c] {
+				seen[c] = true
+				all = append(all, c)
+			}
+		}
+	}
+	return all
+}
+
+// attach adds a client to the clients of an endpoint, must be called with h.mu held
+func (h *Hub) attach(c *client, endpoint string) {
+	if len(h.clients[endpoint]) == 0 && isPattern(endpoint) {
+		h.patterns.Insert(endpoint)
+	}
+	h.clients[endpoint] = append(h.clients[endpoint], c)
+	c.subscriptions[endpoint] = true
+}
+
+// detach removes a client from the clients of an endpoint, must be called with h.mu held
+func (h *Hub) detach(c *client, endpoint string) {
+	conns := h.clients[endpoint]
+	kept := make([]*client, 0, len(conns))
+	for _, other := range conns {
+		if other != c {
+			kept = append(kept, other)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(h.clients, endpoint)
+		touchEndpoint(endpoint)
+		if isPattern(endpoint) {
+			h.patterns.Remove(endpoint)
+		}
+	} else {
+		h.clients[endpoint] = kept
+	}
+	delete(c.subscriptions, endpoint)
+	delete(c.filters, endpoint)
+}
+
+// subscriberCount returns the number of clients subscribed to an endpoint, directly or through a pattern
+func (h *Hub) subscriberCount(endpoint string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers(endpoint))
+}
+
+// subscribers returns the clients subscribed to an endpoint, either directly or through a pattern. Must be
+// called with h.mu held.
+func (h *Hub) subscribers(endpoint string) []*client {
+	conns := append([]*client(nil), h.clients[endpoint]...)
+	matched := h.patterns.Match(endpoint)
+	// Messages of temporary endpoints only reach clients holding their token, which can't subscribe to patterns,
+	// and those of reserved endpoints only reach admins subscribed to them directly
+	if len(matched) == 0 || isReserved(endpoint) || temporaryOf(endpoint) != nil {
+		return conns
+	}
+
+	// Clients may be subscribed through several patterns but only receive every message once
+	seen := make(map[*client]bool, len(conns))
+	for _, c := range conns {
+		seen[c] = true
+	}
+	for _, pattern := range matched {
+		if pattern == endpoint {
+			continue
+		}
+		for _, c := range h.clients[pattern] {
+			if !seen[c] {
+				seen[c] = true
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns
+}
+
+// client returns the connected client with an ID, nil if there's none. Must be called with h.mu held.
+func (h *Hub) client(id string) *client {
+	for _, conns := range h.clients {
+		for _, c := range conns {
+			if c.id == id {
+				return c
+			}
+		}
+	}
+	return nil
+}
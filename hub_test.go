@@ -0,0 +1,231 @@
+package sockethook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a client connection which keeps the frames written to it, failing writes once told to
+type fakeConn struct {
+	mu     sync.Mutex
+	frames []interface{}
+	fail   bool
+	closed bool
+}
+
+func (f *fakeConn) WriteJSON(v interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail || f.closed {
+		return errors.New("write failed")
+	}
+	f.frames = append(f.frames, v)
+	return nil
+}
+
+func (f *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+func (f *fakeConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// queuedFrames returns the frames queued for a client which has no writer, emptying its queue
+func queuedFrames(c *client) []interface{} {
+	var frames []interface{}
+	for {
+		select {
+		case v := <-c.send:
+			frames = append(frames, v)
+		default:
+			return frames
+		}
+	}
+}
+
+func TestRegisterResumesFromSequence(t *testing.T) {
+	const endpoint = "/test/hub/resume"
+	replayBuffer.SetOverrides(map[string]int{endpoint: 3})
+	defer replayBuffer.SetOverrides(nil)
+
+	// Numbering carries on across runs of the test, so sequence numbers are relative to the start
+	start := currentSequence(endpoint)
+	for i := uint64(1); i <= 5; i++ {
+		replayBuffer.Record(Message{ID: fmt.Sprintf("m%d", start+i), Endpoint: endpoint, Seq: start + i})
+	}
+	advanceSequence(endpoint, start+5)
+
+	tests := []struct {
+		name     string
+		seq      uint64
+		replayed []string
+		reset    string
+	}{
+		{"up to date", start + 5, nil, ""},
+		{"missed buffered messages", start + 3, []string{fmt.Sprintf("m%d", start+4), fmt.Sprintf("m%d", start+5)}, ""},
+		{"missed messages pushed out", start + 1, nil, resetGap},
+		{"ahead of the endpoint", start + 6, nil, resetAhead},
+	}
+	for _, test := range tests {
+		h := newHub()
+		c := newClient(&fakeConn{}, endpoint)
+		h.register(c, WelcomeFrame{Type: frameWelcome}, resumePoint{bySeq: true, seq: test.seq})
+
+		frames := queuedFrames(c)
+		welcome := frames[0].(WelcomeFrame)
+		if welcome.Seq != start+5 || welcome.Replayed != len(test.replayed) || welcome.ResumeGap != (test.reset != "") {
+			t.Errorf("%s: welcome %+v, expected seq %d, %d replayed", test.name, welcome, start+5, len(test.replayed))
+		}
+		var replayed []string
+		reset := ""
+		for _, frame := range frames[1:] {
+			switch frame := frame.(type) {
+			case Message:
+				replayed = append(replayed, frame.ID)
+			case ResetFrame:
+				if frame.Seq != start+5 || frame.Endpoint != endpoint {
+					t.Errorf("%s: reset frame %+v, expected seq %d", test.name, frame, start+5)
+				}
+				reset = frame.Reason
+			}
+		}
+		if !reflect.DeepEqual(replayed, test.replayed) || reset != test.reset {
+			t.Errorf("%s: replayed %v and reset %q, expected %v and %q", test.name, replayed, reset, test.replayed, test.reset)
+		}
+	}
+}
+
+func TestDeliverEvictsEverySlowClient(t *testing.T) {
+	const endpoint = "/test/hub/evict"
+	h := newHub()
+	var clients []*client
+	for i := 0; i < 6; i++ {
+		c := newClient(&fakeConn{}, endpoint)
+		h.register(c, WelcomeFrame{Type: frameWelcome}, resumePoint{})
+		queuedFrames(c)
+		clients = append(clients, c)
+	}
+	// Neighbouring clients fail together, which skipped the second of them when removing in place
+	slow := map[*client]bool{clients[1]: true, clients[2]: true, clients[4]: true}
+	for c := range slow {
+		for c.queue(Message{}) {
+		}
+	}
+
+	h.deliver(Message{ID: "evict", Endpoint: endpoint})
+
+	h.mu.Lock()
+	remaining := h.clients[endpoint]
+	evictions := h.evictions[endpoint]
+	h.mu.Unlock()
+	if len(remaining) != 3 || evictions != 3 {
+		t.Fatalf("%d clients remaining and %d evictions, expected 3 of each", len(remaining), evictions)
+	}
+	for _, c := range clients {
+		if slow[c] {
+			if !c.closed || !c.conn.(*fakeConn).closed {
+				t.Errorf("slow client %s wasn't closed", c.id)
+			}
+			continue
+		}
+		frames := queuedFrames(c)
+		if len(frames) != 1 || frames[0].(Message).ID != "evict" {
+			t.Errorf("client %s received %v, expected the message once", c.id, frames)
+		}
+	}
+
+	// Evicting clients which are already gone doesn't count them again
+	h.evict(endpoint, clients[1])
+	if h.evictions[endpoint] != 3 {
+		t.Errorf("%d evictions after evicting a removed client again", h.evictions[endpoint])
+	}
+}
+
+func TestMetricsCountEvictions(t *testing.T) {
+	const endpoint = "/test/hub/evictions-metric"
+	hub.mu.Lock()
+	hub.evictions[endpoint] = 2
+	hub.mu.Unlock()
+	defer func() {
+		hub.mu.Lock()
+		delete(hub.evictions, endpoint)
+		hub.mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `sockethook_evictions_total{endpoint="` + endpoint + `"} 2`; !strings.Contains(w.Body.String(), line) {
+		t.Errorf("metrics don't contain %s", line)
+	}
+}
+
+// BenchmarkHubDeliver fans a message out to the clients of an endpoint, taking it from each client's queue as
+// its writer would
+func BenchmarkHubDeliver(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("%d clients", size), func(b *testing.B) {
+			const endpoint = "/bench/hub/deliver"
+			h := newHub()
+			clients := make([]*client, size)
+			for i := range clients {
+				clients[i] = newClient(&fakeConn{}, endpoint)
+				h.register(clients[i], WelcomeFrame{Type: frameWelcome}, resumePoint{})
+				queuedFrames(clients[i])
+			}
+			msg := Message{ID: "bench", Endpoint: endpoint, Data: map[string]interface{}{"id": 42}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.deliver(msg)
+				for _, c := range clients {
+					<-c.send
+				}
+			}
+		})
+	}
+}
+
+func TestDeliverSkipsMessagesReplayedOnRegister(t *testing.T) {
+	const endpoint = "/test/hub/recorded"
+	replayBuffer.SetOverrides(map[string]int{endpoint: 10})
+	defer replayBuffer.SetOverrides(nil)
+
+	// The last message was recorded, but not delivered yet, when the client registered
+	start := currentSequence(endpoint)
+	for i := uint64(1); i <= 3; i++ {
+		replayBuffer.Record(Message{ID: fmt.Sprintf("m%d", start+i), Endpoint: endpoint, Seq: start + i})
+	}
+	advanceSequence(endpoint, start+4)
+
+	h := newHub()
+	c := newClient(&fakeConn{}, endpoint)
+	h.register(c, WelcomeFrame{Type: frameWelcome}, resumePoint{bySeq: true, seq: start + 1})
+	h.deliver(Message{ID: fmt.Sprintf("m%d", start+3), Endpoint: endpoint, Seq: start + 3})
+	h.deliver(Message{ID: fmt.Sprintf("m%d", start+4), Endpoint: endpoint, Seq: start + 4})
+
+	var received []string
+	for _, frame := range queuedFrames(c)[1:] {
+		received = append(received, frame.(Message).ID)
+	}
+	expected := []string{fmt.Sprintf("m%d", start+2), fmt.Sprintf("m%d", start+3), fmt.Sprintf("m%d", start+4)}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %v, expected %v", received, expected)
+	}
+	if c.replayed[endpoint] != 0 {
+		t.Errorf("replayed messages still remembered after a later one was delivered")
+	}
+}
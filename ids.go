@@ -0,0 +1,152 @@
+package sockethook
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDGenerator creates unique message IDs which sort by creation time
+type IDGenerator interface {
+	NewID() string
+}
+
+// newIDGenerator returns the generator for a format, nodeID is only used by snowflake
+func newIDGenerator(format string, nodeID int64) (IDGenerator, error) {
+	switch format {
+	case "uuidv7":
+		return &uuidV7Generator{}, nil
+	case "ulid":
+		return &ulidGenerator{}, nil
+	case "snowflake":
+		if nodeID < 0 || nodeID > snowflakeMaxNode {
+			return nil, fmt.Errorf("snowflake node ID must be between 0 and %d", snowflakeMaxNode)
+		}
+		return &snowflakeGenerator{node: nodeID}, nil
+	}
+
+	return nil, fmt.Errorf("unknown ID format %q, expected uuidv7, ulid or snowflake", format)
+}
+
+// uuidV7Generator creates RFC 9562 version 7 UUIDs, using a counter for IDs within the same millisecond
+type uuidV7Generator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	counter uint16
+}
+
+func (g *uuidV7Generator) NewID() string {
+	g.mu.Lock()
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms <= g.lastMs {
+		// Keep IDs monotonic if the clock hasn't moved or went backwards
+		ms = g.lastMs
+		g.counter++
+		if g.counter > 0xfff {
+			ms++
+			g.counter = 0
+		}
+	} else {
+		g.counter = 0
+	}
+	g.lastMs = ms
+	counter := g.counter
+	g.mu.Unlock()
+
+	var b [16]byte
+	rand.Read(b[8:])
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | byte(counter>>8)
+	b[7] = byte(counter)
+	b[8] = 0x80 | b[8]&0x3f
+
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// Crockford's base32 alphabet used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator creates monotonic ULIDs, incrementing the random part for IDs within the same millisecond
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	entropy [10]byte
+}
+
+func (g *ulidGenerator) NewID() string {
+	g.mu.Lock()
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		for i := len(g.entropy) - 1; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(g.entropy[:])
+	}
+	g.lastMs = ms
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	copy(b[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	// Encode 128 bits as 26 base32 characters, most significant first
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// Snowflake IDs use 41 bits of milliseconds since this epoch, 10 bits of node ID and 12 bits of sequence
+const snowflakeEpoch = 1288834974657
+const snowflakeMaxNode = 1<<10 - 1
+
+type snowflakeGenerator struct {
+	mu       sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+}
+
+func (g *snowflakeGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := time.Now().UnixNano()/int64(time.Millisecond) - snowflakeEpoch
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		g.sequence = (g.sequence + 1) & 0xfff
+		if g.sequence == 0 {
+			ms++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = ms
+
+	return strconv.FormatInt(ms<<22|g.node<<12|g.sequence, 10)
+}
@@ -0,0 +1,230 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum size of an import request in bytes, 0 for unlimited. The messages are held in memory until they're
+// imported, so this bounds the memory an import takes.
+var maxImportSize int64 = 256 << 20
+
+// ImportResult is the answer to an import request
+type ImportResult struct {
+	Endpoint string `json:"endpoint"`
+	// Messages read from the request, how many of them were added to the history log and how many are being
+	// broadcasted in the background
+	Messages  int `json:"messages"`
+	Imported  int `json:"imported"`
+	Broadcast int `json:"broadcast"`
+}
+
+// runImport implements the import command which imports messages from a file into an endpoint of a running
+// instance, for example when migrating from another relay
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:1234", "URL of the Sockethook server, including any base path.")
+	adminToken := flags.String("admin-token", "", "Admin token of the server.")
+	broadcast := flags.Bool("broadcast", false, "Also broadcast the imported messages to the clients of the endpoint.")
+	rate := flags.Float64("rate", recordingReplayRate, "Messages broadcasted per second.")
+	burst := flags.Int("burst", 1, "Messages which may be broadcasted at once above the rate.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sockethook import [options] <endpoint> <file.ndjson>")
+		fmt.Fprintln(os.Stderr, "The file holds one message per line, as exported from /admin/export, - to read it from standard input.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	endpoint := "/" + strings.Trim(flags.Arg(0), "/")
+	logEntry := log.WithField("endpoint", endpoint).WithField("server", *server)
+
+	var file io.Reader = os.Stdin
+	if flags.Arg(1) != "-" {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			logEntry.Errorln("Import failed:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		file = f
+	}
+
+	query := url.Values{}
+	if *broadcast {
+		query.Set("broadcast", "true")
+		query.Set("rate", strconv.FormatFloat(*rate, 'f', -1, 64))
+		query.Set("burst", strconv.Itoa(*burst))
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(*server, "/")+"/admin/import"+endpoint+"?"+query.Encode(), file)
+	if err != nil {
+		logEntry.Errorln("Import failed:", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logEntry.Errorln("Import failed:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		logEntry.WithField("status", resp.StatusCode).Errorln("Import failed:", strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+
+	var result ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		logEntry.Errorln("Import failed, invalid response:", err)
+		os.Exit(1)
+	}
+	logEntry.WithFields(log.Fields{
+		"messages":  result.Messages,
+		"imported":  result.Imported,
+		"broadcast": result.Broadcast,
+	}).Infoln("Messages imported ✅")
+}
+
+// handleImport adds the messages of the request, one per line as exported, to the history log of an endpoint,
+// keeping their IDs, sequence numbers and time of receipt. With broadcast=true they're also broadcasted to the
+// clients of the endpoint at rate per second with up to burst at once, in the background. Broadcasts are
+// numbered like any other message, so clients get new sequence numbers after the highest imported one.
+func handleImport(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if isPattern(endpoint) || !strings.HasPrefix(endpoint, "/") || isReserved(endpoint) {
+		http.Error(w, "expected an endpoint", 400)
+		return
+	}
+	if !declared(endpoint) {
+		http.Error(w, "endpoint isn't declared", 404)
+		return
+	}
+	query := r.URL.Query()
+	broadcast := query.Get("broadcast") == "true"
+	rate := recordingReplayRate
+	if value := query.Get("rate"); value != "" {
+		var err error
+		if rate, err = strconv.ParseFloat(value, 64); err != nil || rate <= 0 {
+			http.Error(w, "invalid rate, expected messages per second", 400)
+			return
+		}
+	}
+	burst := 1
+	if value := query.Get("burst"); value != "" {
+		var err error
+		if burst, err = strconv.Atoi(value); err != nil || burst <= 0 {
+			http.Error(w, "invalid burst, expected a number of messages", 400)
+			return
+		}
+	}
+	logged := historyLog.Enabled(endpoint)
+	if !logged && !broadcast {
+		http.Error(w, "endpoint isn't logged", 404)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if maxImportSize > 0 {
+		if r.ContentLength > maxImportSize {
+			http.Error(w, fmt.Sprintf("import larger than %d bytes", maxImportSize), 413)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	}
+	entries, err := readImport(body, endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	result := ImportResult{Endpoint: endpoint, Messages: len(entries)}
+	if logged {
+		if result.Imported, err = historyLog.Import(endpoint, entries); err != nil {
+			log.WithField("endpoint", endpoint).Errorln("Failed to import messages:", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	var seq uint64
+	for _, entry := range entries {
+		if entry.Message.Seq > seq {
+			seq = entry.Message.Seq
+		}
+	}
+	advanceSequence(endpoint, seq)
+	if broadcast {
+		result.Broadcast = len(entries)
+		go broadcastImport(endpoint, entries, newRateLimiter(rate, burst))
+	}
+
+	log.WithFields(log.Fields{
+		"endpoint":  endpoint,
+		"messages":  result.Messages,
+		"imported":  result.Imported,
+		"broadcast": result.Broadcast,
+	}).Warnln("Messages imported")
+	writeJSON(w, result)
+}
+
+// readImport decodes the messages of an import, rejecting all of them if one is invalid. Messages without an ID
+// get one and those without a time of receipt are taken as received now.
+func readImport(body io.Reader, endpoint string) ([]historyEntry, error) {
+	entries := []historyEntry{}
+	decoder := json.NewDecoder(body)
+	for i := 1; ; i++ {
+		var msg Message
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i, err)
+		}
+
+		at := time.Now().UTC()
+		if msg.ReceivedAt != "" {
+			received, err := time.Parse(time.RFC3339Nano, msg.ReceivedAt)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: invalid received_at %q, expected RFC3339", i, msg.ReceivedAt)
+			}
+			at = received.UTC()
+		} else {
+			msg.ReceivedAt = at.Format(time.RFC3339Nano)
+		}
+		if msg.ID == "" {
+			msg.ID = idGenerator.NewID()
+		}
+		msg.Type, msg.Endpoint, msg.Attempt = frameData, endpoint, 0
+		entries = append(entries, historyEntry{At: at, Message: msg})
+	}
+	return entries, nil
+}
+
+// broadcastImport broadcasts imported messages on their endpoint as fast as the limiter allows, keeping their
+// IDs and time of receipt like replayed recordings. Their sequence numbers are assigned when they're dispatched.
+func broadcastImport(endpoint string, entries []historyEntry, limiter *rateLimiter) {
+	for _, entry := range entries {
+		limiter.Wait()
+		msg := entry.Message
+		msg.imported = true
+		hub.Broadcast(msg)
+	}
+
+	log.WithField("endpoint", endpoint).WithField("messages", len(entries)).Infoln("Imported messages broadcasted")
+	publishEvent("messages_imported", map[string]interface{}{"endpoint": endpoint, "messages": len(entries)})
+}
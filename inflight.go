@@ -0,0 +1,63 @@
+package sockethook
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Semaphore limiting the number of concurrently handled hooks, nil if unlimited
+var hookSlots chan struct{}
+
+// How long hooks wait for a free slot before being rejected
+var hookQueueTimeout = 5 * time.Second
+
+// Number of hooks currently waiting for a slot
+var hooksQueued int64
+
+// Number of hooks currently being handled, including those waiting for a slot
+var hooksInFlight int64
+
+// setMaxInflightHooks limits the number of hooks handled at the same time, 0 for unlimited
+func setMaxInflightHooks(max int) {
+	if max > 0 {
+		hookSlots = make(chan struct{}, max)
+	}
+}
+
+// acquireHookSlot waits for a free slot to handle a hook in, returning false if none freed up in time or the hook
+// was abandoned while waiting
+func acquireHookSlot(ctx context.Context) bool {
+	if hookSlots == nil {
+		return true
+	}
+
+	// Fast path when a slot is available right away
+	select {
+	case hookSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	queued := atomic.AddInt64(&hooksQueued, 1)
+	defer atomic.AddInt64(&hooksQueued, -1)
+	log.WithField("queued", queued).Debugln("Hook waiting for a free slot")
+
+	select {
+	case hookSlots <- struct{}{}:
+		return true
+	case <-time.After(hookQueueTimeout):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseHookSlot frees a slot taken by acquireHookSlot
+func releaseHookSlot() {
+	if hookSlots != nil {
+		<-hookSlots
+	}
+}
@@ -0,0 +1,273 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Inspector stores full dumps of requests sent to endpoints flagged for inspection. Only hooks which were
+// broadcast are captured, not those rejected, suppressed as retries or dropped before reaching the hub.
+type Inspector struct {
+	mu sync.Mutex
+
+	// Maximum number of dumps kept per endpoint
+	size  int
+	dumps map[string][]RequestDump
+}
+
+// RequestDump is a captured hook request
+type RequestDump struct {
+	ID         string              `json:"id"`
+	ReceivedAt time.Time           `json:"received_at"`
+	Duration   string              `json:"duration"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+	// Body is the raw body, base64 encoded if it isn't valid UTF-8
+	Body       string `json:"body"`
+	BodyBinary bool   `json:"body_binary"`
+	raw        []byte
+}
+
+// ReplayResult describes the response of a replay target
+type ReplayResult struct {
+	Target   string `json:"target"`
+	Status   int    `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newInspector(endpoints []string, size int) *Inspector {
+	i := &Inspector{size: size, dumps: make(map[string][]RequestDump)}
+	for _, endpoint := range endpoints {
+		i.dumps[strings.TrimRight(endpoint, "/")] = []RequestDump{}
+	}
+	return i
+}
+
+// Inspecting checks if an endpoint is flagged for inspection
+func (i *Inspector) Inspecting(endpoint string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	_, ok := i.dumps[endpoint]
+	return ok
+}
+
+// Record stores a dump of a broadcast hook's request if its endpoint is flagged for inspection, dropping the
+// oldest when full
+func (i *Inspector) Record(endpoint string, id string, r *http.Request, body []byte, received time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	dumps, ok := i.dumps[endpoint]
+	if !ok {
+		return
+	}
+
+	// Credentials and secrets in headers are masked, which is why replays of captured requests don't carry them
+	dump := dumpRequest(id, r, body, received)
+	dump.Headers = redactor.RedactHeaders(endpoint, r.Header)
+	dumps = append(dumps, dump)
+	if len(dumps) > i.size {
+		dumps = dumps[len(dumps)-i.size:]
+	}
+	i.dumps[endpoint] = dumps
+}
+
+// dumpRequest captures a hook request with its body
+func dumpRequest(id string, r *http.Request, body []byte, received time.Time) RequestDump {
+	dump := RequestDump{
+		ID:         id,
+		ReceivedAt: received.UTC(),
+		Duration:   time.Since(received).String(),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		RemoteAddr: r.RemoteAddr,
+		Headers:    r.Header,
+		raw:        body,
+	}
+	if utf8.Valid(body) {
+		dump.Body = string(body)
+	} else {
+		dump.Body = base64.StdEncoding.EncodeToString(body)
+		dump.BodyBinary = true
+	}
+	return dump
+}
+
+// Trim drops the oldest half of the stored dumps of every endpoint to free memory
+func (i *Inspector) Trim() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for endpoint, dumps := range i.dumps {
+		i.dumps[endpoint] = append([]RequestDump{}, dumps[(len(dumps)+1)/2:]...)
+	}
+}
+
+// Dumps returns the stored dumps for an endpoint, newest first
+func (i *Inspector) Dumps(endpoint string) ([]RequestDump, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	dumps, ok := i.dumps[endpoint]
+	if !ok {
+		return nil, false
+	}
+
+	result := make([]RequestDump, len(dumps))
+	for j, dump := range dumps {
+		result[len(dumps)-1-j] = dump
+	}
+	return result, true
+}
+
+// Find returns a stored dump by ID
+func (i *Inspector) Find(endpoint string, id string) (RequestDump, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, dump := range i.dumps[endpoint] {
+		if dump.ID == id {
+			return dump, true
+		}
+	}
+	return RequestDump{}, false
+}
+
+// Replay re-sends a captured request to an arbitrary URL, such as a local development server, without the
+// headers which were masked when it was captured
+func (dump RequestDump) Replay(target string) ReplayResult {
+	result := ReplayResult{Target: target}
+
+	req, err := http.NewRequest(dump.Method, target, bytes.NewReader(dump.raw))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for name, values := range dump.Headers {
+		if name == "Content-Length" || name == "Host" || (len(values) > 0 && values[0] == redactedValue) {
+			continue
+		}
+		req.Header[name] = values
+	}
+
+	start := time.Now()
+	resp, err := replayClient.Do(req)
+	result.Duration = time.Since(start).String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	return result
+}
+
+// Client used to replay captured requests
+var replayClient = &http.Client{Timeout: 30 * time.Second}
+
+var inspectTemplate = template.Must(template.New("inspect").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sockethook inspector: {{.Endpoint}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.dump { border: 1px solid #ccc; border-radius: 4px; margin-bottom: 1em; padding: 0 1em; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+th { text-align: left; padding-right: 1em; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>{{.Endpoint}}</h1>
+<p>{{len .Dumps}} captured requests, newest first. <a href="?format=json">JSON</a></p>
+{{range .Dumps}}
+<div class="dump">
+<h3>{{.Method}} {{.URL}}</h3>
+<p>{{.ReceivedAt.Format "2006-01-02 15:04:05.000 MST"}} from {{.RemoteAddr}}, handled in {{.Duration}} <small>{{.ID}}</small></p>
+<table>
+{{range $name, $values := .Headers}}{{range $values}}<tr><th>{{$name}}</th><td>{{.}}</td></tr>{{end}}{{end}}
+</table>
+<pre>{{.Body}}</pre>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// handleInspect serves the captured requests of an endpoint as HTML, or as JSON if requested.
+// POST requests with a replay ID and target URL re-send a captured request. Only admins may use the inspector, as
+// captured requests may hold anything their senders included and replays are sent to any URL.
+func handleInspect(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	dumps, ok := inspector.Dumps(endpoint)
+	if !ok {
+		log.WithField("path", r.URL.Path).Warnln("404 Not found")
+		w.WriteHeader(404)
+		return
+	}
+
+	if r.Method == "POST" {
+		handleReplay(w, r, endpoint)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dumps)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	inspectTemplate.Execute(w, struct {
+		Endpoint string
+		Dumps    []RequestDump
+	}{endpoint, dumps})
+}
+
+// handleReplay re-sends the captured request given by the replay parameter to the target parameter
+func handleReplay(w http.ResponseWriter, r *http.Request, endpoint string) {
+	dump, ok := inspector.Find(endpoint, r.FormValue("replay"))
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	target := r.FormValue("target")
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		http.Error(w, "target must be an http or https URL", 400)
+		return
+	}
+
+	result := dump.Replay(target)
+	log.WithFields(log.Fields{
+		"endpoint": endpoint,
+		"id":       dump.ID,
+		"target":   target,
+		"status":   result.Status,
+	}).Infoln("Replayed captured request")
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Error != "" {
+		w.WriteHeader(502)
+	}
+	json.NewEncoder(w).Encode(result)
+}
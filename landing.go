@@ -0,0 +1,255 @@
+package sockethook
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether a page with the server's status and usage examples is served at /
+var landingPage = true
+
+// Port hooks are accepted at when it's separate from sockets, used in the examples of the landing page
+var landingHookPort int
+
+// Endpoint used in the examples of the landing page when none are configured
+const landingExampleEndpoint = "/example"
+
+// LandingPage is what the landing page shows, with URLs built from the request so that examples work as they are
+type LandingPage struct {
+	Version     string
+	Uptime      string
+	Clients     int
+	Maintenance bool
+	// Whether socket clients have to present a token
+	Auth      bool
+	Endpoints []LandingEndpoint
+	// URLs the playground sends hooks to and connects to, followed by the endpoint
+	HookBase   string
+	SocketBase string
+}
+
+// LandingEndpoint is an endpoint shown on the landing page with the URLs to reach it at
+type LandingEndpoint struct {
+	Endpoint  string
+	HookURL   string
+	SocketURL string
+	SSEURL    string
+	// Whether hooks have to be signed, in which case the example is rejected
+	Verified bool
+	// Who is responsible for the endpoint, if known
+	Ownership *EndpointOwnership
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sockethook</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 60em; }
+.endpoint { border: 1px solid #ccc; border-radius: 4px; margin-bottom: 1em; padding: 0 1em; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+th { text-align: left; padding-right: 1em; }
+#playground label { display: block; margin-top: 0.5em; }
+#playground textarea { width: 100%; font-family: monospace; }
+#playground-log { max-height: 30em; }
+.delivered { color: #080; }
+</style>
+</head>
+<body>
+<h1>Sockethook</h1>
+<table>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Connected clients</th><td>{{.Clients}}</td></tr>
+<tr><th>Status</th><td>{{if .Maintenance}}In maintenance{{else}}Accepting hooks{{end}}</td></tr>
+</table>
+<p>Hooks sent to an endpoint are relayed to the websocket and event stream clients listening on it.{{if .Auth}} Clients have to present a token, replace &lt;token&gt; below with yours.{{end}}</p>
+{{range .Endpoints}}
+<div class="endpoint">
+<h2>{{.Endpoint}}</h2>
+{{with .Ownership}}{{if .Description}}<p>{{.Description}}</p>{{end}}{{if or .Owner .Contact}}<p><small>Owned by {{if .Owner}}{{.Owner}}{{else}}unknown{{end}}{{if .Contact}}, contact {{.Contact}}{{end}}</small></p>{{end}}{{end}}
+<p>Send a hook:{{if .Verified}} <small>(hooks to this endpoint have to be signed, so this one is rejected)</small>{{end}}</p>
+<pre>curl -X POST {{.HookURL}} -H 'Content-Type: application/json' -d '{"hello": "world"}'</pre>
+<p>Listen with a websocket:</p>
+<pre>wscat -c {{.SocketURL}}{{if $.Auth}} -H 'Authorization: Bearer &lt;token&gt;'{{end}}</pre>
+<p>Or as server-sent events:</p>
+<pre>curl -N {{.SSEURL}}{{if $.Auth}} -H 'Authorization: Bearer &lt;token&gt;'{{end}}</pre>
+</div>
+{{end}}
+<div id="playground" class="endpoint" data-hook="{{.HookBase}}" data-socket="{{.SocketBase}}">
+<h2>Playground</h2>
+<p>Listen on an endpoint and send test hooks to it, to watch them being delivered.</p>
+<label>Endpoint <input id="playground-endpoint" list="playground-endpoints" value="{{with index .Endpoints 0}}{{.Endpoint}}{{end}}" size="40"></label>
+<datalist id="playground-endpoints">{{range .Endpoints}}<option value="{{.Endpoint}}">{{end}}</datalist>
+{{if .Auth}}<label>Token <input id="playground-token" type="password" size="40"></label>{{end}}
+<button id="playground-connect" type="button">Connect</button>
+<label>Headers <textarea id="playground-headers" rows="3">Content-Type: application/json</textarea></label>
+<label>Body <textarea id="playground-body" rows="6">{"hello": "world"}</textarea></label>
+<button id="playground-send" type="button">Send hook</button>
+<pre id="playground-log"></pre>
+</div>
+<script>
+(function() {
+  var pane = document.getElementById("playground");
+  var logView = document.getElementById("playground-log");
+  var socket = null;
+  // Hooks sent from the playground by tag, to tell when they're delivered
+  var sent = {};
+
+  function field(id) {
+    var element = document.getElementById(id);
+    return element ? element.value : "";
+  }
+
+  function write(line, className) {
+    var entry = document.createElement("div");
+    entry.textContent = new Date().toISOString().substr(11, 12) + " " + line;
+    if (className) {
+      entry.className = className;
+    }
+    logView.insertBefore(entry, logView.firstChild);
+  }
+
+  document.getElementById("playground-connect").onclick = function() {
+    if (socket) {
+      socket.close();
+    }
+    var url = pane.dataset.socket + field("playground-endpoint");
+    if (field("playground-token")) {
+      url += "?token=" + encodeURIComponent(field("playground-token"));
+    }
+    socket = new WebSocket(url);
+    socket.onopen = function() { write("Connected to " + url); };
+    socket.onclose = function(event) { write("Disconnected (" + event.code + ")"); };
+    socket.onmessage = function(event) {
+      var frame;
+      try {
+        frame = JSON.parse(event.data);
+      } catch (e) {
+        write("Received " + event.data);
+        return;
+      }
+      var tag = frame.headers && frame.headers["X-Sockethook-Playground"];
+      if (tag && sent[tag]) {
+        write("Delivered " + frame.id + " after " + Math.round(performance.now() - sent[tag]) + "ms", "delivered");
+        delete sent[tag];
+      }
+      write("Received " + JSON.stringify(frame, null, 2));
+    };
+  };
+
+  document.getElementById("playground-send").onclick = function() {
+    var headers = {};
+    field("playground-headers").split("\n").forEach(function(line) {
+      var colon = line.indexOf(":");
+      if (colon > 0) {
+        headers[line.substr(0, colon).trim()] = line.substr(colon + 1).trim();
+      }
+    });
+    var tag = Math.random().toString(36).substr(2);
+    headers["X-Sockethook-Playground"] = tag;
+    sent[tag] = performance.now();
+
+    var url = pane.dataset.hook + field("playground-endpoint");
+    fetch(url, {method: "POST", headers: headers, body: field("playground-body")}).then(function(response) {
+      write("Sent hook to " + url + ", answered " + response.status);
+    }, function(err) {
+      write("Failed to send hook to " + url + ": " + err);
+    });
+  };
+})();
+</script>
+</body>
+</html>
+`))
+
+// handleLanding serves the landing page, with examples for the configured endpoints of the request's namespace
+func handleLanding(w http.ResponseWriter, r *http.Request, namespace string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(405)
+		return
+	}
+
+	status := adminStatus()
+	page := LandingPage{
+		Version:     status.Version,
+		Uptime:      time.Duration(status.UptimeSeconds * float64(time.Second)).Round(time.Second).String(),
+		Clients:     status.Clients,
+		Maintenance: status.Maintenance,
+		Auth:        socketAuthEnabled(),
+	}
+
+	var sseBase string
+	page.HookBase, page.SocketBase, sseBase = publicURLs(r)
+	for _, endpoint := range landingEndpoints(namespace) {
+		page.Endpoints = append(page.Endpoints, LandingEndpoint{
+			Endpoint:  endpoint,
+			HookURL:   page.HookBase + endpoint,
+			SocketURL: page.SocketBase + endpoint,
+			SSEURL:    sseBase + endpoint,
+			Verified:  len(verifiersFor(namespace+endpoint)) > 0,
+			Ownership: ownershipOf(namespace + endpoint),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	landingTemplate.Execute(w, page)
+}
+
+// publicURLs returns the base URLs hooks, websockets and event streams are reached at, as seen by a request
+func publicURLs(r *http.Request) (string, string, string) {
+	scheme, host := "http", r.Host
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	hookHost := host
+	if landingHookPort != 0 {
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		hookHost = net.JoinHostPort(hostname, strconv.Itoa(landingHookPort))
+	}
+	socketScheme := "ws"
+	if scheme == "https" {
+		socketScheme = "wss"
+	}
+	return scheme + "://" + hookHost + basePath + "/hook", socketScheme + "://" + host + basePath + "/socket", scheme + "://" + host + basePath + "/sse"
+}
+
+// landingEndpoints returns the endpoints of a namespace which are declared, including those of the configuration
+// file, or have signature verification, without the namespace and sorted. Patterns are left out as they can't be sent to.
+func landingEndpoints(namespace string) []string {
+	seen := make(map[string]bool)
+	add := func(endpoint string) {
+		// Temporary endpoints are only known to whoever created them
+		if isPattern(endpoint) || !strings.HasPrefix(endpoint, namespace+"/") || temporaryOf(endpoint) != nil {
+			return
+		}
+		seen[strings.TrimPrefix(endpoint, namespace)] = true
+	}
+
+	for _, endpoint := range declaredEndpoints() {
+		add(endpoint)
+	}
+	for endpoint := range endpointVerifiers {
+		add(endpoint)
+	}
+
+	endpoints := make([]string, 0, len(seen))
+	for endpoint := range seen {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	if len(endpoints) == 0 {
+		endpoints = append(endpoints, landingExampleEndpoint)
+	}
+	return endpoints
+}
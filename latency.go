@@ -0,0 +1,89 @@
+package sockethook
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LatencyBudget limits how long after receipt a message may still be delivered
+type LatencyBudget struct {
+	mu sync.Mutex
+
+	// Budget for endpoints without their own, 0 means unlimited
+	fallback time.Duration
+	// Budgets for specific endpoints
+	endpoints map[string]time.Duration
+	// Drop late deliveries instead of only counting and logging them
+	drop bool
+	// Number of late deliveries per endpoint
+	late map[string]int
+}
+
+// newLatencyBudget parses budgets of the form "500ms" (all endpoints) or "/endpoint=500ms"
+func newLatencyBudget(rules []string, drop bool) (*LatencyBudget, error) {
+	b := &LatencyBudget{
+		endpoints: make(map[string]time.Duration),
+		drop:      drop,
+		late:      make(map[string]int),
+	}
+
+	for _, rule := range rules {
+		endpoint := ""
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid latency budget %q, expected /endpoint=duration", rule)
+			}
+			endpoint, rule = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+
+		budget, err := time.ParseDuration(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency budget %q: %v", rule, err)
+		}
+
+		if endpoint == "" {
+			b.fallback = budget
+		} else {
+			b.endpoints[endpoint] = budget
+		}
+	}
+
+	return b, nil
+}
+
+// Allow checks if a message received at the given time is still within its endpoint's budget.
+// Late deliveries are counted and logged, and only allowed if dropping is disabled.
+func (b *LatencyBudget) Allow(endpoint string, received time.Time) bool {
+	budget, ok := b.endpoints[endpoint]
+	if !ok {
+		budget = b.fallback
+	}
+	if budget <= 0 || received.IsZero() {
+		return true
+	}
+
+	elapsed := time.Since(received)
+	if elapsed <= budget {
+		return true
+	}
+
+	b.mu.Lock()
+	b.late[endpoint]++
+	late := b.late[endpoint]
+	b.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"endpoint": endpoint,
+		"elapsed":  elapsed,
+		"budget":   budget,
+		"late":     late,
+		"dropped":  b.drop,
+	}).Warnln("Delivery exceeded latency budget")
+
+	return !b.drop
+}
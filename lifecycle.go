@@ -0,0 +1,288 @@
+package sockethook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhooks server events are POSTed to, so that external systems can react to the relay's state changing
+var lifecycleWebhooks []*lifecycleWebhook
+
+// Secret lifecycle notifications are signed with, empty to not sign them
+var lifecycleSecret string
+
+// Number of notifications waiting to be sent per webhook before new ones are dropped
+var lifecycleQueueSize = 256
+
+// Number of retries of notifications which failed and the backoff before the first one, doubling every time
+var lifecycleRetries = 3
+var lifecycleBackoff = time.Second
+
+// How long after a quota_exceeded event the same quota of the same endpoint isn't reported again
+var quotaCooldown = time.Minute
+
+// Number of failed deliveries to clients of an endpoint within the window after which a delivery_failures event
+// is published, at most once per window. 0 to disable.
+var deliveryFailureThreshold = 50
+var deliveryFailureWindow = time.Minute
+
+// Quotas reported by quota_exceeded events
+const (
+	quotaRateLimit  = "rate_limit"
+	quotaMaxClients = "max_clients"
+)
+
+// LifecycleWebhookConfig is a webhook in the lifecycle_webhooks section of the configuration file
+type LifecycleWebhookConfig struct {
+	URL string `yaml:"url"`
+	// Types of events sent to the webhook, all if empty
+	Events []string `yaml:"events"`
+}
+
+// lifecycleWebhook sends the server events it's interested in to a URL from a queue of its own, in order, so that
+// a slow or unreachable webhook holds up neither the relay nor other webhooks
+type lifecycleWebhook struct {
+	target string
+	// Types of events sent, all if empty
+	events map[string]bool
+	client *http.Client
+	queue  chan lifecycleNotification
+	// Notifications queued or being sent, accessed atomically
+	pending int64
+}
+
+// lifecycleNotification is an event waiting to be sent to a webhook
+type lifecycleNotification struct {
+	id    string
+	event Event
+	body  []byte
+}
+
+// parseLifecycleWebhooks parses webhooks of the form URL or type,type=URL, the latter only receiving events of
+// the types listed
+func parseLifecycleWebhooks(rules []string) ([]*lifecycleWebhook, error) {
+	webhooks := []*lifecycleWebhook{}
+	for _, rule := range rules {
+		target, events := rule, map[string]bool{}
+		if i := strings.Index(rule, "="); i > 0 && !strings.Contains(rule[:i], ":") {
+			target = rule[i+1:]
+			for _, event := range strings.Split(rule[:i], ",") {
+				if event = strings.TrimSpace(event); event != "" {
+					events[event] = true
+				}
+			}
+		}
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid lifecycle webhook %q, expected URL or event,event=URL", rule)
+		}
+		webhooks = append(webhooks, &lifecycleWebhook{
+			target: target,
+			events: events,
+			client: &http.Client{Timeout: forwardTimeout},
+			queue:  make(chan lifecycleNotification, lifecycleQueueSize),
+		})
+	}
+	return webhooks, nil
+}
+
+// startLifecycleWebhooks starts sending server events to webhooks
+func startLifecycleWebhooks(webhooks []*lifecycleWebhook) {
+	lifecycleWebhooks = webhooks
+	for _, webhook := range webhooks {
+		go webhook.run()
+	}
+}
+
+// notifyLifecycle queues a server event for every webhook interested in it, dropping it for webhooks which
+// can't keep up
+func notifyLifecycle(event Event) {
+	if len(lifecycleWebhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithField("type", event.Type).Errorln("Failed to encode lifecycle notification:", err)
+		return
+	}
+	notification := lifecycleNotification{id: idGenerator.NewID(), event: event, body: body}
+	for _, webhook := range lifecycleWebhooks {
+		if len(webhook.events) > 0 && !webhook.events[event.Type] {
+			continue
+		}
+		atomic.AddInt64(&webhook.pending, 1)
+		select {
+		case webhook.queue <- notification:
+		default:
+			atomic.AddInt64(&webhook.pending, -1)
+			metrics.lifecycleNotifications.Inc("dropped")
+			log.WithField("webhook", webhook.target).WithField("type", event.Type).Warnln("Lifecycle webhook queue full, dropping notification")
+		}
+	}
+}
+
+// run sends queued notifications, retrying failed ones with exponential backoff. Failures aren't published as
+// events themselves, so that an unreachable webhook can't cause a flood of notifications.
+func (l *lifecycleWebhook) run() {
+	for notification := range l.queue {
+		logEntry := log.WithFields(log.Fields{"webhook": l.target, "type": notification.event.Type, "id": notification.id})
+		backoff := lifecycleBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := l.send(notification)
+			if err == nil {
+				metrics.lifecycleNotifications.Inc("success")
+				logEntry.WithField("attempt", attempt).Debugln("Lifecycle notification sent")
+				break
+			}
+			if !retry || attempt > lifecycleRetries {
+				metrics.lifecycleNotifications.Inc("failure")
+				logEntry.WithField("attempts", attempt).Warnln("Sending lifecycle notification failed:", err)
+				break
+			}
+
+			metrics.lifecycleNotifications.Inc("retry")
+			logEntry.WithField("attempt", attempt).WithField("backoff", backoff).Infoln("Sending lifecycle notification failed, retrying:", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		atomic.AddInt64(&l.pending, -1)
+	}
+}
+
+// flushLifecycleWebhooks waits for the notifications queued for every webhook to be sent, or given up on, until
+// the timeout has passed
+func flushLifecycleWebhooks(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, webhook := range lifecycleWebhooks {
+		for atomic.LoadInt64(&webhook.pending) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if remaining := atomic.LoadInt64(&webhook.pending); remaining > 0 {
+			log.WithField("webhook", webhook.target).WithField("notifications", remaining).Warnln("Lifecycle notifications still unsent at shutdown")
+		}
+	}
+}
+
+// send POSTs a notification once, returning whether a failure is worth retrying, like forwarded hooks
+func (l *lifecycleWebhook) send(notification lifecycleNotification) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, l.target, bytes.NewReader(notification.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sockethook-Event", notification.event.Type)
+	// Retries carry the same ID, so that receivers can skip notifications they already handled
+	req.Header.Set("X-Sockethook-Delivery", notification.id)
+	req.Header.Set("X-Sockethook-Instance", instanceID)
+	if lifecycleSecret != "" {
+		mac := hmac.New(sha256.New, []byte(lifecycleSecret))
+		mac.Write(notification.body)
+		req.Header.Set("X-Sockethook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// Times at which quotas were last reported exceeded, per endpoint and quota
+var quotaReports = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// quotaExceeded publishes a quota_exceeded event for an endpoint, unless the same quota was reported within the
+// cooldown
+func quotaExceeded(endpoint string, quota string, details map[string]interface{}) {
+	key := quota + " " + endpoint
+	now := time.Now()
+	quotaReports.Lock()
+	if last, ok := quotaReports.last[key]; ok && now.Sub(last) < quotaCooldown {
+		quotaReports.Unlock()
+		return
+	}
+	quotaReports.last[key] = now
+	// Reports older than the cooldown no longer suppress anything
+	for k, last := range quotaReports.last {
+		if now.Sub(last) >= quotaCooldown {
+			delete(quotaReports.last, k)
+		}
+	}
+	quotaReports.Unlock()
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["endpoint"] = endpoint
+	details["quota"] = quota
+	publishEvent("quota_exceeded", details)
+}
+
+// Failed deliveries to clients per endpoint in the current window
+var deliveryFailures = struct {
+	sync.Mutex
+	endpoints map[string]*failureWindow
+}{endpoints: make(map[string]*failureWindow)}
+
+type failureWindow struct {
+	start    time.Time
+	failures int
+	reported bool
+}
+
+// observeDeliveryFailure counts a message which couldn't be delivered to a client of an endpoint, publishing a
+// delivery_failures event once the failures within the window reach the threshold
+func observeDeliveryFailure(endpoint string) {
+	if deliveryFailureThreshold <= 0 || isReserved(endpoint) {
+		return
+	}
+	now := time.Now()
+	deliveryFailures.Lock()
+	w, ok := deliveryFailures.endpoints[endpoint]
+	if !ok || now.Sub(w.start) >= deliveryFailureWindow {
+		// Windows of other endpoints which have ended are dropped along with this one's
+		for e, other := range deliveryFailures.endpoints {
+			if now.Sub(other.start) >= deliveryFailureWindow {
+				delete(deliveryFailures.endpoints, e)
+			}
+		}
+		w = &failureWindow{start: now}
+		deliveryFailures.endpoints[endpoint] = w
+	}
+	w.failures++
+	report := w.failures >= deliveryFailureThreshold && !w.reported
+	if report {
+		w.reported = true
+	}
+	deliveryFailures.Unlock()
+
+	if report {
+		log.WithField("endpoint", endpoint).WithField("window", deliveryFailureWindow).Warnln("Delivery failures above threshold")
+		publishEvent("delivery_failures", map[string]interface{}{
+			"endpoint":  endpoint,
+			"threshold": deliveryFailureThreshold,
+			"window":    deliveryFailureWindow.String(),
+		})
+	}
+}
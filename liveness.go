@@ -0,0 +1,111 @@
+package sockethook
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveness holds the times, as Unix nanoseconds, at which a client was last heard from and written to, and an
+// estimate of its round trip time. Fields are accessed atomically.
+type liveness struct {
+	lastPing     int64
+	lastPong     int64
+	lastFrame    int64
+	lastDelivery int64
+	// Moving average of the time between sending a ping and receiving its pong, in nanoseconds
+	rtt int64
+}
+
+// ClientLiveness reports how recently a client was heard from and written to, for debugging consumers which
+// don't seem to receive anything
+type ClientLiveness struct {
+	ID            string   `json:"id"`
+	Endpoint      string   `json:"endpoint"`
+	Subscriptions []string `json:"subscriptions"`
+	Transport     string   `json:"transport"`
+	RemoteAddr    string   `json:"remote_addr"`
+	// Fingerprint of the token the client authenticated with, which it can be blocked by
+	TokenFingerprint string `json:"token_fingerprint,omitempty"`
+	ConnectedAt      string `json:"connected_at"`
+	LastPing         string `json:"last_ping,omitempty"`
+	LastPong         string `json:"last_pong,omitempty"`
+	LastFrame        string `json:"last_frame,omitempty"`
+	LastDelivery     string `json:"last_delivery,omitempty"`
+	// Round trip time estimated from pings, in milliseconds, if a pong was received
+	RTTMs *float64 `json:"rtt_ms,omitempty"`
+	// Number of frames waiting in the client's buffer
+	Buffered int `json:"buffered"`
+	// Labels the client connected with
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// pinged records that a ping was sent to the client
+func (l *liveness) pinged(now time.Time) {
+	atomic.StoreInt64(&l.lastPing, now.UnixNano())
+}
+
+// ponged records a pong from the client, updating the round trip time from the last ping
+func (l *liveness) ponged(now time.Time) {
+	atomic.StoreInt64(&l.lastPong, now.UnixNano())
+	ping := atomic.LoadInt64(&l.lastPing)
+	if ping == 0 {
+		return
+	}
+	sample := now.UnixNano() - ping
+	if rtt := atomic.LoadInt64(&l.rtt); rtt > 0 {
+		sample = (rtt*7 + sample) / 8
+	}
+	atomic.StoreInt64(&l.rtt, sample)
+}
+
+// received records a frame sent by the client
+func (l *liveness) received(now time.Time) {
+	atomic.StoreInt64(&l.lastFrame, now.UnixNano())
+}
+
+// delivered records a message written to the client
+func (l *liveness) delivered(now time.Time) {
+	atomic.StoreInt64(&l.lastDelivery, now.UnixNano())
+}
+
+// report returns the liveness of a client, must be called with hub.mu held
+func (c *client) report() ClientLiveness {
+	report := ClientLiveness{
+		ID:               c.id,
+		Endpoint:         c.endpoint,
+		Subscriptions:    []string{},
+		Transport:        "sse",
+		RemoteAddr:       c.conn.RemoteAddr().String(),
+		TokenFingerprint: tokenFingerprint(c.token),
+		ConnectedAt:      c.connected.UTC().Format(time.RFC3339Nano),
+		LastPing:         formatNanos(atomic.LoadInt64(&c.liveness.lastPing)),
+		LastPong:         formatNanos(atomic.LoadInt64(&c.liveness.lastPong)),
+		LastFrame:        formatNanos(atomic.LoadInt64(&c.liveness.lastFrame)),
+		LastDelivery:     formatNanos(atomic.LoadInt64(&c.liveness.lastDelivery)),
+		Buffered:         len(c.send),
+		Labels:           c.labels,
+	}
+	if _, ok := c.conn.(*websocket.Conn); ok {
+		report.Transport = "websocket"
+	}
+	for subscription := range c.subscriptions {
+		report.Subscriptions = append(report.Subscriptions, subscription)
+	}
+	sort.Strings(report.Subscriptions)
+	if rtt := atomic.LoadInt64(&c.liveness.rtt); rtt > 0 {
+		ms := float64(rtt) / float64(time.Millisecond)
+		report.RTTMs = &ms
+	}
+	return report
+}
+
+// formatNanos formats Unix nanoseconds in RFC3339, returning an empty string for 0
+func formatNanos(nanos int64) string {
+	if nanos == 0 {
+		return ""
+	}
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,154 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoggingSettings control which log entries are written, changeable at runtime through /logging
+type LoggingSettings struct {
+	// Minimum level of entries written, e.g. "info" or "debug"
+	Level string `json:"level"`
+	// Endpoints or patterns whose entries are written down to the debug level, regardless of the level
+	DebugEndpoints []string `json:"debug_endpoints"`
+	// Fraction of info and debug entries written, warnings and errors are always written
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// Current logging settings and those given on startup, which DELETE /logging restores
+var logging = struct {
+	sync.RWMutex
+	settings LoggingSettings
+	level    log.Level
+	initial  LoggingSettings
+}{}
+
+// logFilter drops the entries which the logging settings exclude before they're formatted by the wrapped
+// formatter. Entries are filtered here rather than by the logger's level, so that debug entries of single
+// endpoints get through.
+type logFilter struct {
+	log.Formatter
+}
+
+// Format returns nothing for entries which are excluded, which the logger then writes as nothing
+func (f logFilter) Format(entry *log.Entry) ([]byte, error) {
+	logging.RLock()
+	level, settings := logging.level, logging.settings
+	logging.RUnlock()
+
+	if entry.Level > level {
+		endpoint, _ := entry.Data["endpoint"].(string)
+		if endpoint == "" || !debugEndpoint(settings.DebugEndpoints, endpoint) {
+			return nil, nil
+		}
+	}
+	if entry.Level >= log.InfoLevel && settings.SampleRate < 1 && rand.Float64() >= settings.SampleRate {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// debugEndpoint checks if an endpoint is one of the debugged endpoints or matched by one of their patterns
+func debugEndpoint(debugEndpoints []string, endpoint string) bool {
+	for _, debug := range debugEndpoints {
+		if debug == endpoint || (isPattern(debug) && patternCovers(debug, endpoint)) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupLogging installs the log filter with the settings given on startup
+func setupLogging(settings LoggingSettings) error {
+	if err := setLogging(settings); err != nil {
+		return err
+	}
+	logging.Lock()
+	logging.initial = logging.settings
+	logging.Unlock()
+	log.SetFormatter(logFilter{log.StandardLogger().Formatter})
+	return nil
+}
+
+// setLogging validates and applies logging settings
+func setLogging(settings LoggingSettings) error {
+	level, err := log.ParseLevel(settings.Level)
+	if err != nil {
+		return err
+	}
+	if settings.SampleRate < 0 || settings.SampleRate > 1 {
+		return fmt.Errorf("invalid sample rate %v, expected a fraction between 0 and 1", settings.SampleRate)
+	}
+	debugEndpoints := []string{}
+	for _, endpoint := range settings.DebugEndpoints {
+		if !strings.HasPrefix(endpoint, "/") || !validPattern(endpoint) {
+			return fmt.Errorf("invalid debug endpoint %q", endpoint)
+		}
+		debugEndpoints = append(debugEndpoints, strings.TrimRight(endpoint, "/"))
+	}
+	settings.DebugEndpoints = debugEndpoints
+
+	logging.Lock()
+	logging.settings, logging.level = settings, level
+	logging.Unlock()
+
+	// Debug entries are only created by the logger when it's at the debug level
+	if len(debugEndpoints) > 0 && level < log.DebugLevel {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(level)
+	}
+	return nil
+}
+
+// handleLogging shows (GET), changes (POST/PUT) or restores the startup settings of (DELETE) logging. Fields
+// left out of changes keep their current value.
+func handleLogging(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		logging.RLock()
+		settings := logging.settings
+		logging.RUnlock()
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := setLogging(settings); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.WithFields(log.Fields{
+			"level":           settings.Level,
+			"debug_endpoints": strings.Join(settings.DebugEndpoints, ","),
+			"sample_rate":     settings.SampleRate,
+		}).Warnln("Logging settings changed")
+	case "DELETE":
+		logging.RLock()
+		initial := logging.initial
+		logging.RUnlock()
+		setLogging(initial)
+		log.Warnln("Logging settings restored")
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	logging.RLock()
+	defer logging.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logging.settings)
+}
@@ -1,114 +1,1626 @@
-package main
+package sockethook
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// Map holding all Websocket clients and the endpoints they are subscribed to
-var clients = make(map[string][]*websocket.Conn)
-var upgrader = websocket.Upgrader{}
+// Version of Sockethook, set at build time with -ldflags "-X github.com/corollari/sockethook.version=..."
+var version = "dev"
+
+// Origins are checked per endpoint when admitting clients, see originAllowed
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }, Error: upgradeError}
+
+// Enricher adding configured metadata to messages before broadcast
+var enricher = &Enricher{}
+
+// Redactor masking sensitive values in messages before broadcast
+var redactor = &Redactor{}
+
+// Per-endpoint limits on how late messages may be delivered
+var latencyBudget = &LatencyBudget{}
+
+// Extra headers set on hook responses
+var responseHeaders = &ResponseHeaders{}
+
+// Inspector capturing full requests sent to flagged endpoints
+var inspector = newInspector(nil, 0)
+
+// Detector for traffic anomalies, nil if disabled
+var alertDetector *AlertDetector
+
+// Path prefix under which all routes are served, e.g. /sockethook
+var basePath string
+
+// Endpoints under this prefix are reserved for messages generated by Sockethook itself
+const reservedPrefix = "/sockethook"
+
+// Generator for message IDs
+var idGenerator IDGenerator = &uuidV7Generator{}
 
 // Message which will be sent as JSON to Websocket clients
 type Message struct {
-	Headers  map[string]string `json:"headers"`
-	Endpoint string            `json:"endpoint"`
-	Data     interface{}       `json:"data"`
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// Position of the message on its endpoint, increasing by one for every message
+	Seq      uint64                 `json:"seq"`
+	Headers  map[string]string      `json:"headers"`
+	Endpoint string                 `json:"endpoint"`
+	Data     interface{}            `json:"data"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Time at which the server received the message, in RFC3339 with nanoseconds
+	ReceivedAt string `json:"received_at"`
+	// Hex encoded SHA-256 of the original request body, before any redaction
+	BodySHA256 string `json:"body_sha256,omitempty"`
+	// Delivery attempt when a message which must be acknowledged is sent again, starting at 2
+	Attempt int `json:"attempt,omitempty"`
+	// Method, query parameters, remote IP and all values of the headers of the hook, only written to clients
+	// using version 2 of the schema
+	Method       string              `json:"method,omitempty"`
+	Query        map[string][]string `json:"query,omitempty"`
+	RemoteAddr   string              `json:"remote_addr,omitempty"`
+	HeaderValues map[string][]string `json:"header_values,omitempty"`
+	// Content type of the hook and, if its body isn't JSON, how it's encoded in data
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	// ID of the client which published the message, for messages published by clients rather than hooks
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Number of messages dropped in favor of this one by a debounced or throttled endpoint
+	Collapsed int `json:"collapsed,omitempty"`
+	// Retry metadata sent by the provider of the hook, if any
+	Delivery *DeliveryInfo `json:"delivery,omitempty"`
+	// Outcome of signature verification, for hooks to endpoints which verify signatures
+	Verification *Verification `json:"verification,omitempty"`
+	// Number of messages with the same payload suppressed before this one, which is the last of them
+	Repeats int `json:"repeats,omitempty"`
+
+	// Time at which the message was received, used to enforce latency budgets
+	received time.Time
+	// Size of the message as JSON, counted towards egress bytes
+	size int
+	// Whether the message summarizes an aggregation window, rather than being aggregated itself
+	summary bool
+	// Whether the message was released by a debounced or throttled endpoint, rather than being held back
+	paced bool
+	// Whether the message was released once its endpoint's delivery window opened, rather than being held back
+	windowed bool
+	// Whether the message was imported into the history log, which it isn't logged to again when broadcasted
+	imported bool
+	// Whether the message reports suppressed duplicates, rather than being checked for being one
+	repeat bool
+	// Client which published the message, which it isn't delivered back to
+	publisher *client
+	// Priority of the message in its endpoint's queue
+	priority priority
+	// Whether the message was forwarded by another instance to this one as the owner of its endpoint, and whether
+	// it's published to the broker once numbered, as its endpoint is owned by this instance
+	forwarded       bool
+	publishNumbered bool
 }
 
-func handleHook(w http.ResponseWriter, r *http.Request, endpoint string) {
-	msg := Message{}
+func handleHook(w http.ResponseWriter, r *http.Request, namespace string, endpoint string) {
+	endpoint = namespace + endpoint
+	atomic.AddInt64(&hooksInFlight, 1)
+	defer atomic.AddInt64(&hooksInFlight, -1)
+
+	received := time.Now()
 	logEntry := log.WithField("endpoint", endpoint)
+	// Every stage of handling gives up once the publisher disconnects or shutdown times out
+	ctx, cancel := hookContext(r)
+	defer cancel()
+	access := accessFor(r)
+	access.record(accessHook, endpoint, "")
+	responseHeaders.Apply(w, endpoint)
 
-	// Transfer headers to response
-	msg.Headers = make(map[string]string)
-	for k, v := range r.Header {
-		msg.Headers[k] = v[0]
+	if isDraining() {
+		logEntry.Warnln("Rejected hook, shutting down")
+		w.Header().Set("Retry-After", retryAfter())
+		w.WriteHeader(503)
+		return
+	}
+	if isStandby() {
+		logEntry.Warnln("Rejected hook, running as standby")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "this instance is a standby, hooks are accepted by the active instance", 503)
+		return
+	}
+	if readReplica {
+		logEntry.Warnln("Rejected hook, running as a read replica")
+		http.Error(w, "hooks are only accepted by writer instances", 421)
+		return
+	}
+	if active, retry := inMaintenance(); active {
+		logEntry.Warnln("Rejected hook, in maintenance mode")
+		w.Header().Set("Retry-After", retry)
+		w.WriteHeader(503)
+		return
 	}
 
-	// Set endpoint on response
-	msg.Endpoint = endpoint
+	if isReserved(endpoint) {
+		logEntry.Warnln("Rejected hook to reserved endpoint")
+		w.WriteHeader(403)
+		return
+	}
+	if isPattern(endpoint) {
+		logEntry.Warnln("Rejected hook to pattern endpoint")
+		w.WriteHeader(400)
+		return
+	}
+	if temporaryExpired(endpoint) {
+		logEntry.Warnln("Rejected hook to expired temporary endpoint")
+		http.Error(w, "endpoint has expired", 410)
+		return
+	}
+	if !declared(endpoint) {
+		if captureHook(w, r, endpoint, received, logEntry) {
+			return
+		}
+		logEntry.Warnln("Rejected hook to undeclared endpoint")
+		w.WriteHeader(404)
+		return
+	}
+	if archiveOf(endpoint) != nil {
+		logEntry.Warnln("Rejected hook to archived endpoint")
+		http.Error(w, "endpoint is archived", 410)
+		return
+	}
+	if ok, wait := allowHook(endpoint, remoteIP(r)); !ok {
+		logEntry.WithField("ip", remoteIP(r)).Warnln("Rejected hook, rate limit exceeded")
+		quotaExceeded(endpoint, quotaRateLimit, map[string]interface{}{"ip": remoteIP(r)})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(429)
+		return
+	}
+	alertDetector.Observe(endpoint)
+
+	if shedding(shedRejectHooks) {
+		logEntry.Warnln("Rejected hook, memory limit exceeded")
+		w.Header().Set("Retry-After", retryAfter())
+		w.WriteHeader(429)
+		return
+	}
+
+	// Limit the number of hooks handled concurrently
+	if !acquireHookSlot(ctx) {
+		if abandoned(ctx, "queue", logEntry) {
+			return
+		}
+		logEntry.WithField("queued", atomic.LoadInt64(&hooksQueued)).Warnln("Rejected hook, too many in flight")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(503)
+		return
+	}
+	defer releaseHookSlot()
+
+	msg := hookMessage(r, endpoint, received)
+	access.record(accessHook, endpoint, msg.ID)
 
 	// Read body of request
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
+	buf, ok, err := readBody(r)
+	if abandoned(ctx, "body", logEntry) {
+		return
+	}
+	if err != nil {
+		// A partial body is never broadcasted
+		metrics.abandonedHooks.Inc("body")
+		logEntry.Warnln("Abandoned hook, failed to read body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if !ok {
+		logEntry.WithField("max", maxBodySize).Warnln("Rejected hook, body too large")
+		w.WriteHeader(413)
+		return
+	}
+	observeHook(r, namespace, endpoint, buf.Len())
+	exportEvent(otlpSeverityInfo, "hook.received", "Hook received", map[string]interface{}{
+		"endpoint":       endpoint,
+		"message.id":     msg.ID,
+		"size":           buf.Len(),
+		"client.address": r.RemoteAddr,
+	})
+
+	// Provider verification requests are answered directly instead of being broadcasted
+	if answerHandshake(w, r, endpoint, buf.Bytes()) {
+		return
+	}
+
+	// Reject hooks which weren't signed with the endpoint's secret, unless the endpoint accepts unverified ones
+	verification, ok := verifySignature(r, endpoint, buf.Bytes())
+	if !ok {
+		if quarantineHook(r, endpoint, msg.ID, buf.Bytes(), received, "invalid signature") {
+			logEntry.WithField("id", msg.ID).Warnln("Rejected hook, invalid signature, quarantined for review")
+		} else {
+			logEntry.Warnln("Rejected hook, invalid signature")
+		}
+		alertDetector.ObserveAuthFailure(endpoint)
+		w.WriteHeader(401)
+		return
+	}
+	if verification != nil && !verification.Verified {
+		logEntry.Infoln("Accepted hook with invalid signature as unverified")
+	}
+	msg.Verification = verification
+	stripSecretHeaders(&msg)
+
+	// Retries of deliveries which already reached a client may be answered without broadcasting them again
+	if msg.Delivery = deliveryInfo(r, buf.Bytes()); msg.Delivery != nil {
+		relayed := deliveries.Observe(endpoint, msg.Delivery)
+		if msg.Delivery.Retry {
+			metrics.retries.Inc(msg.Delivery.Provider)
+		}
+		if relayed && suppressRelayedRetries {
+			metrics.suppressedRetries.Inc(msg.Delivery.Provider)
+			logEntry.WithField("delivery", msg.Delivery.ID).Infoln("Suppressed retry of hook already delivered")
+			return
+		}
+	}
+
+	// Only broadcast hooks which the endpoint's validator accepts
+	if !validateHook(ctx, w, r, msg, buf.Bytes(), logEntry) {
+		return
+	}
+
+	if err := shapeMessage(&msg, r, buf.Bytes(), received); err != nil {
+		logEntry.Warnln("Failed to transform hook, broadcasting it as is:", err)
+	}
+
+	// Once broadcasted a hook is delivered and persisted even if its publisher goes away, so this is the last
+	// point at which it's dropped
+	if abandoned(ctx, "broadcast", logEntry) {
+		return
+	}
 
-	// If request is JSON, unmarshal and save to response. Otherwise just save as string.
-	if r.Header.Get("Content-Type") == "application/json" {
-		json.Unmarshal(buf.Bytes(), &msg.Data)
+	// Register for a client response before broadcasting so that fast responses aren't missed
+	var response chan HookResponse
+	if respondEndpoints[endpoint] {
+		response = expectResponse(msg.ID, endpoint)
+	}
+
+	forwardHook(r, msg, buf.Bytes())
+	publishToBus(msg)
+	count := hub.Broadcast(msg)
+	access.broadcast(buf.Len(), msg.BodySHA256, count)
+	if msg.Delivery != nil && count > 0 {
+		deliveries.Relayed(endpoint, msg.Delivery)
+	}
+	inspector.Record(endpoint, msg.ID, r, buf.Bytes(), received)
+
+	logEntry.WithFields(log.Fields{"clients": count, "id": msg.ID, "body_sha256": msg.BodySHA256}).Infoln("Hook broadcasted")
+
+	if response != nil {
+		writeHookResponse(ctx, w, msg.ID, response, logEntry)
+	}
+}
+
+// hookMessage builds the message of a hook from its request, with its headers and request metadata, a new ID and
+// the time it was received
+func hookMessage(r *http.Request, endpoint string, received time.Time) Message {
+	msg := Message{
+		Headers:      make(map[string]string),
+		HeaderValues: make(map[string][]string),
+		Method:       r.Method,
+		Query:        r.URL.Query(),
+		RemoteAddr:   remoteIP(r),
+		ID:           idGenerator.NewID(),
+		Endpoint:     endpoint,
+		ReceivedAt:   received.UTC().Format(time.RFC3339Nano),
+		received:     received,
+		priority:     hookPriority(r, endpoint),
+	}
+	for k, v := range r.Header {
+		msg.Headers[k] = v[0]
+		msg.HeaderValues[k] = append([]string{}, v...)
+	}
+	return msg
+}
+
+// shapeMessage sets the data of a hook's message from its body, then masks sensitive values, reshapes the data
+// and adds configured metadata. Returns why the endpoint's transform failed, in which case the data is left as
+// it was.
+func shapeMessage(msg *Message, r *http.Request, body []byte, received time.Time) error {
+	sum := sha256.Sum256(body)
+	msg.BodySHA256 = hex.EncodeToString(sum[:])
+
+	// If request is JSON, unmarshal and save to response. Otherwise save the raw body, which is encoded as base64.
+	msg.ContentType = r.Header.Get("Content-Type")
+	if msg.ContentType == "application/json" {
+		json.Unmarshal(body, &msg.Data)
 	} else {
-		msg.Data = buf.Bytes()
+		msg.Data = body
+		msg.Encoding = encodingBase64
 	}
 
-	// Get all clients listening to the current endpoint
-	conns := clients[endpoint]
+	redactor.Redact(msg)
+	var err error
+	if t := transformFor(msg.Endpoint); t != nil {
+		err = t.Transform(msg)
+	}
+	enricher.Enrich(msg, r, received)
+	return err
+}
 
-	if conns != nil {
-		for i, conn := range conns {
-			if conn.WriteJSON(msg) != nil {
-				// Remove client and close connection if sending failed
-				conns = append(conns[:i], conns[i+1:]...)
-				conn.Close()
+// writeHookResponse waits for a client to respond to a message and serves it as the hook response
+func writeHookResponse(ctx context.Context, w http.ResponseWriter, id string, response chan HookResponse, logEntry *log.Entry) {
+	select {
+	case resp := <-response:
+		for name, value := range resp.Headers {
+			if !hopHeaders[name] {
+				w.Header().Set(name, value)
 			}
 		}
+		if resp.Status == 0 {
+			resp.Status = 200
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+		logEntry.WithField("status", resp.Status).Infoln("Hook answered by client")
+	case <-time.After(respondTimeout):
+		cancelResponse(id)
+		logEntry.Warnln("No client responded to hook in time")
+		w.WriteHeader(504)
+	case <-ctx.Done():
+		cancelResponse(id)
+		abandoned(ctx, "response", logEntry)
 	}
+}
 
-	clients[endpoint] = conns
+// isReserved checks if an endpoint is reserved for messages generated by Sockethook
+func isReserved(endpoint string) bool {
+	return endpoint == reservedPrefix || strings.HasPrefix(endpoint, reservedPrefix+"/")
+}
 
-	logEntry.WithField("clients", len(conns)).Infoln("Hook broadcasted")
+// admitClient checks that a new client may connect to an endpoint and reserves a slot for it, rejecting it with
+// an error status and the reason otherwise. Returns the token the client authenticated with.
+func admitClient(w http.ResponseWriter, r *http.Request, endpoint string, logEntry *log.Entry) (string, bool) {
+	if !validPattern(endpoint) {
+		logEntry.Warnln("Rejected client, invalid pattern")
+		rejectClient(w, 400, "invalid_pattern", "invalid endpoint pattern")
+		return "", false
+	}
+
+	// Blocked clients are refused before anything else about them is checked
+	token := requestToken(r)
+	if entry, blocked := blockedClient(remoteIP(r), token); blocked {
+		logEntry.WithField("ip", remoteIP(r)).WithField("entry", entry.ID).Warnln("Rejected client, blocked")
+		rejectClient(w, 403, "blocked", "the client is blocked")
+		return "", false
+	}
+	if temporaryExpired(endpoint) {
+		logEntry.Warnln("Rejected client, temporary endpoint has expired")
+		rejectClient(w, 410, "endpoint_expired", "the temporary endpoint has expired")
+		return "", false
+	}
+
+	// Clients have to present a token granting access to the endpoint when tokens are configured
+	if !authorized(token, endpoint) {
+		alertDetector.ObserveAuthFailure(endpoint)
+		if token == "" {
+			logEntry.Warnln("Rejected client, missing token")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			rejectClient(w, 401, "missing_token", "a token is required, in an Authorization: Bearer header or the token query parameter")
+		} else {
+			logEntry.Warnln("Rejected client, token not valid for endpoint")
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			rejectClient(w, 403, "invalid_token", "the token doesn't grant access to the endpoint")
+		}
+		return "", false
+	}
+	if !originAllowed(r.Header.Get("Origin"), r.Host, endpoint) {
+		logEntry.WithField("origin", r.Header.Get("Origin")).Warnln("Rejected client, origin not allowed")
+		rejectClient(w, 403, "origin_not_allowed", "the origin isn't allowed to connect to the endpoint")
+		return "", false
+	}
+	if !declared(endpoint) {
+		logEntry.Warnln("Rejected client, endpoint isn't declared")
+		rejectClient(w, 403, "undeclared_endpoint", "the endpoint isn't declared")
+		return "", false
+	}
+	if archiveOf(endpoint) != nil {
+		logEntry.Warnln("Rejected client, endpoint is archived")
+		rejectClient(w, 410, "endpoint_archived", "the endpoint is archived and doesn't accept clients")
+		return "", false
+	}
+
+	if isDraining() {
+		logEntry.Warnln("Rejected client, shutting down")
+		w.Header().Set("Retry-After", retryAfter())
+		rejectClient(w, 503, "shutting_down", "the server is shutting down, reconnect after Retry-After")
+		return "", false
+	}
+	if isStandby() {
+		logEntry.Warnln("Rejected client, running as standby")
+		w.Header().Set("Retry-After", "1")
+		rejectClient(w, 503, "standby", "the server is a standby, connect to the active instance")
+		return "", false
+	}
+	if active, retry := inMaintenance(); active {
+		logEntry.Warnln("Rejected client, in maintenance mode")
+		w.Header().Set("Retry-After", retry)
+		rejectClient(w, 503, "maintenance", "the server is in maintenance mode, reconnect after Retry-After")
+		return "", false
+	}
+
+	if shedding(shedRejectClients) {
+		logEntry.Warnln("Rejected client, memory limit exceeded")
+		w.Header().Set("Retry-After", retryAfter())
+		rejectClient(w, 503, "overloaded", "the server is over its memory limit, reconnect after Retry-After")
+		return "", false
+	}
+
+	// Limit the rate of new connections while recovering from a restart
+	if !allowAccept() {
+		logEntry.Warnln("Rejected client, recovering from restart")
+		w.Header().Set("Retry-After", retryAfter())
+		rejectClient(w, 503, "recovering", "the server is recovering from a restart, reconnect after Retry-After")
+		return "", false
+	}
+
+	// Reserve a slot on the endpoint, possibly waiting for other clients to leave
+	if !acquireSlot(endpoint) {
+		logEntry.Warnln("Rejected client, endpoint is full")
+		quotaExceeded(endpoint, quotaMaxClients, map[string]interface{}{"max": maxClients})
+		w.Header().Set("Retry-After", "1")
+		rejectClient(w, 503, "endpoint_full", "the endpoint has as many clients as it allows, reconnect after Retry-After")
+		return "", false
+	}
+
+	return token, true
 }
 
-func handleClient(w http.ResponseWriter, r *http.Request, endpoint string) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// welcomeFrame returns the welcome frame of a newly connected client
+func welcomeFrame(c *client) WelcomeFrame {
+	welcome := WelcomeFrame{
+		Type:          frameWelcome,
+		ServerVersion: version,
+		ConnectionID:  c.id,
+		Endpoint:      c.endpoint,
+		Features: Features{
+			Format:      "json",
+			Compression: c.compressed,
+			TimeSync:    timeSyncEnabled,
+			Respond:     respondEndpoints[c.endpoint],
+			Replay:      replayBuffer.Enabled(c.endpoint),
+			Ack:         ackRequired(c.endpoint) && ackClient(c),
+			Schema:      c.schema,
+			Binary:      c.binary && binaryThreshold > 0,
+			Publish:     canPublish(c),
+		},
+		ServerTime: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if f := c.filters[c.endpoint]; f != nil {
+		welcome.Filter = f.source
+	}
+	if c.where != nil {
+		welcome.Where = c.where.rules()
+	}
+	welcome.Session = c.session
+	welcome.Labels = c.labels
+	return welcome
+}
+
+func handleClient(w http.ResponseWriter, r *http.Request, namespace string, endpoint string) {
+	endpoint = namespace + endpoint
 	logEntry := log.WithField("endpoint", endpoint)
 
+	if !requireUpgrade(w, r) {
+		logEntry.Warnln("Rejected client, not a websocket handshake")
+		return
+	}
+	f, ok := connectFilter(w, r, logEntry)
+	if !ok {
+		return
+	}
+	schema, ok := connectSchema(w, r, logEntry)
+	if !ok {
+		return
+	}
+	conditions, ok := connectWhere(w, r, logEntry)
+	if !ok {
+		return
+	}
+	limiter, ok := connectReplayRate(w, r, logEntry)
+	if !ok {
+		return
+	}
+	resume, ok := connectResume(w, r, logEntry)
+	if !ok {
+		return
+	}
+	labels, ok := connectLabels(w, r, logEntry)
+	if !ok {
+		return
+	}
+	token, ok := admitClient(w, r, endpoint, logEntry)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+
 	if err != nil {
-		logEntry.Println(err)
-		// Send Upgrade required response if upgrade fails
-		w.WriteHeader(426)
+		hub.mu.Lock()
+		releaseSlot(endpoint)
+		hub.mu.Unlock()
+
+		// The upgrader has answered the client already, or hijacked the connection if writing the handshake failed
+		logEntry.Warnln("Rejected client, handshake failed:", err)
 		return
 	}
 
-	// Add client to endpoint slice
-	clients[endpoint] = append(clients[endpoint], conn)
+	// Register the client, its welcome frame is queued before any message
+	c := newClient(conn, endpoint)
+	c.schema = schema
+	c.binary = r.URL.Query().Get("binary") == "true"
+	c.where = conditions
+	c.replayLimiter = limiter
+	c.token = token
+	c.session, c.restored = restoreSession(r, endpoint, token)
+	c.labels = c.restored.restoreLabels(labels)
+	resume = c.restored.resumePoint(resume)
+	c.origin = r.Header.Get("Origin")
+	c.host = r.Host
+	c.ip = remoteIP(r)
+	c.country = countryLabel(c.ip)
+	c.namespace = namespace
+	if c.compressed = negotiatesCompression(r); c.compressed {
+		conn.SetCompressionLevel(compressionLevel)
+	}
+	if f != nil {
+		c.filters[endpoint] = f
+	}
+	count := hub.Register(c, welcomeFrame(c), resume)
+	go c.writePump()
+	accessFor(r).record(accessConnect, endpoint, c.id)
+
+	logEntry.WithField("clients", count).WithField("id", c.id).Infoln("Client connected")
 
-	logEntry.WithField("clients", len(clients[endpoint])).Infoln("Client connected")
+	// Read until the connection is closed so that control frames are handled and departures are noticed
+	c.keepAlive()
+	go func() {
+		defer logDisconnect(c)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					logEntry.WithField("id", c.id).Warnln("Reaping unresponsive client")
+					hub.evict(endpoint, c)
+					return
+				}
+				hub.Unregister(endpoint, c)
+				return
+			}
+			c.touch()
+			c.liveness.received(time.Now())
+			handleClientFrame(c, endpoint, data)
+		}
+	}()
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimRight(r.URL.Path, "/")
+// router returns a handler for hooks and/or sockets, allowing them to be served on separate listeners
+func router(hooks bool, sockets bool) http.HandlerFunc {
+	return logAccess(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimRight(r.URL.Path, "/")
 
-	/**
-	 * Check prefix of URL path:
-	 * 	/hook is used for webhooks and requests will be broadcasted to all listening clients.
-	 * 	/socket is used for connect a new socket client
-	 */
-	if strings.HasPrefix(path, "/hook") {
-		handleHook(w, r, strings.TrimPrefix(path, "/hook"))
-	} else if strings.HasPrefix(path, "/socket") {
-		handleClient(w, r, strings.TrimPrefix(path, "/socket"))
-	} else {
-		log.WithField("path", r.URL.Path).Warnln("404 Not found")
-		w.WriteHeader(404)
+		// All routes live under the base path when running behind a shared reverse proxy
+		if basePath != "" {
+			if path != basePath && !strings.HasPrefix(path, basePath+"/") {
+				log.WithField("path", r.URL.Path).Warnln("404 Not found")
+				w.WriteHeader(404)
+				return
+			}
+			path = strings.TrimPrefix(path, basePath)
+		}
+
+		// Probes come before host routing, as orchestrators send them to the address of the instance
+		if !separateProbes && handleProbes(w, r, path) {
+			return
+		}
+
+		// Endpoints are namespaced per hostname when host routing is enabled, the hostname of a request over TLS
+		// having to be the one its connection was established for so that tenants stay isolated
+		if sniMismatch(r) {
+			log.WithField("host", r.Host).WithField("sni", r.TLS.ServerName).Warnln("421 Host doesn't match TLS server name")
+			w.WriteHeader(421)
+			return
+		}
+		namespace, ok := hostNamespace(r)
+		if !ok {
+			log.WithField("host", r.Host).Warnln("404 Unknown host")
+			w.WriteHeader(404)
+			return
+		}
+
+		/**
+		 * Check prefix of URL path:
+		 * 	/hook is used for webhooks and requests will be broadcasted to all listening clients.
+		 * 	/h/<code> receives webhooks for the endpoint a short URL minted through the admin API is bound to
+		 * 	/socket is used for connect a new socket client
+		 * 	/sse streams messages as server-sent events to clients which can't use websockets
+		 * 	/inspect shows requests captured for endpoints flagged for inspection when an admin token is set
+		 * 	/history serves logged messages when the history log is enabled
+		 * 	/chaos controls failure injection when chaos mode is enabled and an admin token is set
+		 * 	/maintenance toggles maintenance mode when an admin token is set
+		 * 	/logging changes log levels and sampling when an admin token is set
+		 * 	/admin shows the state of the server and disconnects clients when an admin token is set
+		 * 	/metrics serves Prometheus metrics unless disabled
+		 * 	/healthz and /readyz are the liveness and readiness probes, unless they have a listener of their own
+		 * 	/ shows the server's status and examples of using its endpoints unless disabled
+		 * 	Any other path may serve a static response, such as a provider's verification file
+		 */
+		// Browsers may only use hooks and the admin API from allowed origins, sockets check origins when admitting clients
+		if !strings.HasPrefix(path, "/socket") && !strings.HasPrefix(path, "/sse") && !handleCORS(w, r) {
+			return
+		}
+		if hooks && strings.HasPrefix(path, "/hook") {
+			handleHook(w, r, namespace, strings.TrimPrefix(path, "/hook"))
+		} else if hooks && strings.HasPrefix(path, "/h/") {
+			handleShortHook(w, r, strings.TrimPrefix(path, "/h"))
+		} else if hooks && chaosEnabled() && adminToken != "" && path == "/chaos" {
+			handleChaos(w, r)
+		} else if hooks && metricsEnabled && path == "/metrics" {
+			handleMetrics(w, r)
+		} else if hooks && adminToken != "" && path == "/maintenance" {
+			handleMaintenance(w, r)
+		} else if hooks && adminToken != "" && path == "/logging" {
+			handleLogging(w, r)
+		} else if hooks && adminToken != "" && (path == "/admin" || strings.HasPrefix(path, "/admin/")) {
+			handleAdmin(w, r, strings.TrimPrefix(path, "/admin"))
+		} else if hooks && adminToken != "" && strings.HasPrefix(path, "/inspect") {
+			handleInspect(w, r, namespace+strings.TrimPrefix(path, "/inspect"))
+		} else if sockets && strings.HasPrefix(path, "/socket") {
+			handleClient(w, r, namespace, strings.TrimPrefix(path, "/socket"))
+		} else if sockets && strings.HasPrefix(path, "/sse") {
+			handleSSE(w, r, namespace, strings.TrimPrefix(path, "/sse"))
+		} else if sockets && historyLog != nil && strings.HasPrefix(path, "/history") {
+			handleHistory(w, r, namespace+strings.TrimPrefix(path, "/history"))
+		} else if sockets && landingPage && path == "" {
+			handleLanding(w, r, namespace)
+		} else if static, ok := staticResponses[path]; ok {
+			static.serve(w, r)
+		} else {
+			log.WithField("path", r.URL.Path).Warnln("404 Not found")
+			w.WriteHeader(404)
+		}
+	})
+}
+
+// Main runs the sockethook command, parsing its subcommand and flags from os.Args
+func Main() {
+	// Run subcommands, the server being the default
+	if len(os.Args) > 1 && os.Args[1] == "tunnel" {
+		runTunnel(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelftest(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-config" {
+		runMigrateConfig(os.Args[2:])
+		return
 	}
+
+	flags := defineFlags()
+	flag.Parse()
+	applyFlags(flags)
+	startServers(flags, setupSubsystems(flags))
+}
+
+// commandFlags holds the values of the command line flags which aren't kept in package variables
+type commandFlags struct {
+	configFile               string
+	address                  string
+	port                     int
+	hookAddress              string
+	hookPort                 int
+	grpcAddress              string
+	grpcPort                 int
+	healthAddress            string
+	healthPort               int
+	enrich                   stringList
+	enrichComputed           string
+	geoipDB                  string
+	geoipASNDB               string
+	declare                  stringList
+	maxBody                  string
+	binaryThresholdSize      string
+	compression              bool
+	compressionThresholdSize string
+	maxInflightHooks         int
+	inspect                  stringList
+	inspectSize              int
+	priorityRules            stringList
+	memoryLimit              string
+	profileDir               string
+	profileLatency           time.Duration
+	profileDuration          time.Duration
+	profileInterval          time.Duration
+	metricsLabels            string
+	origins                  stringList
+	logFormat                string
+	accessLog                string
+	logLevel                 string
+	logDebugEndpoints        stringList
+	logSampleRate            float64
+	hookHeaders              stringList
+	handshakeRules           stringList
+	hostRoutes               stringList
+	verify                   stringList
+	allowUnverified          stringList
+	socketTokenRules         stringList
+	socketTokenFile          string
+	blocklistFile            string
+	shortURLFile             string
+	respond                  stringList
+	historyDir               string
+	historyEndpoints         stringList
+	historyRetention         time.Duration
+	historyMaxMessages       int
+	historyKeyFile           string
+	historyCompression       string
+	maxImport                string
+	recordDir                string
+	recordings               stringList
+	recordMaxMessages        int
+	forward                  stringList
+	forwardSecretRules       stringList
+	eventBus                 stringList
+	clientPublish            stringList
+	static                   stringList
+	transform                stringList
+	collapseDuplicates       stringList
+	debounce                 stringList
+	throttle                 stringList
+	windowRules              stringList
+	aggregate                stringList
+	validation               stringList
+	ack                      stringList
+	writeErrorBudget         float64
+	writeErrorWindow         time.Duration
+	writeErrorMinWrites      int
+	circuitCooldown          time.Duration
+	sloTargets               stringList
+	sloObjective             float64
+	sloWindow                time.Duration
+	latencyBudgets           stringList
+	replayBuffers            stringList
+	replayTTL                time.Duration
+	replayMaxAges            stringList
+	dropLate                 bool
+	tlsCerts                 stringList
+	tlsKeys                  stringList
+	autocertDomains          stringList
+	autocertCache            string
+	autocertEmail            string
+	enableH2C                bool
+	timeSyncInterval         time.Duration
+	idFormat                 string
+	otlpEndpoint             string
+	otlpHeaders              stringList
+	otlpServiceName          string
+	otlpInterval             time.Duration
+	rateLimits               stringList
+	ipRateLimits             stringList
+	redisURL                 string
+	redisChannel             string
+	rateLimitBackendName     string
+	nodeID                   int64
+	migrateTo                stringList
+	drainTimeout             time.Duration
+	redactPaths              stringList
+	redactPatterns           stringList
+	redactPresets            string
+	alerts                   bool
+	alertWindow              time.Duration
+	alertSpikeFactor         float64
+	alertMinCount            int
+	alertSilence             int
+	alertSinks               stringList
+	lifecycleTargets         stringList
+}
+
+// subsystems are the logs, exporter and broker set up from the flags, which are only started once the whole
+// configuration was validated, and the handlers of the listeners
+type subsystems struct {
+	webhooks   []*lifecycleWebhook
+	history    *HistoryLog
+	deliveries *DeliveryLog
+	recorder   *Recorder
+	exporter   *OTLPExporter
+	redis      *redisBroker
+	// Whether hooks are accepted on a listener of their own, and the handlers of the listeners
+	separateHooks bool
+	rootHandler   http.Handler
+	hookHandler   http.Handler
+	tlsConf       *tls.Config
 }
 
-func main() {
+// defineFlags defines the command line flags, which options kept in package variables are parsed into directly
+func defineFlags() *commandFlags {
+	flags := &commandFlags{}
+	flag.StringVar(&flags.configFile, "config", "", "YAML configuration file with options and per-endpoint settings, reloaded on SIGHUP.")
+
 	// Get command line options --address and --port
-	address := flag.String("address", "", "Address to bind to.")
-	port := flag.Int("port", 1234, "Port to bind to. Default: 1234")
-	flag.Parse()
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	flag.StringVar(&flags.address, "address", "", "Address to bind to.")
+	flag.IntVar(&flags.port, "port", 1234, "Port to bind to. Default: 1234")
+	flag.StringVar(&basePath, "base-path", "", "Path prefix under which all routes are served, e.g. /sockethook.")
+	flag.StringVar(&flags.hookAddress, "hook-address", "", "Address to bind the hook listener to, if separate from sockets.")
+	flag.IntVar(&flags.hookPort, "hook-port", 0, "Port to accept hooks at. If set, /hook is only served on this port and not on --port.")
+	flag.StringVar(&flags.grpcAddress, "grpc-address", "", "Address to bind the gRPC listener to.")
+	flag.IntVar(&flags.grpcPort, "grpc-port", 0, "Port to serve the gRPC Subscribe API at, see sockethook.proto. 0 to disable.")
+	flag.StringVar(&flags.healthAddress, "health-address", "", "Address to bind the health probe listener to.")
+	flag.IntVar(&flags.healthPort, "health-port", 0, "Port to serve the /healthz and /readyz probes at. If set, they're only served on this port and not next to the other routes.")
+	flag.Var(&flags.enrich, "enrich", "Static metadata added to messages, as key=value or /endpoint:key=value. Can be repeated.")
+	flag.StringVar(&flags.enrichComputed, "enrich-computed", "", "Comma-separated computed metadata added to messages: received_at, source_ip, host.")
+	flag.StringVar(&flags.geoipDB, "geoip-db", "", "Path to a MaxMind country or city database used to resolve the source of hooks.")
+	flag.StringVar(&flags.geoipASNDB, "geoip-asn-db", "", "Path to a MaxMind ASN database used to resolve the source of hooks.")
+	flag.IntVar(&maxClients, "max-clients", 0, "Maximum number of clients per endpoint, 0 for unlimited.")
+	flag.DurationVar(&waitlistTimeout, "waitlist-timeout", 0, "How long new clients wait for a free slot on a full endpoint before being rejected.")
+	flag.IntVar(&waitlistSize, "waitlist-size", 100, "Maximum number of clients waiting for a slot per endpoint.")
+	flag.IntVar(&maxSubscriptions, "max-subscriptions", 0, "Maximum number of endpoints a connection may subscribe to, 0 for unlimited.")
+	flag.BoolVar(&declaredOnly, "declared-endpoints", false, "Only accept hooks and clients on declared endpoints, rejecting others with 404 and 403 instead of creating endpoints when they're first used.")
+	flag.Var(&flags.declare, "declare-endpoint", "Endpoint or pattern which is declared, besides those of the configuration file and the admin API. Can be repeated.")
+	flag.DurationVar(&endpointIdleTimeout, "endpoint-idle-timeout", 0, "How long an endpoint without clients and hooks is kept before its sequence numbers and buffered messages are dropped, 0 to keep them.")
+	flag.StringVar(&flags.maxBody, "max-body-size", "10MB", "Maximum size of hook bodies, e.g. 1MB, larger ones being rejected with 413. 0 for unlimited.")
+	flag.StringVar(&flags.binaryThresholdSize, "binary-threshold", "0", "Size above which non-JSON bodies are sent as binary frames to websocket clients connecting with ?binary=true, e.g. 64KB. 0 to disable.")
+	flag.BoolVar(&flags.compression, "compression", false, "Negotiate permessage-deflate with websocket clients which support it, compressing large frames.")
+	flag.IntVar(&compressionLevel, "compression-level", 1, "Compression level of permessage-deflate, from -2 (Huffman only) and 1 (fastest) to 9 (smallest).")
+	flag.StringVar(&flags.compressionThresholdSize, "compression-threshold", "1KB", "Size from which frames are compressed for clients which negotiated compression, e.g. 4KB.")
+	flag.IntVar(&flags.maxInflightHooks, "max-inflight-hooks", 0, "Maximum number of hooks handled concurrently, 0 for unlimited.")
+	flag.DurationVar(&hookQueueTimeout, "hook-queue-timeout", 5*time.Second, "How long hooks wait for a free slot before being rejected.")
+	flag.Var(&flags.inspect, "inspect", "Endpoint for which full requests are captured and shown to admins at /inspect/<endpoint>. Can be repeated.")
+	flag.IntVar(&flags.inspectSize, "inspect-size", 100, "Number of captured requests kept per inspected endpoint.")
+	flag.IntVar(&endpointQueueSize, "endpoint-queue-size", 256, "Number of messages queued per endpoint before new ones are dropped.")
+	flag.IntVar(&maxDispatchers, "max-dispatchers", 0, "Maximum number of endpoints delivering messages at the same time, each on a goroutine of its own, 0 for unlimited.")
+	flag.StringVar(&priorityHeader, "priority-header", "X-Sockethook-Priority", "Header setting the priority of a hook in its endpoint's queue, high, normal or low, empty to ignore it.")
+	flag.Var(&flags.priorityRules, "priority", "Priority of the hooks of an endpoint which don't set one in the priority header, as /endpoint=high. Can be repeated.")
+	flag.DurationVar(&dispatcherIdleTimeout, "dispatcher-idle-timeout", time.Minute, "How long the dispatcher of an endpoint without messages is kept running.")
+	flag.IntVar(&forwardQueueSize, "forward-queue-size", 256, "Number of hooks queued per forward target before new ones are dead-lettered.")
+	flag.IntVar(&busQueueSize, "bus-queue-size", 1024, "Number of hooks queued per event bus before new ones are dead-lettered.")
+	flag.IntVar(&brokerQueueSize, "broker-queue-size", 1024, "Number of messages queued for the broker before new ones are only delivered locally.")
+	flag.BoolVar(&readReplica, "read-replica", false, "Run as a read replica, serving clients with the messages published to the broker by writer instances and rejecting hooks. Requires --redis-url.")
+	flag.StringVar(&standbyOf, "standby-of", "", "URL of the active instance, e.g. http://10.0.0.1:8080, to run as its standby: syncing its declared endpoints, sequence numbers and replay buffers, and rejecting hooks and clients until promoted. Requires --admin-token, the same as the active instance's.")
+	flag.DurationVar(&standbySyncInterval, "standby-sync-interval", time.Second, "How often a standby syncs from the active instance.")
+	flag.DurationVar(&standbyFailoverAfter, "standby-failover-after", 0, "How long syncing from the active instance may fail before the standby promotes itself, e.g. 30s, 0 to only promote it through the admin API.")
+	flag.DurationVar(&brokerBatchWindow, "broker-batch-window", 0, "How long messages are collected before publishing them to the broker in one payload, e.g. 50ms, 0 to publish every message on its own.")
+	flag.IntVar(&brokerBatchSize, "broker-batch-size", 100, "Largest number of messages published to the broker in one payload.")
+	flag.BoolVar(&brokerCompress, "broker-compress", false, "Compress payloads published to the broker with gzip.")
+	flag.BoolVar(&endpointOwnership, "endpoint-ownership", false, "Give every endpoint an owner among the writer instances sharing the broker, which numbers and orders its messages for the whole cluster. Requires --redis-url.")
+	flag.DurationVar(&clusterHeartbeatInterval, "cluster-heartbeat", 5*time.Second, "How often instances sharing a broker announce themselves and their clients to each other, for the cluster topology.")
+	flag.IntVar(&brokerDedupSize, "broker-dedup-size", 10000, "Number of messages from other instances remembered so that those relayed more than once are only delivered once, 0 to not deduplicate them.")
+	flag.IntVar(&historyQueueSize, "history-queue-size", 4096, "Number of messages queued for the history log before new ones are dropped.")
+	flag.IntVar(&otlpQueueSize, "otlp-queue-size", 4096, "Number of log records queued for OTLP export before new ones are dropped.")
+	flag.DurationVar(&pingInterval, "ping-interval", 30*time.Second, "Interval at which websocket pings are sent to clients, 0 to disable.")
+	flag.DurationVar(&pongTimeout, "pong-timeout", 10*time.Second, "How long clients have to answer a ping before they're disconnected.")
+	flag.IntVar(&clientBufferSize, "client-buffer", 256, "Number of frames buffered per client before it's disconnected as too slow.")
+	flag.StringVar(&flags.memoryLimit, "memory-limit", "", "Soft memory limit, e.g. 512MB, above which load is shed instead of running out of memory.")
+	flag.StringVar(&flags.profileDir, "profile-dir", "", "Directory to which CPU and heap profiles are written when overloaded, empty to disable.")
+	flag.DurationVar(&flags.profileLatency, "profile-latency", 0, "Delivery latency above which profiles are captured, 0 to only capture on memory pressure.")
+	flag.DurationVar(&flags.profileDuration, "profile-duration", 10*time.Second, "How long CPU profiles are recorded for.")
+	flag.DurationVar(&flags.profileInterval, "profile-interval", 10*time.Minute, "Minimum time between two profile captures.")
+	flag.BoolVar(&chaos.enabled, "chaos", false, "Enable the /chaos API for injecting write latency, disconnects and dropped messages, for admins only. For testing only.")
+	flag.BoolVar(&validateOnly, "validate-config", false, "Validate the configuration, report every error found and exit without starting the server.")
+	flag.BoolVar(&validateOnly, "dry-run", false, "Alias of --validate-config.")
+	flag.BoolVar(&landingPage, "landing-page", true, "Serve a page at / with the server's status and examples of sending hooks to and listening on its endpoints.")
+	flag.BoolVar(&metricsEnabled, "metrics", true, "Serve Prometheus metrics at /metrics, next to /hook.")
+	flag.StringVar(&flags.metricsLabels, "metrics-labels", "endpoint,tenant,event", "Comma-separated dimensions which become labels in /metrics: endpoint, tenant and event.")
+	flag.Var((*stringList)(&metricEndpoints), "metrics-endpoint", "Endpoint given its own label in /metrics, or a pattern such as /orders/* under which the endpoints it matches are counted. Others are counted as other. Can be repeated.")
+	flag.IntVar(&maxMetricLabels, "metrics-max-labels", 1000, "Maximum number of distinct values per label in /metrics, further ones are counted as other.")
+	flag.StringVar(&metricsEventHeader, "metrics-event-header", "", "Header holding the event type of hooks, e.g. X-GitHub-Event, counted per event in /metrics.")
+	flag.Var(&flags.origins, "allowed-origins", "Comma-separated origins browsers may connect and send hooks and admin requests from besides the server's own, such as https://app.example.com or *.example.com. Can be repeated.")
+	flag.BoolVar(&insecureOrigins, "insecure-origins", false, "Accept connections and requests from any origin.")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required by admin APIs such as /maintenance, which are disabled if empty.")
+	flag.StringVar(&flags.logFormat, "log-format", logFormatText, "Format of log entries: text or json.")
+	flag.StringVar(&flags.accessLog, "access-log", "", "File every request, hook and socket connection is logged to, - for standard output. Uses the format of --log-format.")
+	flag.StringVar(&flags.logLevel, "log-level", "info", "Minimum level of log entries written: debug, info, warning or error. Can be changed at runtime through /logging.")
+	flag.Var(&flags.logDebugEndpoints, "log-debug-endpoint", "Endpoint or pattern whose log entries are written down to the debug level. Can be repeated.")
+	flag.Float64Var(&flags.logSampleRate, "log-sample-rate", 1, "Fraction of info and debug log entries written, warnings and errors are always written.")
+	flag.Var(&flags.hookHeaders, "response-header", "Header set on hook responses, as \"Name: value\" or \"/endpoint:Name: value\". Can be repeated.")
+	flag.Var(&flags.handshakeRules, "handshake", "Answer provider verification handshakes on an endpoint, as /endpoint=slack, sns or graph. Can be repeated.")
+	flag.Var(&flags.hostRoutes, "host", "Namespace prefixed to the endpoints of requests for a hostname, as host=/namespace or *=/namespace. Can be repeated.")
+	flag.Var(&flags.verify, "verify", "Verify hook signatures on an endpoint, as /endpoint=github:secret, stripe, gitlab or /endpoint=hmac:Header:secret. Can be repeated.")
+	flag.DurationVar(&rotationWindow, "rotation-window", 24*time.Hour, "How long the previous secret or token of an endpoint stays valid after rotating it through the admin API.")
+	flag.DurationVar(&archiveGrace, "archive-grace", 7*24*time.Hour, "How long the messages of endpoints archived through the admin API are kept before they're purged.")
+	flag.StringVar(&temporaryPrefix, "temporary-prefix", "/temporary", "Endpoint below which temporary endpoints are created through the admin API.")
+	flag.DurationVar(&temporaryTTL, "temporary-ttl", time.Hour, "How long temporary endpoints last unless they're created with a ttl.")
+	flag.DurationVar(&maxTemporaryTTL, "max-temporary-ttl", 24*time.Hour, "Longest ttl temporary endpoints may be created with.")
+	flag.IntVar(&maxTemporaryEndpoints, "max-temporary-endpoints", 1000, "Number of temporary endpoints which may exist at the same time.")
+	flag.DurationVar(&expiredRetention, "expired-retention", 24*time.Hour, "How long expired temporary endpoints answer with 410 Gone before they're forgotten.")
+	flag.BoolVar(&captureUndeclared, "capture-undeclared", false, "Capture hooks to undeclared endpoints into quarantine, answering them with 202, so they can be inspected and their endpoints promoted through the admin API. Requires --declared-endpoints and --quarantine-size.")
+	flag.IntVar(&quarantineSize, "quarantine-size", 0, "Number of hooks failing signature verification kept for review and replay through the admin API, 0 to reject them without keeping them.")
+	flag.Var(&flags.allowUnverified, "allow-unverified", "Endpoint with signature verification which accepts hooks failing it, marking them as unverified instead of rejecting them. Can be repeated.")
+	flag.Var(&flags.socketTokenRules, "socket-token", "Token socket clients must present, as token or /endpoint=token. Can be repeated.")
+	flag.StringVar(&flags.socketTokenFile, "socket-token-file", "", "File with one socket token per line, followed by the endpoints it grants access to.")
+	flag.StringVar(&flags.blocklistFile, "blocklist-file", "", "File the blocklist of clients managed through the admin API is kept in, so it survives restarts. Empty to keep it in memory.")
+	flag.StringVar(&flags.shortURLFile, "short-url-file", "", "File the short hook URLs minted through the admin API are kept in, so they survive restarts. Empty to keep them in memory.")
+	flag.Var(&flags.respond, "respond", "Endpoint whose hooks are answered with the response sent back by a client, such as a tunnel. Can be repeated.")
+	flag.DurationVar(&respondTimeout, "respond-timeout", 10*time.Second, "How long hooks on responding endpoints wait for a client response.")
+	flag.StringVar(&flags.historyDir, "history-dir", "", "Directory messages are logged to, so they can be fetched from /history after a restart. Empty to disable.")
+	flag.Var(&flags.historyEndpoints, "history-endpoint", "Endpoint or pattern whose messages are logged, all if not given. Can be repeated.")
+	flag.DurationVar(&flags.historyRetention, "history-retention", 7*24*time.Hour, "How long logged messages are kept, 0 to keep them until pushed out by --history-max-messages.")
+	flag.IntVar(&flags.historyMaxMessages, "history-max-messages", 10000, "Number of logged messages kept per endpoint.")
+	flag.StringVar(&flags.historyKeyFile, "history-key-file", "", "File holding the hex encoded 32 byte key messages logged to --history-dir and recordings are encrypted with, using AES-256-GCM. Empty to log them in plain text.")
+	flag.StringVar(&flags.historyCompression, "history-compression", "none", "Compression of messages logged to --history-dir and recordings, none or gzip. Messages logged before are converted as the logs are compacted.")
+	flag.IntVar(&deliveryHistorySize, "delivery-history-size", 10000, "Number of messages whose delivery attempts are kept for the admin API, in the history directory if given. 0 to keep none.")
+	flag.StringVar(&flags.maxImport, "max-import-size", "256MB", "Maximum size of imports through /admin/import, e.g. 1GB. 0 for unlimited.")
+	flag.StringVar(&flags.recordDir, "record-dir", "", "Directory the messages of recorded endpoints are kept in.")
+	flag.Var(&flags.recordings, "record", "Endpoint or pattern whose messages are all kept for a retention, as /endpoint=7d, to be replayed into another endpoint through /admin/recordings. Can be repeated.")
+	flag.IntVar(&flags.recordMaxMessages, "record-max-messages", 100000, "Number of recorded messages kept per endpoint.")
+	flag.Var(&flags.forward, "forward", "URL hooks to an endpoint or pattern are forwarded to alongside being broadcasted, as /endpoint=URL. Can be repeated.")
+	flag.IntVar(&forwardRetries, "forward-retries", 5, "Number of times a hook which couldn't be forwarded is retried before it's dead-lettered.")
+	flag.DurationVar(&forwardBackoff, "forward-backoff", time.Second, "Delay before retrying a failed forward, doubling with every retry up to a minute and jittered down to half of it.")
+	flag.DurationVar(&forwardTimeout, "forward-timeout", 10*time.Second, "How long forward targets have to answer.")
+	flag.IntVar(&deadLetterStoreSize, "dead-letter-store-size", 1000, "Number of hooks which couldn't be forwarded kept to be requeued through the admin API, 0 to keep none.")
+	flag.Var(&flags.forwardSecretRules, "forward-secret", "Secret hooks forwarded to a target are re-signed with in X-Hub-Signature-256, as URL=secret with the URL as given to --forward. Can be repeated.")
+	flag.Var(&flags.eventBus, "event-bus", "URL of an event bus hooks to an endpoint or pattern are published to, as /endpoint=nats://host:4222/prefix. Can be repeated.")
+	flag.Var(&flags.clientPublish, "client-publish", "Where messages published by clients of an endpoint or pattern go, as /endpoint=broadcast to broadcast them to its other clients or /endpoint=URL to POST them to a callback. Can be repeated.")
+	flag.DurationVar(&publishTimeout, "client-publish-timeout", 10*time.Second, "How long callbacks have to answer messages published by clients.")
+	flag.BoolVar(&suppressRelayedRetries, "suppress-relayed-retries", false, "Answer retried deliveries of hooks which were already delivered to a client without broadcasting them again.")
+	flag.DurationVar(&deliveryWindow, "delivery-window", 24*time.Hour, "How long delivery IDs of hooks are remembered to recognize retries.")
+	flag.StringVar(&deliveryIDHeader, "delivery-id-header", "", "Header identifying deliveries of hooks from providers Sockethook doesn't know, the same for all attempts.")
+	flag.StringVar(&attemptHeader, "attempt-header", "", "Header holding the attempt number of hooks from providers Sockethook doesn't know.")
+	flag.Var(&flags.static, "static-response", "Small response served at a path, such as a provider's verification file, as /path=content or /path=@file. Can be repeated.")
+	flag.Var(&flags.transform, "transform", "Transformation of the data of JSON hooks to an endpoint or pattern, as /endpoint=template:{{...}} with a Go template producing JSON or /endpoint=jq:{title: .title} with a jq-like expression. Can be repeated.")
+	flag.Var(&flags.collapseDuplicates, "collapse-duplicates", "Endpoint or pattern whose consecutive messages with the same payload are suppressed within a window, as /endpoint=1m, the last of them being delivered with their number. Can be repeated.")
+	flag.Var(&flags.debounce, "debounce", "Endpoint or pattern of which only the last message is delivered, once no message arrived for the interval, as /endpoint=2s. Add :collapsed to set the number of messages dropped. Can be repeated.")
+	flag.Var(&flags.windowRules, "delivery-hours", "Endpoint or pattern whose messages are only delivered during a window, as '/endpoint=mon-fri 08:00-20:00 Europe/Stockholm', held back until it opens otherwise. Can be repeated.")
+	flag.IntVar(&windowBufferSize, "delivery-hours-buffer", 10000, "Number of messages held per endpoint outside its delivery window before the oldest are dead-lettered.")
+	flag.Var(&flags.throttle, "throttle", "Endpoint or pattern of which at most one message is delivered per interval, as /endpoint=10s. Add :collapsed to set the number of messages dropped. Can be repeated.")
+	flag.Var(&flags.aggregate, "aggregate", "Endpoint or pattern whose messages are delivered as one summary per window, as /endpoint=10s:count, collect or sum, min, max or avg with a path such as /endpoint=10s:avg:data.value. Can be repeated.")
+	flag.Var(&flags.validation, "validation-url", "URL hooks to an endpoint are POSTed to before they're broadcasted, as /endpoint=URL, only broadcasting them if it answers with 2xx. Can be repeated.")
+	flag.DurationVar(&validationTimeout, "validation-timeout", 5*time.Second, "How long validators have to answer before hooks are rejected.")
+	flag.Var(&flags.ack, "ack", "Endpoint or pattern whose messages websocket clients must acknowledge, unacknowledged ones being sent again. Can be repeated.")
+	flag.DurationVar(&ackTimeout, "ack-timeout", 5*time.Second, "How long clients have to acknowledge a message before it's sent again, doubling with every retry.")
+	flag.IntVar(&ackMaxRetries, "ack-max-retries", 5, "Number of times an unacknowledged message is sent again before it's dead-lettered.")
+	flag.StringVar(&deadLetterURL, "dead-letter-url", "", "URL messages which couldn't be delivered are POSTed to. They're always logged.")
+	flag.Float64Var(&flags.writeErrorBudget, "write-error-budget", 0, "Fraction of writes to a client or endpoint which may fail before buffers are reduced, clients disconnected and circuits opened. 0 evicts slow clients right away.")
+	flag.DurationVar(&flags.writeErrorWindow, "write-error-window", time.Minute, "Window over which the write error budget is computed.")
+	flag.IntVar(&flags.writeErrorMinWrites, "write-error-min-writes", 20, "Number of writes in a window before the write error budget applies.")
+	flag.DurationVar(&flags.circuitCooldown, "circuit-cooldown", 30*time.Second, "How long an endpoint over its write error budget isn't delivered to.")
+	flag.Var(&flags.sloTargets, "slo", "Delivery latency target tracked in /metrics, as 250ms or /endpoint=250ms. Can be repeated.")
+	flag.Float64Var(&flags.sloObjective, "slo-objective", 0.99, "Fraction of deliveries which should meet the --slo target.")
+	flag.DurationVar(&flags.sloWindow, "slo-window", 5*time.Minute, "Rolling window over which latency percentiles and SLO burn rates are computed.")
+	flag.Var(&flags.latencyBudgets, "latency-budget", "Maximum delay between receiving and delivering a message, as 500ms or /endpoint=500ms. Can be repeated.")
+	flag.Var(&flags.replayBuffers, "replay-buffer", "Number of recent messages kept for reconnecting clients, as 100 or /endpoint=100. Can be repeated.")
+	flag.DurationVar(&flags.replayTTL, "replay-ttl", 0, "How long messages are kept for reconnecting clients, 0 for as long as they fit.")
+	flag.Float64Var(&replayRate, "replay-rate", 0, "Messages per second replayed to each resuming client, 0 to replay them at once. Clients may ask for a lower rate with the replay_rate query parameter.")
+	flag.IntVar(&replayBurst, "replay-burst", 0, "Messages which may be replayed at once above the replay rate, 0 for one second's worth.")
+	flag.DurationVar(&sessionGrace, "session-grace", 0, "How long the subscriptions, position and labels of a disconnected client are kept for it to reconnect with its session token, 0 to not issue session tokens.")
+	flag.Var(&flags.replayMaxAges, "replay-max-age", "Age above which buffered messages of an endpoint aren't replayed, as /endpoint=10m. Can be repeated.")
+	flag.BoolVar(&flags.dropLate, "drop-late", false, "Drop deliveries which exceed the latency budget instead of only logging them.")
+	flag.Var(&flags.tlsCerts, "tls-cert", "TLS certificate file, enabling HTTPS and wss://. Can be repeated, the certificate matching the requested hostname being served.")
+	flag.Var(&flags.tlsKeys, "tls-key", "TLS private key file of the --tls-cert given in the same position. Can be repeated.")
+	flag.Var(&flags.autocertDomains, "autocert-domain", "Domain to obtain a TLS certificate for from Let's Encrypt, requires --port 443. Can be repeated.")
+	flag.StringVar(&flags.autocertCache, "autocert-cache", "autocert", "Directory in which certificates obtained from Let's Encrypt are stored.")
+	flag.StringVar(&flags.autocertEmail, "autocert-email", "", "Contact email passed to Let's Encrypt.")
+	flag.BoolVar(&flags.enableH2C, "h2c", false, "Accept HTTP/2 without TLS (h2c), letting publishers multiplex hooks over one connection.")
+	flag.DurationVar(&flags.timeSyncInterval, "time-sync-interval", 0, "Interval at which time sync frames are sent to clients, 0 to disable.")
+	flag.StringVar(&flags.idFormat, "id-format", "uuidv7", "Format of message IDs: uuidv7, ulid or snowflake.")
+	flag.StringVar(&flags.otlpEndpoint, "otlp-endpoint", "", "Base URL of an OpenTelemetry collector, e.g. http://localhost:4318, to which delivery events are exported as OTLP logs.")
+	flag.Var(&flags.otlpHeaders, "otlp-header", "Header sent with OTLP exports as Name=value, e.g. for authentication. Can be repeated.")
+	flag.StringVar(&flags.otlpServiceName, "otlp-service-name", "sockethook", "Service name of exported OTLP logs.")
+	flag.DurationVar(&flags.otlpInterval, "otlp-interval", 5*time.Second, "Interval at which delivery events are exported.")
+	flag.Var(&flags.rateLimits, "rate-limit", "Hooks accepted per second as rate[:burst], for each endpoint or a single one as /endpoint=rate[:burst]. Excess hooks are rejected with 429. Can be repeated.")
+	flag.Var(&flags.ipRateLimits, "ip-rate-limit", "Hooks accepted per second from each source IP as rate[:burst], across all endpoints or on a single one as /endpoint=rate[:burst]. Can be repeated.")
+	flag.StringVar(&flags.redisURL, "redis-url", "", "Redis URL, e.g. redis://:password@localhost:6379, through which hooks are broadcast to the clients of all instances.")
+	flag.StringVar(&flags.redisChannel, "redis-channel", "sockethook", "Redis pub/sub channel shared by the instances.")
+	flag.StringVar(&flags.rateLimitBackendName, "rate-limit-backend", "memory", "Where the buckets of rate limits are kept: memory, limiting each instance separately, or redis, sharing them with all instances using --redis-url and --redis-channel.")
+	flag.Int64Var(&flags.nodeID, "node-id", 0, "Node ID embedded in snowflake message IDs, unique per instance.")
+	flag.DurationVar(&reconnectDelay, "reconnect-delay", time.Second, "Minimum reconnect delay suggested to clients on shutdown.")
+	flag.DurationVar(&reconnectJitter, "reconnect-jitter", 5*time.Second, "Maximum random jitter added to the suggested reconnect delay.")
+	flag.Var(&flags.migrateTo, "migrate-to", "URL of another instance suggested to clients for reconnecting on shutdown. Can be repeated.")
+	flag.DurationVar(&flags.drainTimeout, "drain-timeout", 10*time.Second, "How long to wait for in-flight hooks and queued messages when shutting down.")
+	flag.DurationVar(&recoveryPeriod, "recovery-period", 0, "How long after startup new connections are rate limited.")
+	flag.Float64Var(&recoveryRate, "recovery-rate", 50, "Connections accepted per second during the recovery period.")
+	flag.IntVar(&recoveryBurst, "recovery-burst", 0, "Connections which may be accepted at once above the recovery rate, 0 for one second's worth.")
+	flag.Var(&flags.redactPaths, "redact-path", "JSON path in hook bodies to mask, as a.b.c or /endpoint:a.b.c. \"*\" matches any key. Can be repeated.")
+	flag.Var(&flags.redactPatterns, "redact-pattern", "Regular expression masked in hook headers and bodies. Can be repeated.")
+	flag.StringVar(&flags.redactPresets, "redact-preset", "", "Comma-separated built-in patterns to mask: email, card, token.")
+	flag.BoolVar(&flags.alerts, "alerts", false, "Detect traffic anomalies and broadcast them on "+alertsEndpoint+".")
+	flag.DurationVar(&flags.alertWindow, "alert-window", time.Minute, "Length of the window over which hook rates are compared.")
+	flag.Float64Var(&flags.alertSpikeFactor, "alert-spike-factor", 5, "Number of times above the usual rate which counts as a spike.")
+	flag.IntVar(&flags.alertMinCount, "alert-min-count", 10, "Minimum number of hooks, or authentication failures, in a window before a spike is reported.")
+	flag.IntVar(&flags.alertSilence, "alert-silence", 5, "Number of empty windows after which an active endpoint counts as silent.")
+	flag.Var(&flags.alertSinks, "alert-sink", "URL to which alerts are POSTed as JSON. Can be repeated.")
+	flag.Var(&flags.lifecycleTargets, "lifecycle-webhook", "URL to which server events are POSTed as JSON, as URL for every event or event,event=URL for some. Can be repeated.")
+	flag.StringVar(&lifecycleSecret, "lifecycle-secret", "", "Secret lifecycle webhook notifications are signed with in X-Sockethook-Signature, empty to not sign them.")
+	flag.IntVar(&lifecycleQueueSize, "lifecycle-queue-size", 256, "Number of server events queued per lifecycle webhook before new ones are dropped.")
+	flag.IntVar(&deliveryFailureThreshold, "delivery-failure-threshold", 50, "Number of failed deliveries to clients of an endpoint within --delivery-failure-window after which a delivery_failures event is published, 0 to disable.")
+	flag.DurationVar(&deliveryFailureWindow, "delivery-failure-window", time.Minute, "Window over which failed deliveries are counted.")
+	flag.DurationVar(&quotaCooldown, "quota-event-cooldown", time.Minute, "How long after a quota_exceeded event the same quota of an endpoint isn't reported again.")
+	return flags
+}
 
-	http.HandleFunc("/", handler)
+// applyFlags applies the configuration file and the parsed flags to the package, validating them
+func applyFlags(flags *commandFlags) {
+	// Options from the configuration file only apply if they weren't given on the command line
+	var cfg *Config
+	if flags.configFile != "" {
+		var err error
+		if cfg, err = loadConfig(flags.configFile); err != nil {
+			configError(err)
+		} else if err := applyConfigFlags(cfg); err != nil {
+			configError(err)
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	if formatter, err := logFormatter(flags.logFormat); err != nil {
+		configError(err)
+	} else {
+		log.SetFormatter(formatter)
+		if flags.accessLog != "" {
+			if accessLogger, err = newAccessLogger(flags.accessLog, formatter); err != nil {
+				configError(err)
+			}
+		}
+	}
+	if err := setupLogging(LoggingSettings{Level: flags.logLevel, DebugEndpoints: flags.logDebugEndpoints, SampleRate: flags.logSampleRate}); err != nil {
+		configError(err)
+	}
+
+	if basePath != "" {
+		basePath = "/" + strings.Trim(basePath, "/")
+	}
+
+	var err error
+	idGenerator, err = newIDGenerator(flags.idFormat, flags.nodeID)
+	if err != nil {
+		configError(err)
+	}
+
+	enricher, err = newEnricher(flags.enrich, strings.Split(flags.enrichComputed, ","))
+	if err != nil {
+		configError(err)
+	}
+
+	responseHeaders, err = newResponseHeaders(flags.hookHeaders)
+	if err != nil {
+		configError(err)
+	}
+
+	if err := setHandshakes(flags.handshakeRules); err != nil {
+		configError(err)
+	}
+
+	if err := setVerifiers(flags.verify); err != nil {
+		configError(err)
+	}
+	setUnverifiedEndpoints(flags.allowUnverified)
+
+	if err := setHostNamespaces(flags.hostRoutes); err != nil {
+		configError(err)
+	}
+
+	if err := addSocketTokens(flags.socketTokenRules); err != nil {
+		configError(err)
+	}
+	if flags.socketTokenFile != "" {
+		if err := loadSocketTokens(flags.socketTokenFile); err != nil {
+			configError(err)
+		}
+	}
+	if flags.blocklistFile != "" {
+		if err := loadBlocklist(flags.blocklistFile); err != nil {
+			configError(err)
+		}
+	}
+	if flags.shortURLFile != "" {
+		if err := loadShortURLs(flags.shortURLFile); err != nil {
+			configError(err)
+		}
+	}
+
+	latencyBudget, err = newLatencyBudget(flags.latencyBudgets, flags.dropLate)
+	if err != nil {
+		configError(err)
+	}
+
+	if err := setMetricLabels(flags.metricsLabels); err != nil {
+		configError(err)
+	}
+	for _, endpoint := range metricEndpoints {
+		if !strings.HasPrefix(endpoint, "/") || !validPattern(endpoint) {
+			configError(fmt.Errorf("invalid metrics endpoint %q", endpoint))
+		}
+	}
+
+	if len(flags.sloTargets) > 0 {
+		sloTracker, err = newSLOTracker(flags.sloTargets, flags.sloObjective, flags.sloWindow)
+		if err != nil {
+			configError(err)
+		}
+	}
+
+	if buffer, err := newReplayBuffer(flags.replayBuffers, flags.replayTTL); err != nil {
+		configError(err)
+	} else {
+		replayBuffer = buffer
+	}
+	if ages, err := parseReplayMaxAges(flags.replayMaxAges); err != nil {
+		configError(err)
+	} else {
+		replayBuffer.SetMaxAges(ages)
+	}
+	if priorities, err := parseEndpointPriorities(flags.priorityRules); err != nil {
+		configError(err)
+	} else {
+		endpointPriorities = priorities
+	}
+	if sessionGrace < 0 {
+		configError(fmt.Errorf("invalid session grace period %v", sessionGrace))
+	}
+	if replayRate < 0 || replayBurst < 0 {
+		configError(fmt.Errorf("invalid replay rate %v or burst %d", replayRate, replayBurst))
+	}
+
+	// Endpoint settings of the configuration file are applied on top of those given as options
+	if cfg != nil {
+		if err := applyEndpointConfig(cfg); err != nil {
+			configError(err)
+		} else if !validateOnly {
+			go watchConfig(flags.configFile)
+		}
+	}
+
+	redactor, err = newRedactor(flags.redactPaths, flags.redactPatterns, strings.Split(flags.redactPresets, ","))
+	if err != nil {
+		configError(err)
+	}
+
+	if flags.geoipDB != "" || flags.geoipASNDB != "" {
+		geoip, err := openGeoIP(flags.geoipDB, flags.geoipASNDB)
+		if err != nil {
+			configError(err)
+		} else if enricher != nil {
+			enricher.geoip = geoip
+		}
+	}
+
+	migrationTargets = flags.migrateTo
+	if err := validateLimits(); err != nil {
+		configError(err)
+	}
+	if err := setTemporaryPrefix(temporaryPrefix); err != nil {
+		configError(err)
+	}
+	setMaxInflightHooks(flags.maxInflightHooks)
+
+	if flags.profileDir != "" {
+		profiler = &Profiler{
+			dir:              flags.profileDir,
+			cpuDuration:      flags.profileDuration,
+			minInterval:      flags.profileInterval,
+			latencyThreshold: flags.profileLatency,
+		}
+	}
+
+	if size, err := parseSize(flags.maxBody); err != nil {
+		configError(err)
+	} else {
+		maxBodySize = int64(size)
+	}
+	if size, err := parseSize(flags.maxImport); err != nil {
+		configError(err)
+	} else {
+		maxImportSize = int64(size)
+	}
+	if err := setCompression(flags.compression); err != nil {
+		configError(err)
+	}
+	if size, err := parseSize(flags.compressionThresholdSize); err != nil {
+		configError(err)
+	} else {
+		compressionThreshold = int64(size)
+	}
+	if size, err := parseSize(flags.binaryThresholdSize); err != nil {
+		configError(err)
+	} else {
+		binaryThreshold = int64(size)
+	}
+
+	if flags.memoryLimit != "" {
+		limit, err := parseSize(flags.memoryLimit)
+		if err != nil {
+			configError(err)
+		}
+		go monitorMemory(limit, time.Second)
+	}
+	inspector = newInspector(flags.inspect, flags.inspectSize)
+	if len(flags.inspect) > 0 && adminToken == "" {
+		log.Warnln("The inspector requires --admin-token, captured requests won't be served")
+	}
+	if err := declareEndpoints(flags.declare); err != nil {
+		configError(err)
+	}
+	if readReplica && flags.redisURL == "" {
+		configError(fmt.Errorf("--read-replica requires --redis-url"))
+	} else if readReplica && flags.hookPort != 0 {
+		configError(fmt.Errorf("--read-replica doesn't accept hooks, --hook-port can't be set"))
+	}
+	standbyOf = strings.TrimRight(standbyOf, "/")
+	if standbyOf != "" {
+		if u, err := url.Parse(standbyOf); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			configError(fmt.Errorf("invalid --standby-of %q, expected the http(s) URL of the active instance", standbyOf))
+		} else if adminToken == "" {
+			configError(fmt.Errorf("--standby-of requires --admin-token"))
+		} else if standbySyncInterval <= 0 || standbyFailoverAfter < 0 {
+			configError(fmt.Errorf("invalid standby sync interval %v or failover delay %v", standbySyncInterval, standbyFailoverAfter))
+		}
+	}
+	if endpointOwnership && flags.redisURL == "" {
+		configError(fmt.Errorf("--endpoint-ownership requires --redis-url"))
+	}
+	if clusterHeartbeatInterval <= 0 {
+		configError(fmt.Errorf("invalid cluster heartbeat interval %v", clusterHeartbeatInterval))
+	}
+	if brokerBatchWindow < 0 || brokerBatchSize < 1 {
+		configError(fmt.Errorf("invalid broker batch window %v or size %d", brokerBatchWindow, brokerBatchSize))
+	}
+	if endpointIdleTimeout < 0 {
+		configError(fmt.Errorf("invalid endpoint idle timeout %v", endpointIdleTimeout))
+	} else if endpointIdleTimeout > 0 && !validateOnly {
+		interval := time.Minute
+		if endpointIdleTimeout < interval {
+			interval = endpointIdleTimeout
+		}
+		go collectIdleEndpoints(interval)
+	}
+	setRespondEndpoints(flags.respond)
+	setAckEndpoints(flags.ack)
+	if targets, err := parseForwardTargets(flags.forward); err != nil {
+		configError(err)
+	} else {
+		forwardTargets = targets
+	}
+	if secrets, err := parseForwardSecrets(flags.forwardSecretRules); err != nil {
+		configError(err)
+	} else {
+		forwardSecrets = secrets
+	}
+	if targets, err := parseBusTargets(flags.eventBus); err != nil {
+		configError(err)
+	} else {
+		busTargets = targets
+	}
+	if parsed, err := parseOrigins(flags.origins); err != nil {
+		configError(err)
+	} else {
+		allowedOrigins = parsed
+	}
+	if targets, err := parsePublishTargets(flags.clientPublish); err != nil {
+		configError(err)
+	} else {
+		publishTargets = targets
+	}
+	if responses, err := parseStaticResponses(flags.static); err != nil {
+		configError(err)
+	} else {
+		staticResponses = responses
+	}
+	if parsed, err := parseTransforms(flags.transform); err != nil {
+		configError(err)
+	} else {
+		transforms = parsed
+	}
+	if windows, err := parseDuplicateWindows(flags.collapseDuplicates); err != nil {
+		configError(err)
+	} else {
+		duplicates = newDuplicateCollapser(windows)
+	}
+	policies := make(map[string]pacePolicy)
+	if err := parsePacePolicies(paceDebounce, flags.debounce, policies); err != nil {
+		configError(err)
+	}
+	if err := parsePacePolicies(paceThrottle, flags.throttle, policies); err != nil {
+		configError(err)
+	}
+	pacing = newPacer(policies)
+	if windows, err := parseDeliveryWindows(flags.windowRules); err != nil {
+		configError(err)
+	} else {
+		deliveryWindows = newWindowHolder(windows)
+	}
+	if rules, err := parseAggregations(flags.aggregate); err != nil {
+		configError(err)
+	} else {
+		aggregations = newAggregator(rules)
+	}
+	if urls, err := parseValidationURLs(flags.validation); err != nil {
+		configError(err)
+	} else {
+		validationURLs = urls
+	}
+
+	if limits, err := parseHookLimits("endpoint", flags.rateLimits); err != nil {
+		configError(err)
+	} else {
+		hookRateLimits = limits
+	}
+	if limits, err := parseHookLimits("ip", flags.ipRateLimits); err != nil {
+		configError(err)
+	} else {
+		hookIPRateLimits = limits
+	}
+	if captureUndeclared && (!declaredOnly || quarantineSize <= 0) {
+		configError(fmt.Errorf("--capture-undeclared requires --declared-endpoints and --quarantine-size"))
+	}
+	switch flags.rateLimitBackendName {
+	case "memory":
+	case "redis":
+		if flags.redisURL == "" {
+			configError(fmt.Errorf("--rate-limit-backend redis requires --redis-url"))
+		} else if backend, err := newRedisRateLimits(flags.redisURL, flags.redisChannel+":ratelimit:"); err != nil {
+			configError(err)
+		} else {
+			rateLimitBackend = backend
+		}
+	default:
+		configError(fmt.Errorf("invalid rate limit backend %q, expected memory or redis", flags.rateLimitBackendName))
+	}
+
+	switch flags.historyCompression {
+	case "none", "gzip":
+		historyCompress = flags.historyCompression == "gzip"
+	default:
+		configError(fmt.Errorf("invalid history compression %q, expected none or gzip", flags.historyCompression))
+	}
+	if flags.historyKeyFile != "" {
+		if historyCipher, err = loadHistoryKey(flags.historyKeyFile); err != nil {
+			configError(err)
+		}
+	}
+}
+
+// setupSubsystems starts the alert detector and lifecycle webhooks, opens the logs, exporter and broker the flags
+// ask for and builds the handlers of the listeners
+func setupSubsystems(flags *commandFlags) *subsystems {
+	s := &subsystems{}
+	var err error
+
+	if flags.alerts {
+		alertDetector = newAlertDetector(flags.alertWindow, flags.alertSpikeFactor, flags.alertMinCount, flags.alertSilence, flags.alertSinks)
+		go alertDetector.Run()
+	}
+	s.webhooks, err = parseLifecycleWebhooks(flags.lifecycleTargets)
+	if err != nil {
+		configError(err)
+	}
+	startLifecycleWebhooks(s.webhooks)
+
+	if flags.historyDir != "" {
+		if s.history, err = newHistoryLog(flags.historyDir, flags.historyEndpoints, flags.historyRetention, flags.historyMaxMessages); err != nil {
+			configError(err)
+		}
+	}
+
+	if deliveryHistorySize > 0 {
+		if s.deliveries, err = newDeliveryLog(deliveryHistorySize, flags.historyDir); err != nil {
+			configError(err)
+		}
+	}
+
+	if len(flags.recordings) > 0 {
+		if s.recorder, err = newRecorder(flags.recordDir, flags.recordings, flags.recordMaxMessages); err != nil {
+			configError(err)
+		}
+	}
+
+	if flags.writeErrorBudget != 0 {
+		if writeBudget, err = newWriteBudget(flags.writeErrorBudget, flags.writeErrorWindow, flags.writeErrorMinWrites, flags.circuitCooldown); err != nil {
+			configError(err)
+		}
+	}
+
+	if flags.otlpEndpoint != "" {
+		if s.exporter, err = newOTLPExporter(flags.otlpEndpoint, flags.otlpHeaders, flags.otlpServiceName, flags.otlpInterval); err != nil {
+			configError(err)
+		}
+	}
+
+	if flags.redisURL != "" {
+		if s.redis, err = newRedisBroker(flags.redisURL, flags.redisChannel); err != nil {
+			configError(err)
+		}
+	}
+
+	if flags.timeSyncInterval > 0 {
+		timeSyncEnabled = true
+		go sendTimeSync(flags.timeSyncInterval)
+	}
+
+	// Hooks are either served alongside sockets or on their own listener, e.g. bound to an internal interface only
+	s.separateHooks = flags.hookPort != 0
+	if s.separateHooks {
+		landingHookPort = flags.hookPort
+	}
+	separateProbes = flags.healthPort != 0
+	s.rootHandler = router(!s.separateHooks, true)
+	s.hookHandler = router(true, false)
+
+	// Websocket upgrades are HTTP/1.1 requests and are passed through to the handler unchanged
+	if flags.enableH2C {
+		s.hookHandler = h2c.NewHandler(s.hookHandler, &http2.Server{})
+		if !s.separateHooks {
+			s.rootHandler = h2c.NewHandler(s.rootHandler, &http2.Server{})
+		}
+	}
+
+	s.tlsConf, err = tlsConfig(flags.tlsCerts, flags.tlsKeys, flags.autocertDomains, flags.autocertCache, flags.autocertEmail)
+	if err != nil {
+		configError(err)
+	} else if err := checkHostCertificates(s.tlsConf, flags.autocertDomains); err != nil {
+		configError(err)
+	}
+	return s
+}
+
+// startServers starts the subsystems and listeners, serving until the server is shut down. When only validating
+// the configuration, the environment is checked and the configuration reported instead.
+func startServers(flags *commandFlags, s *subsystems) {
+	if validateOnly {
+		listenAddresses := []string{fmt.Sprintf("%s:%d", flags.address, flags.port)}
+		if s.separateHooks {
+			listenAddresses = append(listenAddresses, fmt.Sprintf("%s:%d", flags.hookAddress, flags.hookPort))
+		}
+		if flags.grpcPort != 0 {
+			listenAddresses = append(listenAddresses, fmt.Sprintf("%s:%d", flags.grpcAddress, flags.grpcPort))
+		}
+		if separateProbes {
+			listenAddresses = append(listenAddresses, fmt.Sprintf("%s:%d", flags.healthAddress, flags.healthPort))
+		}
+		dirs := []string{}
+		if flags.profileDir != "" {
+			dirs = append(dirs, flags.profileDir)
+		}
+		if flags.historyDir != "" {
+			dirs = append(dirs, flags.historyDir)
+		}
+		if len(flags.recordings) > 0 && flags.recordDir != "" {
+			dirs = append(dirs, flags.recordDir)
+		}
+		if len(flags.autocertDomains) > 0 {
+			dirs = append(dirs, flags.autocertCache)
+		}
+		backends := append(flags.alertSinks, flags.migrateTo...)
+		for _, webhook := range s.webhooks {
+			backends = append(backends, webhook.target)
+		}
+		if flags.redisURL != "" {
+			backends = append(backends, flags.redisURL)
+		}
+		if flags.otlpEndpoint != "" {
+			backends = append(backends, flags.otlpEndpoint)
+		}
+		if standbyOf != "" {
+			backends = append(backends, standbyOf)
+		}
+		for _, target := range validationURLs {
+			backends = append(backends, target)
+		}
+		for _, targets := range forwardTargets {
+			backends = append(backends, targets...)
+		}
+		for _, targets := range busTargets {
+			backends = append(backends, targets...)
+		}
+		for _, target := range publishTargets {
+			if target != publishBroadcast {
+				backends = append(backends, target)
+			}
+		}
+		validateEnvironment(listenAddresses, dirs, backends)
+		reportConfig()
+	}
+
+	if s.redis != nil {
+		startBroker(s.redis)
+	}
+	if standbyOf != "" {
+		startStandby()
+	}
+	if s.exporter != nil {
+		otlpExporter = s.exporter
+		go s.exporter.Run()
+	}
+	if s.history != nil {
+		historyLog = s.history
+		go s.history.Run(time.Minute)
+	}
+	if s.deliveries != nil {
+		deliveryLog = s.deliveries
+		go s.deliveries.Run()
+	}
+	if s.recorder != nil {
+		recorder = s.recorder
+		s.recorder.Run(time.Minute)
+	}
+
+	rootServer := &http.Server{Addr: fmt.Sprintf("%s:%d", flags.address, flags.port), Handler: s.rootHandler, TLSConfig: s.tlsConf}
+	hookServer := &http.Server{Addr: fmt.Sprintf("%s:%d", flags.hookAddress, flags.hookPort), Handler: s.hookHandler, TLSConfig: s.tlsConf}
+	servers := []*http.Server{rootServer}
+	if s.separateHooks {
+		servers = append(servers, hookServer)
+	}
+	// gRPC needs HTTP/2, which plain listeners only speak through h2c
+	var grpcServer *http.Server
+	if flags.grpcPort != 0 {
+		var grpcHandler http.Handler = grpcRouter()
+		if s.tlsConf == nil {
+			grpcHandler = h2c.NewHandler(grpcHandler, &http2.Server{})
+		}
+		grpcServer = &http.Server{Addr: fmt.Sprintf("%s:%d", flags.grpcAddress, flags.grpcPort), Handler: grpcHandler, TLSConfig: s.tlsConf}
+		servers = append(servers, grpcServer)
+	}
+	probedServers = servers
+
+	// Drain connections when stopped, letting subscribers of the events endpoint know
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		shutdown(servers, sig, flags.drainTimeout)
+		close(stopped)
+	}()
+
+	if chaosEnabled() && adminToken == "" {
+		log.Warnln("Chaos mode is enabled without an admin token, /chaos won't be served")
+	} else if chaosEnabled() {
+		log.Warnln("Chaos mode is enabled, failures can be injected through /chaos")
+	}
 
 	// Start HTTP server
-	log.Infof("Sockethook is ready and listening at port %d ✅", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", *address, *port), nil))
+	startRecovery()
+	publishEvent("startup", map[string]interface{}{"port": flags.port})
+	if s.separateHooks {
+		go func() {
+			log.Infof("Accepting hooks at port %d", flags.hookPort)
+			listenAndServe(hookServer)
+		}()
+	}
+	if grpcServer != nil {
+		go func() {
+			log.Infof("Serving gRPC subscriptions at port %d", flags.grpcPort)
+			listenAndServe(grpcServer)
+		}()
+	}
+	// The probe listener isn't shut down with the others, so that readiness fails rather than probes being refused
+	// while draining
+	if separateProbes {
+		go func() {
+			log.Infof("Serving health probes at port %d", flags.healthPort)
+			listenAndServe(&http.Server{Addr: fmt.Sprintf("%s:%d", flags.healthAddress, flags.healthPort), Handler: probeRouter()})
+		}()
+	}
+	log.Infof("Sockethook is ready and listening at port %d ✅", flags.port)
+	listenAndServe(rootServer)
+	<-stopped
 }
@@ -0,0 +1,126 @@
+package sockethook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Token required by admin APIs such as /maintenance, which are disabled if empty
+var adminToken string
+
+// MaintenanceSettings describe the maintenance mode, during which hooks and new clients are rejected
+type MaintenanceSettings struct {
+	Active bool `json:"active"`
+	// Shown to clients, e.g. "Upgrading the database"
+	Message string `json:"message,omitempty"`
+	// How long clients and publishers should wait before retrying, e.g. "5m"
+	RetryAfter string `json:"retry_after,omitempty"`
+}
+
+// MaintenanceNotice tells clients that maintenance mode started or ended, existing connections are kept open
+type MaintenanceNotice struct {
+	Type         string `json:"type"`
+	Active       bool   `json:"active"`
+	Message      string `json:"message,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// Current maintenance mode
+var maintenance = struct {
+	sync.Mutex
+	settings   MaintenanceSettings
+	retryAfter time.Duration
+}{}
+
+// Retry delay suggested during maintenance when none is given
+var defaultMaintenanceRetry = time.Minute
+
+// inMaintenance checks if maintenance mode is active, returning the Retry-After header value to reject with
+func inMaintenance() (bool, string) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	seconds := int((maintenance.retryAfter + time.Second - 1) / time.Second)
+	return maintenance.settings.Active, strconv.Itoa(seconds)
+}
+
+// setMaintenance switches maintenance mode and notifies all connected clients and subscribers of the events
+// endpoint. Buffers and connections are kept.
+func setMaintenance(settings MaintenanceSettings) error {
+	retryAfter := defaultMaintenanceRetry
+	if settings.RetryAfter != "" {
+		var err error
+		if retryAfter, err = time.ParseDuration(settings.RetryAfter); err != nil {
+			return err
+		}
+	}
+	if !settings.Active {
+		settings = MaintenanceSettings{}
+	}
+
+	maintenance.Lock()
+	maintenance.settings, maintenance.retryAfter = settings, retryAfter
+	maintenance.Unlock()
+
+	log.WithField("active", settings.Active).WithField("message", settings.Message).Warnln("Maintenance mode changed")
+	publishEvent("maintenance", map[string]interface{}{"active": settings.Active, "message": settings.Message})
+
+	notice := MaintenanceNotice{Type: frameMaintenance, Active: settings.Active, Message: settings.Message}
+	if settings.Active {
+		notice.RetryAfterMs = int64(retryAfter / time.Millisecond)
+	}
+	for _, c := range hub.all() {
+		c.queue(notice)
+	}
+	return nil
+}
+
+// adminAuthorized checks that a request to an admin API carries the admin token
+func adminAuthorized(r *http.Request) bool {
+	return isAdminToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// isAdminToken checks if a token is the admin token, which is never the case without one
+func isAdminToken(token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// handleMaintenance shows (GET), changes (POST/PUT) or ends (DELETE) maintenance mode
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		settings := MaintenanceSettings{Active: true}
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := setMaintenance(settings); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case "DELETE":
+		setMaintenance(MaintenanceSettings{})
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.settings)
+}
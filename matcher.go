@@ -0,0 +1,126 @@
+package sockethook
+
+import "strings"
+
+// Wildcard segments of subscription patterns. A single wildcard matches exactly one path segment while a
+// trailing multi wildcard matches any number of remaining segments, including none.
+const (
+	singleWildcard = "*"
+	multiWildcard  = "**"
+)
+
+// matcher is a trie of subscription patterns keyed by path segment, so the patterns matching an endpoint are
+// found by walking its segments once no matter how many patterns are subscribed to
+type matcher struct {
+	root *matchNode
+}
+
+type matchNode struct {
+	children map[string]*matchNode
+	// Pattern ending at this node, empty if no pattern ends here
+	pattern string
+}
+
+func newMatcher() *matcher {
+	return &matcher{root: &matchNode{}}
+}
+
+// isPattern checks if an endpoint contains wildcards
+func isPattern(endpoint string) bool {
+	for _, segment := range segments(endpoint) {
+		if segment == singleWildcard || segment == multiWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// validPattern checks that a multi wildcard only appears as the last segment of an endpoint
+func validPattern(endpoint string) bool {
+	parts := segments(endpoint)
+	for i, segment := range parts {
+		if segment == multiWildcard && i != len(parts)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// segments splits an endpoint into its path segments
+func segments(endpoint string) []string {
+	return strings.Split(strings.Trim(endpoint, "/"), "/")
+}
+
+// Insert adds a pattern to the trie
+func (m *matcher) Insert(pattern string) {
+	node := m.root
+	for _, segment := range segments(pattern) {
+		if node.children == nil {
+			node.children = make(map[string]*matchNode)
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			child = &matchNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.pattern = pattern
+}
+
+// Remove deletes a pattern from the trie, pruning nodes which no longer lead to any pattern
+func (m *matcher) Remove(pattern string) {
+	m.root.remove(segments(pattern))
+}
+
+// remove deletes the pattern at the end of a path below this node and reports if the node may be pruned
+func (n *matchNode) remove(path []string) bool {
+	if len(path) == 0 {
+		n.pattern = ""
+	} else if child, ok := n.children[path[0]]; ok && child.remove(path[1:]) {
+		delete(n.children, path[0])
+	}
+	return n.pattern == "" && len(n.children) == 0
+}
+
+// Match returns all patterns matching an endpoint
+func (m *matcher) Match(endpoint string) []string {
+	return m.root.match(segments(endpoint), nil)
+}
+
+func (n *matchNode) match(path []string, matched []string) []string {
+	if multi, ok := n.children[multiWildcard]; ok && multi.pattern != "" {
+		matched = append(matched, multi.pattern)
+	}
+	if len(path) == 0 {
+		if n.pattern != "" {
+			matched = append(matched, n.pattern)
+		}
+		return matched
+	}
+
+	if child, ok := n.children[path[0]]; ok {
+		matched = child.match(path[1:], matched)
+	}
+	if child, ok := n.children[singleWildcard]; ok {
+		matched = child.match(path[1:], matched)
+	}
+	return matched
+}
+
+// patternCovers checks if a pattern matches every endpoint matched by another endpoint, which may be a pattern
+// itself
+func patternCovers(pattern string, endpoint string) bool {
+	p, e := segments(pattern), segments(endpoint)
+	for i, segment := range p {
+		switch {
+		case segment == multiWildcard:
+			return true
+		case i >= len(e) || e[i] == multiWildcard:
+			return false
+		case segment != singleWildcard && segment != e[i]:
+			return false
+		}
+	}
+	return len(p) == len(e)
+}
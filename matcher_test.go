@@ -0,0 +1,123 @@
+package sockethook
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatcherMatch(t *testing.T) {
+	m := newMatcher()
+	for _, pattern := range []string{"/orders", "/orders/*", "/orders/**", "/orders/*/paid", "/**", "/users/*/events/**"} {
+		m.Insert(pattern)
+	}
+
+	tests := []struct {
+		endpoint string
+		expected []string
+	}{
+		{"/orders", []string{"/**", "/orders", "/orders/**"}},
+		{"/orders/42", []string{"/**", "/orders/*", "/orders/**"}},
+		{"/orders/42/paid", []string{"/**", "/orders/**", "/orders/*/paid"}},
+		{"/orders/42/refunded", []string{"/**", "/orders/**"}},
+		{"/users", []string{"/**"}},
+		{"/users/ada/events", []string{"/**", "/users/*/events/**"}},
+		{"/users/ada/events/login/failed", []string{"/**", "/users/*/events/**"}},
+		{"/users/ada/profile", []string{"/**"}},
+	}
+	for _, test := range tests {
+		matched := m.Match(test.endpoint)
+		sort.Strings(matched)
+		if !reflect.DeepEqual(matched, test.expected) {
+			t.Errorf("Match(%q) = %v, expected %v", test.endpoint, matched, test.expected)
+		}
+	}
+}
+
+func TestMatcherRemove(t *testing.T) {
+	m := newMatcher()
+	m.Insert("/orders/*")
+	m.Insert("/orders/*/paid")
+	m.Remove("/orders/*")
+
+	if matched := m.Match("/orders/42"); len(matched) != 0 {
+		t.Errorf("Match(/orders/42) = %v after removing /orders/*, expected nothing", matched)
+	}
+	if matched := m.Match("/orders/42/paid"); !reflect.DeepEqual(matched, []string{"/orders/*/paid"}) {
+		t.Errorf("Match(/orders/42/paid) = %v, expected the remaining pattern", matched)
+	}
+	m.Remove("/orders/*/paid")
+	if len(m.root.children) != 0 {
+		t.Errorf("expected the trie to be pruned once empty, got %d children", len(m.root.children))
+	}
+}
+
+func TestPatternCovers(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		endpoint string
+		covers   bool
+	}{
+		{"/orders", "/orders", true},
+		{"/orders", "/users", false},
+		{"/orders/*", "/orders/42", true},
+		{"/orders/*", "/orders", false},
+		{"/orders/*", "/orders/42/paid", false},
+		{"/orders/*", "/orders/*", true},
+		{"/orders/*", "/orders/**", false},
+		{"/orders/**", "/orders", true},
+		{"/orders/**", "/orders/42/paid", true},
+		{"/orders/**", "/orders/**", true},
+		{"/orders/*/paid", "/orders/*/paid", true},
+		{"/orders/*/paid", "/orders/*/*", false},
+		{"/*/*", "/orders/*", true},
+		{"/**", "/anything/at/all", true},
+	}
+	for _, test := range tests {
+		if covers := patternCovers(test.pattern, test.endpoint); covers != test.covers {
+			t.Errorf("patternCovers(%q, %q) = %v, expected %v", test.pattern, test.endpoint, covers, test.covers)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		valid    bool
+		pattern  bool
+	}{
+		{"/orders", true, false},
+		{"/orders/*", true, true},
+		{"/orders/**", true, true},
+		{"/orders/*/paid", true, true},
+		{"/orders/**/paid", false, true},
+	}
+	for _, test := range tests {
+		if valid := validPattern(test.endpoint); valid != test.valid {
+			t.Errorf("validPattern(%q) = %v, expected %v", test.endpoint, valid, test.valid)
+		}
+		if pattern := isPattern(test.endpoint); pattern != test.pattern {
+			t.Errorf("isPattern(%q) = %v, expected %v", test.endpoint, pattern, test.pattern)
+		}
+	}
+}
+
+// BenchmarkMatcherMatch matches an endpoint against growing numbers of patterns, which should take about as long
+// for every size as only the patterns along the endpoint's path are visited
+func BenchmarkMatcherMatch(b *testing.B) {
+	for _, size := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprintf("%d patterns", size), func(b *testing.B) {
+			m := newMatcher()
+			for i := 0; i < size; i++ {
+				m.Insert(fmt.Sprintf("/tenants/%d/orders/*", i))
+				m.Insert(fmt.Sprintf("/tenants/%d/**", i))
+			}
+			m.Insert("/tenants/*/orders/*")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Match(fmt.Sprintf("/tenants/%d/orders/42", i%size))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package sockethook
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Load shedding levels, each one including the measures of the ones below it
+const (
+	shedNone = iota
+	// Trim buffered data such as captured requests
+	shedTrimBuffers
+	// Reject new socket connections
+	shedRejectClients
+	// Reject hooks with 429
+	shedRejectHooks
+)
+
+// Fractions of the memory limit at which each shedding level starts
+var shedThresholds = []float64{shedTrimBuffers: 0.8, shedRejectClients: 0.9, shedRejectHooks: 1.0}
+
+var shedLevelNames = []string{"none", "trim_buffers", "reject_clients", "reject_hooks"}
+
+// Fraction of the memory limit usage has to fall below before buffers are trimmed again, so that usage hovering
+// around the threshold doesn't trim them on every check
+var trimRearmThreshold = 0.7
+
+// Current load shedding level
+var shedLevel int32
+
+// shedding checks if the current load shedding level is at least the given one
+func shedding(level int32) bool {
+	return atomic.LoadInt32(&shedLevel) >= level
+}
+
+// monitorMemory compares memory used by the process against the limit every interval and adjusts load shedding
+func monitorMemory(limit uint64, interval time.Duration) {
+	trimmed := false
+	for range time.Tick(interval) {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		used := stats.Sys - stats.HeapReleased
+
+		level := int32(shedNone)
+		for l := shedTrimBuffers; l <= shedRejectHooks; l++ {
+			if float64(used) >= shedThresholds[l]*float64(limit) {
+				level = int32(l)
+			}
+		}
+
+		previous := atomic.SwapInt32(&shedLevel, level)
+		if level != previous {
+			log.WithFields(log.Fields{
+				"used":  used,
+				"limit": limit,
+				"level": shedLevelNames[level],
+			}).Warnln("Load shedding level changed")
+			publishEvent("load_shedding", map[string]interface{}{
+				"level": shedLevelNames[level],
+				"used":  used,
+				"limit": limit,
+			})
+		}
+
+		// Buffers are trimmed once each time the threshold is crossed, dropping their oldest half
+		if level >= shedTrimBuffers && !trimmed {
+			trimmed = true
+			profiler.Trigger("memory")
+			inspector.Trim()
+			replayBuffer.Trim()
+			debug.FreeOSMemory()
+		} else if float64(used) < trimRearmThreshold*float64(limit) {
+			trimmed = false
+		}
+	}
+}
+
+// parseSize parses a byte size such as 512MB or 2GB
+func parseSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := uint64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   uint64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.size
+			s = strings.TrimSuffix(s, unit.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,424 @@
+package sockethook
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve Prometheus metrics at /metrics
+var metricsEnabled = true
+
+// Number of distinct label values tracked per metric, further ones being counted under "other" so that
+// publishers can't grow the metrics without bound
+var maxMetricLabels = 1000
+
+// Dimensions which become metric labels, metrics being aggregated over the others
+var metricLabels = map[string]bool{"endpoint": true, "tenant": true, "event": true}
+
+// Endpoints given their own label, either exact endpoints or patterns under which all endpoints they match are
+// counted, e.g. /orders/* for endpoints with IDs in them. Endpoints not listed are counted under "other". If
+// empty, every endpoint gets its own label.
+var metricEndpoints []string
+
+// Header holding the event type of hooks, e.g. X-GitHub-Event, counted per event if set
+var metricsEventHeader string
+
+// Process wide metrics
+var metrics = struct {
+	hooksReceived          *counterVec
+	hookEvents             *counterVec
+	broadcasts             *counterVec
+	deliveries             *counterVec
+	ingressBytes           *counterVec
+	egressBytes            *counterVec
+	tenantIngressBytes     *counterVec
+	tenantEgressBytes      *counterVec
+	messageSize            *histogram
+	deliveryLatency        *histogram
+	hookBodySize           *histogramVec
+	hookHeaders            *histogramVec
+	remediations           *counterVec
+	forwards               *counterVec
+	busPublishes           *counterVec
+	publishes              *counterVec
+	paced                  *counterVec
+	duplicates             *counterVec
+	retries                *counterVec
+	suppressedRetries      *counterVec
+	rateLimitErrors        *counterVec
+	quarantined            *counterVec
+	windowed               *counterVec
+	rejections             *counterVec
+	abandonedHooks         *counterVec
+	lifecycleNotifications *counterVec
+}{
+	hooksReceived:          newCounterVec(),
+	hookEvents:             newCounterVec(),
+	broadcasts:             newCounterVec(),
+	deliveries:             newCounterVec(),
+	ingressBytes:           newCounterVec(),
+	egressBytes:            newCounterVec(),
+	tenantIngressBytes:     newCounterVec(),
+	tenantEgressBytes:      newCounterVec(),
+	messageSize:            newHistogram([]float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}),
+	deliveryLatency:        newHistogram([]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+	hookBodySize:           newHistogramVec([]float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}),
+	hookHeaders:            newHistogramVec([]float64{5, 10, 15, 20, 30, 50, 100}),
+	remediations:           newCounterVec(),
+	forwards:               newCounterVec(),
+	busPublishes:           newCounterVec(),
+	publishes:              newCounterVec(),
+	paced:                  newCounterVec(),
+	duplicates:             newCounterVec(),
+	retries:                newCounterVec(),
+	suppressedRetries:      newCounterVec(),
+	rateLimitErrors:        newCounterVec(),
+	quarantined:            newCounterVec(),
+	windowed:               newCounterVec(),
+	rejections:             newCounterVec(),
+	abandonedHooks:         newCounterVec(),
+	lifecycleNotifications: newCounterVec(),
+}
+
+// counterVec is a set of counters keyed by label values, e.g. per endpoint
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]float64)}
+}
+
+// Inc increments the counter of a label value
+func (v *counterVec) Inc(label string) {
+	v.Add(label, 1)
+}
+
+// Add adds to the counter of a label value, falling back to "other" once too many values are tracked
+func (v *counterVec) Add(label string, value float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.values[label]; !ok && len(v.values) >= maxMetricLabels {
+		label = "other"
+	}
+	v.values[label] += value
+}
+
+// snapshot returns a copy of the counters
+func (v *counterVec) snapshot() map[string]float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	values := make(map[string]float64, len(v.values))
+	for label, value := range v.values {
+		values[label] = value
+	}
+	return values
+}
+
+// histogram counts observations into cumulative buckets with the given upper bounds
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+// Observe adds a value to the histogram
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// write writes the histogram in the Prometheus text format
+func (h *histogram) write(w io.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.writeSeries(w, name, "", "")
+}
+
+// writeSeries writes the buckets, sum and count of the histogram with a label, left out if empty, must be
+// called with h.mu held
+func (h *histogram) writeSeries(w io.Writer, name string, label string, value string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(label, value, "le", formatFloat(bound)), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(label, value, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, formatLabels(label, value), formatFloat(h.sum), name, formatLabels(label, value), h.count)
+}
+
+// histogramVec is a histogram per value of a single label
+type histogramVec struct {
+	mu         sync.Mutex
+	bounds     []float64
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(bounds []float64) *histogramVec {
+	return &histogramVec{bounds: bounds, histograms: make(map[string]*histogram)}
+}
+
+// Observe adds a value to the histogram of a label value, falling back to "other" once too many values are
+// tracked
+func (v *histogramVec) Observe(label string, value float64) {
+	v.mu.Lock()
+	h, ok := v.histograms[label]
+	if !ok && len(v.histograms) >= maxMetricLabels {
+		label = "other"
+		h, ok = v.histograms[label]
+	}
+	if !ok {
+		h = newHistogram(v.bounds)
+		v.histograms[label] = h
+	}
+	v.mu.Unlock()
+	h.Observe(value)
+}
+
+// write writes the histograms in the Prometheus text format, sorted by label value
+func (v *histogramVec) write(w io.Writer, name string, help string, label string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	values := make([]string, 0, len(v.histograms))
+	for value := range v.histograms {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		h := v.histograms[value]
+		h.mu.Lock()
+		h.writeSeries(w, name, label, value)
+		h.mu.Unlock()
+	}
+}
+
+// observeDelivery records the outcome of writing a message to a client
+func observeDelivery(c *client, msg Message, err error) {
+	if err != nil {
+		metrics.deliveries.Inc("failure")
+		observeDeliveryFailure(msg.Endpoint)
+		return
+	}
+	metrics.deliveries.Inc("success")
+	metrics.egressBytes.Add(endpointLabel(msg.Endpoint), float64(msg.size))
+	metrics.tenantEgressBytes.Add(tenantLabel(c.namespace), float64(msg.size))
+	if !msg.received.IsZero() {
+		latency := time.Since(msg.received)
+		metrics.deliveryLatency.Observe(latency.Seconds())
+		sloTracker.Observe(msg.Endpoint, latency)
+	}
+}
+
+// setMetricLabels parses a comma-separated list of the dimensions which become labels
+func setMetricLabels(labels string) error {
+	metricLabels = make(map[string]bool)
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		switch label {
+		case "":
+		case "endpoint", "tenant", "event":
+			metricLabels[label] = true
+		default:
+			return fmt.Errorf("unknown metric label %q, expected endpoint, tenant or event", label)
+		}
+	}
+	return nil
+}
+
+// endpointLabel returns the label an endpoint is counted under, empty if endpoints aren't a label
+func endpointLabel(endpoint string) string {
+	if !metricLabels["endpoint"] {
+		return ""
+	}
+	if len(metricEndpoints) == 0 {
+		return endpoint
+	}
+	for _, allowed := range metricEndpoints {
+		if allowed == endpoint || (isPattern(allowed) && patternCovers(allowed, endpoint)) {
+			return allowed
+		}
+	}
+	return "other"
+}
+
+// tenantLabel returns the label of a host routing namespace, "default" for the one without a prefix and empty
+// if tenants aren't a label
+func tenantLabel(namespace string) string {
+	if !metricLabels["tenant"] {
+		return ""
+	}
+	if namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// observeHook records a hook received on an endpoint
+func observeHook(r *http.Request, namespace string, endpoint string, size int) {
+	metrics.hooksReceived.Inc(endpointLabel(endpoint))
+	metrics.messageSize.Observe(float64(size))
+	metrics.hookBodySize.Observe(endpointLabel(endpoint), float64(size))
+	metrics.hookHeaders.Observe(endpointLabel(endpoint), float64(len(r.Header)))
+	metrics.ingressBytes.Add(endpointLabel(endpoint), float64(size))
+	metrics.tenantIngressBytes.Add(tenantLabel(namespace), float64(size))
+	if metricsEventHeader != "" && metricLabels["event"] {
+		event := r.Header.Get(metricsEventHeader)
+		if event == "" {
+			event = "none"
+		}
+		metrics.hookEvents.Inc(event)
+	}
+}
+
+// handleMetrics serves all metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	clients := make(map[string]float64)
+	countries := make(map[string]float64)
+	counted := make(map[*client]bool)
+	evictions := make(map[string]float64)
+	hub.mu.Lock()
+	for endpoint, n := range hub.evictions {
+		evictions[endpointLabel(endpoint)] += float64(n)
+	}
+	for endpoint, conns := range hub.clients {
+		clients[endpointLabel(endpoint)] += float64(len(conns))
+		// Clients subscribed to several endpoints are counted once per country
+		for _, c := range conns {
+			if c.country != "" && !counted[c] {
+				counted[c] = true
+				countries[c.country]++
+			}
+		}
+	}
+	hub.mu.Unlock()
+
+	writeGauge(w, "sockethook_clients", "Number of clients subscribed to an endpoint.", "endpoint", clients)
+	if len(countries) > 0 {
+		writeGauge(w, "sockethook_clients_by_country", "Number of connected clients per country their IP resolves to with GeoIP.", "country", countries)
+	}
+	writeCounter(w, "sockethook_evictions_total", "Number of clients evicted per endpoint for being too slow, failing writes or being blocked.", "endpoint", evictions)
+	writeCounter(w, "sockethook_hooks_received_total", "Number of hooks received per endpoint.", "endpoint", metrics.hooksReceived.snapshot())
+	if metricsEventHeader != "" && metricLabels["event"] {
+		writeCounter(w, "sockethook_hook_events_total", "Number of hooks received per event type.", "event", metrics.hookEvents.snapshot())
+	}
+	writeCounter(w, "sockethook_broadcasts_total", "Number of messages queued for delivery (success), dropped because the endpoint's queue was full (failure), skipped because they were already delivered from the broker (duplicate), or forwarded to the instance owning their endpoint (forwarded).", "result", metrics.broadcasts.snapshot())
+	writeCounter(w, "sockethook_deliveries_total", "Number of messages written to clients (success), lost to write errors and slow clients (failure) or not delivered because the endpoint's circuit is open (circuit_open).", "result", metrics.deliveries.snapshot())
+	writeCounter(w, "sockethook_ingress_bytes_total", "Bytes of hook bodies received per endpoint.", "endpoint", metrics.ingressBytes.snapshot())
+	writeCounter(w, "sockethook_egress_bytes_total", "Bytes of messages written to clients per endpoint.", "endpoint", metrics.egressBytes.snapshot())
+	writeCounter(w, "sockethook_tenant_ingress_bytes_total", "Bytes of hook bodies received per host routing namespace.", "tenant", metrics.tenantIngressBytes.snapshot())
+	writeCounter(w, "sockethook_tenant_egress_bytes_total", "Bytes of messages written to clients per host routing namespace.", "tenant", metrics.tenantEgressBytes.snapshot())
+	metrics.messageSize.write(w, "sockethook_message_size_bytes", "Size of hook bodies in bytes.")
+	metrics.deliveryLatency.write(w, "sockethook_delivery_latency_seconds", "Time from receiving a hook to writing it to a client.")
+	metrics.hookBodySize.write(w, "sockethook_hook_body_size_bytes", "Size of hook bodies in bytes per endpoint.", "endpoint")
+	metrics.hookHeaders.write(w, "sockethook_hook_headers", "Number of headers of hooks per endpoint.", "endpoint")
+	writeCounter(w, "sockethook_forwards_total", "Number of hooks forwarded to targets (success), retried (retry), dead-lettered (failure) or requeued from the dead letters (requeued).", "result", metrics.forwards.snapshot())
+	writeCounter(w, "sockethook_event_bus_publishes_total", "Number of hooks published to event buses (success), retried (retry) or dead-lettered (failure).", "result", metrics.busPublishes.snapshot())
+	writeCounter(w, "sockethook_client_publishes_total", "Number of messages published by clients which were broadcasted, sent to a callback, failed or were rejected.", "result", metrics.publishes.snapshot())
+	writeCounter(w, "sockethook_paced_messages_total", "Number of messages of debounced and throttled endpoints which were held back and released later, or dropped.", "result", metrics.paced.snapshot())
+	writeCounter(w, "sockethook_delivery_hours_messages_total", "Number of messages held back outside their endpoint's delivery window, released once it opened, or dead-lettered.", "result", metrics.windowed.snapshot())
+	writeCounter(w, "sockethook_duplicates_total", "Number of messages suppressed for repeating the previous payload of their endpoint, and of reports delivered for them.", "result", metrics.duplicates.snapshot())
+	writeCounter(w, "sockethook_hook_retries_total", "Number of hooks which were retries of earlier deliveries, per provider.", "provider", metrics.retries.snapshot())
+	writeCounter(w, "sockethook_suppressed_retries_total", "Number of retried hooks which weren't broadcast as they were already delivered to a client, per provider.", "provider", metrics.suppressedRetries.snapshot())
+	writeCounter(w, "sockethook_rate_limit_backend_errors_total", "Number of rate limit checks made in memory because the rate limit backend failed.", "", metrics.rateLimitErrors.snapshot())
+	writeCounter(w, "sockethook_quarantined_hooks_total", "Number of hooks failing signature verification which were quarantined, dropped from a full quarantine, released by replaying them or discarded.", "result", metrics.quarantined.snapshot())
+	writeCounter(w, "sockethook_rejected_clients_total", "Number of websocket, event stream and gRPC clients rejected when connecting, per reason.", "reason", metrics.rejections.snapshot())
+	writeCounter(w, "sockethook_abandoned_hooks_total", "Number of hooks given up on because their publisher disconnected or shutdown timed out, per stage of handling.", "stage", metrics.abandonedHooks.snapshot())
+	writeCounter(w, "sockethook_lifecycle_notifications_total", "Number of server events sent to lifecycle webhooks, per result.", "result", metrics.lifecycleNotifications.snapshot())
+	writeCounter(w, "sockethook_remediations_total", "Number of remediations applied to clients and endpoints over their write error budget.", "action", metrics.remediations.snapshot())
+	if broker != nil {
+		writeClusterMetrics(w)
+	}
+	if writeBudget != nil {
+		writeGauge(w, "sockethook_open_circuits", "Number of endpoints whose circuit is open.", "", map[string]float64{"": float64(writeBudget.openCircuits())})
+	}
+	sloTracker.write(w)
+}
+
+// writeClusterMetrics writes the members of the cluster sharing the broker, their clients and the relay lag of
+// the other instances
+func writeClusterMetrics(w io.Writer) {
+	topology := clusterTopology()
+	clients := make(map[string]float64, len(topology.Nodes))
+	lag := make(map[string]float64, len(topology.Nodes))
+	for _, node := range topology.Nodes {
+		clients[node.Instance] = float64(node.Clients)
+		if !node.Self {
+			lag[node.Instance] = node.RelayLagSeconds
+		}
+	}
+	writeGauge(w, "sockethook_cluster_nodes", "Number of instances sharing the broker which were heard from recently, including this one.", "", map[string]float64{"": float64(len(topology.Nodes))})
+	writeGauge(w, "sockethook_cluster_node_clients", "Number of clients connected to each instance of the cluster.", "instance", clients)
+	writeGauge(w, "sockethook_cluster_relay_lag_seconds", "Time from another instance receiving a hook to its message arriving through the broker, for its latest message.", "instance", lag)
+}
+
+func writeCounter(w io.Writer, name string, help string, label string, values map[string]float64) {
+	writeMetric(w, name, help, "counter", label, values)
+}
+
+func writeGauge(w io.Writer, name string, help string, label string, values map[string]float64) {
+	writeMetric(w, name, help, "gauge", label, values)
+}
+
+// writeMetric writes a metric with one label in the Prometheus text format, sorted by label value
+func writeMetric(w io.Writer, name string, help string, kind string, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	labels := make([]string, 0, len(values))
+	for value := range values {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+	for _, value := range labels {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(label, value), formatFloat(values[value]))
+	}
+}
+
+// formatLabels formats label pairs given as name, value, ..., leaving out those with empty values
+func formatLabels(pairs ...string) string {
+	formatted := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			formatted = append(formatted, pairs[i]+"=\""+escapeLabel(pairs[i+1])+"\"")
+		}
+	}
+	if len(formatted) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(formatted, ",") + "}"
+}
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,207 @@
+package sockethook
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Version of the configuration file format written for this release. Files without a version are version 1.
+const configVersion = 2
+
+// configMigration upgrades a configuration file from one version to the next, returning what it changed so that
+// the file can be updated by hand later
+type configMigration struct {
+	from    int
+	migrate func(root *yaml.Node) ([]string, error)
+}
+
+// Migrations of older configuration files, in order
+var configMigrations = []configMigration{
+	// Version 2 groups the rate and burst of endpoint rate limits
+	{from: 1, migrate: migrateRateLimits},
+}
+
+// migrateConfig upgrades a configuration file to the current version, returning the upgraded file, the version
+// it had and what was changed. Files of the current version are returned as they are.
+func migrateConfig(data []byte) ([]byte, int, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, 0, nil, err
+	}
+	if len(doc.Content) == 0 {
+		return data, configVersion, nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return data, configVersion, nil, nil
+	}
+
+	version := 1
+	if node := mappingValue(root, "version"); node != nil {
+		v, err := strconv.Atoi(node.Value)
+		if err != nil || v < 1 {
+			return nil, 0, nil, fmt.Errorf("invalid version %q, expected a number", node.Value)
+		}
+		version = v
+	}
+	if version > configVersion {
+		return nil, 0, nil, fmt.Errorf("version %d is newer than version %d of this release of Sockethook", version, configVersion)
+	}
+	if version == configVersion {
+		return data, version, nil, nil
+	}
+
+	from := version
+	changes := []string{}
+	for _, migration := range configMigrations {
+		if migration.from != version {
+			continue
+		}
+		changed, err := migration.migrate(root)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("migrating from version %d: %v", version, err)
+		}
+		changes = append(changes, changed...)
+		version++
+	}
+	setMappingValue(root, "version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)})
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, 0, nil, err
+	}
+	return buf.Bytes(), from, changes, nil
+}
+
+// migrateRateLimits turns rate_limit and rate_burst of endpoints into rate_limit with a rate and burst, and the
+// same for ip_rate_limit and ip_rate_burst
+func migrateRateLimits(root *yaml.Node) ([]string, error) {
+	endpoints := mappingValue(root, "endpoints")
+	if endpoints == nil || endpoints.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	changes := []string{}
+	for i := 0; i+1 < len(endpoints.Content); i += 2 {
+		endpoint, settings := endpoints.Content[i].Value, endpoints.Content[i+1]
+		if settings.Kind != yaml.MappingNode {
+			continue
+		}
+		for _, keys := range [][2]string{{"rate_limit", "rate_burst"}, {"ip_rate_limit", "ip_rate_burst"}} {
+			rate, burst := mappingValue(settings, keys[0]), mappingValue(settings, keys[1])
+			if rate == nil && burst == nil {
+				continue
+			}
+			if (rate != nil && rate.Kind != yaml.ScalarNode) || (burst != nil && burst.Kind != yaml.ScalarNode) {
+				return nil, fmt.Errorf("endpoint %s: expected %s and %s to be numbers", endpoint, keys[0], keys[1])
+			}
+			limit := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			if rate != nil {
+				limit.Content = append(limit.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rate"}, rate)
+			}
+			if burst != nil {
+				limit.Content = append(limit.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "burst"}, burst)
+			}
+			removeMappingKey(settings, keys[1])
+			setMappingValue(settings, keys[0], limit)
+			changes = append(changes, fmt.Sprintf("endpoint %s: %s and %s are now the rate and burst of %s", endpoint, keys[0], keys[1], keys[0]))
+		}
+	}
+	return changes, nil
+}
+
+// mappingValue returns the value of a key of a YAML mapping, nil if it doesn't have it
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue replaces the value of a key of a YAML mapping, adding the key at the start if it doesn't have it
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	// Comments heading the mapping stay at its start
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	if len(mapping.Content) > 0 {
+		keyNode.HeadComment, mapping.Content[0].HeadComment = mapping.Content[0].HeadComment, ""
+	}
+	mapping.Content = append([]*yaml.Node{keyNode, value}, mapping.Content...)
+}
+
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// runMigrateConfig implements the migrate-config command, which upgrades a configuration file to the current
+// version and writes it to standard output, or back to the file with -w
+func runMigrateConfig(args []string) {
+	flags := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	write := flags.Bool("w", false, "Write the upgraded configuration back to the file instead of standard output.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sockethook migrate-config [options] <config.yaml>")
+		fmt.Fprintf(os.Stderr, "Upgrades a configuration file to version %d, the version of this release.\n", configVersion)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	logEntry := log.WithField("path", path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logEntry.Errorln("Migration failed:", err)
+		os.Exit(1)
+	}
+	migrated, from, changes, err := migrateConfig(data)
+	if err != nil {
+		logEntry.Errorln("Migration failed:", err)
+		os.Exit(1)
+	}
+	for _, change := range changes {
+		logEntry.Infoln("Migrated:", change)
+	}
+
+	if !*write {
+		os.Stdout.Write(migrated)
+		return
+	}
+	if from == configVersion {
+		logEntry.Infoln("Configuration is already at the current version")
+		return
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		err = ioutil.WriteFile(path, migrated, info.Mode())
+	}
+	if err != nil {
+		logEntry.Errorln("Migration failed:", err)
+		os.Exit(1)
+	}
+	logEntry.WithField("from", from).WithField("to", configVersion).Infoln("Configuration migrated ✅")
+}
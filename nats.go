@@ -0,0 +1,173 @@
+package sockethook
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long connecting to NATS and publishing a message may take
+var natsTimeout = 5 * time.Second
+
+// natsPublisher publishes to NATS over a single connection speaking the NATS client protocol, which is
+// reconnected when it fails. nats:// URLs connect in plain text unless the server requires TLS, tls:// URLs always
+// use TLS. Credentials are taken from the URL as user:password or a token as the user.
+type natsPublisher struct {
+	url *url.URL
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	closed bool
+}
+
+// natsInfo is the part of the INFO a NATS server greets clients with which matters for connecting
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect are the options a client sends after connecting
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+func newNATSPublisher(u *url.URL) (Publisher, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q, missing host", u.String())
+	}
+	return &natsPublisher{url: u}, nil
+}
+
+// Publish sends a payload to a subject and waits for the server to have processed it, reconnecting first if
+// the previous connection failed
+func (p *natsPublisher) Publish(subject string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errBrokerClosed
+	}
+	if p.conn == nil {
+		conn, reader, err := p.dial()
+		if err != nil {
+			return err
+		}
+		p.conn, p.reader = conn, reader
+	}
+
+	// A PING after the message is answered once the server processed it, or with an error if it refused it
+	p.conn.SetDeadline(time.Now().Add(natsTimeout))
+	command := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+	_, err := p.conn.Write([]byte(command))
+	if err == nil {
+		err = natsWaitPong(p.conn, p.reader)
+	}
+	if err != nil {
+		p.conn.Close()
+		p.conn, p.reader = nil, nil
+	}
+	return err
+}
+
+// dial connects and authenticates to the server
+func (p *natsPublisher) dial() (net.Conn, *bufio.Reader, error) {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		host = net.JoinHostPort(p.url.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+
+	// Servers greet clients with their INFO in plain text, after which the connection is upgraded to TLS
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected greeting from NATS: %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired || p.url.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.url.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn, reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := natsConnect{Name: "sockethook", Lang: "go", Version: version, Protocol: 1}
+	if user := p.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			options.User, options.Pass = user.Username(), pass
+		} else {
+			options.AuthToken = user.Username()
+		}
+	}
+	data, _ := json.Marshal(options)
+	_, err = conn.Write([]byte("CONNECT " + string(data) + "\r\nPING\r\n"))
+	if err == nil {
+		err = natsWaitPong(conn, reader)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// natsWaitPong reads from a connection until the server answers a PING, answering its own PINGs and skipping
+// other messages
+func natsWaitPong(conn net.Conn, reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// Close closes the connection, after which publishing fails
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.reader = nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Origins browsers may connect and send requests from besides the server's own, as exact origins or hosts or
+// wildcards of subdomains such as https://*.example.com
+var allowedOrigins []string
+
+// Accept any origin, as Sockethook did before origins were checked
+var insecureOrigins = false
+
+// How long browsers may cache the answers to CORS preflight requests
+var corsMaxAge = 10 * time.Minute
+
+// parseOrigins parses allowed origins, each value being a comma-separated list
+func parseOrigins(values []string) ([]string, error) {
+	origins := []string{}
+	for _, value := range values {
+		for _, origin := range strings.Split(value, ",") {
+			origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+			if origin == "" {
+				continue
+			}
+			if err := checkOrigin(origin); err != nil {
+				return nil, err
+			}
+			origins = append(origins, origin)
+		}
+	}
+	return origins, nil
+}
+
+// checkOrigin checks that an allowed origin is an http:// or https:// origin or a host, which may start with a
+// *. wildcard
+func checkOrigin(origin string) error {
+	if origin == "*" {
+		return fmt.Errorf("invalid allowed origin *, use --insecure-origins to allow any origin")
+	}
+	host := origin
+	if i := strings.Index(origin, "://"); i >= 0 {
+		if scheme := origin[:i]; scheme != "http" && scheme != "https" {
+			return fmt.Errorf("invalid allowed origin %q, expected an http:// or https:// origin", origin)
+		}
+		host = origin[i+3:]
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return fmt.Errorf("invalid allowed origin %q, expected an origin such as https://app.example.com or *.example.com", origin)
+	}
+	return nil
+}
+
+// matchOrigin checks if an origin sent by a browser matches an allowed origin. Allowed origins without a scheme
+// match both http and https, and *.example.com matches the subdomains of example.com but not example.com itself.
+func matchOrigin(allowed string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := allowed
+	if i := strings.Index(allowed, "://"); i >= 0 {
+		if allowed[:i] != u.Scheme {
+			return false
+		}
+		host = allowed[i+3:]
+	}
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(strings.ToLower(u.Host), strings.ToLower(host[1:]))
+	}
+	return strings.EqualFold(host, u.Host)
+}
+
+// matchOrigins checks if an origin matches any of the allowed origins
+func matchOrigins(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		if matchOrigin(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin checks if a browser sent a request from a page served by the host it was sent to
+func sameOrigin(origin string, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
+
+// originAllowed checks if clients connecting from an origin to a host may subscribe to an endpoint. The origins
+// of an endpoint's settings take precedence, otherwise requests without an origin, which don't come from
+// browsers, and those from the host itself or allowed origins are. The endpoint is empty for requests not
+// concerning one, such as to the admin API.
+func originAllowed(origin string, host string, endpoint string) bool {
+	if settings := settingsFor(endpoint); settings != nil && len(settings.origins) > 0 {
+		return matchOrigins(settings.origins, strings.TrimRight(origin, "/"))
+	}
+	if origin == "" || insecureOrigins {
+		return true
+	}
+	return sameOrigin(origin, host) || matchOrigins(allowedOrigins, origin)
+}
+
+// handleCORS sets the CORS headers of requests from browsers to hooks and the admin API and answers preflight
+// requests, returning false if the request was answered. Requests from origins which aren't allowed are
+// rejected with 403, so that pages elsewhere can't send hooks or use an admin token stored in the browser.
+func handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	if !originAllowed(origin, r.Host, "") {
+		log.WithField("origin", origin).WithField("path", r.URL.Path).Warnln("Rejected request, origin not allowed")
+		w.WriteHeader(403)
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(204)
+		return false
+	}
+	w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+	return true
+}
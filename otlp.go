@@ -0,0 +1,231 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exporter of delivery events as OpenTelemetry logs, nil if disabled
+var otlpExporter *OTLPExporter
+
+// Number of log records buffered for export before new ones are dropped
+var otlpQueueSize = 4096
+
+// Maximum number of log records sent in one request
+var otlpBatchSize = 512
+
+// Severity numbers of the OpenTelemetry log data model
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+// OTLPExporter sends structured delivery events to an OpenTelemetry collector using OTLP over HTTP with JSON
+// encoding, in batches from its own goroutine so that a slow collector never holds up delivery
+type OTLPExporter struct {
+	url         string
+	headers     map[string]string
+	serviceName string
+	interval    time.Duration
+	client      *http.Client
+
+	records chan otlpRecord
+	flush   chan chan struct{}
+}
+
+// otlpRecord is a log record waiting to be exported
+type otlpRecord struct {
+	at         time.Time
+	severity   int
+	event      string
+	body       string
+	attributes map[string]interface{}
+}
+
+// newOTLPExporter creates an exporter for a collector's base URL such as http://localhost:4318, with extra
+// request headers given as Name=value, e.g. for authentication
+func newOTLPExporter(endpoint string, headers []string, serviceName string, interval time.Duration) (*OTLPExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected an http:// or https:// URL", endpoint)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid OTLP export interval %v", interval)
+	}
+
+	e := &OTLPExporter{
+		url:         strings.TrimRight(endpoint, "/") + "/v1/logs",
+		headers:     make(map[string]string),
+		serviceName: serviceName,
+		interval:    interval,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		records:     make(chan otlpRecord, otlpQueueSize),
+		flush:       make(chan chan struct{}),
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected Name=value", header)
+		}
+		e.headers[parts[0]] = parts[1]
+	}
+	return e, nil
+}
+
+// exportEvent queues a delivery event for export, dropping it if the queue is full
+func exportEvent(severity int, event string, body string, attributes map[string]interface{}) {
+	if otlpExporter == nil {
+		return
+	}
+
+	select {
+	case otlpExporter.records <- otlpRecord{at: time.Now(), severity: severity, event: event, body: body, attributes: attributes}:
+	default:
+		log.WithField("event", event).Debugln("OTLP export queue full, dropping log record")
+	}
+}
+
+// Run exports queued records whenever a batch is full or the interval has passed
+func (e *OTLPExporter) Run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := make([]otlpRecord, 0, otlpBatchSize)
+	for {
+		select {
+		case record := <-e.records:
+			batch = append(batch, record)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-e.flush:
+			// Drain what's queued so far, then export it before acknowledging the flush
+			for len(e.records) > 0 {
+				batch = append(batch, <-e.records)
+				if len(batch) >= otlpBatchSize {
+					e.export(batch)
+					batch = batch[:0]
+				}
+			}
+			e.export(batch)
+			batch = batch[:0]
+			close(done)
+			continue
+		}
+
+		e.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// Flush exports all queued records, waiting at most until the timeout
+func (e *OTLPExporter) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// export sends a batch of records to the collector
+func (e *OTLPExporter) export(batch []otlpRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Errorln("Failed to encode OTLP logs:", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorln("Failed to create OTLP request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.WithField("url", e.url).WithField("records", len(batch)).Warnln("Failed to export OTLP logs:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.WithField("url", e.url).WithField("records", len(batch)).Warnln("Failed to export OTLP logs: status", resp.StatusCode)
+	}
+}
+
+// encode builds an ExportLogsServiceRequest in the JSON encoding of OTLP, in which 64-bit integers are strings
+func (e *OTLPExporter) encode(batch []otlpRecord) map[string]interface{} {
+	records := make([]map[string]interface{}, len(batch))
+	for i, record := range batch {
+		attributes := []map[string]interface{}{otlpAttribute("event.name", record.event)}
+		for key, value := range record.attributes {
+			attributes = append(attributes, otlpAttribute(key, value))
+		}
+
+		severityText := "INFO"
+		if record.severity >= otlpSeverityWarn {
+			severityText = "WARN"
+		}
+		timestamp := strconv.FormatInt(record.at.UnixNano(), 10)
+		records[i] = map[string]interface{}{
+			"timeUnixNano":         timestamp,
+			"observedTimeUnixNano": timestamp,
+			"severityNumber":       record.severity,
+			"severityText":         severityText,
+			"body":                 map[string]interface{}{"stringValue": record.body},
+			"attributes":           attributes,
+		}
+	}
+
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{
+					otlpAttribute("service.name", e.serviceName),
+					otlpAttribute("service.version", version),
+					otlpAttribute("service.instance.id", instanceID),
+				},
+			},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": "sockethook", "version": version},
+				"logRecords": records,
+			}},
+		}},
+	}
+}
+
+// otlpAttribute encodes a key-value pair, as a string unless it's a number or boolean
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var encoded map[string]interface{}
+	switch v := value.(type) {
+	case int:
+		encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		encoded = map[string]interface{}{"doubleValue": v}
+	case bool:
+		encoded = map[string]interface{}{"boolValue": v}
+	default:
+		encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return map[string]interface{}{"key": key, "value": encoded}
+}
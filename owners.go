@@ -0,0 +1,86 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// EndpointOwnership tells who is responsible for an endpoint and how to reach them, so that on-call engineers know
+// who to page when it misbehaves
+type EndpointOwnership struct {
+	Owner       string `json:"owner,omitempty"`
+	Contact     string `json:"contact,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Ownership of endpoints and patterns set through the admin API, taking precedence over the configuration file
+var ownerships = struct {
+	sync.RWMutex
+	endpoints map[string]EndpointOwnership
+}{endpoints: make(map[string]EndpointOwnership)}
+
+func (o EndpointOwnership) empty() bool {
+	return o == EndpointOwnership{}
+}
+
+// ownershipOf returns the ownership of an endpoint, set for the endpoint itself or else a pattern covering it, nil
+// if it has none. Ownership set through the admin API takes precedence over the configuration file.
+func ownershipOf(endpoint string) *EndpointOwnership {
+	ownerships.RLock()
+	admin := ownerships.endpoints
+	ownership, ok := admin[endpoint]
+	if !ok {
+		for pattern, o := range admin {
+			if isPattern(pattern) && patternCovers(pattern, endpoint) {
+				ownership, ok = o, true
+				break
+			}
+		}
+	}
+	ownerships.RUnlock()
+	if ok {
+		return &ownership
+	}
+
+	configured.RLock()
+	defer configured.RUnlock()
+	if settings := configured.endpoints[endpoint]; settings != nil && !settings.ownership.empty() {
+		ownership := settings.ownership
+		return &ownership
+	}
+	for pattern, settings := range configured.endpoints {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) && !settings.ownership.empty() {
+			ownership := settings.ownership
+			return &ownership
+		}
+	}
+	return nil
+}
+
+// setOwnership sets the ownership of an endpoint through the admin API, removing it if it's empty
+func setOwnership(endpoint string, ownership EndpointOwnership) {
+	ownerships.Lock()
+	defer ownerships.Unlock()
+	if ownership.empty() {
+		delete(ownerships.endpoints, endpoint)
+		return
+	}
+	ownerships.endpoints[endpoint] = ownership
+}
+
+// readOwnership reads the ownership sent when declaring an endpoint, returning false if the body is empty and the
+// ownership is to be left as it is
+func readOwnership(r *http.Request) (EndpointOwnership, bool, error) {
+	var ownership EndpointOwnership
+	err := json.NewDecoder(r.Body).Decode(&ownership)
+	if err == io.EOF {
+		return ownership, false, nil
+	}
+	if err != nil {
+		return ownership, false, fmt.Errorf("invalid body: %v", err)
+	}
+	return ownership, true, nil
+}
@@ -0,0 +1,103 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Give every endpoint an owner among the writer instances sharing the broker, which numbers, orders and publishes
+// the endpoint's messages for the whole cluster so that every instance delivers them in the same order
+var endpointOwnership = false
+
+// endpointForward is a message received by an instance which doesn't own its endpoint, published for the owner
+type endpointForward struct {
+	Owner   string  `json:"owner"`
+	Message Message `json:"message"`
+}
+
+// ownershipActive returns whether messages are numbered by the owners of their endpoints
+func ownershipActive() bool {
+	return endpointOwnership && broker != nil
+}
+
+// endpointOwner returns the writer instance owning an endpoint, chosen by rendezvous hashing, a form of consistent
+// hashing, over the members of the cluster taking part in endpoint ownership. When an instance joins or leaves,
+// only the endpoints it owns, or comes to own, move. Returns an empty owner if there's no writer.
+func endpointOwner(endpoint string) string {
+	members := []string{}
+	if !readReplica {
+		members = append(members, instanceID)
+	}
+	for instance, p := range clusterPeers() {
+		if !p.heartbeat.ReadReplica && p.heartbeat.EndpointOwnership {
+			members = append(members, instance)
+		}
+	}
+	return rendezvousOwner(members, endpoint)
+}
+
+// rendezvousOwner returns the member with the highest hash of it and the endpoint, the lowest ID on ties
+func rendezvousOwner(members []string, endpoint string) string {
+	owner, highest := "", uint64(0)
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(endpoint))
+		weight := h.Sum64()
+		if owner == "" || weight > highest || (weight == highest && member < owner) {
+			owner, highest = member, weight
+		}
+	}
+	return owner
+}
+
+// forwardToOwner publishes a message for the owner of its endpoint if that's another instance, returning whether
+// it did. Messages are delivered locally if the broker fails, keeping them flowing at the cost of their order.
+func forwardToOwner(msg Message) bool {
+	if !ownershipActive() || msg.forwarded || isReserved(msg.Endpoint) {
+		return false
+	}
+	owner := endpointOwner(msg.Endpoint)
+	if owner == "" || owner == instanceID {
+		return false
+	}
+
+	logEntry := log.WithField("endpoint", msg.Endpoint).WithField("id", msg.ID).WithField("owner", owner)
+	payload, err := json.Marshal(brokerEnvelope{Instance: instanceID, Forward: &endpointForward{Owner: owner, Message: msg}})
+	if err == nil {
+		err = broker.Publish(payload)
+	}
+	if err != nil {
+		logEntry.Warnln("Failed to forward message to the owner of its endpoint, delivering it locally:", err)
+		return false
+	}
+	logEntry.Debugln("Forwarded message to the owner of its endpoint")
+	return true
+}
+
+// handleForward broadcasts a message forwarded by another instance if this instance owns its endpoint. Owners
+// broadcast forwarded messages even if they no longer see themselves as owners, so that messages don't bounce
+// between instances while they disagree about the members of the cluster.
+func handleForward(forward endpointForward) {
+	if forward.Owner != instanceID {
+		return
+	}
+	msg := forward.Message
+	msg.forwarded = true
+	if received, err := time.Parse(time.RFC3339Nano, msg.ReceivedAt); err == nil {
+		msg.received = received
+	}
+	hub.Broadcast(msg)
+}
+
+// followOwner continues the numbering of an endpoint from the sequence number its owner gave a message, so that
+// every instance numbers the endpoint's messages alike
+func followOwner(msg Message) {
+	if ownershipActive() && msg.Seq > 0 {
+		advanceSequence(msg.Endpoint, msg.Seq-1)
+	}
+}
@@ -0,0 +1,125 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRendezvousOwnerMovesOnlyEndpointsOfChangedMembers(t *testing.T) {
+	owned := make(map[string]int)
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		endpoint := fmt.Sprintf("/orders/%d", i)
+		owner := rendezvousOwner([]string{"a", "b", "c"}, endpoint)
+		owned[owner]++
+		before[endpoint] = owner
+	}
+	for _, member := range []string{"a", "b", "c"} {
+		if owned[member] < 200 {
+			t.Errorf("%s owns %d of 1000 endpoints", member, owned[member])
+		}
+	}
+
+	for endpoint, owner := range before {
+		after := rendezvousOwner([]string{"c", "a"}, endpoint)
+		if owner != "b" && after != owner {
+			t.Errorf("%s moved from %s to %s when b left", endpoint, owner, after)
+		}
+		if owner == "b" && after == "b" {
+			t.Errorf("%s still owned by b after it left", endpoint)
+		}
+	}
+	if owner := rendezvousOwner(nil, "/orders"); owner != "" {
+		t.Errorf("owner %q without members", owner)
+	}
+}
+
+// publishedEnvelopes returns the envelopes published to a test broker, emptying it
+func publishedEnvelopes(t *testing.T, b *testBroker) []brokerEnvelope {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var envelopes []brokerEnvelope
+	for _, payload := range b.published {
+		envelope, err := decodeBrokerPayload(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	b.published = nil
+	return envelopes
+}
+
+func TestEndpointOwnership(t *testing.T) {
+	b := &testBroker{}
+	defer func(active bool, previous Broker, queue chan Message) {
+		endpointOwnership, broker, brokerQueue = active, previous, queue
+		peers.Lock()
+		peers.nodes = make(map[string]*peer)
+		peers.Unlock()
+	}(endpointOwnership, broker, brokerQueue)
+	endpointOwnership, broker, brokerQueue = true, b, make(chan Message, 10)
+	observeHeartbeat("peer-z", nodeHeartbeat{EndpointOwnership: true})
+	observeHeartbeat("replica", nodeHeartbeat{ReadReplica: true, EndpointOwnership: true})
+	observeHeartbeat("unowned", nodeHeartbeat{})
+
+	// Endpoints are spread over the writers taking part, read replicas and other writers owning none
+	var remote, local string
+	for remote == "" || local == "" {
+		endpoint := uniqueEndpoint("/test/ownership")
+		switch endpointOwner(endpoint) {
+		case "peer-z":
+			remote = endpoint
+		case instanceID:
+			local = endpoint
+		case "replica", "unowned":
+			t.Fatalf("%s owns %s", endpointOwner(endpoint), endpoint)
+		}
+	}
+	replayBuffer.SetOverrides(map[string]int{local: 10, remote: 10})
+	defer replayBuffer.SetOverrides(nil)
+
+	// Messages of endpoints owned by another instance are forwarded to it rather than delivered
+	hub.Broadcast(Message{ID: "remote", Endpoint: remote})
+	envelopes := publishedEnvelopes(t, b)
+	if len(envelopes) != 1 || envelopes[0].Forward == nil || envelopes[0].Forward.Owner != "peer-z" || envelopes[0].Forward.Message.ID != "remote" {
+		t.Fatalf("expected the message to be forwarded to peer-z, published %+v", envelopes)
+	}
+	if seq := currentSequence(remote); seq != 0 {
+		t.Errorf("forwarded message numbered %d locally", seq)
+	}
+
+	// Messages forwarded to this instance as the owner are numbered here and published with their number
+	payload, _ := json.Marshal(brokerEnvelope{Instance: "peer-z", Forward: &endpointForward{Owner: instanceID, Message: Message{ID: "local", Endpoint: local}}})
+	handleBrokerPayload(payload)
+	waitForBuffered(t, local, 0, 1)
+	numbered := <-brokerQueue
+	if numbered.ID != "local" || numbered.Seq != 1 {
+		t.Errorf("published %s numbered %d, expected local numbered 1", numbered.ID, numbered.Seq)
+	}
+	// Those forwarded to another owner are left to it
+	payload, _ = json.Marshal(brokerEnvelope{Instance: "peer-z", Forward: &endpointForward{Owner: "peer-y", Message: Message{ID: "other", Endpoint: local}}})
+	handleBrokerPayload(payload)
+
+	// Messages of other owners continue their numbering, under IDs of their own as instances skip those they saw
+	followed := "followed" + remote
+	payload, _ = json.Marshal(brokerEnvelope{Instance: "peer-z", Message: &Message{ID: followed, Endpoint: remote, Seq: 7}})
+	handleBrokerPayload(payload)
+	if messages := waitForBuffered(t, remote, 0, 1); messages[0].ID != followed || messages[0].Seq != 7 {
+		t.Errorf("delivered %s numbered %d, expected %s numbered 7", messages[0].ID, messages[0].Seq, followed)
+	}
+
+	// Once the owner left the cluster its endpoints are owned by the remaining writers
+	peers.Lock()
+	peers.nodes["peer-z"].lastSeen = time.Now().Add(-4 * clusterHeartbeatInterval)
+	peers.Unlock()
+	if owner := endpointOwner(remote); owner != instanceID {
+		t.Errorf("%s owned by %q after peer-z left", remote, owner)
+	}
+	if seq := currentSequence(local); seq != 1 {
+		t.Errorf("message forwarded to another owner was numbered, sequence %d", seq)
+	}
+}
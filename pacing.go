@@ -0,0 +1,182 @@
+package sockethook
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pacing policies
+const (
+	// Only the last message is delivered, once the endpoint has been quiet for the interval
+	paceDebounce = "debounce"
+	// At most one message is delivered per interval, the first right away and the last of the rest once it ends
+	paceThrottle = "throttle"
+)
+
+// Option of pacing policies which sets the number of messages dropped in favor of a delivered one
+const paceCollapsed = "collapsed"
+
+// Pacing policies of endpoints given on the command line
+var pacing = newPacer(nil)
+
+// pacePolicy is how an endpoint or pattern's messages are paced
+type pacePolicy struct {
+	policy   string
+	interval time.Duration
+	// Whether delivered messages carry the number of messages dropped in their favor
+	collapsed bool
+}
+
+// pacer holds back messages of noisy endpoints, such as repeated status pings, delivering fewer of them
+type pacer struct {
+	policies map[string]pacePolicy
+
+	mu     sync.Mutex
+	states map[string]*paceState
+}
+
+// paceState is the state of an endpoint whose messages are being held back
+type paceState struct {
+	policy pacePolicy
+	timer  *time.Timer
+	// Last message held back, if any, and the number of messages dropped since the last delivery
+	held    *Message
+	dropped int
+}
+
+func newPacer(policies map[string]pacePolicy) *pacer {
+	return &pacer{policies: policies, states: make(map[string]*paceState)}
+}
+
+// parsePacePolicies parses pacing policies of the form /endpoint=interval or /endpoint=interval:collapsed
+func parsePacePolicies(policy string, rules []string, policies map[string]pacePolicy) error {
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return fmt.Errorf("invalid %s %q, expected /endpoint=interval[:collapsed]", policy, rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		if isReserved(endpoint) {
+			return fmt.Errorf("invalid %s %q, endpoint is reserved", policy, rule)
+		}
+		if _, ok := policies[endpoint]; ok {
+			return fmt.Errorf("invalid %s %q, endpoint is already debounced or throttled", policy, rule)
+		}
+
+		spec := strings.SplitN(parts[1], ":", 2)
+		interval, err := time.ParseDuration(spec[0])
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid %s interval %q", policy, spec[0])
+		}
+		p := pacePolicy{policy: policy, interval: interval}
+		if len(spec) == 2 {
+			if spec[1] != paceCollapsed {
+				return fmt.Errorf("invalid %s option %q, expected collapsed", policy, spec[1])
+			}
+			p.collapsed = true
+		}
+		policies[endpoint] = p
+	}
+	return nil
+}
+
+// policy returns the pacing policy of an endpoint, an exact policy taking precedence over patterns
+func (p *pacer) policy(endpoint string) (pacePolicy, bool) {
+	if policy, ok := p.policies[endpoint]; ok {
+		return policy, true
+	}
+	for pattern, policy := range p.policies {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return policy, true
+		}
+	}
+	return pacePolicy{}, false
+}
+
+// Hold checks if a message is held back by its endpoint's pacing policy, returning false if it's to be
+// delivered right away
+func (p *pacer) Hold(msg Message) bool {
+	if len(p.policies) == 0 || isReserved(msg.Endpoint) {
+		return false
+	}
+	policy, ok := p.policy(msg.Endpoint)
+	if !ok {
+		return false
+	}
+	endpoint := msg.Endpoint
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.states[endpoint]
+	if !ok {
+		s = &paceState{policy: policy}
+		s.timer = time.AfterFunc(policy.interval, func() { p.release(endpoint, false) })
+		p.states[endpoint] = s
+		// The first message of a throttled interval is delivered right away and starts it
+		if policy.policy == paceThrottle {
+			return false
+		}
+	} else if policy.policy == paceDebounce {
+		s.timer.Reset(policy.interval)
+	}
+
+	if s.held != nil {
+		s.dropped++
+		metrics.paced.Inc("dropped")
+	}
+	s.held = &msg
+	return true
+}
+
+// release delivers the message held back for an endpoint, if any. A throttled endpoint starts a new interval
+// when a message is delivered, and stops being throttled after an interval without messages or if stop is set.
+func (p *pacer) release(endpoint string, stop bool) {
+	p.mu.Lock()
+	s, ok := p.states[endpoint]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	policy, held, dropped := s.policy, s.held, s.dropped
+	s.held, s.dropped = nil, 0
+	if held == nil || stop || policy.policy == paceDebounce {
+		s.timer.Stop()
+		delete(p.states, endpoint)
+	} else {
+		s.timer.Reset(policy.interval)
+	}
+	p.mu.Unlock()
+	if held == nil {
+		return
+	}
+
+	msg := *held
+	msg.paced = true
+	if policy.collapsed {
+		msg.Collapsed = dropped
+	}
+	// Holding back is deliberate, so latency budgets count from the release
+	msg.received = time.Now()
+	metrics.paced.Inc("released")
+	log.WithFields(log.Fields{"endpoint": endpoint, "policy": policy.policy, "dropped": dropped}).Debugln("Releasing paced message")
+	hub.Broadcast(msg)
+}
+
+// FlushAll delivers all held back messages right away, such as when shutting down
+func (p *pacer) FlushAll() {
+	p.mu.Lock()
+	endpoints := make([]string, 0, len(p.states))
+	for endpoint := range p.states {
+		endpoints = append(endpoints, endpoint)
+	}
+	p.mu.Unlock()
+
+	for _, endpoint := range endpoints {
+		p.release(endpoint, true)
+	}
+}
@@ -0,0 +1,99 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Maximum size of hook bodies in bytes, larger ones are rejected with 413. 0 disables the limit.
+var maxBodySize int64 = 10 << 20
+
+// Size in bytes above which non-JSON bodies are sent to websocket clients which asked for it as binary frames,
+// 0 to always send them in the data frame
+var binaryThreshold int64
+
+// Encodings of the data of messages whose body isn't JSON
+const (
+	// Data is the body encoded as base64
+	encodingBase64 = "base64"
+	// Data is the body as a string, used with version 2 of the schema for bodies which are valid UTF-8
+	encodingUTF8 = "utf8"
+	// Data is null and the body follows the data frame as a binary websocket frame
+	encodingBinary = "binary"
+)
+
+// readBody reads the body of a hook, returning false if it's larger than the maximum body size. No more than
+// the maximum is read, so that huge uploads don't have to be held in memory to be rejected. Fails if the body
+// couldn't be read in full, such as when the publisher disconnects while sending it.
+func readBody(r *http.Request) (*bytes.Buffer, bool, error) {
+	buf := new(bytes.Buffer)
+	if maxBodySize <= 0 {
+		_, err := buf.ReadFrom(r.Body)
+		return buf, true, err
+	}
+	if r.ContentLength > maxBodySize {
+		return nil, false, nil
+	}
+	_, err := buf.ReadFrom(io.LimitReader(r.Body, maxBodySize+1))
+	return buf, int64(buf.Len()) <= maxBodySize, err
+}
+
+// rawBody returns the body of a message whose body isn't JSON. Messages from other instances carry it as
+// base64, as that's how it's encoded for the broker.
+func rawBody(msg Message) ([]byte, bool) {
+	switch data := msg.Data.(type) {
+	case []byte:
+		return data, true
+	case string:
+		if msg.Encoding == encodingBase64 {
+			body, err := base64.StdEncoding.DecodeString(data)
+			return body, err == nil
+		}
+	}
+	return nil, false
+}
+
+// utf8Body returns the body of a message as a string if it's valid UTF-8
+func utf8Body(msg Message) (string, bool) {
+	body, ok := rawBody(msg)
+	if !ok || !utf8.Valid(body) {
+		return "", false
+	}
+	return string(body), true
+}
+
+// binaryBody returns the body of a message if it's written to a client as a binary frame, which is the case for
+// non-JSON bodies above the binary threshold sent to websocket clients which connected with ?binary=true
+func binaryBody(c *client, msg Message) ([]byte, bool) {
+	if !c.binary || binaryThreshold <= 0 {
+		return nil, false
+	}
+	body, ok := rawBody(msg)
+	if !ok || int64(len(body)) <= binaryThreshold {
+		return nil, false
+	}
+	return body, true
+}
+
+// writeMessage writes a message to a client in its schema, followed by the body as a binary frame if it's sent
+// as one
+func writeMessage(c *client, msg Message) error {
+	body, binary := binaryBody(c, msg)
+	if binary {
+		msg.Data, msg.Encoding = nil, encodingBinary
+	}
+	if err := writeFrame(c, msg.encode(c.schema)); err != nil {
+		return err
+	}
+	if binary && c.compressed {
+		return writeCompressed(c.conn.(*websocket.Conn), websocket.BinaryMessage, body)
+	} else if binary {
+		return c.conn.(*websocket.Conn).WriteMessage(websocket.BinaryMessage, body)
+	}
+	return nil
+}
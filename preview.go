@@ -0,0 +1,145 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PreviewRequest is a sample hook sent to /admin/preview/<endpoint>, with the options of a client it's previewed
+// for
+type PreviewRequest struct {
+	// Method, headers and query string of the hook, POST without any if empty
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Query   string            `json:"query"`
+	// Body of the hook, either JSON as it is or any other content as a string. A JSON body is sent as
+	// application/json unless the headers set a content type.
+	Body    json.RawMessage `json:"body"`
+	RawBody string          `json:"raw_body"`
+	// Filter, where conditions and schema version of the client, as given when connecting
+	Filter string   `json:"filter"`
+	Where  []string `json:"where"`
+	Schema int      `json:"schema"`
+}
+
+// MessagePreview is the message a sample hook would be broadcast as, and whether a client connected with the
+// preview's options would receive it
+type MessagePreview struct {
+	Endpoint string `json:"endpoint"`
+	// Whether the endpoint is declared, as hooks to an undeclared endpoint are rejected
+	Declared bool `json:"declared"`
+	// The message as written to the client, numbered as the next message of the endpoint
+	Message interface{} `json:"message"`
+	// Why the endpoint's transform failed, in which case the message is broadcast untransformed
+	TransformError string `json:"transform_error,omitempty"`
+	// Whether the client would receive the message and, if not, which of where or filter excludes it
+	Delivered  bool   `json:"delivered"`
+	FilteredBy string `json:"filtered_by,omitempty"`
+}
+
+// readPreviewRequest reads a sample hook and builds the request it would be sent as, which carries none of the
+// headers of the admin request, along with its body
+func readPreviewRequest(r *http.Request, endpoint string) (PreviewRequest, *http.Request, []byte, error) {
+	var preview PreviewRequest
+	buf, ok, err := readBody(r)
+	if err == nil && !ok {
+		err = fmt.Errorf("body larger than %d bytes", maxBodySize)
+	}
+	if err == nil {
+		err = json.Unmarshal(buf.Bytes(), &preview)
+	}
+	if err != nil {
+		return preview, nil, nil, fmt.Errorf("invalid body: %v", err)
+	}
+	if len(preview.Body) > 0 && preview.RawBody != "" {
+		return preview, nil, nil, fmt.Errorf("invalid body: expected either body or raw_body")
+	}
+	if preview.Schema == 0 {
+		preview.Schema = schemaV1
+	}
+	if preview.Schema != schemaV1 && preview.Schema != schemaV2 {
+		return preview, nil, nil, fmt.Errorf("unsupported schema %d, expected %d or %d", preview.Schema, schemaV1, schemaV2)
+	}
+
+	body := []byte(preview.RawBody)
+	if len(preview.Body) > 0 {
+		body = preview.Body
+	}
+	method := preview.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	target := "/hook" + endpoint
+	if preview.Query != "" {
+		target += "?" + strings.TrimPrefix(preview.Query, "?")
+	}
+	hook, err := http.NewRequest(strings.ToUpper(method), target, bytes.NewReader(body))
+	if err != nil {
+		return preview, nil, nil, fmt.Errorf("invalid hook: %v", err)
+	}
+	for name, value := range preview.Headers {
+		hook.Header.Set(name, value)
+	}
+	if len(preview.Body) > 0 && hook.Header.Get("Content-Type") == "" {
+		hook.Header.Set("Content-Type", "application/json")
+	}
+	hook.Host = r.Host
+	hook.RemoteAddr = r.RemoteAddr
+	return preview, hook, body, nil
+}
+
+// handlePreview shows the message a sample hook to an endpoint would be broadcast as, after redaction,
+// transformation and enrichment, without broadcasting it. Signatures, validators, aggregation, duplicate
+// suppression, pacing and delivery windows aren't applied.
+func handlePreview(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if endpoint == "" || isPattern(endpoint) {
+		http.Error(w, "expected an endpoint", 400)
+		return
+	}
+	if isReserved(endpoint) {
+		http.Error(w, "endpoint is reserved", 400)
+		return
+	}
+	preview, hook, body, err := readPreviewRequest(r, endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var f *filter
+	if preview.Filter != "" {
+		if f, err = parseFilter(preview.Filter); err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter: %v", err), 400)
+			return
+		}
+	}
+	var conditions *where
+	if len(preview.Where) > 0 {
+		if conditions, err = parseWhere(preview.Where); err != nil {
+			http.Error(w, fmt.Sprintf("invalid where condition: %v", err), 400)
+			return
+		}
+	}
+
+	received := time.Now()
+	msg := hookMessage(hook, endpoint, received)
+	stripSecretHeaders(&msg)
+	result := MessagePreview{Endpoint: endpoint, Declared: declared(endpoint), Delivered: true}
+	if err := shapeMessage(&msg, hook, body, received); err != nil {
+		result.TransformError = err.Error()
+	}
+	msg.Type = frameData
+	msg.Seq = currentSequence(endpoint) + 1
+
+	// Clients check where conditions before the filter, like when messages are delivered
+	if conditions != nil && !conditions.Match(msg) {
+		result.Delivered, result.FilteredBy = false, "where"
+	} else if f != nil && !f.Match(filterDocument(msg)) {
+		result.Delivered, result.FilteredBy = false, "filter"
+	}
+	result.Message = msg.encode(preview.Schema)
+	writeJSON(w, result)
+}
@@ -0,0 +1,72 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// priority of a message in its endpoint's queue, messages of a higher priority being delivered before queued
+// ones of a lower priority
+type priority int
+
+const (
+	priorityLow priority = iota - 1
+	priorityNormal
+	priorityHigh
+)
+
+// Number of priorities, each having its own lane in a dispatcher's queue
+const priorityLanes = 3
+
+var priorityNames = map[string]priority{"low": priorityLow, "normal": priorityNormal, "high": priorityHigh}
+
+// Header publishers can set the priority of a hook with, empty to only use the priorities of endpoints
+var priorityHeader = "X-Sockethook-Priority"
+
+// Priorities of endpoints other than normal, for hooks which don't set one in the priority header
+var endpointPriorities = make(map[string]priority)
+
+// lane returns the index of the priority's lane in a dispatcher's queue, the highest priority coming first
+func (p priority) lane() int {
+	return int(priorityHigh - p)
+}
+
+// parsePriority parses the name of a priority
+func parsePriority(name string) (priority, error) {
+	p, ok := priorityNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return priorityNormal, fmt.Errorf("unknown priority %q, expected high, normal or low", name)
+	}
+	return p, nil
+}
+
+// parseEndpointPriorities parses priorities given as /endpoint=priority
+func parseEndpointPriorities(rules []string) (map[string]priority, error) {
+	priorities := make(map[string]priority, len(rules))
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid priority %q, expected /endpoint=priority", rule)
+		}
+		p, err := parsePriority(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		priorities[strings.TrimRight(parts[0], "/")] = p
+	}
+	return priorities, nil
+}
+
+// hookPriority returns the priority of a hook, given by its priority header or otherwise its endpoint. Invalid
+// header values are ignored.
+func hookPriority(r *http.Request, endpoint string) priority {
+	if priorityHeader != "" {
+		if value := r.Header.Get(priorityHeader); value != "" {
+			if p, err := parsePriority(value); err == nil {
+				return p
+			}
+		}
+	}
+	return endpointPriorities[endpoint]
+}
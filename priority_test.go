@@ -0,0 +1,53 @@
+package sockethook
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseEndpointPriorities(t *testing.T) {
+	tests := []struct {
+		rules      []string
+		priorities map[string]priority
+		valid      bool
+	}{
+		{[]string{"/alerts=high", "/reports/=LOW"}, map[string]priority{"/alerts": priorityHigh, "/reports": priorityLow}, true},
+		{[]string{"/alerts=urgent"}, nil, false},
+		{[]string{"alerts=high"}, nil, false},
+		{[]string{"/alerts"}, nil, false},
+	}
+	for _, test := range tests {
+		priorities, err := parseEndpointPriorities(test.rules)
+		if (err == nil) != test.valid || (test.valid && !reflect.DeepEqual(priorities, test.priorities)) {
+			t.Errorf("parseEndpointPriorities(%q) = %v, %v", test.rules, priorities, err)
+		}
+	}
+}
+
+func TestHookPriority(t *testing.T) {
+	endpointPriorities = map[string]priority{"/alerts": priorityHigh}
+	defer func() { endpointPriorities = make(map[string]priority) }()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		header   string
+		priority priority
+	}{
+		{"default", "/orders", "", priorityNormal},
+		{"endpoint priority", "/alerts", "", priorityHigh},
+		{"header overrides endpoint", "/alerts", "low", priorityLow},
+		{"header", "/orders", "High", priorityHigh},
+		{"invalid header ignored", "/alerts", "urgent", priorityHigh},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/hook"+test.endpoint, nil)
+		if test.header != "" {
+			r.Header.Set(priorityHeader, test.header)
+		}
+		if p := hookPriority(r, test.endpoint); p != test.priority {
+			t.Errorf("%s: priority %d, expected %d", test.name, p, test.priority)
+		}
+	}
+}
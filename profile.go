@@ -0,0 +1,106 @@
+package sockethook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Profiler captures CPU and heap profiles and a goroutine dump to disk when the server is overloaded
+type Profiler struct {
+	mu sync.Mutex
+
+	// Directory profiles are written to
+	dir string
+	// How long CPU profiles are recorded for
+	cpuDuration time.Duration
+	// Minimum time between two captures
+	minInterval time.Duration
+	// Delivery latency above which a capture is triggered, 0 to disable
+	latencyThreshold time.Duration
+
+	last    time.Time
+	running bool
+}
+
+// Profiler used for overload captures, nil if disabled
+var profiler *Profiler
+
+// ObserveLatency triggers a capture if a delivery took longer than the latency threshold
+func (p *Profiler) ObserveLatency(latency time.Duration) {
+	if p == nil || p.latencyThreshold <= 0 || latency < p.latencyThreshold {
+		return
+	}
+	p.Trigger("latency")
+}
+
+// Trigger starts a capture in the background unless one is running or happened too recently
+func (p *Profiler) Trigger(reason string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	if p.running || time.Since(p.last) < p.minInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.running = true
+	p.last = time.Now()
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.running = false
+			p.mu.Unlock()
+		}()
+
+		dir, err := p.capture(reason)
+		if err != nil {
+			log.WithField("reason", reason).Errorln("Failed to capture profiles:", err)
+			return
+		}
+		log.WithFields(log.Fields{"reason": reason, "dir": dir}).Warnln("Captured profiles on overload")
+	}()
+}
+
+// capture writes a goroutine dump, heap profile and CPU profile to a new timestamped directory
+func (p *Profiler) capture(reason string) (string, error) {
+	dir := filepath.Join(p.dir, fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), reason))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// Goroutines and heap are captured first as they show the state at the time of the overload
+	for _, name := range []string{"goroutine", "heap"} {
+		f, err := os.Create(filepath.Join(dir, name+".pprof"))
+		if err != nil {
+			return "", err
+		}
+		err = pprof.Lookup(name).WriteTo(f, 0)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := pprof.StartCPUProfile(f); err != nil {
+		return "", err
+	}
+	time.Sleep(p.cpuDuration)
+	pprof.StopCPUProfile()
+
+	return dir, nil
+}
@@ -0,0 +1,194 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Frame types of the wire protocol. Every frame sent to or by a client is a JSON object with a type field,
+// data frames carrying hooks and all others being control frames which clients can handle without looking
+// at message payloads.
+const (
+	// Sent by the server: a hook or server generated message
+	frameData = "data"
+	// Sent by the server: once after connecting
+	frameWelcome = "welcome"
+	// Sent by the server: periodically, with the server's clock
+	frameTimeSync = "time_sync"
+	// Sent by the server: in reply to a ping frame
+	framePong = "pong"
+	// Sent by the server: when a client frame couldn't be handled
+	frameError = "error"
+	// Sent by the server: when a subscribe or unsubscribe frame succeeded
+	frameSubscriptionAck = "subscription_ack"
+	// Sent by the server: right before it shuts down
+	frameShutdownNotice = "shutdown_notice"
+	// Sent by the server: when maintenance mode starts or ends
+	frameMaintenance = "maintenance"
+	// Sent by the server: when a publish frame succeeded
+	framePublished = "published"
+	// Sent by the server: right after the welcome frame, when the messages a resuming client missed can't be
+	// replayed
+	frameReset = "reset"
+	// Sent by clients: to check the connection is alive
+	framePing = "ping"
+	// Sent by clients: the response to the hook of a message
+	frameResponse = "response"
+	// Sent by clients: to acknowledge a message on an endpoint with acknowledgements
+	frameAck = "ack"
+	// Sent by clients: to start receiving messages from another endpoint
+	frameSubscribe = "subscribe"
+	// Sent by clients: to stop receiving messages from an endpoint
+	frameUnsubscribe = "unsubscribe"
+	// Sent by clients: to publish a message on the endpoint they connected to
+	framePublish = "publish"
+)
+
+// Error codes of error frames
+const (
+	errorInvalidFrame         = "invalid_frame"
+	errorUnknownType          = "unknown_type"
+	errorInvalidEndpoint      = "invalid_endpoint"
+	errorPermissionDenied     = "permission_denied"
+	errorEndpointFull         = "endpoint_full"
+	errorAlreadySubscribed    = "already_subscribed"
+	errorNotSubscribed        = "not_subscribed"
+	errorTooManySubscriptions = "too_many_subscriptions"
+	errorInvalidFilter        = "invalid_filter"
+	errorRateLimited          = "rate_limited"
+	errorPublishFailed        = "publish_failed"
+	errorEndpointArchived     = "endpoint_archived"
+	errorEndpointExpired      = "endpoint_expired"
+)
+
+// WelcomeFrame is sent to clients right after connecting, so they can initialize their state
+type WelcomeFrame struct {
+	Type          string `json:"type"`
+	ServerVersion string `json:"server_version"`
+	ConnectionID  string `json:"connection_id"`
+	Endpoint      string `json:"endpoint"`
+	// Sequence number of the last message on the endpoint, messages received after this one have higher numbers
+	Seq        uint64   `json:"seq"`
+	Features   Features `json:"features"`
+	ServerTime string   `json:"server_time"`
+	// Number of missed messages sent right after the welcome frame when resuming with a last event ID
+	Replayed int `json:"replayed,omitempty"`
+	// Set when resuming if the last event ID wasn't buffered anymore, or a reset frame follows, so messages may
+	// have been lost
+	ResumeGap bool `json:"resume_gap,omitempty"`
+	// Filter of the subscription to the endpoint, if one was given
+	Filter string `json:"filter,omitempty"`
+	// Where conditions given when connecting, as path:value
+	Where []string `json:"where,omitempty"`
+	// Token to reconnect with to restore the session, and whether the session was restored with the
+	// subscriptions given, if sessions are enabled
+	Session         string   `json:"session,omitempty"`
+	SessionRestored bool     `json:"session_restored,omitempty"`
+	Subscriptions   []string `json:"subscriptions,omitempty"`
+	// Labels the client connected with, including those of a restored session
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Reasons of reset frames
+const (
+	// Messages the client missed aren't buffered anymore, or never were
+	resetGap = "gap"
+	// The client saw a higher sequence number than the endpoint's, as its numbering started over
+	resetAhead = "ahead"
+)
+
+// ResetFrame tells a client resuming from a sequence number that the messages it missed can't be replayed, so it
+// has to resynchronize its state before handling the messages which follow, from the sequence number given on
+type ResetFrame struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+	// Sequence number of the last message on the endpoint
+	Seq    uint64 `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// Features describes the protocol features negotiated for a connection
+type Features struct {
+	Format      string `json:"format"`
+	Compression bool   `json:"compression"`
+	TimeSync    bool   `json:"time_sync"`
+	Respond     bool   `json:"respond"`
+	Replay      bool   `json:"replay"`
+	Ack         bool   `json:"ack"`
+	// Version of the message schema used for data frames
+	Schema int `json:"schema"`
+	// Whether large non-JSON bodies are sent as binary frames
+	Binary bool `json:"binary"`
+	// Whether the client can publish messages on its endpoint
+	Publish bool `json:"publish"`
+}
+
+// ErrorFrame tells a client that one of its frames couldn't be handled. ID and endpoint echo those of the
+// frame which failed, if it had them.
+type ErrorFrame struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// SubscriptionAck confirms a subscribe or unsubscribe frame, echoing its ID
+type SubscriptionAck struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Action   string `json:"action"`
+	Endpoint string `json:"endpoint"`
+	// Sequence number of the last message on the endpoint
+	Seq uint64 `json:"seq"`
+	// Filter of the subscription, if one was given
+	Filter string `json:"filter,omitempty"`
+}
+
+// PongFrame answers a ping frame, echoing its ID
+type PongFrame struct {
+	Type       string `json:"type"`
+	ID         string `json:"id,omitempty"`
+	ServerTime string `json:"server_time"`
+}
+
+// ShutdownNotice tells a client the server is about to shut down, when to reconnect and optionally which
+// other instances to reconnect to
+type ShutdownNotice struct {
+	Type             string   `json:"type"`
+	ReconnectAfterMs int64    `json:"reconnect_after_ms"`
+	Alternatives     []string `json:"alternatives,omitempty"`
+}
+
+// clientFrame holds the fields common to all frames sent by clients
+type clientFrame struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Endpoint string `json:"endpoint"`
+	// Filter expression of a subscription, see filter
+	Filter string `json:"filter"`
+}
+
+// handleClientFrame processes a frame sent by a client, answering with an error frame if it can't be handled
+func handleClientFrame(c *client, endpoint string, data []byte) {
+	var frame clientFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		c.queue(ErrorFrame{Type: frameError, Code: errorInvalidFrame, Message: "frames must be JSON objects"})
+		return
+	}
+
+	switch frame.Type {
+	case framePing:
+		c.queue(PongFrame{Type: framePong, ID: frame.ID, ServerTime: time.Now().UTC().Format(time.RFC3339Nano)})
+	case frameResponse:
+		handleResponseFrame(c, data)
+	case frameAck:
+		handleAckFrame(c, frame.ID)
+	case frameSubscribe, frameUnsubscribe:
+		handleSubscriptionFrame(c, frame)
+	case framePublish:
+		handlePublishFrame(c, data)
+	default:
+		c.queue(ErrorFrame{Type: frameError, Code: errorUnknownType, Message: "unknown frame type " + frame.Type})
+	}
+}
@@ -0,0 +1,210 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Where messages published by clients go per endpoint or pattern, given on the command line: publishBroadcast
+// to broadcast them to the endpoint's other clients, or a callback URL to POST them to
+var publishTargets = make(map[string]string)
+
+const publishBroadcast = "broadcast"
+
+// How long callbacks have to answer published messages
+var publishTimeout = 10 * time.Second
+
+// Number of messages a client may have waiting for a callback at once, further ones being rejected
+var maxPublishesInFlight int64 = 8
+
+// Maximum size of callback responses sent back to clients
+var maxPublishResponse int64 = 64 << 10
+
+var publishClient = &http.Client{}
+
+// PublishFrame is sent by clients to publish a message on the endpoint they connected to
+type PublishFrame struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id"`
+	Data interface{} `json:"data"`
+}
+
+// PublishedFrame confirms a publish frame, echoing its ID. Messages sent to a callback carry its status and
+// response, which is included as is if it's JSON and as a string otherwise.
+type PublishedFrame struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`
+	MessageID string          `json:"message_id"`
+	Status    int             `json:"status,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// parsePublishTargets parses publish targets of the form /endpoint=broadcast or /endpoint=URL, where the
+// endpoint may be a pattern
+func parsePublishTargets(rules []string) (map[string]string, error) {
+	targets := make(map[string]string)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid client publish target %q, expected /endpoint=broadcast or /endpoint=URL", rule)
+		}
+		if err := checkPublishTarget(parts[1]); err != nil {
+			return nil, err
+		}
+		targets[strings.TrimRight(parts[0], "/")] = parts[1]
+	}
+	return targets, nil
+}
+
+// checkPublishTarget checks that a publish target is broadcast or an absolute http:// or https:// URL
+func checkPublishTarget(target string) error {
+	if target == publishBroadcast {
+		return nil
+	}
+	if err := checkValidationURL(target); err != nil {
+		return fmt.Errorf("invalid client publish target %q, expected broadcast or an http:// or https:// URL", target)
+	}
+	return nil
+}
+
+// publishTarget returns where messages published by clients of an endpoint go, empty if clients can't publish.
+// The configuration file takes precedence over options, and exact endpoints over patterns.
+func publishTarget(endpoint string) string {
+	if settings := settingsFor(endpoint); settings != nil && settings.publishTarget != "" {
+		return settings.publishTarget
+	}
+	if target, ok := publishTargets[endpoint]; ok {
+		return target
+	}
+	for pattern, target := range publishTargets {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return target
+		}
+	}
+	return ""
+}
+
+// canPublish checks if a client can publish messages, which needs a websocket as event streams are one-way
+func canPublish(c *client) bool {
+	if _, ok := c.conn.(*websocket.Conn); !ok {
+		return false
+	}
+	return publishTarget(c.endpoint) != ""
+}
+
+// handlePublishFrame publishes a message sent by a client on the endpoint it connected to. Published messages
+// count against the endpoint's rate limits like hooks.
+func handlePublishFrame(c *client, data []byte) {
+	var frame PublishFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Code: errorInvalidFrame, Message: "invalid publish frame"})
+		return
+	}
+	target := publishTarget(c.endpoint)
+	if target == "" {
+		c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Endpoint: c.endpoint, Code: errorPermissionDenied, Message: "publishing isn't enabled on " + c.endpoint})
+		return
+	}
+	logEntry := log.WithField("endpoint", c.endpoint).WithField("client", c.id)
+	if ok, _ := allowHook(c.endpoint, c.ip); !ok {
+		logEntry.Warnln("Rejected published message, rate limit exceeded")
+		metrics.publishes.Inc("rejected")
+		c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Endpoint: c.endpoint, Code: errorRateLimited, Message: "rate limit exceeded"})
+		return
+	}
+
+	received := time.Now()
+	msg := Message{
+		Type:         frameData,
+		ID:           idGenerator.NewID(),
+		Headers:      make(map[string]string),
+		Endpoint:     c.endpoint,
+		Data:         frame.Data,
+		ReceivedAt:   received.UTC().Format(time.RFC3339Nano),
+		RemoteAddr:   c.ip,
+		ConnectionID: c.id,
+		received:     received,
+		publisher:    c,
+	}
+	redactor.Redact(&msg)
+
+	if target == publishBroadcast {
+		count := hub.Broadcast(msg)
+		metrics.publishes.Inc("broadcast")
+		logEntry.WithField("clients", count).Infoln("Published message broadcasted")
+		c.queue(PublishedFrame{Type: framePublished, ID: frame.ID, MessageID: msg.ID})
+		return
+	}
+
+	// Callbacks are called from their own goroutine so that the client's pings and acknowledgements are still read
+	if atomic.AddInt64(&c.publishing, 1) > maxPublishesInFlight {
+		atomic.AddInt64(&c.publishing, -1)
+		metrics.publishes.Inc("rejected")
+		c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Endpoint: c.endpoint, Code: errorPublishFailed, Message: "too many messages waiting for the callback"})
+		return
+	}
+	go func() {
+		defer atomic.AddInt64(&c.publishing, -1)
+		status, body, err := postPublished(target, msg)
+		if err != nil {
+			logEntry.WithField("callback", target).Warnln("Publishing message failed:", err)
+			metrics.publishes.Inc("failure")
+			c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Endpoint: c.endpoint, Code: errorPublishFailed, Message: err.Error()})
+			return
+		}
+		logEntry.WithField("callback", target).WithField("status", status).Infoln("Published message sent to callback")
+		metrics.publishes.Inc("callback")
+		c.queue(PublishedFrame{Type: framePublished, ID: frame.ID, MessageID: msg.ID, Status: status, Data: publishedData(body)})
+	}()
+}
+
+// postPublished POSTs a published message to a callback as JSON, returning its status and response
+func postPublished(target string, msg Message) (int, []byte, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sockethook-Endpoint", msg.Endpoint)
+	req.Header.Set("X-Sockethook-Id", msg.ID)
+	req.Header.Set("X-Sockethook-Connection-Id", msg.ConnectionID)
+
+	client := *publishClient
+	client.Timeout = publishTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxPublishResponse})
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, response, nil
+}
+
+// publishedData encodes a callback response for a published frame, as is if it's JSON and as a string otherwise
+func publishedData(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	encoded, _ := json.Marshal(string(body))
+	return encoded
+}
@@ -0,0 +1,278 @@
+package sockethook
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of hooks failing signature verification kept for review, 0 to reject them without keeping them
+var quarantineSize int
+
+// Whether hooks to undeclared endpoints are captured into quarantine instead of being rejected
+var captureUndeclared bool
+
+// Reason of hooks captured because their endpoint isn't declared
+const reasonUndeclared = "undeclared endpoint"
+
+// QuarantinedHook is a hook which failed signature verification, kept so that it can be replayed once the
+// endpoint's secrets are fixed instead of being lost
+type QuarantinedHook struct {
+	Endpoint string      `json:"endpoint"`
+	Reason   string      `json:"reason"`
+	Request  RequestDump `json:"request"`
+}
+
+// QuarantineReplay is the outcome of replaying a quarantined hook, which is released if it's accepted
+type QuarantineReplay struct {
+	ID       string `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Status   int    `json:"status"`
+	Released bool   `json:"released"`
+	// Response to the replayed hook, such as why it was rejected
+	Body string `json:"body,omitempty"`
+}
+
+// Hooks failing signature verification, oldest first and bounded by quarantineSize
+var quarantine = struct {
+	sync.Mutex
+	hooks []QuarantinedHook
+}{}
+
+// Context key marking hooks replayed from quarantine, which aren't quarantined again if they still fail
+type quarantineReplayKey struct{}
+
+// quarantineHook keeps a hook which failed verification for review, dropping the oldest hook when full. Returns
+// whether the hook was kept, which it isn't when quarantine is disabled or the hook is replayed from it.
+func quarantineHook(r *http.Request, endpoint string, id string, body []byte, received time.Time, reason string) bool {
+	if quarantineSize <= 0 || r.Context().Value(quarantineReplayKey{}) != nil {
+		return false
+	}
+
+	hook := QuarantinedHook{Endpoint: endpoint, Reason: reason, Request: dumpRequest(id, r, body, received)}
+	quarantine.Lock()
+	quarantine.hooks = append(quarantine.hooks, hook)
+	dropped := 0
+	if len(quarantine.hooks) > quarantineSize {
+		dropped = len(quarantine.hooks) - quarantineSize
+		quarantine.hooks = append([]QuarantinedHook{}, quarantine.hooks[dropped:]...)
+	}
+	quarantine.Unlock()
+
+	metrics.quarantined.Inc("quarantined")
+	if dropped > 0 {
+		metrics.quarantined.Add("dropped", float64(dropped))
+	}
+	publishEvent("hook_quarantined", map[string]interface{}{"endpoint": endpoint, "id": id, "reason": reason})
+	return true
+}
+
+// quarantinedHooks returns the quarantined hooks of an endpoint, or of all endpoints if it's empty, newest first
+func quarantinedHooks(endpoint string) []QuarantinedHook {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+
+	hooks := []QuarantinedHook{}
+	for i := len(quarantine.hooks) - 1; i >= 0; i-- {
+		if endpoint == "" || quarantine.hooks[i].Endpoint == endpoint {
+			hooks = append(hooks, quarantine.hooks[i])
+		}
+	}
+	return hooks
+}
+
+// findQuarantined returns a quarantined hook by ID
+func findQuarantined(id string) (QuarantinedHook, bool) {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+
+	for _, hook := range quarantine.hooks {
+		if hook.Request.ID == id {
+			return hook, true
+		}
+	}
+	return QuarantinedHook{}, false
+}
+
+// releaseQuarantined removes a hook from quarantine, returning whether it was there
+func releaseQuarantined(id string) bool {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+
+	for i, hook := range quarantine.hooks {
+		if hook.Request.ID == id {
+			quarantine.hooks = append(quarantine.hooks[:i:i], quarantine.hooks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// replayQuarantined handles a quarantined hook again as if the provider sent it now, checked against the
+// current secrets of its endpoint. Hooks which are accepted are released, those which still fail stay.
+func replayQuarantined(hook QuarantinedHook) QuarantineReplay {
+	result := QuarantineReplay{ID: hook.Request.ID, Endpoint: hook.Endpoint}
+	dump := hook.Request
+
+	req, err := http.NewRequest(dump.Method, dump.URL, bytes.NewReader(dump.raw))
+	if err != nil {
+		result.Status, result.Body = 500, err.Error()
+		return result
+	}
+	for name, values := range dump.Headers {
+		req.Header[name] = values
+	}
+	req.RemoteAddr = dump.RemoteAddr
+	req = req.WithContext(context.WithValue(req.Context(), quarantineReplayKey{}, true))
+
+	response := &replayResponse{header: make(http.Header)}
+	handleHook(response, req, "", hook.Endpoint)
+	result.Status = response.status
+	if result.Status == 0 {
+		result.Status = 200
+	}
+	result.Body = strings.TrimSpace(response.body.String())
+
+	if result.Status < 300 && releaseQuarantined(result.ID) {
+		result.Released = true
+		metrics.quarantined.Inc("released")
+	}
+	log.WithFields(log.Fields{
+		"endpoint": hook.Endpoint,
+		"id":       result.ID,
+		"status":   result.Status,
+		"released": result.Released,
+	}).Warnln("Replayed quarantined hook")
+	return result
+}
+
+// replayResponse collects the response to a hook replayed from quarantine
+type replayResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *replayResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *replayResponse) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.body.Write(data)
+}
+
+func (r *replayResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// captureHook keeps a hook to an undeclared endpoint in quarantine, so that it can be inspected and the endpoint
+// promoted. Returns whether the hook was captured and answered, which it isn't when capture mode is off or the
+// hook is replayed from quarantine.
+func captureHook(w http.ResponseWriter, r *http.Request, endpoint string, received time.Time, logEntry *log.Entry) bool {
+	if !captureUndeclared || r.Context().Value(quarantineReplayKey{}) != nil {
+		return false
+	}
+	buf, ok, err := readBody(r)
+	if err != nil {
+		logEntry.Warnln("Abandoned hook, failed to read body:", err)
+		w.WriteHeader(400)
+		return true
+	}
+	if !ok {
+		logEntry.WithField("max", maxBodySize).Warnln("Rejected hook, body too large")
+		w.WriteHeader(413)
+		return true
+	}
+	id := idGenerator.NewID()
+	if !quarantineHook(r, endpoint, id, buf.Bytes(), received, reasonUndeclared) {
+		return false
+	}
+	logEntry.WithField("id", id).Warnln("Captured hook to undeclared endpoint")
+	// Providers are told the hook arrived, so they keep sending while the endpoint is reviewed
+	w.WriteHeader(202)
+	return true
+}
+
+// promoteCaptured declares an endpoint whose hooks were captured and replays them, oldest first
+func promoteCaptured(endpoint string) []QuarantineReplay {
+	declareByAdmin(endpoint)
+	hooks := quarantinedHooks(endpoint)
+	results := []QuarantineReplay{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hooks[i].Reason == reasonUndeclared {
+			results = append(results, replayQuarantined(hooks[i]))
+		}
+	}
+	return results
+}
+
+// handleQuarantine serves the review API of quarantined hooks below /admin/quarantine: listing them, showing,
+// replaying and discarding single hooks, replaying all hooks of an endpoint after fixing its secrets, and
+// promoting an undeclared endpoint whose hooks were captured
+func handleQuarantine(w http.ResponseWriter, r *http.Request, path string) {
+	endpoint := strings.TrimRight(r.URL.Query().Get("endpoint"), "/")
+
+	switch {
+	case path == "":
+		allowMethod(w, r, "GET", func() { writeJSON(w, quarantinedHooks(endpoint)) })
+	case path == "/promote":
+		allowMethod(w, r, "POST", func() {
+			if endpoint == "" || !strings.HasPrefix(endpoint, "/") || isPattern(endpoint) || isReserved(endpoint) {
+				http.Error(w, "expected an endpoint", 400)
+				return
+			}
+			writeJSON(w, map[string]interface{}{"endpoint": endpoint, "replayed": promoteCaptured(endpoint)})
+		})
+	case path == "/replay":
+		allowMethod(w, r, "POST", func() {
+			hooks := quarantinedHooks(endpoint)
+			results := make([]QuarantineReplay, 0, len(hooks))
+			// Replay oldest first, in the order the provider sent them
+			for i := len(hooks) - 1; i >= 0; i-- {
+				results = append(results, replayQuarantined(hooks[i]))
+			}
+			writeJSON(w, results)
+		})
+	case strings.HasSuffix(path, "/replay"):
+		allowMethod(w, r, "POST", func() {
+			hook, ok := findQuarantined(strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/replay"))
+			if !ok {
+				http.Error(w, "no quarantined hook with that ID", 404)
+				return
+			}
+			writeJSON(w, replayQuarantined(hook))
+		})
+	default:
+		id := strings.TrimPrefix(path, "/")
+		switch r.Method {
+		case "GET":
+			hook, ok := findQuarantined(id)
+			if !ok {
+				http.Error(w, "no quarantined hook with that ID", 404)
+				return
+			}
+			writeJSON(w, hook)
+		case "DELETE":
+			if !releaseQuarantined(id) {
+				http.Error(w, "no quarantined hook with that ID", 404)
+				return
+			}
+			metrics.quarantined.Inc("discarded")
+			log.WithField("id", id).Warnln("Discarded quarantined hook")
+			w.WriteHeader(204)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(405)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package sockethook
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of idle buckets kept per limiter set before they're swept, so that publishers sending from many
+// addresses or to many endpoints can't grow them without bound
+var maxRateLimiters = 10000
+
+// Rate limits of hooks given on the command line, per endpoint and per source IP
+var hookRateLimits = newHookLimits()
+var hookIPRateLimits = newHookLimits()
+
+// RateLimitBackend keeps the token buckets of hook rate limits. Without one they're kept in memory, limiting each
+// instance separately, while a backend shared by the instances such as Redis enforces limits across all of them.
+type RateLimitBackend interface {
+	// Take takes a token from the bucket of a key, which holds up to burst tokens and is refilled at rate tokens
+	// per second, returning false and the time until a token is available if it's empty
+	Take(key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+// Backend shared by instances keeping the buckets of rate limits, nil to keep them in memory
+var rateLimitBackend RateLimitBackend
+
+// Whether the rate limit backend is failing, in which case limits are enforced in memory until it recovers
+var rateLimitBackendDown int32
+
+// rateLimit is a number of hooks accepted per second and the number which may be accepted at once above it
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// hookLimits holds rate limits for all endpoints and for specific ones, each limiting a bucket per key
+type hookLimits struct {
+	fallback  *limiterSet
+	endpoints map[string]*limiterSet
+}
+
+func newHookLimits() *hookLimits {
+	return &hookLimits{endpoints: make(map[string]*limiterSet)}
+}
+
+// parseHookLimits parses rate limits of the form "10" or "10:20" (all endpoints) or "/endpoint=10:20", where
+// the optional second number is the burst. The kind of limit names their buckets in the rate limit backend.
+func parseHookLimits(kind string, rules []string) (*hookLimits, error) {
+	limits := newHookLimits()
+	for _, rule := range rules {
+		endpoint := ""
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid rate limit %q, expected /endpoint=rate[:burst]", rule)
+			}
+			endpoint, rule = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+
+		limit, err := parseRateLimit(rule)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint == "" {
+			limits.fallback = newLimiterSet(kind, limit)
+		} else {
+			limits.endpoints[endpoint] = newLimiterSet(kind+endpoint, limit)
+		}
+	}
+	return limits, nil
+}
+
+// parseRateLimit parses a rate with an optional burst as rate[:burst]
+func parseRateLimit(value string) (rateLimit, error) {
+	parts := strings.SplitN(value, ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected hooks per second", value)
+	}
+	burst := 0
+	if len(parts) == 2 {
+		if burst, err = strconv.Atoi(parts[1]); err != nil || burst <= 0 {
+			return rateLimit{}, fmt.Errorf("invalid rate limit burst %q", value)
+		}
+	}
+	return newRateLimit(rate, burst), nil
+}
+
+// newRateLimit creates a rate limit, the burst defaulting to one second's worth of hooks
+func newRateLimit(rate float64, burst int) rateLimit {
+	if burst == 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return rateLimit{rate: rate, burst: burst}
+}
+
+// set returns the limiters of an endpoint, nil if it isn't limited
+func (l *hookLimits) set(endpoint string) *limiterSet {
+	if set, ok := l.endpoints[endpoint]; ok {
+		return set
+	}
+	return l.fallback
+}
+
+// allowHook checks if a hook from an IP to an endpoint is within the rate limits of both, returning how long to
+// wait before retrying if it isn't. The IP is checked first, so that a flooding sender doesn't use up the
+// endpoint's limit for others. Limits of the configuration file take precedence over those given as options.
+func allowHook(endpoint string, ip string) (bool, time.Duration) {
+	settings := settingsFor(endpoint)
+
+	// The IP limit for all endpoints is shared by them, so it limits each IP across endpoints
+	ipLimiters := hookIPRateLimits.set(endpoint)
+	if settings != nil && settings.ipLimiters != nil {
+		ipLimiters = settings.ipLimiters
+	}
+	if ipLimiters != nil {
+		if ok, wait := ipLimiters.Allow(ip); !ok {
+			return false, wait
+		}
+	}
+
+	if settings != nil && settings.limiter != nil {
+		return settings.limiter.Allow(endpoint)
+	}
+	if endpointLimiters := hookRateLimits.set(endpoint); endpointLimiters != nil {
+		return endpointLimiters.Allow(endpoint)
+	}
+	return true, 0
+}
+
+// limiterSet is a rate limit applied to a separate bucket per key, such as an endpoint or IP
+type limiterSet struct {
+	// Prefix of the keys of the set's buckets in the rate limit backend, unique per set
+	name string
+
+	mu       sync.Mutex
+	limit    rateLimit
+	limiters map[string]*rateLimiter
+}
+
+func newLimiterSet(name string, limit rateLimit) *limiterSet {
+	return &limiterSet{name: name, limit: limit, limiters: make(map[string]*rateLimiter)}
+}
+
+// Allow takes a token from the bucket of a key, from the rate limit backend if there is one. Buckets in memory
+// are created when needed, and used while the backend is failing so that hooks are still limited per instance.
+func (s *limiterSet) Allow(key string) (bool, time.Duration) {
+	if backend := rateLimitBackend; backend != nil {
+		ok, wait, err := backend.Take(s.name+":"+key, s.limit.rate, s.limit.burst)
+		if err == nil {
+			if atomic.CompareAndSwapInt32(&rateLimitBackendDown, 1, 0) {
+				log.Infoln("Rate limit backend recovered, limiting hooks across instances again")
+			}
+			return ok, wait
+		}
+		metrics.rateLimitErrors.Inc("")
+		if atomic.CompareAndSwapInt32(&rateLimitBackendDown, 0, 1) {
+			log.Warnln("Rate limit backend failed, limiting hooks per instance until it recovers:", err)
+		}
+	}
+
+	s.mu.Lock()
+	l, ok := s.limiters[key]
+	if !ok {
+		if len(s.limiters) >= maxRateLimiters {
+			s.sweep()
+		}
+		l = newRateLimiter(s.limit.rate, s.limit.burst)
+		s.limiters[key] = l
+	}
+	s.mu.Unlock()
+	return l.Allow()
+}
+
+// sweep drops the buckets which have refilled completely, as they behave like new ones. Must be called with
+// s.mu held.
+func (s *limiterSet) sweep() {
+	for key, l := range s.limiters {
+		if l.full() {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+// rateLimiter is a token bucket refilled at a fixed rate
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token from the bucket, returning false and the time until a token is available if it's empty
+func (l *rateLimiter) Allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	l.tokens--
+	return true, 0
+}
+
+// Wait takes a token from the bucket, waiting until one is available if it's empty
+func (l *rateLimiter) Wait() {
+	for {
+		ok, wait := l.Allow()
+		if ok {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// full checks if the bucket has refilled completely
+func (l *rateLimiter) full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	return l.tokens >= l.burst
+}
+
+// refill adds the tokens accrued since the last call, must be called with l.mu held
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
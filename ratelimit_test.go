@@ -0,0 +1,109 @@
+package sockethook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected rateLimit
+		valid    bool
+	}{
+		{"10", rateLimit{rate: 10, burst: 10}, true},
+		{"10:20", rateLimit{rate: 10, burst: 20}, true},
+		{"0.5", rateLimit{rate: 0.5, burst: 1}, true},
+		{"2.5:1", rateLimit{rate: 2.5, burst: 1}, true},
+		{"", rateLimit{}, false},
+		{"0", rateLimit{}, false},
+		{"-1", rateLimit{}, false},
+		{"fast", rateLimit{}, false},
+		{"10:0", rateLimit{}, false},
+		{"10:many", rateLimit{}, false},
+	}
+	for _, test := range tests {
+		limit, err := parseRateLimit(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("parseRateLimit(%q) error = %v, expected valid %v", test.value, err, test.valid)
+			continue
+		}
+		if limit != test.expected {
+			t.Errorf("parseRateLimit(%q) = %+v, expected %+v", test.value, limit, test.expected)
+		}
+	}
+}
+
+func TestParseHookLimits(t *testing.T) {
+	limits, err := parseHookLimits("endpoint", []string{"5", "/orders/=1:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		endpoint string
+		expected rateLimit
+	}{
+		{"/orders", rateLimit{rate: 1, burst: 2}},
+		{"/users", rateLimit{rate: 5, burst: 5}},
+	}
+	for _, test := range tests {
+		set := limits.set(test.endpoint)
+		if set == nil || set.limit != test.expected {
+			t.Errorf("set(%q) = %+v, expected %+v", test.endpoint, set, test.expected)
+		}
+	}
+
+	for _, rules := range [][]string{{"/orders"}, {"/orders=fast"}, {"0"}} {
+		if _, err := parseHookLimits("endpoint", rules); err == nil {
+			t.Errorf("parseHookLimits(%q) accepted invalid rules", rules)
+		}
+	}
+}
+
+func TestLimiterSetAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    rateLimit
+		keys     []string
+		expected []bool
+	}{
+		{"burst", newRateLimit(1, 3), []string{"a", "a", "a", "a"}, []bool{true, true, true, false}},
+		{"per key", newRateLimit(1, 1), []string{"a", "b", "a", "b", "c"}, []bool{true, true, false, false, true}},
+	}
+	for _, test := range tests {
+		set := newLimiterSet("test", test.limit)
+		for i, key := range test.keys {
+			ok, wait := set.Allow(key)
+			if ok != test.expected[i] {
+				t.Errorf("%s: Allow(%q) #%d = %v, expected %v", test.name, key, i, ok, test.expected[i])
+			}
+			if ok && wait != 0 {
+				t.Errorf("%s: Allow(%q) #%d allowed with a wait of %s", test.name, key, i, wait)
+			}
+			// At one hook per second an empty bucket has a token again within a second
+			if !ok && (wait <= 0 || wait > time.Second) {
+				t.Errorf("%s: Allow(%q) #%d wait = %s, expected up to 1s", test.name, key, i, wait)
+			}
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(100, 1)
+	if ok, _ := l.Allow(); !ok {
+		t.Fatal("first hook refused")
+	}
+	if ok, _ := l.Allow(); ok {
+		t.Fatal("hook above the burst allowed")
+	}
+	if l.full() {
+		t.Fatal("empty bucket is full")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !l.full() {
+		t.Fatal("bucket not refilled")
+	}
+	if ok, _ := l.Allow(); !ok {
+		t.Fatal("hook refused after refilling")
+	}
+}
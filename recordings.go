@@ -0,0 +1,262 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Recorder of endpoints whose traffic is kept for replaying to new consumers, nil if disabled
+var recorder *Recorder
+
+// Messages per second replayed from a recording unless the request gives a rate
+var recordingReplayRate = 100.0
+
+// Recorder keeps all messages of recorded endpoints for a retention of their own, such as a week, so that teams
+// starting to consume an endpoint can have its recent traffic replayed into an endpoint of their own to backfill
+// their state. Each recorded endpoint or pattern is logged like the history log, in a directory of its own.
+type Recorder struct {
+	recordings []*recording
+}
+
+// recording is an endpoint or pattern being recorded
+type recording struct {
+	endpoint  string
+	retention time.Duration
+	log       *HistoryLog
+}
+
+// RecordingStatus describes a recorded endpoint
+type RecordingStatus struct {
+	Endpoint string `json:"endpoint"`
+	// Endpoint or pattern of the --record option it's recorded by
+	RecordedBy string `json:"recorded_by"`
+	Retention  string `json:"retention"`
+	Messages   int    `json:"messages"`
+	Oldest     string `json:"oldest,omitempty"`
+	Newest     string `json:"newest,omitempty"`
+}
+
+// RecordingReplay is a request to replay the recording of an endpoint into a target endpoint
+type RecordingReplay struct {
+	Target string `json:"target"`
+	// Window of the recording replayed, in RFC3339, the whole recording if not given
+	Since string `json:"since"`
+	Until string `json:"until"`
+	// Messages replayed per second, and how many may be sent at once above that rate
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// RecordingReplayStarted is the answer to a replay request, the messages being replayed in the background
+type RecordingReplayStarted struct {
+	Endpoint string `json:"endpoint"`
+	Target   string `json:"target"`
+	Messages int    `json:"messages"`
+}
+
+// newRecorder parses recordings of the form /endpoint=retention, where the retention is a duration or a number
+// of days such as 7d, and opens their logs in a directory
+func newRecorder(dir string, rules []string, maxMessages int) (*Recorder, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("recording endpoints requires --record-dir")
+	}
+
+	r := &Recorder{}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid recording %q, expected /endpoint=retention", rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		retention, err := parseRetention(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording %q: %v", rule, err)
+		}
+		h, err := newHistoryLog(filepath.Join(dir, url.PathEscape(endpoint)), []string{endpoint}, retention, maxMessages)
+		if err != nil {
+			return nil, err
+		}
+		r.recordings = append(r.recordings, &recording{endpoint: endpoint, retention: retention, log: h})
+	}
+	return r, nil
+}
+
+// parseRetention parses a positive duration, accepting a number of days such as 7d
+func parseRetention(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 1 {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	return retention, nil
+}
+
+// Record queues a message for the recordings of its endpoint
+func (r *Recorder) Record(msg Message) {
+	if r == nil {
+		return
+	}
+	for _, rec := range r.recordings {
+		rec.log.Record(msg)
+	}
+}
+
+// find returns the recording of an endpoint, nil if it isn't recorded
+func (r *Recorder) find(endpoint string) *recording {
+	if r == nil {
+		return nil
+	}
+	for _, rec := range r.recordings {
+		if rec.log.Enabled(endpoint) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// Run writes and compacts the logs of the recordings until they're closed
+func (r *Recorder) Run(interval time.Duration) {
+	for _, rec := range r.recordings {
+		go rec.log.Run(interval)
+	}
+}
+
+// Close writes what's queued for the recordings and closes their logs
+func (r *Recorder) Close(timeout time.Duration) {
+	for _, rec := range r.recordings {
+		rec.log.Close(timeout)
+	}
+}
+
+// Ready checks if messages can be written to the logs of all recordings
+func (r *Recorder) Ready() error {
+	for _, rec := range r.recordings {
+		if err := rec.log.Ready(); err != nil {
+			return fmt.Errorf("%s: %v", rec.endpoint, err)
+		}
+	}
+	return nil
+}
+
+// Statuses returns every recorded endpoint with the number and age of the messages recorded
+func (r *Recorder) Statuses() ([]RecordingStatus, error) {
+	statuses := []RecordingStatus{}
+	for _, rec := range r.recordings {
+		endpoints, err := rec.log.loggedEndpoints()
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range endpoints {
+			entries, err := rec.log.Between(endpoint, time.Time{}, time.Time{})
+			if err != nil {
+				return nil, err
+			}
+			status := RecordingStatus{Endpoint: endpoint, RecordedBy: rec.endpoint, Retention: rec.retention.String(), Messages: len(entries)}
+			if len(entries) > 0 {
+				status.Oldest = entries[0].At.Format(time.RFC3339Nano)
+				status.Newest = entries[len(entries)-1].At.Format(time.RFC3339Nano)
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// handleRecordingReplay starts replaying the recording of an endpoint into the target endpoint of the request,
+// which has to be a plain endpoint of its own so that the replay doesn't reach the consumers of the recorded one
+func handleRecordingReplay(w http.ResponseWriter, r *http.Request, endpoint string) {
+	rec := recorder.find(endpoint)
+	if rec == nil || isPattern(endpoint) {
+		http.Error(w, "endpoint isn't recorded", 404)
+		return
+	}
+
+	req := RecordingReplay{Rate: recordingReplayRate, Burst: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	req.Target = strings.TrimRight(req.Target, "/")
+	if !strings.HasPrefix(req.Target, "/") || isPattern(req.Target) || isReserved(req.Target) {
+		http.Error(w, "invalid target, expected an endpoint", 400)
+		return
+	}
+	if req.Target == endpoint || recorder.find(req.Target) != nil {
+		http.Error(w, "target has to be an endpoint of its own which isn't recorded", 400)
+		return
+	}
+	if req.Rate <= 0 {
+		http.Error(w, "invalid rate, expected messages per second", 400)
+		return
+	}
+	if req.Burst <= 0 {
+		http.Error(w, "invalid burst, expected a number of messages", 400)
+		return
+	}
+	var since, until time.Time
+	for _, bound := range []struct {
+		value string
+		t     *time.Time
+	}{{req.Since, &since}, {req.Until, &until}} {
+		if bound.value == "" {
+			continue
+		}
+		var err error
+		if *bound.t, err = time.Parse(time.RFC3339Nano, bound.value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid time %q, expected RFC3339", bound.value), 400)
+			return
+		}
+	}
+
+	entries, err := rec.log.Between(endpoint, since, until)
+	if err != nil {
+		log.WithField("endpoint", endpoint).Errorln("Failed to read recording:", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"endpoint": endpoint,
+		"target":   req.Target,
+		"messages": len(entries),
+	}).Warnln("Replaying recording")
+	go replayRecording(endpoint, req.Target, entries, newRateLimiter(req.Rate, req.Burst))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(RecordingReplayStarted{Endpoint: endpoint, Target: req.Target, Messages: len(entries)})
+}
+
+// replayRecording broadcasts recorded messages on the target endpoint as fast as the limiter allows, keeping
+// their IDs and time of receipt so that consumers can tell them apart from the live messages they receive later
+func replayRecording(endpoint string, target string, entries []historyEntry, limiter *rateLimiter) {
+	for _, entry := range entries {
+		limiter.Wait()
+		msg := entry.Message
+		msg.Endpoint, msg.Seq, msg.Attempt = target, 0, 0
+		metadata := map[string]interface{}{"recorded_endpoint": endpoint}
+		for key, value := range msg.Metadata {
+			metadata[key] = value
+		}
+		msg.Metadata = metadata
+		hub.Broadcast(msg)
+	}
+
+	log.WithField("endpoint", endpoint).WithField("target", target).Infoln("Recording replayed")
+	publishEvent("recording_replayed", map[string]interface{}{"endpoint": endpoint, "target": target, "messages": len(entries)})
+}
@@ -0,0 +1,187 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Replacement for values removed by redaction
+const redactedValue = "[REDACTED]"
+
+// Built-in patterns which can be enabled by name
+var redactPresets = map[string]string{
+	"email": `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"card":  `\b(?:\d[ \-]?){13,16}\b`,
+	"token": `(?i)\b(?:bearer\s+[A-Za-z0-9\-._~+/]+=*|sk_(?:live|test)_[A-Za-z0-9]+|gh[pousr]_[A-Za-z0-9]{36,})`,
+}
+
+// Redactor masks sensitive values in messages before they are broadcasted
+type Redactor struct {
+	paths    []redactPath
+	patterns []*regexp.Regexp
+}
+
+// redactPath is a dotted JSON path, optionally limited to a single endpoint. "*" matches any key or index.
+type redactPath struct {
+	endpoint string
+	parts    []string
+}
+
+// newRedactor parses JSON paths of the form "a.b.c" or "/endpoint:a.b.c", regular expressions and preset names
+func newRedactor(paths []string, patterns []string, presets []string) (*Redactor, error) {
+	r := &Redactor{}
+
+	for _, path := range paths {
+		endpoint := ""
+		if strings.HasPrefix(path, "/") {
+			parts := strings.SplitN(path, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid redaction path %q, expected /endpoint:path", path)
+			}
+			endpoint, path = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		if path == "" {
+			return nil, fmt.Errorf("empty redaction path")
+		}
+		r.paths = append(r.paths, redactPath{endpoint: endpoint, parts: strings.Split(path, ".")})
+	}
+
+	for _, name := range presets {
+		if name == "" {
+			continue
+		}
+		pattern, ok := redactPresets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction preset %q", name)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// Redact masks all matching paths and patterns in the headers and data of a message
+func (r *Redactor) Redact(msg *Message) {
+	if len(r.paths) == 0 && len(r.patterns) == 0 {
+		return
+	}
+
+	for _, path := range r.paths {
+		if path.endpoint == "" || path.endpoint == msg.Endpoint {
+			msg.Data = redactAtPath(msg.Data, path.parts)
+		}
+	}
+
+	if len(r.patterns) == 0 {
+		return
+	}
+
+	for k, v := range msg.Headers {
+		msg.Headers[k] = r.redactString(v)
+	}
+	for _, values := range []map[string][]string{msg.HeaderValues, msg.Query} {
+		for _, v := range values {
+			for i := range v {
+				v[i] = r.redactString(v[i])
+			}
+		}
+	}
+
+	if body, ok := msg.Data.([]byte); ok {
+		msg.Data = []byte(r.redactString(string(body)))
+	} else {
+		msg.Data = r.redactValue(msg.Data)
+	}
+}
+
+// Headers holding credentials or signatures, which are always masked in captured requests
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"Stripe-Signature",
+	"X-Slack-Signature",
+	"X-Gitlab-Token",
+}
+
+// RedactHeaders returns a copy of the headers of a request to an endpoint with credentials, signatures and the
+// endpoint's secret headers masked, and the patterns applied to all other values
+func (r *Redactor) RedactHeaders(endpoint string, headers http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		copied := make([]string, len(values))
+		for i, v := range values {
+			copied[i] = r.redactString(v)
+		}
+		redacted[name] = copied
+	}
+	for _, name := range append(credentialHeaders, secretHeadersFor(endpoint)...) {
+		name = http.CanonicalHeaderKey(name)
+		for i := range redacted[name] {
+			redacted[name][i] = redactedValue
+		}
+	}
+	return redacted
+}
+
+// redactAtPath replaces the value at a path inside decoded JSON
+func redactAtPath(value interface{}, parts []string) interface{} {
+	if len(parts) == 0 {
+		return redactedValue
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if parts[0] == "*" || parts[0] == key {
+				v[key] = redactAtPath(child, parts[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if parts[0] == "*" || parts[0] == fmt.Sprint(i) {
+				v[i] = redactAtPath(child, parts[1:])
+			}
+		}
+	}
+
+	return value
+}
+
+// redactValue applies all patterns to every string inside decoded JSON
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = r.redactValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = r.redactValue(child)
+		}
+	}
+
+	return value
+}
+
+func (r *Redactor) redactString(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redactedValue)
+	}
+	return s
+}
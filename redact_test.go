@@ -0,0 +1,138 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// decodeJSON decodes JSON like hooks are, failing the test if it's invalid
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestRedactorRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		patterns []string
+		presets  []string
+		endpoint string
+		data     string
+		expected string
+	}{
+		{"path", []string{"user.password"}, nil, nil, "/signup",
+			`{"user":{"name":"ada","password":"hunter2"}}`,
+			`{"user":{"name":"ada","password":"[REDACTED]"}}`},
+		{"path with $ prefix", []string{"$.token"}, nil, nil, "/signup",
+			`{"token":"abc","keep":"x"}`,
+			`{"token":"[REDACTED]","keep":"x"}`},
+		{"wildcard key and index", []string{"cards.*.number"}, nil, nil, "/payments",
+			`{"cards":[{"number":"4242","brand":"visa"},{"number":"5555"}]}`,
+			`{"cards":[{"number":"[REDACTED]","brand":"visa"},{"number":"[REDACTED]"}]}`},
+		{"array index", []string{"items.1"}, nil, nil, "/orders",
+			`{"items":["a","b","c"]}`,
+			`{"items":["a","[REDACTED]","c"]}`},
+		{"path of another endpoint", []string{"/payments:secret"}, nil, nil, "/orders",
+			`{"secret":"s"}`,
+			`{"secret":"s"}`},
+		{"path of the endpoint", []string{"/payments/:secret"}, nil, nil, "/payments",
+			`{"secret":"s"}`,
+			`{"secret":"[REDACTED]"}`},
+		{"missing path", []string{"user.password"}, nil, nil, "/signup",
+			`{"user":"ada"}`,
+			`{"user":"ada"}`},
+		{"pattern in nested strings", nil, []string{`\d{3}-\d{4}`}, nil, "/calls",
+			`{"from":"call 555-1234","to":["555-9876"],"count":5551234}`,
+			`{"from":"call [REDACTED]","to":["[REDACTED]"],"count":5551234}`},
+		{"email preset", nil, nil, []string{"email"}, "/signup",
+			`{"contact":"write to ada@example.com today"}`,
+			`{"contact":"write to [REDACTED] today"}`},
+		{"card preset", nil, nil, []string{"card"}, "/payments",
+			`{"card":"4242 4242 4242 4242"}`,
+			`{"card":"[REDACTED]"}`},
+		{"token preset", nil, nil, []string{"token"}, "/payments",
+			`{"auth":"Bearer abc.def","key":"sk_live_123abc"}`,
+			`{"auth":"[REDACTED]","key":"[REDACTED]"}`},
+	}
+	for _, test := range tests {
+		r, err := newRedactor(test.paths, test.patterns, test.presets)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		msg := Message{Endpoint: test.endpoint, Data: decodeJSON(t, test.data)}
+		r.Redact(&msg)
+		if expected := decodeJSON(t, test.expected); !reflect.DeepEqual(msg.Data, expected) {
+			t.Errorf("%s: redacted %v, expected %v", test.name, msg.Data, expected)
+		}
+	}
+}
+
+func TestRedactorRedactsHeadersAndRawBodies(t *testing.T) {
+	r, err := newRedactor(nil, nil, []string{"email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{
+		Endpoint:     "/signup",
+		Headers:      map[string]string{"X-User": "ada@example.com"},
+		HeaderValues: map[string][]string{"X-User": {"ada@example.com"}},
+		Query:        map[string][]string{"email": {"ada@example.com"}},
+		Data:         []byte("email=ada@example.com"),
+	}
+	r.Redact(&msg)
+	if msg.Headers["X-User"] != redactedValue || msg.HeaderValues["X-User"][0] != redactedValue || msg.Query["email"][0] != redactedValue {
+		t.Errorf("headers and query not redacted: %v %v %v", msg.Headers, msg.HeaderValues, msg.Query)
+	}
+	if body := string(msg.Data.([]byte)); body != "email=[REDACTED]" {
+		t.Errorf("raw body redacted to %q", body)
+	}
+}
+
+func TestRedactHeadersMasksCredentials(t *testing.T) {
+	r, err := newRedactor(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{
+		"Authorization":    {"Bearer abc"},
+		"Stripe-Signature": {"t=1,v1=abc"},
+		"Content-Type":     {"application/json"},
+	}
+	redacted := r.RedactHeaders("/payments", headers)
+	expected := map[string][]string{
+		"Authorization":    {redactedValue},
+		"Stripe-Signature": {redactedValue},
+		"Content-Type":     {"application/json"},
+	}
+	if !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("RedactHeaders = %v, expected %v", redacted, expected)
+	}
+	if headers.Get("Authorization") != "Bearer abc" {
+		t.Error("RedactHeaders changed the request's headers")
+	}
+}
+
+func TestNewRedactorRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		paths    []string
+		patterns []string
+		presets  []string
+	}{
+		{[]string{"/payments"}, nil, nil},
+		{[]string{"$"}, nil, nil},
+		{nil, []string{"("}, nil},
+		{nil, nil, []string{"phone"}},
+	}
+	for _, test := range tests {
+		if _, err := newRedactor(test.paths, test.patterns, test.presets); err == nil {
+			t.Errorf("newRedactor(%q, %q, %q) accepted invalid rules", test.paths, test.patterns, test.presets)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package sockethook
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long connecting to Redis and publishing a message may take
+var redisTimeout = 5 * time.Second
+
+// Longest wait between attempts to resubscribe after the connection to Redis was lost
+var redisMaxBackoff = 30 * time.Second
+
+// Returned when using a Redis broker which has been closed
+var errBrokerClosed = errors.New("broker closed")
+
+// redisBroker relays messages between instances through Redis pub/sub, using one connection for publishing and
+// one for the subscription. Both are reconnected when they fail.
+type redisBroker struct {
+	url     *url.URL
+	channel string
+
+	mu sync.Mutex
+	// Connection publishes are sent on, nil until first used or after it failed
+	pub    net.Conn
+	reader *bufio.Reader
+	// Connection of the subscription, closed to stop it
+	sub    net.Conn
+	closed bool
+	// Whether the subscription is confirmed, and why it was lost otherwise
+	subscribed bool
+	subErr     error
+}
+
+// newRedisBroker creates a broker for a redis:// or rediss:// URL, which may contain a username and password.
+// Connections are only made once the broker is used.
+func newRedisBroker(rawURL string, channel string) (*redisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis:// or rediss://", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, missing host", rawURL)
+	}
+	if channel == "" {
+		return nil, fmt.Errorf("Redis channel is empty")
+	}
+	return &redisBroker{url: u, channel: channel}, nil
+}
+
+// Publish sends a payload to the channel, reconnecting first if the previous connection failed
+func (b *redisBroker) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	if b.pub == nil {
+		conn, reader, err := redisDial(b.url)
+		if err != nil {
+			return err
+		}
+		b.pub, b.reader = conn, reader
+	}
+
+	b.pub.SetDeadline(time.Now().Add(redisTimeout))
+	_, err := redisCommand(b.pub, b.reader, "PUBLISH", b.channel, string(payload))
+	if err != nil {
+		b.pub.Close()
+		b.pub, b.reader = nil, nil
+	}
+	return err
+}
+
+// Subscribe receives the payloads published to the channel on its own goroutine, resubscribing with backoff
+// whenever the connection is lost
+func (b *redisBroker) Subscribe(handle func(payload []byte)) {
+	go func() {
+		backoff := time.Second
+		for {
+			err := b.subscribe(handle, func() { backoff = time.Second })
+			if err == errBrokerClosed {
+				return
+			}
+			b.mu.Lock()
+			b.subscribed, b.subErr = false, err
+			b.mu.Unlock()
+			log.WithField("channel", b.channel).WithField("retry", backoff).Warnln("Redis subscription lost:", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+		}
+	}()
+}
+
+// subscribe subscribes to the channel and handles payloads until the connection fails, calling subscribed once
+// the subscription has been confirmed
+func (b *redisBroker) subscribe(handle func(payload []byte), subscribed func()) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBrokerClosed
+	}
+	b.mu.Unlock()
+
+	conn, reader, err := redisDial(b.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBrokerClosed
+	}
+	b.sub = conn
+	b.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := redisCommand(conn, reader, "SUBSCRIBE", b.channel); err != nil {
+		return b.subscriptionError(err)
+	}
+	conn.SetDeadline(time.Time{})
+	subscribed()
+	b.mu.Lock()
+	b.subscribed = true
+	b.mu.Unlock()
+	log.WithField("channel", b.channel).Infoln("Subscribed to Redis")
+
+	for {
+		reply, err := redisReadReply(reader)
+		if err != nil {
+			return b.subscriptionError(err)
+		}
+		// Pushed messages are arrays of "message", the channel and the payload
+		if parts, ok := reply.([]interface{}); ok && len(parts) == 3 {
+			kind, _ := parts[0].([]byte)
+			payload, _ := parts[2].([]byte)
+			if string(kind) == "message" {
+				handle(payload)
+			}
+		}
+	}
+}
+
+// subscriptionError returns errBrokerClosed instead of the error caused by closing the subscription
+func (b *redisBroker) subscriptionError(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBrokerClosed
+	}
+	return err
+}
+
+// Ready checks if the subscription is confirmed, as messages of other instances are missed until it is
+func (b *redisBroker) Ready() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.closed:
+		return errBrokerClosed
+	case b.subscribed:
+		return nil
+	case b.subErr != nil:
+		return b.subErr
+	}
+	return errors.New("not subscribed to Redis yet")
+}
+
+// Close closes both connections and stops the subscription
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub, b.reader = nil, nil
+	}
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	return nil
+}
+
+// redisDial connects to the Redis server of a URL, over TLS for rediss://, and authenticates if the URL contains
+// a password
+func redisDial(u *url.URL) (net.Conn, *bufio.Reader, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if username := u.User.Username(); username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err := redisCommand(conn, reader, args...); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("Redis authentication failed: %v", err)
+		}
+	}
+	return conn, reader, nil
+}
+
+// redisCommand sends a command and reads its reply, returning error replies as errors
+func redisCommand(conn net.Conn, reader *bufio.Reader, args ...string) (interface{}, error) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, command.String()); err != nil {
+		return nil, err
+	}
+	return redisReadReply(reader)
+}
+
+// redisReadReply reads a reply in the Redis serialization protocol. Simple strings and bulk strings are returned
+// as []byte, integers as int64, arrays as []interface{} and nil bulk strings and arrays as nil.
+func redisReadReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid Redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return []byte(value), nil
+	case '-':
+		return nil, errors.New(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		parts := make([]interface{}, count)
+		for i := range parts {
+			if parts[i], err = redisReadReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	default:
+		return nil, fmt.Errorf("invalid Redis reply %q", line)
+	}
+}
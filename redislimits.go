@@ -0,0 +1,108 @@
+package sockethook
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the Redis rate limit backend is left alone after it failed, rate limits being enforced in memory
+// meanwhile instead of every hook waiting for a connection to time out
+var redisLimitRetryDelay = time.Second
+
+// Token bucket taking a token from the hash at KEYS[1] with the rate and burst of ARGV. Time is taken from the
+// Redis server so that instances with clocks apart share buckets correctly, and buckets expire once they'd have
+// refilled completely, as they behave like new ones then.
+const redisTokenBucket = `
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', string.format('%.6f', tokens), 'last', string.format('%.6f', now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+if allowed == 1 then
+	return {1, 0}
+end
+return {0, math.ceil((1 - tokens) / rate * 1000)}
+`
+
+// redisRateLimits keeps the token buckets of rate limits in Redis, so that they're shared by every instance using
+// the same server and prefix. Buckets are checked over a single connection which is reconnected when it fails.
+type redisRateLimits struct {
+	url    *url.URL
+	prefix string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	// Time before which the backend isn't reconnected to after failing
+	retryAt time.Time
+}
+
+// newRedisRateLimits creates a rate limit backend for a redis:// or rediss:// URL, whose bucket keys start with
+// the prefix. The connection is only made once the backend is used.
+func newRedisRateLimits(rawURL string, prefix string) (*redisRateLimits, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis:// or rediss://", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, missing host", rawURL)
+	}
+	return &redisRateLimits{url: u, prefix: prefix}, nil
+}
+
+// Take takes a token from a bucket in Redis, failing without trying while the backend is left alone after an
+// error
+func (l *redisRateLimits) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		if time.Now().Before(l.retryAt) {
+			return false, 0, errors.New("Redis unavailable")
+		}
+		conn, reader, err := redisDial(l.url)
+		if err != nil {
+			l.retryAt = time.Now().Add(redisLimitRetryDelay)
+			return false, 0, err
+		}
+		l.conn, l.reader = conn, reader
+	}
+
+	l.conn.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := redisCommand(l.conn, l.reader, "EVAL", redisTokenBucket, "1", l.prefix+key,
+		strconv.FormatFloat(rate, 'f', -1, 64), strconv.Itoa(burst))
+	if err != nil {
+		l.conn.Close()
+		l.conn, l.reader = nil, nil
+		l.retryAt = time.Now().Add(redisLimitRetryDelay)
+		return false, 0, err
+	}
+
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 2 {
+		return false, 0, fmt.Errorf("invalid Redis rate limit reply %v", reply)
+	}
+	allowed, _ := parts[0].(int64)
+	wait, _ := parts[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,46 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientRejection is the body of the response a websocket or event stream client is rejected with, so that
+// clients can tell why they can't connect without parsing log output on the server
+type ClientRejection struct {
+	// Reason of the rejection, such as missing_token or origin_not_allowed
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// rejectClient answers a connecting client with an error status and a JSON body giving the reason, counting
+// rejections per reason
+func rejectClient(w http.ResponseWriter, status int, reason string, message string) {
+	metrics.rejections.Inc(reason)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ClientRejection{Error: reason, Message: message})
+}
+
+// requireUpgrade rejects requests to socket endpoints which aren't websocket handshakes, such as a browser opening
+// the URL, with 426 and the protocol to upgrade to. Returns whether the request is a handshake.
+func requireUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	if websocket.IsWebSocketUpgrade(r) {
+		return true
+	}
+	w.Header().Set("Upgrade", "websocket")
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Sec-WebSocket-Version", "13")
+	rejectClient(w, 426, "not_websocket", "expected a websocket handshake, connect with a websocket client or use /sse for event streams")
+	return false
+}
+
+// upgradeError answers handshakes the upgrader fails, such as those with an unsupported version or without a
+// key, with the versions supported as the upgrader would. Nothing else may be written after it.
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	w.Header().Set("Sec-WebSocket-Version", "13")
+	rejectClient(w, status, "handshake_failed", reason.Error())
+}
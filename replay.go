@@ -0,0 +1,347 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Buffer of recent messages replayed to reconnecting clients
+var replayBuffer = &ReplayBuffer{}
+
+// Messages per second replayed to each resuming client, 0 to replay them at once, and how many may be replayed
+// at once above that rate, 0 for one second's worth
+var replayRate float64
+var replayBurst int
+
+// ReplayBuffer keeps the last messages of endpoints so reconnecting clients can receive what they missed
+type ReplayBuffer struct {
+	mu sync.Mutex
+
+	// Number of messages kept for endpoints without their own size, 0 disables buffering
+	fallback int
+	// Number of messages kept for specific endpoints
+	sizes map[string]int
+	// Sizes from the configuration file, taking precedence over sizes
+	overrides map[string]int
+	// How long messages are kept, 0 keeps them until they're pushed out
+	ttl time.Duration
+	// Age above which messages of specific endpoints aren't replayed, however long they're kept
+	maxAges map[string]time.Duration
+	// Buffered messages per endpoint
+	rings map[string]*ring
+}
+
+// ring is a fixed size buffer of messages which overwrites the oldest one when full
+type ring struct {
+	entries []ringEntry
+	start   int
+	count   int
+	// Sequence number of the last message recorded
+	last uint64
+}
+
+type ringEntry struct {
+	msg Message
+	at  time.Time
+}
+
+// newReplayBuffer parses sizes of the form "100" (all endpoints) or "/endpoint=100"
+func newReplayBuffer(rules []string, ttl time.Duration) (*ReplayBuffer, error) {
+	b := &ReplayBuffer{sizes: make(map[string]int), ttl: ttl, rings: make(map[string]*ring)}
+
+	for _, rule := range rules {
+		endpoint := ""
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid replay buffer %q, expected /endpoint=size", rule)
+			}
+			endpoint, rule = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+
+		size, err := strconv.Atoi(rule)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid replay buffer size %q", rule)
+		}
+
+		if endpoint == "" {
+			b.fallback = size
+		} else {
+			b.sizes[endpoint] = size
+		}
+	}
+
+	return b, nil
+}
+
+// parseReplayMaxAges parses maximum ages of replayed messages of the form "/endpoint=10m"
+func parseReplayMaxAges(rules []string) (map[string]time.Duration, error) {
+	ages := make(map[string]time.Duration)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(rule, "/") {
+			return nil, fmt.Errorf("invalid replay max age %q, expected /endpoint=duration", rule)
+		}
+		age, err := time.ParseDuration(parts[1])
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("invalid replay max age %q, expected a duration such as 10m", rule)
+		}
+		ages[strings.TrimRight(parts[0], "/")] = age
+	}
+	return ages, nil
+}
+
+// SetMaxAges sets the age above which messages of endpoints aren't replayed
+func (b *ReplayBuffer) SetMaxAges(ages map[string]time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxAges = ages
+}
+
+// size returns the number of messages kept for an endpoint
+func (b *ReplayBuffer) size(endpoint string) int {
+	if size, ok := b.overrides[endpoint]; ok {
+		return size
+	}
+	if size, ok := b.sizes[endpoint]; ok {
+		return size
+	}
+	return b.fallback
+}
+
+// SetOverrides replaces the sizes set by the configuration file. Buffers whose size changes are dropped.
+func (b *ReplayBuffer) SetOverrides(overrides map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.overrides = overrides
+	for endpoint, r := range b.rings {
+		if len(r.entries) != b.size(endpoint) {
+			delete(b.rings, endpoint)
+		}
+	}
+}
+
+// Enabled checks if messages of an endpoint are buffered
+func (b *ReplayBuffer) Enabled(endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size(endpoint) > 0
+}
+
+// Record adds a message to the buffer of its endpoint
+func (b *ReplayBuffer) Record(msg Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := b.size(msg.Endpoint)
+	if size <= 0 {
+		return
+	}
+
+	r, ok := b.rings[msg.Endpoint]
+	if !ok {
+		r = &ring{entries: make([]ringEntry, size)}
+		b.rings[msg.Endpoint] = r
+	}
+
+	entry := ringEntry{msg: msg, at: time.Now()}
+	if msg.Seq > r.last {
+		r.last = msg.Seq
+	}
+	if r.count < len(r.entries) {
+		r.entries[(r.start+r.count)%len(r.entries)] = entry
+		r.count++
+	} else {
+		r.entries[r.start] = entry
+		r.start = (r.start + 1) % len(r.entries)
+	}
+}
+
+// Since returns the buffered messages of an endpoint received after the one with the given ID, oldest first,
+// leaving out those older than the endpoint's maximum age. If the message isn't buffered anymore all buffered
+// messages are returned and found is false, as some of the messages after it may have been lost.
+func (b *ReplayBuffer) Since(endpoint string, id string) (messages []Message, found bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rings[endpoint]
+	if !ok {
+		return nil, false
+	}
+
+	maxAge := b.maxAges[endpoint]
+	for i := 0; i < r.count; i++ {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if b.ttl > 0 && time.Since(entry.at) > b.ttl {
+			continue
+		}
+		if maxAge > 0 && time.Since(entry.at) > maxAge {
+			// The message a client resumes from may be too old to replay while those after it aren't
+			if entry.msg.ID == id {
+				found = true
+			}
+			continue
+		}
+		if entry.msg.ID == id {
+			messages, found = nil, true
+			continue
+		}
+		messages = append(messages, entry.msg)
+	}
+	return messages, found
+}
+
+// SinceSeq returns the buffered messages of an endpoint with a higher sequence number than seq, oldest first,
+// leaving out those too old like Since. Complete is false if messages after seq were recorded but aren't all
+// buffered anymore, or the endpoint isn't buffered at all, as some of them were lost.
+func (b *ReplayBuffer) SinceSeq(endpoint string, seq uint64) (messages []Message, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rings[endpoint]
+	if !ok {
+		return nil, false
+	}
+	maxAge := b.maxAges[endpoint]
+	for i := 0; i < r.count; i++ {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if entry.msg.Seq <= seq || (b.ttl > 0 && time.Since(entry.at) > b.ttl) || (maxAge > 0 && time.Since(entry.at) > maxAge) {
+			continue
+		}
+		messages = append(messages, entry.msg)
+	}
+	// Messages numbered but not recorded yet are still on their way, and delivered live
+	if seq >= r.last {
+		return messages, true
+	}
+	return messages, len(messages) > 0 && messages[0].Seq == seq+1
+}
+
+// After returns the buffered messages with a higher sequence number than the one given for their endpoint, all
+// of them for endpoints without one, oldest first per endpoint
+func (b *ReplayBuffer) After(sequences map[string]uint64) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := []Message{}
+	for endpoint, r := range b.rings {
+		for i := 0; i < r.count; i++ {
+			entry := r.entries[(r.start+i)%len(r.entries)]
+			if b.ttl > 0 && time.Since(entry.at) > b.ttl {
+				continue
+			}
+			if entry.msg.Seq > sequences[endpoint] {
+				messages = append(messages, entry.msg)
+			}
+		}
+	}
+	return messages
+}
+
+// Counts returns the number of messages buffered per endpoint
+func (b *ReplayBuffer) Counts() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	counts := make(map[string]int, len(b.rings))
+	for endpoint, r := range b.rings {
+		counts[endpoint] = r.count
+	}
+	return counts
+}
+
+// Purge drops the buffered messages of an endpoint, returning how many there were
+func (b *ReplayBuffer) Purge(endpoint string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rings[endpoint]
+	if !ok {
+		return 0
+	}
+	delete(b.rings, endpoint)
+	return r.count
+}
+
+// Trim drops the oldest half of the buffered messages of every endpoint
+func (b *ReplayBuffer) Trim() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, r := range b.rings {
+		drop := (r.count + 1) / 2
+		for i := 0; i < drop; i++ {
+			r.entries[(r.start+i)%len(r.entries)] = ringEntry{}
+		}
+		r.start = (r.start + drop) % len(r.entries)
+		r.count -= drop
+	}
+}
+
+// resumePoint is where a reconnecting client resumes from, after the message with an ID or sequence number
+type resumePoint struct {
+	lastEventID string
+	// Set if the client gave the sequence number of the last message it saw, which takes precedence over the ID
+	bySeq bool
+	seq   uint64
+}
+
+// lastEventID returns the ID of the last message a reconnecting client saw, from the Last-Event-ID header or
+// the last_event_id query parameter
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("last_event_id")
+}
+
+// connectResume returns where a client resumes from, the sequence number of the last_seq query parameter or the
+// last event ID, rejecting the client if the sequence number is invalid
+func connectResume(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (resumePoint, bool) {
+	resume := resumePoint{lastEventID: lastEventID(r)}
+	if value := r.URL.Query().Get("last_seq"); value != "" {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			logEntry.WithField("last_seq", value).Warnln("Rejected client, invalid sequence number")
+			rejectClient(w, 400, "invalid_last_seq", fmt.Sprintf("invalid sequence number %q", value))
+			return resume, false
+		}
+		resume.bySeq, resume.seq = true, seq
+	}
+	return resume, true
+}
+
+// connectReplayRate returns the limiter pacing the messages replayed to a resuming client, nil if they're
+// replayed at once. Clients may ask for a lower rate than the server's with the replay_rate query parameter, and
+// are rejected if it's invalid.
+func connectReplayRate(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (*rateLimiter, bool) {
+	rate := replayRate
+	if value := r.URL.Query().Get("replay_rate"); value != "" {
+		requested, err := strconv.ParseFloat(value, 64)
+		if err != nil || requested <= 0 {
+			logEntry.WithField("replay_rate", value).Warnln("Rejected client, invalid replay rate")
+			rejectClient(w, 400, "invalid_replay_rate", fmt.Sprintf("invalid replay rate %q, expected messages per second", value))
+			return nil, false
+		}
+		if rate == 0 || requested < rate {
+			rate = requested
+		}
+	}
+	return replayLimiter(rate), true
+}
+
+// replayLimiter returns a limiter replaying messages at a rate, nil if the rate is unlimited
+func replayLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	limit := newRateLimit(rate, replayBurst)
+	return newRateLimiter(limit.rate, limit.burst)
+}
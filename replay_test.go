@@ -0,0 +1,195 @@
+package sockethook
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// messageIDs returns the IDs of messages, for comparing them in tests
+func messageIDs(messages []Message) []string {
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestReplayBufferSince(t *testing.T) {
+	b, err := newReplayBuffer([]string{"3", "/small=1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		b.Record(Message{ID: fmt.Sprintf("m%d", i), Endpoint: "/orders"})
+	}
+	b.Record(Message{ID: "s1", Endpoint: "/small"})
+	b.Record(Message{ID: "s2", Endpoint: "/small"})
+
+	tests := []struct {
+		name     string
+		endpoint string
+		id       string
+		expected []string
+		found    bool
+	}{
+		{"after a buffered message", "/orders", "m2", []string{"m3", "m4"}, true},
+		{"after the last message", "/orders", "m4", nil, true},
+		{"after a message pushed out", "/orders", "m1", []string{"m2", "m3", "m4"}, false},
+		{"after an unknown message", "/orders", "unknown", []string{"m2", "m3", "m4"}, false},
+		{"endpoint with its own size", "/small", "s1", []string{"s2"}, false},
+		{"endpoint without messages", "/users", "m1", nil, false},
+	}
+	for _, test := range tests {
+		messages, found := b.Since(test.endpoint, test.id)
+		if ids := messageIDs(messages); !reflect.DeepEqual(ids, test.expected) || found != test.found {
+			t.Errorf("%s: Since(%q, %q) = %v, %v, expected %v, %v", test.name, test.endpoint, test.id, ids, found, test.expected, test.found)
+		}
+	}
+}
+
+func TestReplayBufferSinceSkipsExpired(t *testing.T) {
+	b, err := newReplayBuffer([]string{"3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		b.Record(Message{ID: fmt.Sprintf("m%d", i), Endpoint: "/orders"})
+	}
+	b.rings["/orders"].entries[0].at = time.Now().Add(-time.Hour)
+
+	messages, found := b.Since("/orders", "m1")
+	if ids := messageIDs(messages); !reflect.DeepEqual(ids, []string{"m2", "m3"}) || found {
+		t.Errorf("Since after an expired message = %v, %v, expected [m2 m3], false", ids, found)
+	}
+}
+
+func TestReplayBufferSinceMaxAge(t *testing.T) {
+	b, err := newReplayBuffer([]string{"4"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages, err := parseReplayMaxAges([]string{"/orders/=10m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetMaxAges(ages)
+	for _, endpoint := range []string{"/orders", "/users"} {
+		for i := 1; i <= 4; i++ {
+			b.Record(Message{ID: fmt.Sprintf("m%d", i), Endpoint: endpoint})
+		}
+		b.rings[endpoint].entries[0].at = time.Now().Add(-time.Hour)
+		b.rings[endpoint].entries[1].at = time.Now().Add(-20 * time.Minute)
+	}
+
+	tests := []struct {
+		endpoint string
+		id       string
+		expected []string
+		found    bool
+	}{
+		{"/orders", "m1", []string{"m3", "m4"}, true},
+		{"/orders", "m2", []string{"m3", "m4"}, true},
+		{"/orders", "m3", []string{"m4"}, true},
+		{"/orders", "unknown", []string{"m3", "m4"}, false},
+		{"/users", "m1", []string{"m2", "m3", "m4"}, true},
+	}
+	for _, test := range tests {
+		messages, found := b.Since(test.endpoint, test.id)
+		if ids := messageIDs(messages); !reflect.DeepEqual(ids, test.expected) || found != test.found {
+			t.Errorf("Since(%q, %q) = %v, %v, expected %v, %v", test.endpoint, test.id, ids, found, test.expected, test.found)
+		}
+	}
+}
+
+func TestReplayBufferSinceSeq(t *testing.T) {
+	b, err := newReplayBuffer([]string{"3"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(1); seq <= 5; seq++ {
+		b.Record(Message{ID: fmt.Sprintf("m%d", seq), Endpoint: "/orders", Seq: seq})
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+		seq      uint64
+		expected []string
+		complete bool
+	}{
+		{"after a buffered message", "/orders", 3, []string{"m4", "m5"}, true},
+		{"right before the oldest buffered message", "/orders", 2, []string{"m3", "m4", "m5"}, true},
+		{"after the last message", "/orders", 5, nil, true},
+		{"after messages still on their way", "/orders", 7, nil, true},
+		{"after a message pushed out", "/orders", 1, []string{"m3", "m4", "m5"}, false},
+		{"from the start", "/orders", 0, []string{"m3", "m4", "m5"}, false},
+		{"endpoint without a buffer", "/users", 0, nil, false},
+	}
+	for _, test := range tests {
+		messages, complete := b.SinceSeq(test.endpoint, test.seq)
+		if ids := messageIDs(messages); !reflect.DeepEqual(ids, test.expected) || complete != test.complete {
+			t.Errorf("%s: SinceSeq(%q, %d) = %v, %v, expected %v, %v", test.name, test.endpoint, test.seq, ids, complete, test.expected, test.complete)
+		}
+	}
+}
+
+func TestParseReplayMaxAges(t *testing.T) {
+	tests := []struct {
+		rules []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"/orders=10m", "/users=1h"}, true},
+		{[]string{"10m"}, false},
+		{[]string{"/orders"}, false},
+		{[]string{"/orders=soon"}, false},
+		{[]string{"/orders=0s"}, false},
+	}
+	for _, test := range tests {
+		if _, err := parseReplayMaxAges(test.rules); (err == nil) != test.valid {
+			t.Errorf("parseReplayMaxAges(%q) error = %v, expected valid %v", test.rules, err, test.valid)
+		}
+	}
+}
+
+func TestReplayBufferTrimAndPurge(t *testing.T) {
+	b, err := newReplayBuffer([]string{"4"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		b.Record(Message{ID: fmt.Sprintf("m%d", i), Endpoint: "/orders"})
+	}
+
+	b.Trim()
+	if messages, _ := b.Since("/orders", ""); !reflect.DeepEqual(messageIDs(messages), []string{"m3"}) {
+		t.Errorf("after trimming, buffered %v, expected the newest half [m3]", messageIDs(messages))
+	}
+	if purged := b.Purge("/orders"); purged != 1 {
+		t.Errorf("Purge = %d, expected 1", purged)
+	}
+	if counts := b.Counts(); len(counts) != 0 {
+		t.Errorf("Counts after purging = %v, expected none", counts)
+	}
+}
+
+func TestNewReplayBuffer(t *testing.T) {
+	tests := []struct {
+		rules []string
+		valid bool
+	}{
+		{[]string{"100"}, true},
+		{[]string{"100", "/orders=10", "/users/=0"}, true},
+		{[]string{"-1"}, false},
+		{[]string{"many"}, false},
+		{[]string{"/orders"}, false},
+		{[]string{"/orders=many"}, false},
+	}
+	for _, test := range tests {
+		if _, err := newReplayBuffer(test.rules, 0); (err == nil) != test.valid {
+			t.Errorf("newReplayBuffer(%q) error = %v, expected valid %v", test.rules, err, test.valid)
+		}
+	}
+}
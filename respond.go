@@ -0,0 +1,111 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Endpoints whose hooks are answered with the response sent back by a client, such as a tunnel
+var respondEndpoints = make(map[string]bool)
+
+// How long hooks on responding endpoints wait for a client response
+var respondTimeout = 10 * time.Second
+
+// HookResponse is sent by clients to answer the original hook request of a message
+type HookResponse struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is base64 encoded
+	Body []byte `json:"body,omitempty"`
+}
+
+// Hooks waiting for a response, keyed by message ID
+var pendingResponses = struct {
+	sync.Mutex
+	waiting map[string]*pendingResponse
+}{waiting: make(map[string]*pendingResponse)}
+
+// pendingResponse is a hook waiting for a response, which only clients subscribed to its endpoint may send
+type pendingResponse struct {
+	endpoint string
+	ch       chan HookResponse
+	// Clients the message was delivered to, which are the only ones that may respond once there are any
+	delivered map[*client]bool
+}
+
+// setRespondEndpoints flags endpoints whose hooks wait for a client response
+func setRespondEndpoints(endpoints []string) {
+	for _, endpoint := range endpoints {
+		respondEndpoints[strings.TrimRight(endpoint, "/")] = true
+	}
+}
+
+// expectResponse registers a hook to an endpoint waiting for the response to a message
+func expectResponse(id string, endpoint string) chan HookResponse {
+	ch := make(chan HookResponse, 1)
+
+	pendingResponses.Lock()
+	pendingResponses.waiting[id] = &pendingResponse{endpoint: endpoint, ch: ch, delivered: make(map[*client]bool)}
+	pendingResponses.Unlock()
+	return ch
+}
+
+// responseDelivered records that a message waiting for a response was delivered to a client
+func responseDelivered(id string, c *client) {
+	pendingResponses.Lock()
+	if p, ok := pendingResponses.waiting[id]; ok {
+		p.delivered[c] = true
+	}
+	pendingResponses.Unlock()
+}
+
+// cancelResponse stops waiting for the response to a message
+func cancelResponse(id string) {
+	pendingResponses.Lock()
+	delete(pendingResponses.waiting, id)
+	pendingResponses.Unlock()
+}
+
+// handleResponseFrame passes a client's response on to the hook waiting for it, the first response for a message
+// wins. Responses are only accepted from clients subscribed to the hook's endpoint which the message was
+// delivered to, so that clients of other endpoints can't answer hooks by guessing message IDs.
+func handleResponseFrame(c *client, data []byte) {
+	var resp HookResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return
+	}
+	logEntry := log.WithField("endpoint", c.endpoint).WithField("id", resp.ID)
+
+	pendingResponses.Lock()
+	p, ok := pendingResponses.waiting[resp.ID]
+	pendingResponses.Unlock()
+	if !ok {
+		logEntry.Debugln("Ignoring response for unknown message")
+		return
+	}
+
+	hub.mu.Lock()
+	subscribed := c.subscribedTo(p.endpoint)
+	hub.mu.Unlock()
+
+	pendingResponses.Lock()
+	allowed := subscribed && (len(p.delivered) == 0 || p.delivered[c])
+	if allowed {
+		// Another response may have won or the hook may have given up in the meantime
+		allowed = pendingResponses.waiting[resp.ID] == p
+		delete(pendingResponses.waiting, resp.ID)
+	}
+	pendingResponses.Unlock()
+
+	if !allowed {
+		logEntry.WithField("hook_endpoint", p.endpoint).Warnln("Ignoring response from client which didn't receive the message")
+		return
+	}
+	p.ch <- resp
+}
@@ -0,0 +1,168 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Skip broadcasting retried deliveries of hooks which were already delivered to a client
+var suppressRelayedRetries = false
+
+// How long and how many delivery IDs are remembered to recognize retries
+var deliveryWindow = 24 * time.Hour
+var maxTrackedDeliveries = 100000
+
+// Headers identifying deliveries and attempts of providers not known to Sockethook, given on the command line
+var deliveryIDHeader, attemptHeader string
+
+// Deliveries of hooks seen recently
+var deliveries = newDeliveryTracker()
+
+// DeliveryInfo is the retry metadata a provider sent with a hook
+type DeliveryInfo struct {
+	Provider string `json:"provider"`
+	// ID of the delivery, the same for all attempts
+	ID string `json:"id,omitempty"`
+	// Number of the attempt, starting at 1, if the provider sends it
+	Attempt int `json:"attempt,omitempty"`
+	// Whether the hook is a retry, either given by its attempt or by its ID being seen before
+	Retry bool `json:"retry"`
+	// Why the provider retried, if it sends a reason
+	Reason string `json:"reason,omitempty"`
+}
+
+// retryProvider describes where a provider puts the retry metadata of its hooks
+type retryProvider struct {
+	name string
+	// Header which only the provider's hooks have, if the ID isn't in a header of its own
+	marker string
+	// Header or top-level field of the JSON body holding the delivery ID
+	idHeader string
+	idField  string
+	// Header holding the attempt number, counting retries rather than attempts if retryOffset is 1
+	attemptHeader string
+	retryOffset   int
+	reasonHeader  string
+}
+
+// Providers whose retry metadata is recognized, in order of precedence
+var retryProviders = []retryProvider{
+	{name: "github", idHeader: "X-GitHub-Delivery"},
+	{name: "gitlab", marker: "X-Gitlab-Event", idHeader: "Idempotency-Key"},
+	{name: "gitlab", idHeader: "X-Gitlab-Event-UUID"},
+	{name: "shopify", idHeader: "X-Shopify-Webhook-Id"},
+	{name: "slack", marker: "X-Slack-Signature", idField: "event_id", attemptHeader: "X-Slack-Retry-Num", retryOffset: 1, reasonHeader: "X-Slack-Retry-Reason"},
+	{name: "stripe", marker: "Stripe-Signature", idField: "id"},
+	{name: "standard-webhooks", idHeader: "Webhook-Id"},
+	{name: "svix", idHeader: "Svix-Id"},
+}
+
+// deliveryInfo extracts the retry metadata of a hook, nil if it has none
+func deliveryInfo(r *http.Request, body []byte) *DeliveryInfo {
+	if deliveryIDHeader != "" || attemptHeader != "" {
+		info := &DeliveryInfo{Provider: "custom"}
+		if deliveryIDHeader != "" {
+			info.ID = r.Header.Get(deliveryIDHeader)
+		}
+		if attemptHeader != "" {
+			info.Attempt, _ = strconv.Atoi(r.Header.Get(attemptHeader))
+		}
+		if info.ID != "" || info.Attempt > 0 {
+			return info
+		}
+	}
+
+	for _, p := range retryProviders {
+		if p.marker != "" && r.Header.Get(p.marker) == "" {
+			continue
+		}
+		info := &DeliveryInfo{Provider: p.name}
+		if p.idHeader != "" {
+			info.ID = r.Header.Get(p.idHeader)
+		} else {
+			var fields map[string]interface{}
+			if json.Unmarshal(body, &fields) == nil {
+				info.ID, _ = fields[p.idField].(string)
+			}
+		}
+		if p.attemptHeader != "" {
+			if n, err := strconv.Atoi(r.Header.Get(p.attemptHeader)); err == nil {
+				info.Attempt = n + p.retryOffset
+			}
+		}
+		if p.reasonHeader != "" {
+			info.Reason = r.Header.Get(p.reasonHeader)
+		}
+		if info.ID != "" || info.Attempt > 0 {
+			return info
+		}
+	}
+	return nil
+}
+
+// deliveryTracker remembers the delivery IDs of recent hooks per endpoint and whether they were delivered to a
+// client, forgetting the oldest ones beyond maxTrackedDeliveries
+type deliveryTracker struct {
+	mu    sync.Mutex
+	seen  map[string]*trackedDelivery
+	order []string
+}
+
+type trackedDelivery struct {
+	at      time.Time
+	relayed bool
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{seen: make(map[string]*trackedDelivery)}
+}
+
+func deliveryKey(endpoint string, info *DeliveryInfo) string {
+	return endpoint + "\x00" + info.Provider + "\x00" + info.ID
+}
+
+// Observe records a delivery, marking it as a retry if its ID was seen before, and returns whether it was
+// already relayed
+func (t *deliveryTracker) Observe(endpoint string, info *DeliveryInfo) bool {
+	if info.Attempt > 1 {
+		info.Retry = true
+	}
+	if info.ID == "" {
+		return false
+	}
+	key := deliveryKey(endpoint, info)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.seen[key]; ok && now.Sub(d.at) < deliveryWindow {
+		info.Retry = true
+		return d.relayed
+	}
+	if _, ok := t.seen[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.seen[key] = &trackedDelivery{at: now}
+	for len(t.order) > maxTrackedDeliveries {
+		delete(t.seen, t.order[0])
+		t.order = t.order[1:]
+	}
+	return false
+}
+
+// Relayed marks a delivery as delivered to a client
+func (t *deliveryTracker) Relayed(endpoint string, info *DeliveryInfo) {
+	if info.ID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d, ok := t.seen[deliveryKey(endpoint, info)]; ok {
+		d.relayed = true
+	}
+}
@@ -0,0 +1,275 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the previous secret or token of an endpoint stays valid after rotating it, unless asked otherwise
+var rotationWindow = 24 * time.Hour
+
+// RotationRequest is the body of a request rotating the secret or token of an endpoint
+type RotationRequest struct {
+	// New secret, as provider:secret like --verify. Tokens are generated.
+	Secret string `json:"secret"`
+	// How long the previous secret or token stays valid, such as 1h, --rotation-window if empty
+	Window string `json:"window"`
+}
+
+// EndpointRotation describes the rotated secret or token of an endpoint
+type EndpointRotation struct {
+	Endpoint string `json:"endpoint"`
+	// secret or token
+	Kind      string `json:"kind"`
+	RotatedAt string `json:"rotated_at"`
+	// Provider and ID of the current secret
+	Provider string `json:"provider,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+	// IDs of the previous secrets, or fingerprints of the previous tokens, and until when they're valid
+	Previous      []string `json:"previous,omitempty"`
+	PreviousUntil string   `json:"previous_until,omitempty"`
+	// The new token, only shown when rotating it
+	Token string `json:"token,omitempty"`
+}
+
+// secretRotation is the current secret of an endpoint set through the admin API, which replaces those given as
+// options and in the configuration file, and the secrets accepted until the window ends
+type secretRotation struct {
+	current       verifier
+	secretHeaders []string
+	previous      []verifier
+	until         time.Time
+	rotatedAt     time.Time
+}
+
+// tokenRotation is the current token of an endpoint set through the admin API, and the keys of the tokens
+// granting the endpoint until the window ends, see hashToken
+type tokenRotation struct {
+	current   string
+	previous  []string
+	until     time.Time
+	rotatedAt time.Time
+}
+
+// Rotated secrets and tokens by endpoint, kept in memory
+var rotations = struct {
+	sync.RWMutex
+	secrets map[string]*secretRotation
+	tokens  map[string]*tokenRotation
+}{secrets: make(map[string]*secretRotation), tokens: make(map[string]*tokenRotation)}
+
+// rotatedVerifiers returns the verifiers of an endpoint whose secret was rotated, the current one first
+func rotatedVerifiers(endpoint string) ([]verifier, bool) {
+	rotations.RLock()
+	defer rotations.RUnlock()
+	rotation, ok := rotations.secrets[endpoint]
+	if !ok {
+		return nil, false
+	}
+	verifiers := []verifier{rotation.current}
+	if time.Now().Before(rotation.until) {
+		verifiers = append(verifiers, rotation.previous...)
+	}
+	return verifiers, true
+}
+
+// rotatedSecretHeaders returns the headers holding plain secrets of an endpoint whose secret was rotated
+func rotatedSecretHeaders(endpoint string) []string {
+	rotations.RLock()
+	defer rotations.RUnlock()
+	if rotation, ok := rotations.secrets[endpoint]; ok {
+		return rotation.secretHeaders
+	}
+	return nil
+}
+
+// rotatedTokenGrant checks a token against the rotated token of an endpoint, returning whether it grants access
+// and whether that's decided. Previous tokens are refused once the window ends, and tokens unrelated to the
+// rotation are left to the other grants, unless socket authentication is disabled, when only the rotated tokens
+// grant access.
+func rotatedTokenGrant(key string, endpoint string) (bool, bool) {
+	rotations.RLock()
+	rotation, ok := rotations.tokens[endpoint]
+	rotations.RUnlock()
+	if !ok {
+		return false, false
+	}
+	if key == rotation.current {
+		return true, true
+	}
+	for _, previous := range rotation.previous {
+		if key == previous {
+			return time.Now().Before(rotation.until), true
+		}
+	}
+	return false, !socketAuthEnabled()
+}
+
+// rotateSecret makes a secret the one of an endpoint, the secrets accepted so far staying valid for the window
+func rotateSecret(endpoint string, spec string, window time.Duration) (EndpointRotation, error) {
+	v, secretHeader, err := parseVerifier(spec)
+	if err != nil {
+		return EndpointRotation{}, err
+	}
+	previous := verifiersFor(endpoint)
+	headers := secretHeadersFor(endpoint)
+	if secretHeader != "" {
+		headers = append(headers[:len(headers):len(headers)], secretHeader)
+	}
+
+	now := time.Now()
+	rotation := &secretRotation{current: v, secretHeaders: headers, previous: previous, until: now.Add(window), rotatedAt: now}
+	rotations.Lock()
+	rotations.secrets[endpoint] = rotation
+	rotations.Unlock()
+	log.WithFields(log.Fields{"endpoint": endpoint, "key_id": v.keyID, "window": window}).Warnln("Rotated endpoint secret")
+	return rotation.describe(endpoint), nil
+}
+
+// rotateToken generates a new token for an endpoint, the tokens granting it so far staying valid for the window
+func rotateToken(endpoint string, window time.Duration) (EndpointRotation, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return EndpointRotation{}, err
+	}
+
+	now := time.Now()
+	rotation := &tokenRotation{current: hashToken(token), until: now.Add(window), rotatedAt: now}
+	rotations.Lock()
+	if old, ok := rotations.tokens[endpoint]; ok {
+		rotation.previous = append(rotation.previous, old.current)
+		if now.Before(old.until) {
+			rotation.previous = append(rotation.previous, old.previous...)
+		}
+	}
+	// Tokens granting the endpoint itself are replaced, those granting every endpoint or a pattern aren't
+	configured.RLock()
+	for key, granted := range socketTokens {
+		if containsEndpoint(granted, endpoint) {
+			rotation.previous = append(rotation.previous, key)
+		}
+	}
+	for key, granted := range configured.tokens {
+		if containsEndpoint(granted, endpoint) {
+			rotation.previous = append(rotation.previous, key)
+		}
+	}
+	configured.RUnlock()
+	rotations.tokens[endpoint] = rotation
+	rotations.Unlock()
+
+	log.WithFields(log.Fields{"endpoint": endpoint, "token": tokenFingerprint(token), "window": window}).Warnln("Rotated endpoint token")
+	described := rotation.describe(endpoint)
+	described.Token = token
+	return described, nil
+}
+
+func containsEndpoint(endpoints []string, endpoint string) bool {
+	for _, e := range endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *secretRotation) describe(endpoint string) EndpointRotation {
+	rotation := EndpointRotation{
+		Endpoint:  endpoint,
+		Kind:      "secret",
+		RotatedAt: s.rotatedAt.UTC().Format(time.RFC3339Nano),
+		Provider:  s.current.provider,
+		KeyID:     s.current.keyID,
+	}
+	if time.Now().Before(s.until) && len(s.previous) > 0 {
+		for _, v := range s.previous {
+			rotation.Previous = append(rotation.Previous, v.keyID)
+		}
+		rotation.PreviousUntil = s.until.UTC().Format(time.RFC3339Nano)
+	}
+	return rotation
+}
+
+func (t *tokenRotation) describe(endpoint string) EndpointRotation {
+	rotation := EndpointRotation{
+		Endpoint:  endpoint,
+		Kind:      "token",
+		RotatedAt: t.rotatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if time.Now().Before(t.until) && len(t.previous) > 0 {
+		for _, key := range t.previous {
+			// Fingerprints are the start of the key, like tokenFingerprint
+			rotation.Previous = append(rotation.Previous, key[:16])
+		}
+		rotation.PreviousUntil = t.until.UTC().Format(time.RFC3339Nano)
+	}
+	return rotation
+}
+
+// endpointRotations returns the rotated secrets and tokens, by endpoint
+func endpointRotations() []EndpointRotation {
+	rotations.RLock()
+	defer rotations.RUnlock()
+
+	described := []EndpointRotation{}
+	for endpoint, rotation := range rotations.secrets {
+		described = append(described, rotation.describe(endpoint))
+	}
+	for endpoint, rotation := range rotations.tokens {
+		described = append(described, rotation.describe(endpoint))
+	}
+	sort.Slice(described, func(i, j int) bool {
+		if described[i].Endpoint != described[j].Endpoint {
+			return described[i].Endpoint < described[j].Endpoint
+		}
+		return described[i].Kind < described[j].Kind
+	})
+	return described
+}
+
+// handleRotation rotates the secret or token of an endpoint, kind being secret or token
+func handleRotation(w http.ResponseWriter, r *http.Request, endpoint string, kind string) {
+	if !strings.HasPrefix(endpoint, "/") || isPattern(endpoint) || isReserved(endpoint) {
+		http.Error(w, "expected an endpoint", 400)
+		return
+	}
+	var req RotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "invalid body: "+err.Error(), 400)
+		return
+	}
+	window := rotationWindow
+	if req.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(req.Window); err != nil || window < 0 {
+			http.Error(w, fmt.Sprintf("invalid window %q, expected a duration such as 1h", req.Window), 400)
+			return
+		}
+	}
+
+	var rotation EndpointRotation
+	var err error
+	if kind == "secret" {
+		if req.Secret == "" {
+			http.Error(w, "expected a secret, as provider:secret", 400)
+			return
+		}
+		if rotation, err = rotateSecret(endpoint, req.Secret, window); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	} else if rotation, err = rotateToken(endpoint, window); err != nil {
+		log.Errorln("Failed to rotate token:", err)
+		w.WriteHeader(500)
+		return
+	}
+	writeJSON(w, rotation)
+}
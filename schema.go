@@ -0,0 +1,114 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Versions of the message schema, chosen by clients with the schema query parameter when connecting. Version 1
+// has the first value of every header only. Version 2 adds the method, query parameters and remote IP of hooks
+// and has all values of every header.
+const (
+	schemaV1 = 1
+	schemaV2 = 2
+)
+
+// MessageV2 is a message in version 2 of the schema
+type MessageV2 struct {
+	Type       string                 `json:"type"`
+	Schema     int                    `json:"schema"`
+	ID         string                 `json:"id"`
+	Seq        uint64                 `json:"seq"`
+	Endpoint   string                 `json:"endpoint"`
+	Method     string                 `json:"method,omitempty"`
+	Query      map[string][]string    `json:"query"`
+	Headers    map[string][]string    `json:"headers"`
+	RemoteAddr string                 `json:"remote_addr,omitempty"`
+	Data       interface{}            `json:"data"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	ReceivedAt string                 `json:"received_at"`
+	BodySHA256 string                 `json:"body_sha256,omitempty"`
+	Attempt    int                    `json:"attempt,omitempty"`
+	// Content type of the hook and, if its body isn't JSON, how it's encoded in data
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	// ID of the client which published the message, for messages published by clients rather than hooks
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Number of messages dropped in favor of this one by a debounced or throttled endpoint
+	Collapsed int `json:"collapsed,omitempty"`
+	// Number of messages with the same payload suppressed before this one, which is the last of them
+	Repeats int `json:"repeats,omitempty"`
+	// Retry metadata sent by the provider of the hook, if any
+	Delivery *DeliveryInfo `json:"delivery,omitempty"`
+	// Outcome of signature verification, for hooks to endpoints which verify signatures
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// connectSchema parses the schema version given when connecting in the schema query parameter, rejecting the
+// request with 400 if it isn't supported
+func connectSchema(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (int, bool) {
+	value := r.URL.Query().Get("schema")
+	if value == "" {
+		return schemaV1, true
+	}
+	schema, err := strconv.Atoi(value)
+	if err != nil || schema < schemaV1 || schema > schemaV2 {
+		logEntry.WithField("schema", value).Warnln("Rejected client, unsupported schema")
+		rejectClient(w, 400, "unsupported_schema", fmt.Sprintf("unsupported schema %q, expected %d or %d", value, schemaV1, schemaV2))
+		return 0, false
+	}
+	return schema, true
+}
+
+// encode returns a message as it's written to clients using a version of the schema
+func (msg Message) encode(schema int) interface{} {
+	if schema != schemaV2 {
+		msg.Method, msg.Query, msg.RemoteAddr, msg.HeaderValues = "", nil, "", nil
+		return msg
+	}
+
+	// Messages generated by Sockethook have no request, so their headers are taken from the single values
+	headers := msg.HeaderValues
+	if headers == nil {
+		headers = make(map[string][]string, len(msg.Headers))
+		for name, value := range msg.Headers {
+			headers[name] = []string{value}
+		}
+	}
+	query := msg.Query
+	if query == nil {
+		query = map[string][]string{}
+	}
+	// Text bodies are sent as is rather than as base64
+	if msg.Encoding == encodingBase64 {
+		if body, ok := utf8Body(msg); ok {
+			msg.Data, msg.Encoding = body, encodingUTF8
+		}
+	}
+	return MessageV2{
+		Type:         msg.Type,
+		Schema:       schemaV2,
+		ID:           msg.ID,
+		Seq:          msg.Seq,
+		Endpoint:     msg.Endpoint,
+		Method:       msg.Method,
+		Query:        query,
+		Headers:      headers,
+		RemoteAddr:   msg.RemoteAddr,
+		Data:         msg.Data,
+		Metadata:     msg.Metadata,
+		ReceivedAt:   msg.ReceivedAt,
+		BodySHA256:   msg.BodySHA256,
+		Attempt:      msg.Attempt,
+		ContentType:  msg.ContentType,
+		Encoding:     msg.Encoding,
+		ConnectionID: msg.ConnectionID,
+		Collapsed:    msg.Collapsed,
+		Repeats:      msg.Repeats,
+		Delivery:     msg.Delivery,
+		Verification: msg.Verification,
+	}
+}
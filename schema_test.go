@@ -0,0 +1,209 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestEncodeV1(t *testing.T) {
+	msg := Message{
+		Type:         frameData,
+		ID:           "1",
+		Endpoint:     "/orders",
+		Headers:      map[string]string{"X-Tag": "a"},
+		HeaderValues: map[string][]string{"X-Tag": {"a", "b"}},
+		Method:       "POST",
+		Query:        map[string][]string{"page": {"2"}},
+		RemoteAddr:   "10.0.0.1",
+		ConnectionID: "publisher",
+	}
+	encoded, ok := msg.encode(schemaV1).(Message)
+	if !ok {
+		t.Fatalf("encode(1) = %T, expected a Message", msg.encode(schemaV1))
+	}
+	if encoded.Method != "" || encoded.Query != nil || encoded.RemoteAddr != "" || encoded.HeaderValues != nil {
+		t.Errorf("encode(1) kept fields of version 2: %+v", encoded)
+	}
+	if encoded.ConnectionID != "publisher" || encoded.Headers["X-Tag"] != "a" {
+		t.Errorf("encode(1) lost fields of version 1: %+v", encoded)
+	}
+}
+
+func TestEncodeV2(t *testing.T) {
+	delivery := &DeliveryInfo{Provider: "github", ID: "d1", Retry: true}
+	verification := &Verification{Verified: true, Provider: "github"}
+
+	tests := []struct {
+		name     string
+		msg      Message
+		expected MessageV2
+	}{
+		{
+			"hook",
+			Message{
+				Type: frameData, ID: "1", Seq: 7, Endpoint: "/orders", Data: map[string]interface{}{"id": 42.0},
+				Method: "POST", Query: map[string][]string{"page": {"2"}}, RemoteAddr: "10.0.0.1",
+				Headers: map[string]string{"X-Tag": "a"}, HeaderValues: map[string][]string{"X-Tag": {"a", "b"}},
+				Delivery: delivery, Verification: verification, Collapsed: 2, Repeats: 3,
+			},
+			MessageV2{
+				Type: frameData, Schema: schemaV2, ID: "1", Seq: 7, Endpoint: "/orders", Data: map[string]interface{}{"id": 42.0},
+				Method: "POST", Query: map[string][]string{"page": {"2"}}, RemoteAddr: "10.0.0.1",
+				Headers:  map[string][]string{"X-Tag": {"a", "b"}},
+				Delivery: delivery, Verification: verification, Collapsed: 2, Repeats: 3,
+			},
+		},
+		{
+			"message without request",
+			Message{Type: frameData, ID: "2", Endpoint: "/orders", Headers: map[string]string{"X-Tag": "a"}, ConnectionID: "publisher"},
+			MessageV2{
+				Type: frameData, Schema: schemaV2, ID: "2", Endpoint: "/orders",
+				Query: map[string][]string{}, Headers: map[string][]string{"X-Tag": {"a"}}, ConnectionID: "publisher",
+			},
+		},
+		{
+			"text body",
+			Message{Type: frameData, ID: "3", Endpoint: "/orders", Data: "aGVsbG8=", Encoding: encodingBase64, ContentType: "text/plain"},
+			MessageV2{
+				Type: frameData, Schema: schemaV2, ID: "3", Endpoint: "/orders", Query: map[string][]string{}, Headers: map[string][]string{},
+				Data: "hello", Encoding: encodingUTF8, ContentType: "text/plain",
+			},
+		},
+		{
+			"binary body",
+			Message{Type: frameData, ID: "4", Endpoint: "/orders", Data: "/w==", Encoding: encodingBase64},
+			MessageV2{
+				Type: frameData, Schema: schemaV2, ID: "4", Endpoint: "/orders", Query: map[string][]string{}, Headers: map[string][]string{},
+				Data: "/w==", Encoding: encodingBase64,
+			},
+		},
+	}
+	for _, test := range tests {
+		if encoded := test.msg.encode(schemaV2); !reflect.DeepEqual(encoded, test.expected) {
+			t.Errorf("%s: encode(2) = %+v, expected %+v", test.name, encoded, test.expected)
+		}
+	}
+}
+
+// jsonFields returns the fields of a value as it's written to clients
+func jsonFields(t *testing.T, v interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		field string
+		msg   Message
+		// Whether version 1 has the field, and the field it's written to in version 2 if that differs
+		v1      bool
+		v2Field string
+		v2Value interface{}
+	}{
+		{field: "type", msg: Message{Type: frameData}, v1: true},
+		{field: "id", msg: Message{ID: "m1"}, v1: true},
+		{field: "seq", msg: Message{Seq: 7}, v1: true},
+		{field: "headers", msg: Message{Headers: map[string]string{"X-Tag": "a"}}, v1: true, v2Value: map[string]interface{}{"X-Tag": []interface{}{"a"}}},
+		{field: "endpoint", msg: Message{Endpoint: "/orders"}, v1: true},
+		{field: "data", msg: Message{Data: map[string]interface{}{"n": 1.5, "tags": []interface{}{"a"}}}, v1: true},
+		{field: "metadata", msg: Message{Metadata: map[string]interface{}{"region": "eu"}}, v1: true},
+		{field: "received_at", msg: Message{ReceivedAt: "2026-10-14T09:30:00Z"}, v1: true},
+		{field: "body_sha256", msg: Message{BodySHA256: "abcd"}, v1: true},
+		{field: "attempt", msg: Message{Attempt: 2}, v1: true},
+		{field: "method", msg: Message{Method: "PUT"}},
+		{field: "query", msg: Message{Query: map[string][]string{"page": {"1", "2"}}}},
+		{field: "remote_addr", msg: Message{RemoteAddr: "10.0.0.1"}},
+		{field: "header_values", msg: Message{HeaderValues: map[string][]string{"X-Tag": {"a", "b"}}}, v2Field: "headers"},
+		{field: "content_type", msg: Message{ContentType: "application/xml"}, v1: true},
+		{field: "encoding", msg: Message{Encoding: encodingBase64, Data: "/w=="}, v1: true},
+		{field: "connection_id", msg: Message{ConnectionID: "publisher"}, v1: true},
+		{field: "collapsed", msg: Message{Collapsed: 3}, v1: true},
+		{field: "delivery", msg: Message{Delivery: &DeliveryInfo{Provider: "github", ID: "d1", Attempt: 2, Retry: true, Reason: "timeout"}}, v1: true},
+		{field: "verification", msg: Message{Verification: &Verification{Verified: true, Provider: "github", KeyID: "k1", Signer: "octo/repo"}}, v1: true},
+		{field: "repeats", msg: Message{Repeats: 4}, v1: true},
+	}
+	covered := make(map[string]bool)
+	for _, test := range tests {
+		covered[test.field] = true
+		expected := jsonFields(t, test.msg)[test.field]
+		if expected == nil {
+			t.Fatalf("%s: field not set", test.field)
+		}
+
+		// Messages read back from version 1 have the fields it keeps as they were
+		v1 := jsonFields(t, test.msg.encode(schemaV1))
+		if value, ok := v1[test.field]; test.v1 && !reflect.DeepEqual(value, expected) {
+			t.Errorf("%s: version 1 has %#v, expected %#v", test.field, value, expected)
+		} else if !test.v1 && ok {
+			t.Errorf("%s: version 1 has %#v, expected it to be left out", test.field, value)
+		}
+		if test.v1 {
+			data, _ := json.Marshal(test.msg.encode(schemaV1))
+			var decoded Message
+			if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, test.msg) {
+				t.Errorf("%s: version 1 read back as %+v, %v, expected %+v", test.field, decoded, err, test.msg)
+			}
+		}
+
+		// Every field is in version 2, some under another name or shape
+		v2Field, v2Value := test.field, expected
+		if test.v2Field != "" {
+			v2Field = test.v2Field
+		}
+		if test.v2Value != nil {
+			v2Value = test.v2Value
+		}
+		if value := jsonFields(t, test.msg.encode(schemaV2))[v2Field]; !reflect.DeepEqual(value, v2Value) {
+			t.Errorf("%s: version 2 has %#v in %s, expected %#v", test.field, value, v2Field, v2Value)
+		}
+	}
+
+	// Fields added to messages need a case of their own, so that neither version leaves them out
+	for _, v := range []interface{}{Message{}, MessageV2{}} {
+		fields := reflect.TypeOf(v)
+		for i := 0; i < fields.NumField(); i++ {
+			name := strings.Split(fields.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "schema" && !covered[name] {
+				t.Errorf("no round trip of the %s field of %s", name, fields.Name())
+			}
+		}
+	}
+}
+
+func TestConnectSchema(t *testing.T) {
+	tests := []struct {
+		query  string
+		schema int
+		ok     bool
+	}{
+		{"", schemaV1, true},
+		{"?schema=1", schemaV1, true},
+		{"?schema=2", schemaV2, true},
+		{"?schema=3", 0, false},
+		{"?schema=latest", 0, false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/socket/orders"+test.query, nil)
+		schema, ok := connectSchema(w, r, log.WithField("test", t.Name()))
+		if schema != test.schema || ok != test.ok {
+			t.Errorf("connectSchema(%q) = %d, %v, expected %d, %v", test.query, schema, ok, test.schema, test.ok)
+		}
+		if !ok && w.Code != 400 {
+			t.Errorf("connectSchema(%q) rejected with %d, expected 400", test.query, w.Code)
+		}
+	}
+}
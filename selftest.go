@@ -0,0 +1,133 @@
+package sockethook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// selftestPayload is the hook posted by the self-test, identified by a random nonce
+type selftestPayload struct {
+	Selftest string `json:"selftest"`
+	SentAt   string `json:"sent_at"`
+}
+
+// runSelftest implements the selftest command which checks that a running instance delivers hooks end-to-end,
+// exiting non-zero if it doesn't
+func runSelftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	endpoint := flags.String("endpoint", "/selftest", "Endpoint to send the test hook to.")
+	token := flags.String("token", "", "Token to authenticate the client with, if the server requires one.")
+	secret := flags.String("secret", "", "Secret to sign the test hook with, if the endpoint verifies signatures.")
+	signatureHeader := flags.String("signature-header", "X-Hub-Signature-256", "Header carrying the sha256= HMAC signature of the test hook.")
+	maxLatency := flags.Duration("max-latency", time.Second, "Delivery latency above which the test fails.")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for the test hook to be delivered.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sockethook selftest [options] <url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	latency, err := selftest(strings.TrimRight(flags.Arg(0), "/"), "/"+strings.Trim(*endpoint, "/"), *token, *secret, *signatureHeader, *timeout)
+	logEntry := log.WithField("server", flags.Arg(0)).WithField("latency", latency)
+	if err != nil {
+		logEntry.Errorln("Self-test failed:", err)
+		os.Exit(1)
+	}
+	if latency > *maxLatency {
+		logEntry.Errorf("Self-test failed: delivery took longer than %s", *maxLatency)
+		os.Exit(1)
+	}
+	logEntry.Infoln("Self-test passed ✅")
+}
+
+// selftest connects a client to the endpoint, posts a hook to it and waits for the hook to be delivered,
+// returning the time from posting to delivery
+func selftest(server string, endpoint string, token string, secret string, signatureHeader string, timeout time.Duration) (time.Duration, error) {
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		return 0, fmt.Errorf("expected an http:// or https:// URL, got %q", server)
+	}
+	deadline := time.Now().Add(timeout)
+	socketURL := "ws" + strings.TrimPrefix(server, "http") + "/socket" + endpoint
+	hookURL := server + "/hook" + endpoint
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = timeout
+	conn, resp, err := dialer.Dial(socketURL, header)
+	if err != nil {
+		if resp != nil {
+			return 0, fmt.Errorf("connecting client: %v (status %d)", err, resp.StatusCode)
+		}
+		return 0, fmt.Errorf("connecting client: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(deadline)
+
+	// The welcome frame is queued before any message, so the client is subscribed once it's received
+	var welcome WelcomeFrame
+	if err := conn.ReadJSON(&welcome); err != nil {
+		return 0, fmt.Errorf("reading welcome frame: %v", err)
+	}
+	if welcome.Type != frameWelcome {
+		return 0, fmt.Errorf("expected welcome frame, got %q", welcome.Type)
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	payload := selftestPayload{Selftest: hex.EncodeToString(nonce), SentAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequest("POST", hookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(computeHMAC([]byte(secret), body)))
+	}
+
+	sent := time.Now()
+	hookResp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("posting hook: %v", err)
+	}
+	hookResp.Body.Close()
+	if hookResp.StatusCode < 200 || hookResp.StatusCode > 299 {
+		return 0, fmt.Errorf("posting hook: status %d", hookResp.StatusCode)
+	}
+
+	// Skip control frames and other hooks sent to the endpoint in the meantime
+	for {
+		var msg tunnelMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return time.Since(sent), fmt.Errorf("waiting for delivery: %v", err)
+		}
+		if msg.Type != frameData {
+			continue
+		}
+
+		var received selftestPayload
+		if json.Unmarshal(msg.Data, &received) == nil && received.Selftest == payload.Selftest {
+			return time.Since(sent), nil
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package sockethook relays webhooks to websocket clients. Hooks sent to /hook/<endpoint> are broadcast as
+// JSON messages to every client connected to /socket/<endpoint>.
+//
+// The sockethook command is a thin wrapper around Main. To embed the relay in another service, create a
+// Server and mount it, or its hook and socket handlers, on an existing mux:
+//
+//	server, err := sockethook.New(sockethook.WithBasePath("/relay"), sockethook.WithMaxClients(500))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err := server.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer server.Close()
+//	http.Handle("/relay/", server)
+//	server.Broadcast("/order/created", order)
+//
+// Configuration is shared by the whole process, so only one Server can be started at a time. The sockethooktest
+// package runs one in-process for integration tests.
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server relays hooks to websocket clients and is an http.Handler serving both hooks and sockets
+type Server struct {
+	handler http.Handler
+
+	basePath          string
+	maxClients        int
+	maxSubscriptions  int
+	endpointQueueSize int
+	clientBufferSize  int
+	respond           []string
+	broker            Broker
+	readReplica       bool
+	publishers        map[string]PublisherFactory
+	rateLimitBackend  RateLimitBackend
+
+	// Set while the server is started, and the function stopping its broker
+	started    int32
+	stopBroker func()
+}
+
+// Option configures a Server, returning an error if the configuration is invalid
+type Option func(*Server) error
+
+// WithBasePath serves all routes under a path prefix, e.g. /sockethook
+func WithBasePath(path string) Option {
+	return func(s *Server) error {
+		s.basePath = ""
+		if path != "" {
+			s.basePath = "/" + strings.Trim(path, "/")
+		}
+		return nil
+	}
+}
+
+// WithMaxClients limits the number of clients per endpoint, 0 for unlimited
+func WithMaxClients(n int) Option {
+	return func(s *Server) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum of %d clients", n)
+		}
+		s.maxClients = n
+		return nil
+	}
+}
+
+// WithMaxSubscriptions limits the number of endpoints a connection may subscribe to, 0 for unlimited
+func WithMaxSubscriptions(n int) Option {
+	return func(s *Server) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum of %d subscriptions", n)
+		}
+		s.maxSubscriptions = n
+		return nil
+	}
+}
+
+// WithEndpointQueueSize sets the number of messages queued per endpoint before new ones are dropped
+func WithEndpointQueueSize(n int) Option {
+	return func(s *Server) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid endpoint queue size %d", n)
+		}
+		s.endpointQueueSize = n
+		return nil
+	}
+}
+
+// WithClientBufferSize sets the number of frames buffered per client before it's disconnected as too slow
+func WithClientBufferSize(n int) Option {
+	return func(s *Server) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid client buffer size %d", n)
+		}
+		s.clientBufferSize = n
+		return nil
+	}
+}
+
+// WithRespond makes hooks on the endpoints wait for a response sent back by a client
+func WithRespond(endpoints ...string) Option {
+	return func(s *Server) error {
+		s.respond = append(s.respond, endpoints...)
+		return nil
+	}
+}
+
+// WithBroker relays hooks between instances through a broker, so they reach the clients of every instance. The
+// broker is started with the server and closed with it.
+func WithBroker(b Broker) Option {
+	return func(s *Server) error {
+		if b == nil {
+			return errors.New("broker is nil")
+		}
+		s.broker = b
+		return nil
+	}
+}
+
+// WithReadReplica only serves clients with the messages writer instances publish to the broker, rejecting hooks.
+// Requires WithBroker.
+func WithReadReplica() Option {
+	return func(s *Server) error {
+		s.readReplica = true
+		return nil
+	}
+}
+
+// WithPublisher registers the publisher factory of an event bus URL scheme, such as kafka, for use in
+// event_bus settings
+func WithPublisher(scheme string, factory PublisherFactory) Option {
+	return func(s *Server) error {
+		if scheme == "" || factory == nil {
+			return fmt.Errorf("invalid publisher for scheme %q", scheme)
+		}
+		s.publishers[scheme] = factory
+		return nil
+	}
+}
+
+// WithRateLimitBackend keeps the buckets of rate limits in a backend shared with other instances, enforcing limits
+// across all of them
+func WithRateLimitBackend(b RateLimitBackend) Option {
+	return func(s *Server) error {
+		s.rateLimitBackend = b
+		return nil
+	}
+}
+
+// Set while a Server is started, as its configuration applies to the whole process
+var serverRunning int32
+
+// New creates a Server with the given options applied. It doesn't affect the process until it's started.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		handler:           router(true, true),
+		endpointQueueSize: 256,
+		clientBufferSize:  256,
+		publishers:        make(map[string]PublisherFactory),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.readReplica && s.broker == nil {
+		return nil, errors.New("a read replica requires a broker")
+	}
+	return s, nil
+}
+
+// Start applies the server's configuration to the process and starts its broker, if any, so that it can serve
+// hooks and sockets. Fails if another Server is started, as the two would share and overwrite each other's
+// configuration. A closed Server can be started again.
+func (s *Server) Start() error {
+	if !atomic.CompareAndSwapInt32(&serverRunning, 0, 1) {
+		return errors.New("another Server is started, only one can run per process")
+	}
+	atomic.StoreInt32(&s.started, 1)
+
+	basePath = s.basePath
+	maxClients = s.maxClients
+	maxSubscriptions = s.maxSubscriptions
+	endpointQueueSize = s.endpointQueueSize
+	clientBufferSize = s.clientBufferSize
+	setRespondEndpoints(s.respond)
+	readReplica = s.readReplica
+	for scheme, factory := range s.publishers {
+		publisherFactories[scheme] = factory
+	}
+	rateLimitBackend = s.rateLimitBackend
+	if s.broker != nil {
+		s.stopBroker = startBroker(s.broker)
+	}
+	return nil
+}
+
+// ServeHTTP serves hooks, sockets and the inspector
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// BasePath returns the path prefix all routes are served under, empty if there is none
+func (s *Server) BasePath() string {
+	return s.basePath
+}
+
+// HookHandler returns a handler only serving hooks and the inspector, e.g. for a separate internal listener
+func (s *Server) HookHandler() http.Handler {
+	return router(true, false)
+}
+
+// SocketHandler returns a handler only serving sockets
+func (s *Server) SocketHandler() http.Handler {
+	return router(false, true)
+}
+
+// Broadcast sends data as a message to all clients of an endpoint and returns the number of clients. The data
+// is sent like the JSON body of a hook, so the message is redacted, transformed and enriched like the endpoint's
+// hooks. Returns 0 if the data can't be encoded as JSON.
+func (s *Server) Broadcast(endpoint string, data interface{}) int {
+	logEntry := log.WithField("endpoint", endpoint)
+	body, err := json.Marshal(data)
+	if err != nil {
+		logEntry.Errorln("Failed to broadcast, data isn't JSON:", err)
+		return 0
+	}
+	r, err := http.NewRequest(http.MethodPost, basePath+"/hook"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		logEntry.Errorln("Failed to broadcast:", err)
+		return 0
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	received := time.Now()
+	msg := hookMessage(r, endpoint, received)
+	if err := shapeMessage(&msg, r, body, received); err != nil {
+		logEntry.Warnln("Failed to transform message, broadcasting it as is:", err)
+	}
+	return hub.Broadcast(msg)
+}
+
+// Close sends every client a shutdown notice and closes its connection, then stops the server's broker so that
+// another Server can be started
+func (s *Server) Close() {
+	closeAllClients(time.Now().Add(time.Second))
+	if !atomic.CompareAndSwapInt32(&s.started, 1, 0) {
+		return
+	}
+	if s.stopBroker != nil {
+		s.stopBroker()
+		s.stopBroker = nil
+	}
+	atomic.StoreInt32(&serverRunning, 0)
+}
+
+// SetMaintenance starts or ends maintenance mode, rejecting hooks and new clients while keeping connected ones
+// and suggesting they retry after retryAfter, 0 for the default
+func (s *Server) SetMaintenance(active bool, message string, retryAfter time.Duration) {
+	settings := MaintenanceSettings{Active: active, Message: message}
+	if retryAfter > 0 {
+		settings.RetryAfter = retryAfter.String()
+	}
+	setMaintenance(settings)
+}
@@ -0,0 +1,87 @@
+package sockethook
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testBroker records how it's used and what's published without relaying anything
+type testBroker struct {
+	subscribed int32
+	closed     int32
+
+	mu        sync.Mutex
+	published [][]byte
+}
+
+func (b *testBroker) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, payload)
+	return nil
+}
+
+func (b *testBroker) Subscribe(handle func(payload []byte)) { atomic.AddInt32(&b.subscribed, 1) }
+func (b *testBroker) Ready() error                          { return nil }
+func (b *testBroker) Close() error                          { atomic.AddInt32(&b.closed, 1); return nil }
+
+func TestServerStartsOneAtATime(t *testing.T) {
+	defer func(path string, clients int, b Broker, queue chan Message) {
+		basePath, maxClients, broker, brokerQueue = path, clients, b, queue
+	}(basePath, maxClients, broker, brokerQueue)
+
+	b := &testBroker{}
+	first, err := New(WithBasePath("relay/"), WithMaxClients(3), WithBroker(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := New()
+	if err != nil {
+		t.Fatalf("creating a second server: %v", err)
+	}
+	if basePath != "" || maxClients != 0 || atomic.LoadInt32(&b.subscribed) != 0 {
+		t.Fatalf("options took effect before the server was started")
+	}
+
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if basePath != "/relay" || maxClients != 3 || atomic.LoadInt32(&b.subscribed) != 1 {
+		t.Errorf("options not applied, base path %q, max clients %d", basePath, maxClients)
+	}
+	if err := second.Start(); err == nil {
+		t.Errorf("started a second server while the first one runs")
+	}
+
+	first.Close()
+	if atomic.LoadInt32(&b.closed) != 1 {
+		t.Errorf("broker not closed with the server")
+	}
+	if err := second.Start(); err != nil {
+		t.Errorf("starting a server after the first one closed: %v", err)
+	}
+	second.Close()
+	if basePath != "" || maxClients != 0 {
+		t.Errorf("options of the closed server still apply")
+	}
+}
+
+func TestNewValidatesOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"negative clients", []Option{WithMaxClients(-1)}},
+		{"empty queue", []Option{WithEndpointQueueSize(0)}},
+		{"empty buffer", []Option{WithClientBufferSize(0)}},
+		{"nil broker", []Option{WithBroker(nil)}},
+		{"replica without broker", []Option{WithReadReplica()}},
+		{"publisher without scheme", []Option{WithPublisher("", nil)}},
+	}
+	for _, test := range tests {
+		if _, err := New(test.opts...); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package sockethook
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the state of a disconnected client is kept so that it can be restored when the client reconnects
+// with its session token, 0 to not issue session tokens
+var sessionGrace time.Duration
+
+// Maximum number of labels a client may connect with
+const maxLabels = 16
+
+// Sessions of disconnected clients by token, each expiring after the grace period
+var sessions = struct {
+	sync.Mutex
+	tokens map[string]*session
+}{tokens: make(map[string]*session)}
+
+// session is the state of a disconnected client which is restored when it reconnects within the grace period
+type session struct {
+	// Token the client authenticated with and the endpoint it connected to, which a reconnecting client must match
+	token    string
+	endpoint string
+	// Endpoints the client subscribed to besides the one it connected to and their filters, nil if unfiltered
+	subscriptions map[string]*filter
+	// Sequence number of the last message written to the client on each endpoint
+	cursors map[string]uint64
+	labels  map[string]string
+	expiry  *time.Timer
+}
+
+// saveSession keeps the state of a client which is being removed for the grace period. Must be called with
+// hub.mu held, before the client is detached from its subscriptions.
+func saveSession(c *client) {
+	if c.session == "" || sessionGrace <= 0 {
+		return
+	}
+	s := &session{
+		token:         c.token,
+		endpoint:      c.endpoint,
+		subscriptions: make(map[string]*filter),
+		cursors:       c.cursorsSnapshot(),
+		labels:        c.labels,
+	}
+	for subscription := range c.subscriptions {
+		if subscription != c.endpoint {
+			s.subscriptions[subscription] = c.filters[subscription]
+		}
+	}
+
+	id := c.session
+	sessions.Lock()
+	defer sessions.Unlock()
+	if previous := sessions.tokens[id]; previous != nil {
+		previous.expiry.Stop()
+	}
+	sessions.tokens[id] = s
+	s.expiry = time.AfterFunc(sessionGrace, func() {
+		sessions.Lock()
+		defer sessions.Unlock()
+		if sessions.tokens[id] == s {
+			delete(sessions.tokens, id)
+		}
+	})
+}
+
+// restoreSession returns the session token of a connecting client and the state kept for it, taken from the
+// session given in the session query parameter if it's still kept for the same token and endpoint. Clients which
+// don't pass one, or whose session expired, are issued a new token. Returns an empty token if sessions are
+// disabled.
+func restoreSession(r *http.Request, endpoint string, token string) (string, *session) {
+	if sessionGrace <= 0 {
+		return "", nil
+	}
+
+	if id := r.URL.Query().Get("session"); id != "" {
+		sessions.Lock()
+		s := sessions.tokens[id]
+		if s != nil && s.endpoint == endpoint && subtle.ConstantTimeCompare([]byte(s.token), []byte(token)) == 1 {
+			s.expiry.Stop()
+			delete(sessions.tokens, id)
+		} else {
+			s = nil
+		}
+		sessions.Unlock()
+
+		if s != nil {
+			s.prune()
+			return id, s
+		}
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		log.WithField("endpoint", endpoint).Errorln("Failed to create session token:", err)
+		return "", nil
+	}
+	return id, nil
+}
+
+// prune leaves out the subscriptions a restored session may no longer hold, as their endpoint was archived or
+// expired since
+func (s *session) prune() {
+	for endpoint := range s.subscriptions {
+		if temporaryExpired(endpoint) || !authorized(s.token, endpoint) || !declared(endpoint) || archiveOf(endpoint) != nil {
+			delete(s.subscriptions, endpoint)
+		}
+	}
+}
+
+// resumePoint returns where a client restoring the session resumes its endpoint from, the position given when
+// connecting taking precedence over the session's cursor
+func (s *session) resumePoint(resume resumePoint) resumePoint {
+	if s == nil || resume.bySeq || resume.lastEventID != "" {
+		return resume
+	}
+	if seq, ok := s.cursors[s.endpoint]; ok {
+		return resumePoint{bySeq: true, seq: seq}
+	}
+	return resume
+}
+
+// setCursor sets the sequence number of the last message on an endpoint written to the client, if the client
+// has a session
+func (c *client) setCursor(endpoint string, seq uint64) {
+	if c.session == "" {
+		return
+	}
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	if c.cursors == nil {
+		c.cursors = make(map[string]uint64)
+	}
+	c.cursors[endpoint] = seq
+}
+
+// advanceCursor records that a message was written to the client, if the client has a session
+func (c *client) advanceCursor(msg Message) {
+	if c.session == "" {
+		return
+	}
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	if c.cursors == nil {
+		c.cursors = make(map[string]uint64)
+	}
+	if msg.Seq > c.cursors[msg.Endpoint] {
+		c.cursors[msg.Endpoint] = msg.Seq
+	}
+}
+
+// cursorsSnapshot returns a copy of the client's cursors
+func (c *client) cursorsSnapshot() map[string]uint64 {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	cursors := make(map[string]uint64, len(c.cursors))
+	for endpoint, seq := range c.cursors {
+		cursors[endpoint] = seq
+	}
+	return cursors
+}
+
+// parseLabels parses labels given as key:value
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels may be given", maxLabels)
+	}
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key:value", value)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// connectLabels returns the labels of the label query parameters, answering the client if they're invalid
+func connectLabels(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (map[string]string, bool) {
+	values := r.URL.Query()["label"]
+	if len(values) == 0 {
+		return nil, true
+	}
+	labels, err := parseLabels(values)
+	if err != nil {
+		logEntry.Warnln("Rejected client, invalid label:", err)
+		rejectClient(w, 400, "invalid_label", err.Error())
+		return nil, false
+	}
+	return labels, true
+}
+
+// restoreLabels merges the labels of a restored session into those given when connecting, which take precedence
+func (s *session) restoreLabels(labels map[string]string) map[string]string {
+	if s == nil || len(s.labels) == 0 {
+		return labels
+	}
+	merged := make(map[string]string, len(s.labels)+len(labels))
+	for key, value := range s.labels {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	return merged
+}
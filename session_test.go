@@ -0,0 +1,111 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionRestoresSubscriptionsAndCursors(t *testing.T) {
+	const endpoint = "/test/session/main"
+	const other = "/test/session/other"
+	replayBuffer.SetOverrides(map[string]int{endpoint: 10, other: 10})
+	defer replayBuffer.SetOverrides(nil)
+	sessionGrace = time.Minute
+	defer func() { sessionGrace = 0 }()
+
+	record := func(endpoint string, n int) {
+		for i := 0; i < n; i++ {
+			seq := currentSequence(endpoint) + 1
+			replayBuffer.Record(Message{ID: fmt.Sprintf("%s/%d", endpoint, seq), Endpoint: endpoint, Seq: seq})
+			advanceSequence(endpoint, seq)
+		}
+	}
+	record(endpoint, 2)
+	record(other, 2)
+
+	h := newHub()
+	id, restored := restoreSession(httptest.NewRequest("GET", "/socket"+endpoint, nil), endpoint, "token")
+	if id == "" || restored != nil {
+		t.Fatalf("expected a new session, got %q and %+v", id, restored)
+	}
+	c := newClient(&fakeConn{}, endpoint)
+	c.token, c.session, c.labels = "token", id, map[string]string{"region": "eu"}
+	h.register(c, WelcomeFrame{Type: frameWelcome}, resumePoint{})
+	h.mu.Lock()
+	h.attach(c, other)
+	c.setCursor(other, currentSequence(other))
+	h.mu.Unlock()
+
+	// The client saw one of the messages which follow on the endpoint it connected to before disconnecting
+	record(endpoint, 2)
+	c.advanceCursor(Message{Endpoint: endpoint, Seq: currentSequence(endpoint) - 1})
+	record(other, 1)
+	h.unregister(endpoint, c)
+	queuedFrames(c)
+
+	if _, s := restoreSession(httptest.NewRequest("GET", "/socket"+endpoint+"?session="+id, nil), endpoint, "other token"); s != nil {
+		t.Errorf("restored a session for another token")
+	}
+	if _, s := restoreSession(httptest.NewRequest("GET", "/socket"+other+"?session="+id, nil), other, "token"); s != nil {
+		t.Errorf("restored a session for another endpoint")
+	}
+
+	restoredID, restored := restoreSession(httptest.NewRequest("GET", "/socket"+endpoint+"?session="+id, nil), endpoint, "token")
+	if restoredID != id || restored == nil {
+		t.Fatalf("expected session %q to be restored, got %q", id, restoredID)
+	}
+	c = newClient(&fakeConn{}, endpoint)
+	c.token, c.session, c.restored = "token", restoredID, restored
+	c.labels = restored.restoreLabels(map[string]string{"zone": "b"})
+	h.register(c, welcomeFrame(c), restored.resumePoint(resumePoint{}))
+
+	frames := queuedFrames(c)
+	welcome := frames[0].(WelcomeFrame)
+	if !welcome.SessionRestored || welcome.Session != id || !reflect.DeepEqual(welcome.Subscriptions, []string{other}) {
+		t.Errorf("unexpected welcome frame %+v", welcome)
+	}
+	if !reflect.DeepEqual(welcome.Labels, map[string]string{"region": "eu", "zone": "b"}) {
+		t.Errorf("restored labels %v", welcome.Labels)
+	}
+	var replayed []string
+	for _, frame := range frames[1:] {
+		if msg, ok := frame.(Message); ok {
+			replayed = append(replayed, msg.ID)
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("%s/%d", endpoint, currentSequence(endpoint)),
+		fmt.Sprintf("%s/%d", other, currentSequence(other)),
+	}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("replayed %v, expected %v", replayed, expected)
+	}
+
+	// Sessions are taken when restored, so a token can't be used twice
+	if _, s := restoreSession(httptest.NewRequest("GET", "/socket"+endpoint+"?session="+id, nil), endpoint, "token"); s != nil {
+		t.Errorf("restored a session twice")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		values []string
+		labels map[string]string
+		valid  bool
+	}{
+		{[]string{"region:eu", "team:a:b"}, map[string]string{"region": "eu", "team": "a:b"}, true},
+		{[]string{"empty:"}, map[string]string{"empty": ""}, true},
+		{[]string{"region"}, nil, false},
+		{[]string{":eu"}, nil, false},
+		{make([]string, maxLabels+1), nil, false},
+	}
+	for _, test := range tests {
+		labels, err := parseLabels(test.values)
+		if (err == nil) != test.valid || (test.valid && !reflect.DeepEqual(labels, test.labels)) {
+			t.Errorf("parseLabels(%q) = %v, %v", test.values, labels, err)
+		}
+	}
+}
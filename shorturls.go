@@ -0,0 +1,266 @@
+package sockethook
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Characters and length of short URL codes, about 62 bits of randomness so that they can't be guessed
+const shortCodeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+const shortCodeLength = 12
+
+// ShortURL binds an unguessable hook URL, /h/<code>, to an endpoint, so that URLs registered with providers don't
+// reveal the endpoint and can be replaced without renaming it
+type ShortURL struct {
+	Code        string `json:"code"`
+	Endpoint    string `json:"endpoint"`
+	CreatedAt   string `json:"created_at"`
+	Description string `json:"description,omitempty"`
+	// Set in answers of the admin API
+	HookURL string `json:"hook_url,omitempty"`
+}
+
+// ShortURLRequest is the body of a request minting a short URL. Rotating one takes an empty body.
+type ShortURLRequest struct {
+	Endpoint    string `json:"endpoint"`
+	Description string `json:"description"`
+}
+
+// Short URLs by code, kept in a file if one is given so that they keep working after a restart
+var shortURLs = struct {
+	sync.RWMutex
+	path  string
+	codes map[string]ShortURL
+}{codes: make(map[string]ShortURL)}
+
+// loadShortURLs reads the short URLs from a file, which is written whenever they change. A missing file is no
+// short URLs.
+func loadShortURLs(path string) error {
+	shortURLs.Lock()
+	defer shortURLs.Unlock()
+
+	shortURLs.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var urls []ShortURL
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return fmt.Errorf("invalid short URLs %s: %v", path, err)
+	}
+	for _, u := range urls {
+		if err := validShortEndpoint(u.Endpoint); err != nil {
+			return fmt.Errorf("invalid short URLs %s: %v", path, err)
+		}
+		shortURLs.codes[u.Code] = u
+	}
+	return nil
+}
+
+// saveShortURLs writes the short URLs to their file, through a temporary file so that a crash doesn't lose them.
+// Must be called with the short URLs locked.
+func saveShortURLs() error {
+	if shortURLs.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(listShortURLs(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := shortURLs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, shortURLs.path)
+}
+
+// listShortURLs returns the short URLs, oldest first. Must be called with the short URLs locked.
+func listShortURLs() []ShortURL {
+	urls := make([]ShortURL, 0, len(shortURLs.codes))
+	for _, u := range shortURLs.codes {
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if urls[i].CreatedAt != urls[j].CreatedAt {
+			return urls[i].CreatedAt < urls[j].CreatedAt
+		}
+		return urls[i].Code < urls[j].Code
+	})
+	return urls
+}
+
+// validShortEndpoint checks that short URLs may be bound to an endpoint
+func validShortEndpoint(endpoint string) error {
+	switch {
+	case !strings.HasPrefix(endpoint, "/") || strings.HasSuffix(endpoint, "/"):
+		return fmt.Errorf("invalid endpoint %q", endpoint)
+	case isPattern(endpoint):
+		return fmt.Errorf("endpoint %s is a pattern", endpoint)
+	case isReserved(endpoint):
+		return fmt.Errorf("endpoint %s is reserved", endpoint)
+	}
+	return nil
+}
+
+// newShortCode returns a random short URL code
+func newShortCode() (string, error) {
+	code := make([]byte, shortCodeLength)
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// mintShortURL creates a short URL for an endpoint. Must be called with the short URLs locked.
+func mintShortURL(endpoint string, description string) (ShortURL, error) {
+	code, err := newShortCode()
+	if err != nil {
+		return ShortURL{}, err
+	}
+	u := ShortURL{
+		Code:        code,
+		Endpoint:    endpoint,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339Nano),
+		Description: description,
+	}
+	shortURLs.codes[code] = u
+	return u, nil
+}
+
+// shortURLEndpoint returns the endpoint a short URL code is bound to
+func shortURLEndpoint(code string) (string, bool) {
+	shortURLs.RLock()
+	defer shortURLs.RUnlock()
+	u, ok := shortURLs.codes[code]
+	return u.Endpoint, ok
+}
+
+// handleShortHook serves hooks sent to a short URL, like hooks sent to the endpoint it's bound to
+func handleShortHook(w http.ResponseWriter, r *http.Request, code string) {
+	endpoint, ok := shortURLEndpoint(strings.TrimPrefix(code, "/"))
+	if !ok {
+		log.Warnln("Rejected hook to unknown short URL")
+		w.WriteHeader(404)
+		return
+	}
+	handleHook(w, r, "", endpoint)
+}
+
+// handleShortURLs serves short URLs below /admin/short-urls: listing them, minting them for an endpoint, rotating
+// them, which replaces the code of a short URL with a new one, and removing them
+func handleShortURLs(w http.ResponseWriter, r *http.Request, path string) {
+	hookBase, _, _ := publicURLs(r)
+	hookBase = strings.TrimSuffix(hookBase, "/hook") + "/h/"
+
+	if strings.HasSuffix(path, "/rotate") {
+		allowMethod(w, r, "POST", func() {
+			code := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/rotate")
+			shortURLs.Lock()
+			old, ok := shortURLs.codes[code]
+			if !ok {
+				shortURLs.Unlock()
+				http.Error(w, "no short URL with that code", 404)
+				return
+			}
+			u, err := mintShortURL(old.Endpoint, old.Description)
+			if err == nil {
+				delete(shortURLs.codes, code)
+				if err := saveShortURLs(); err != nil {
+					log.WithField("path", shortURLs.path).Errorln("Failed to save short URLs:", err)
+				}
+			}
+			shortURLs.Unlock()
+			if err != nil {
+				log.Errorln("Failed to rotate short URL:", err)
+				w.WriteHeader(500)
+				return
+			}
+			log.WithField("endpoint", u.Endpoint).Warnln("Rotated short URL")
+			u.HookURL = hookBase + u.Code
+			writeJSON(w, u)
+		})
+		return
+	}
+	if path != "" {
+		allowMethod(w, r, "DELETE", func() {
+			code := strings.TrimPrefix(path, "/")
+			shortURLs.Lock()
+			_, ok := shortURLs.codes[code]
+			if ok {
+				delete(shortURLs.codes, code)
+				if err := saveShortURLs(); err != nil {
+					log.WithField("path", shortURLs.path).Errorln("Failed to save short URLs:", err)
+				}
+			}
+			shortURLs.Unlock()
+			if !ok {
+				http.Error(w, "no short URL with that code", 404)
+				return
+			}
+			w.WriteHeader(204)
+		})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		shortURLs.RLock()
+		urls := listShortURLs()
+		shortURLs.RUnlock()
+		for i := range urls {
+			urls[i].HookURL = hookBase + urls[i].Code
+		}
+		writeJSON(w, urls)
+	case "POST":
+		var req ShortURLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "invalid body: "+err.Error(), 400)
+			return
+		}
+		if err := validShortEndpoint(req.Endpoint); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		shortURLs.Lock()
+		u, err := mintShortURL(req.Endpoint, req.Description)
+		if err == nil {
+			if err := saveShortURLs(); err != nil {
+				log.WithField("path", shortURLs.path).Errorln("Failed to save short URLs:", err)
+			}
+		}
+		shortURLs.Unlock()
+		if err != nil {
+			log.Errorln("Failed to mint short URL:", err)
+			w.WriteHeader(500)
+			return
+		}
+		log.WithField("endpoint", u.Endpoint).Infoln("Minted short URL")
+		u.HookURL = hookBase + u.Code
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(u)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,98 @@
+package sockethook
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Set once shutdown has begun, after which new hooks and clients are rejected
+var draining int32
+
+// Number of messages queued by dispatch which haven't been handed to clients yet
+var undelivered int64
+
+// isDraining checks if the server is shutting down
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// shutdown stops the servers gracefully within the timeout. New hooks and clients are rejected, hooks being
+// handled are finished, queued messages are delivered, and then every client is sent a shutdown event, a
+// shutdown notice and a close frame.
+func shutdown(servers []*http.Server, sig os.Signal, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt32(&draining, 1)
+	log.WithField("timeout", timeout).Infoln("Sockethook is shutting down, draining connections")
+
+	// Stop listening and wait for in-flight hooks. Event streams only end once clients are closed below, so
+	// rather than waiting for the servers to shut down completely only hooks are waited for.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for _, server := range servers {
+		go server.Shutdown(ctx)
+	}
+	for atomic.LoadInt64(&hooksInFlight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if remaining := atomic.LoadInt64(&hooksInFlight); remaining > 0 {
+		log.WithField("hooks", remaining).Warnln("Hooks still in flight at drain timeout, abandoning them")
+		cancelHooks()
+	}
+
+	// Deliver suppressed duplicates, held back messages and the summaries of aggregation windows which haven't
+	// ended yet
+	duplicates.FlushAll()
+	pacing.FlushAll()
+	aggregations.FlushAll()
+	// Messages held until their delivery window opens aren't delivered outside of it
+	deliveryWindows.DeadLetterAll()
+
+	// The shutdown event is dispatched like any other, so it's delivered while draining below, and also sent to
+	// the lifecycle webhooks
+	publishEvent("shutdown", map[string]interface{}{"signal": sig.String()})
+
+	// Wait for dispatchers to hand all queued messages to clients
+	for atomic.LoadInt64(&undelivered) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if remaining := atomic.LoadInt64(&undelivered); remaining > 0 {
+		log.WithField("messages", remaining).Warnln("Messages still undelivered at drain timeout")
+	}
+
+	// Leave clients at least a second to receive what's queued for them
+	closeDeadline := deadline
+	if time.Until(closeDeadline) < time.Second {
+		closeDeadline = time.Now().Add(time.Second)
+	}
+	closeAllClients(closeDeadline)
+
+	// Send the queued lifecycle notifications, such as the shutdown event, with what's left of the timeout and at
+	// least a second
+	flushTimeout := time.Until(deadline)
+	if flushTimeout < time.Second {
+		flushTimeout = time.Second
+	}
+	flushLifecycleWebhooks(flushTimeout)
+
+	if historyLog != nil {
+		historyLog.Close(time.Second)
+	}
+	if deliveryLog != nil {
+		deliveryLog.Close(time.Second)
+	}
+	if recorder != nil {
+		recorder.Close(time.Second)
+	}
+	closeBusPublishers()
+
+	// Export the events of the shutdown itself, such as evictions, before exiting
+	if otlpExporter != nil {
+		otlpExporter.Flush(time.Second)
+	}
+	log.Infoln("Sockethook stopped")
+}
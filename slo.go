@@ -0,0 +1,176 @@
+package sockethook
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency SLOs tracked per endpoint, none by default
+var sloTracker = &SLOTracker{}
+
+// Number of deliveries kept per endpoint to compute percentiles from, older ones are dropped first
+var sloMaxSamples = 10000
+
+// Percentiles of delivery latency exposed per endpoint
+var sloQuantiles = []float64{0.5, 0.9, 0.99}
+
+// SLOTracker keeps the delivery latencies of a rolling window per endpoint to compute percentiles and the rate
+// at which the error budget of a latency target is burnt
+type SLOTracker struct {
+	mu sync.Mutex
+
+	// Target for endpoints without their own, 0 disables tracking
+	fallback time.Duration
+	// Targets for specific endpoints
+	targets map[string]time.Duration
+	// Fraction of deliveries which should meet the target, e.g. 0.99
+	objective float64
+	// Length of the rolling window
+	window time.Duration
+	// Latencies within the window per endpoint label, oldest first
+	samples map[string][]sloSample
+	// Target of the endpoints last observed under each label
+	labelTargets map[string]time.Duration
+}
+
+type sloSample struct {
+	at      time.Time
+	latency time.Duration
+	// Whether the latency exceeded the target of the endpoint the delivery was on
+	slow bool
+}
+
+// newSLOTracker parses targets of the form "250ms" (all endpoints) or "/endpoint=250ms"
+func newSLOTracker(rules []string, objective float64, window time.Duration) (*SLOTracker, error) {
+	if objective <= 0 || objective >= 1 {
+		return nil, fmt.Errorf("invalid SLO objective %v, expected a fraction between 0 and 1", objective)
+	}
+	t := &SLOTracker{targets: make(map[string]time.Duration), objective: objective, window: window, samples: make(map[string][]sloSample), labelTargets: make(map[string]time.Duration)}
+
+	for _, rule := range rules {
+		endpoint := ""
+		if strings.HasPrefix(rule, "/") {
+			parts := strings.SplitN(rule, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid SLO %q, expected /endpoint=duration", rule)
+			}
+			endpoint, rule = strings.TrimRight(parts[0], "/"), parts[1]
+		}
+
+		target, err := time.ParseDuration(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SLO %q: %v", rule, err)
+		}
+
+		if endpoint == "" {
+			t.fallback = target
+		} else {
+			t.targets[endpoint] = target
+		}
+	}
+
+	return t, nil
+}
+
+// target returns the latency target of an endpoint, must be called with t.mu held
+func (t *SLOTracker) target(endpoint string) time.Duration {
+	if target, ok := t.targets[endpoint]; ok {
+		return target
+	}
+	return t.fallback
+}
+
+// Observe records the latency of a delivery on an endpoint with a target, under the endpoint's metric label
+func (t *SLOTracker) Observe(endpoint string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	target := t.target(endpoint)
+	if target <= 0 {
+		return
+	}
+	label := endpointLabel(endpoint)
+	samples, ok := t.samples[label]
+	if !ok && len(t.samples) >= maxMetricLabels {
+		return
+	}
+
+	samples = append(t.expire(samples, time.Now()), sloSample{at: time.Now(), latency: latency, slow: latency > target})
+	if len(samples) > sloMaxSamples {
+		samples = samples[len(samples)-sloMaxSamples:]
+	}
+	t.samples[label] = samples
+	t.labelTargets[label] = target
+}
+
+// expire drops the samples which fell out of the window
+func (t *SLOTracker) expire(samples []sloSample, now time.Time) []sloSample {
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > t.window {
+		i++
+	}
+	return samples[i:]
+}
+
+// write writes the latency percentiles, targets and burn rates of all tracked endpoints in the Prometheus text
+// format. A burn rate of 1 means the error budget is used up exactly at the end of the window, higher rates
+// mean it's burnt faster.
+func (t *SLOTracker) write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	endpoints := make([]string, 0, len(t.samples))
+	for endpoint := range t.samples {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	quantiles := make(map[string][]float64)
+	targets := make(map[string]float64)
+	burnRates := make(map[string]float64)
+	now := time.Now()
+	for _, endpoint := range endpoints {
+		samples := t.expire(t.samples[endpoint], now)
+		t.samples[endpoint] = samples
+		targets[endpoint] = t.labelTargets[endpoint].Seconds()
+
+		latencies := make([]time.Duration, len(samples))
+		slow := 0
+		for i, sample := range samples {
+			latencies[i] = sample.latency
+			if sample.slow {
+				slow++
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		for _, q := range sloQuantiles {
+			value := 0.0
+			if len(latencies) > 0 {
+				// Nearest rank, the smallest latency which at least a fraction q of deliveries didn't exceed
+				value = latencies[int(math.Ceil(q*float64(len(latencies))))-1].Seconds()
+			}
+			quantiles[endpoint] = append(quantiles[endpoint], value)
+		}
+		if len(samples) > 0 {
+			burnRates[endpoint] = float64(slow) / float64(len(samples)) / (1 - t.objective)
+		} else {
+			burnRates[endpoint] = 0
+		}
+	}
+
+	name := "sockethook_delivery_latency_quantile_seconds"
+	fmt.Fprintf(w, "# HELP %s Delivery latency percentiles over the SLO window.\n# TYPE %s gauge\n", name, name)
+	for _, endpoint := range endpoints {
+		for i, q := range sloQuantiles {
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels("endpoint", endpoint, "quantile", formatFloat(q)), formatFloat(quantiles[endpoint][i]))
+		}
+	}
+	writeGauge(w, "sockethook_slo_target_seconds", "Delivery latency target of the SLO.", "endpoint", targets)
+	writeGauge(w, "sockethook_slo_burn_rate", "Rate at which the SLO error budget is burnt over the window, above 1 exhausting it.", "endpoint", burnRates)
+}
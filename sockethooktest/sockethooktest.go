@@ -0,0 +1,376 @@
+// Package sockethooktest runs a sockethook relay in-process for integration tests, with fake clients and
+// assertions on the messages they receive, so that consumers can be tested against the relay without Docker:
+//
+//	func TestOrderCreated(t *testing.T) {
+//		server := sockethooktest.Start(t)
+//		defer server.Close()
+//		client := server.Connect(t, "/order/created")
+//		defer client.Close()
+//
+//		server.SendHook(t, "/order/created", `{"id": 42}`, nil)
+//		server.ExpectMessage(t, "/order/created", sockethooktest.HasData("id", 42))
+//	}
+//
+// Every test starts a relay of its own with the options it needs. The relay's configuration is shared by the whole
+// process though, so only one runs at a time and tests using it can't run in parallel. Starting a relay closes
+// the one of the previous test if it's still running.
+package sockethooktest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corollari/sockethook"
+	"github.com/gorilla/websocket"
+)
+
+// How long expectations wait for a message before failing the test
+var Timeout = 5 * time.Second
+
+// Server is a relay running in-process on a local port
+type Server struct {
+	// Base URL of the relay, such as http://127.0.0.1:41234, including any base path
+	URL   string
+	Relay *sockethook.Server
+
+	listener *httptest.Server
+	mu       sync.Mutex
+	// Clients connected through the server by endpoint, in the order they connected
+	clients map[string][]*Client
+}
+
+// The running server of the test process
+var current struct {
+	sync.Mutex
+	server *Server
+}
+
+// Start starts a relay with the given options on a local port, closing the one a previous test started if it's
+// still running. Fails the test if the relay can't be started, such as when the options are invalid or the
+// process started a sockethook.Server of its own.
+func Start(t testing.TB, opts ...sockethook.Option) *Server {
+	t.Helper()
+	current.Lock()
+	previous := current.server
+	current.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	relay, err := sockethook.New(opts...)
+	if err == nil {
+		err = relay.Start()
+	}
+	if err != nil {
+		t.Fatalf("sockethooktest: starting relay: %v", err)
+	}
+	listener := httptest.NewServer(relay)
+	s := &Server{
+		URL:      listener.URL + relay.BasePath(),
+		Relay:    relay,
+		listener: listener,
+		clients:  make(map[string][]*Client),
+	}
+
+	current.Lock()
+	current.server = s
+	current.Unlock()
+	return s
+}
+
+// Close disconnects the server's clients and stops the relay, so that another one can be started
+func (s *Server) Close() {
+	s.mu.Lock()
+	var clients []*Client
+	for _, connected := range s.clients {
+		clients = append(clients, connected...)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+
+	s.Relay.Close()
+	s.listener.Close()
+
+	current.Lock()
+	if current.server == s {
+		current.server = nil
+	}
+	current.Unlock()
+}
+
+// SendHook sends a hook to an endpoint and returns the status it was answered with. Bodies which are JSON are
+// sent as application/json unless the header sets a content type.
+func (s *Server) SendHook(t testing.TB, endpoint string, body string, header http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/hook"+endpoint, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("sockethooktest: sending hook to %s: %v", endpoint, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Content-Type") == "" && json.Valid([]byte(body)) {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("sockethooktest: sending hook to %s: %v", endpoint, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Connect connects a websocket client to an endpoint, returning once it's subscribed so that every hook sent
+// afterwards reaches it
+func (s *Server) Connect(t testing.TB, endpoint string) *Client {
+	t.Helper()
+	return s.ConnectWith(t, endpoint, nil, nil)
+}
+
+// ConnectWith connects a websocket client to an endpoint with query parameters, such as filter or token, and
+// headers
+func (s *Server) ConnectWith(t testing.TB, endpoint string, query url.Values, header http.Header) *Client {
+	t.Helper()
+	target := "ws" + strings.TrimPrefix(s.URL, "http") + "/socket" + endpoint
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(target, header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v, status %d", err, resp.StatusCode)
+		}
+		t.Fatalf("sockethooktest: connecting to %s: %v", endpoint, err)
+	}
+
+	var welcome sockethook.WelcomeFrame
+	conn.SetReadDeadline(time.Now().Add(Timeout))
+	if err := conn.ReadJSON(&welcome); err != nil || welcome.Type != "welcome" {
+		conn.Close()
+		t.Fatalf("sockethooktest: connecting to %s: no welcome frame: %v", endpoint, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &Client{
+		ConnectionID: welcome.ConnectionID,
+		Endpoint:     endpoint,
+		server:       s,
+		conn:         conn,
+		messages:     make(chan sockethook.Message, 1024),
+		closed:       make(chan struct{}),
+	}
+	go c.read()
+
+	s.mu.Lock()
+	s.clients[endpoint] = append(s.clients[endpoint], c)
+	s.mu.Unlock()
+	return c
+}
+
+// ExpectMessage waits for the first client connected to an endpoint through the server to receive a message
+// matching m, and returns it
+func (s *Server) ExpectMessage(t testing.TB, endpoint string, m Matcher) sockethook.Message {
+	t.Helper()
+	s.mu.Lock()
+	var c *Client
+	if clients := s.clients[endpoint]; len(clients) > 0 {
+		c = clients[0]
+	}
+	s.mu.Unlock()
+	if c == nil {
+		t.Fatalf("sockethooktest: no client connected to %s, connect one before sending hooks", endpoint)
+	}
+	return c.ExpectMessage(t, m)
+}
+
+// remove forgets a closed client
+func (s *Server) remove(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := s.clients[c.Endpoint]
+	for i, other := range clients {
+		if other == c {
+			s.clients[c.Endpoint] = append(clients[:i:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(s.clients[c.Endpoint]) == 0 {
+		delete(s.clients, c.Endpoint)
+	}
+}
+
+// Client is a fake websocket client, keeping the messages it receives until they're expected
+type Client struct {
+	ConnectionID string
+	Endpoint     string
+
+	server   *Server
+	conn     *websocket.Conn
+	messages chan sockethook.Message
+	// Closed once the connection is gone, after which err says why
+	closed chan struct{}
+	err    error
+	once   sync.Once
+}
+
+// read keeps the data messages of the connection until it's closed
+func (c *Client) read() {
+	defer close(c.closed)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var msg sockethook.Message
+		if json.Unmarshal(data, &msg) != nil || msg.Type != "data" {
+			continue
+		}
+		select {
+		case c.messages <- msg:
+		default:
+			// Tests which don't expect their messages mustn't hold up the relay
+		}
+	}
+}
+
+// ExpectMessage waits for a message matching m and returns it, skipping messages which don't match. Fails the
+// test if none arrives within Timeout.
+func (c *Client) ExpectMessage(t testing.TB, m Matcher) sockethook.Message {
+	t.Helper()
+	timeout := time.NewTimer(Timeout)
+	defer timeout.Stop()
+	skipped := 0
+	for {
+		select {
+		case msg := <-c.messages:
+			if m(msg) {
+				return msg
+			}
+			skipped++
+		case <-c.closed:
+			// Messages which arrived before the connection was closed are still expected
+			if len(c.messages) > 0 {
+				continue
+			}
+			t.Fatalf("sockethooktest: client of %s disconnected waiting for a message: %v", c.Endpoint, c.err)
+		case <-timeout.C:
+			t.Fatalf("sockethooktest: no matching message on %s within %s, %d others received", c.Endpoint, Timeout, skipped)
+		}
+	}
+}
+
+// ExpectNoMessage fails the test if a message matching m arrives within d
+func (c *Client) ExpectNoMessage(t testing.TB, m Matcher, d time.Duration) {
+	t.Helper()
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-c.messages:
+			if m(msg) {
+				t.Fatalf("sockethooktest: unexpected message %s on %s", msg.ID, c.Endpoint)
+			}
+		case <-c.closed:
+			return
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// Ack acknowledges a message, for endpoints whose messages must be acknowledged
+func (c *Client) Ack(t testing.TB, msg sockethook.Message) {
+	t.Helper()
+	if err := c.conn.WriteJSON(map[string]string{"type": "ack", "id": msg.ID}); err != nil {
+		t.Fatalf("sockethooktest: acknowledging %s: %v", msg.ID, err)
+	}
+}
+
+// Close disconnects the client
+func (c *Client) Close() {
+	c.once.Do(func() {
+		c.server.remove(c)
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.conn.Close()
+		<-c.closed
+	})
+}
+
+// Matcher decides whether a message is the one expected
+type Matcher func(sockethook.Message) bool
+
+// Any matches every message
+func Any() Matcher {
+	return func(sockethook.Message) bool { return true }
+}
+
+// All matches messages matching every one of the matchers
+func All(matchers ...Matcher) Matcher {
+	return func(msg sockethook.Message) bool {
+		for _, m := range matchers {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// HasHeader matches messages of hooks which had a header with the value
+func HasHeader(name string, value string) Matcher {
+	return func(msg sockethook.Message) bool {
+		return msg.Headers[http.CanonicalHeaderKey(name)] == value
+	}
+}
+
+// HasData matches messages whose JSON data has the value at a dotted path, such as order.id, compared as JSON
+// so that 42 matches the number 42 of the data. An empty path compares the whole data.
+func HasData(path string, value interface{}) Matcher {
+	var want interface{}
+	if encoded, err := json.Marshal(value); err == nil {
+		json.Unmarshal(encoded, &want)
+	}
+	return func(msg sockethook.Message) bool {
+		got, ok := lookup(msg.Data, path)
+		return ok && reflect.DeepEqual(got, want)
+	}
+}
+
+// HasBody matches messages of hooks whose body was exactly body, before any redaction or transformation
+func HasBody(body string) Matcher {
+	sum := sha256.Sum256([]byte(body))
+	want := hex.EncodeToString(sum[:])
+	return func(msg sockethook.Message) bool {
+		return msg.BodySHA256 == want
+	}
+}
+
+// lookup returns the value at a dotted path of decoded JSON
+func lookup(data interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return data, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if data, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,91 @@
+package sockethooktest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corollari/sockethook"
+)
+
+func TestMatchers(t *testing.T) {
+	msg := sockethook.Message{
+		Headers:    map[string]string{"X-Github-Event": "push"},
+		Data:       map[string]interface{}{"id": 42.0, "order": map[string]interface{}{"status": "paid"}},
+		BodySHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	tests := []struct {
+		name    string
+		matcher Matcher
+		want    bool
+	}{
+		{"any", Any(), true},
+		{"number", HasData("id", 42), true},
+		{"wrong number", HasData("id", 43), false},
+		{"nested", HasData("order.status", "paid"), true},
+		{"missing path", HasData("order.total", 10), false},
+		{"path through value", HasData("id.value", 42), false},
+		{"whole data", HasData("", map[string]interface{}{"id": 42, "order": map[string]string{"status": "paid"}}), true},
+		{"header", HasHeader("x-github-event", "push"), true},
+		{"wrong header", HasHeader("X-GitHub-Event", "issues"), false},
+		{"body", HasBody("hello"), true},
+		{"wrong body", HasBody("hello!"), false},
+		{"all", All(HasData("id", 42), HasHeader("X-GitHub-Event", "push")), true},
+		{"all failing", All(HasData("id", 42), HasHeader("X-GitHub-Event", "issues")), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.matcher(msg); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	server := Start(t)
+	defer server.Close()
+	client := server.Connect(t, "/sockethooktest/orders")
+	defer client.Close()
+
+	tests := []struct {
+		name   string
+		body   string
+		header http.Header
+		match  Matcher
+	}{
+		{"json", `{"id": 1, "status": "paid"}`, nil, HasData("status", "paid")},
+		{"header", `{"id": 2}`, http.Header{"X-Event": {"created"}}, All(HasData("id", 2), HasHeader("X-Event", "created"))},
+		{"raw body", "id=3", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, HasBody("id=3")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := server.SendHook(t, "/sockethooktest/orders", test.body, test.header); status != 200 {
+				t.Fatalf("hook answered with %d", status)
+			}
+			server.ExpectMessage(t, "/sockethooktest/orders", test.match)
+		})
+	}
+
+	server.SendHook(t, "/sockethooktest/orders", `{"id": 4}`, nil)
+	client.ExpectNoMessage(t, HasData("id", 5), 200*time.Millisecond)
+}
+
+func TestStartWithOptions(t *testing.T) {
+	first := Start(t)
+	first.Close()
+
+	server := Start(t, sockethook.WithBasePath("/relay"))
+	defer server.Close()
+	if !strings.HasSuffix(server.URL, "/relay") {
+		t.Fatalf("options of the test not applied, URL %s", server.URL)
+	}
+	client := server.Connect(t, "/sockethooktest/relay")
+	defer client.Close()
+	server.SendHook(t, "/sockethooktest/relay", `{"id": 1}`, nil)
+	client.ExpectMessage(t, HasData("id", 1))
+
+	// A test which doesn't close its relay doesn't keep the next one from starting
+	Start(t).Close()
+}
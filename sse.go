@@ -0,0 +1,176 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Returned when writing to an event stream which has been closed
+var errStreamClosed = errors.New("event stream closed")
+
+// sseConn streams frames to a client as server-sent events. Messages are sent as unnamed events with their ID
+// as event ID, so that an EventSource passes it back in Last-Event-ID when reconnecting, while control frames
+// are sent as events named after their type.
+type sseConn struct {
+	mu         sync.Mutex
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	remoteAddr sseAddr
+	// Closed once the stream may not be written to anymore and its handler can return
+	closed     chan struct{}
+	closedOnce sync.Once
+}
+
+// sseAddr is the remote address of an event stream, as reported by net/http
+type sseAddr string
+
+func (a sseAddr) Network() string { return "tcp" }
+func (a sseAddr) String() string  { return string(a) }
+
+// WriteJSON writes a frame as an event
+func (s *sseConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	event := ""
+	if msg, ok := v.(Message); ok {
+		event = "id: " + msg.ID + "\n"
+	} else {
+		var frame struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(data, &frame)
+		event = "event: " + frame.Type + "\n"
+	}
+	return s.write(event + "data: " + string(data) + "\n\n")
+}
+
+// WriteControl writes pings as comments, which keep intermediaries from closing idle streams. Close frames
+// aren't written, the client is told to reconnect with the shutdown notice before it.
+func (s *sseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.PingMessage {
+		return s.write(": ping\n\n")
+	}
+	return nil
+}
+
+// Close ends the stream, after which nothing is written to it anymore. Doesn't wait for a write in progress,
+// which may block on a client which stopped reading.
+func (s *sseConn) Close() error {
+	s.closedOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// RemoteAddr returns the address of the client
+func (s *sseConn) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *sseConn) write(event string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return errStreamClosed
+	default:
+	}
+	if _, err := fmt.Fprint(s.w, event); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// handleSSE streams the messages of an endpoint as server-sent events, for clients which can't use websockets.
+// Streams are one-way, so clients can't send frames such as subscriptions or responses.
+func handleSSE(w http.ResponseWriter, r *http.Request, namespace string, endpoint string) {
+	endpoint = namespace + endpoint
+	logEntry := log.WithField("endpoint", endpoint)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logEntry.Warnln("Rejected event stream, response can't be flushed")
+		w.WriteHeader(500)
+		return
+	}
+
+	f, ok := connectFilter(w, r, logEntry)
+	if !ok {
+		return
+	}
+	schema, ok := connectSchema(w, r, logEntry)
+	if !ok {
+		return
+	}
+	conditions, ok := connectWhere(w, r, logEntry)
+	if !ok {
+		return
+	}
+	limiter, ok := connectReplayRate(w, r, logEntry)
+	if !ok {
+		return
+	}
+	resume, ok := connectResume(w, r, logEntry)
+	if !ok {
+		return
+	}
+	labels, ok := connectLabels(w, r, logEntry)
+	if !ok {
+		return
+	}
+	token, ok := admitClient(w, r, endpoint, logEntry)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	conn := &sseConn{w: w, flusher: flusher, remoteAddr: sseAddr(r.RemoteAddr), closed: make(chan struct{})}
+	c := newClient(conn, endpoint)
+	c.schema = schema
+	c.where = conditions
+	c.replayLimiter = limiter
+	c.token = token
+	c.session, c.restored = restoreSession(r, endpoint, token)
+	c.labels = c.restored.restoreLabels(labels)
+	resume = c.restored.resumePoint(resume)
+	c.origin = r.Header.Get("Origin")
+	c.host = r.Host
+	c.namespace = namespace
+	if f != nil {
+		c.filters[endpoint] = f
+	}
+	count := hub.Register(c, welcomeFrame(c), resume)
+	go c.writePump()
+	accessFor(r).record(accessStream, endpoint, c.id)
+
+	logEntry.WithField("clients", count).WithField("id", c.id).Infoln("Event stream connected")
+
+	// The response can't be written to once the handler returns, so keep it open until the stream is closed
+	select {
+	case <-r.Context().Done():
+		hub.Unregister(endpoint, c)
+	case <-conn.closed:
+	}
+	conn.Close()
+
+	// Wait for a write in progress to finish before the response is finalized
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+}
@@ -0,0 +1,258 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// URL of the active instance a standby syncs from, empty when not running as a standby
+var standbyOf string
+
+// How often a standby syncs from the active instance, and how long syncing may fail before it promotes itself,
+// 0 to only promote it through the admin API
+var standbySyncInterval = time.Second
+var standbyFailoverAfter time.Duration
+
+// 1 while running as a standby which hasn't been promoted
+var standbyActive int32
+
+var standbyClient = &http.Client{Timeout: 10 * time.Second}
+
+// StandbySyncRequest is the body of a standby's request for the state of the active instance, with the last
+// sequence number it synced per endpoint
+type StandbySyncRequest struct {
+	Sequences map[string]uint64 `json:"sequences"`
+}
+
+// StandbySync is the state of the active instance a standby syncs: the endpoints declared through the admin API,
+// the last sequence number of every endpoint and the buffered messages the standby hasn't synced yet
+type StandbySync struct {
+	Instance  string            `json:"instance"`
+	Endpoints []string          `json:"endpoints"`
+	Sequences map[string]uint64 `json:"sequences"`
+	Messages  []Message         `json:"messages"`
+}
+
+// StandbyStatus describes the standby state of the instance
+type StandbyStatus struct {
+	Standby  bool   `json:"standby"`
+	Active   string `json:"active,omitempty"`
+	LastSync string `json:"last_sync,omitempty"`
+	// Why the last sync failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// Outcome of the last sync of a standby, and the last sequence numbers of the active instance
+var standbyState = struct {
+	sync.Mutex
+	lastSync  time.Time
+	err       error
+	sequences map[string]uint64
+}{}
+
+// isStandby checks if the instance is a standby which hasn't been promoted, and doesn't take hooks or clients
+func isStandby() bool {
+	return atomic.LoadInt32(&standbyActive) == 1
+}
+
+// startStandby runs the instance as a standby of standbyOf until promoted
+func startStandby() {
+	atomic.StoreInt32(&standbyActive, 1)
+	log.WithField("active", standbyOf).Warnln("Running as standby")
+	go runStandby()
+}
+
+// runStandby syncs from the active instance until promoted, promoting itself once syncing has failed for
+// standbyFailoverAfter
+func runStandby() {
+	lastSuccess := time.Now()
+	ticker := time.NewTicker(standbySyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isStandby() {
+			return
+		}
+		err := syncFromActive()
+		standbyState.Lock()
+		standbyState.err = err
+		if err == nil {
+			standbyState.lastSync = time.Now()
+		}
+		standbyState.Unlock()
+
+		if err == nil {
+			lastSuccess = time.Now()
+			continue
+		}
+		log.WithField("active", standbyOf).Warnln("Failed to sync from active instance:", err)
+		if standbyFailoverAfter > 0 && time.Since(lastSuccess) >= standbyFailoverAfter {
+			promote("active instance unreachable for " + standbyFailoverAfter.String())
+			return
+		}
+	}
+}
+
+// syncFromActive fetches the state the standby is missing from the active instance and applies it
+func syncFromActive() error {
+	body, err := json.Marshal(StandbySyncRequest{Sequences: syncedSequences()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, standbyOf+"/admin/standby/sync", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := standbyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("active instance answered %s", resp.Status)
+	}
+
+	var state StandbySync
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("invalid state from active instance: %v", err)
+	}
+	applyStandbySync(state)
+	return nil
+}
+
+// syncedSequences returns the last sequence number of every endpoint, the standby's cursor into the buffers of
+// the active instance
+func syncedSequences() map[string]uint64 {
+	synced := make(map[string]uint64)
+	for endpoint, seq := range sequences() {
+		if !isReserved(endpoint) {
+			synced[endpoint] = seq
+		}
+	}
+	return synced
+}
+
+// applyStandbySync takes over the declarations, sequence numbers and buffered messages of the active instance,
+// so that once promoted the standby continues numbering and replays what clients missed
+func applyStandbySync(state StandbySync) {
+	declarations.Lock()
+	active := make(map[string]bool, len(state.Endpoints))
+	for _, endpoint := range state.Endpoints {
+		active[endpoint] = true
+		if declarations.endpoints[endpoint] == "" {
+			declarations.endpoints[endpoint] = declaredByAdmin
+		}
+	}
+	for endpoint, by := range declarations.endpoints {
+		if by == declaredByAdmin && !active[endpoint] {
+			delete(declarations.endpoints, endpoint)
+		}
+	}
+	declarations.Unlock()
+
+	for _, msg := range state.Messages {
+		touchEndpoint(msg.Endpoint)
+		replayBuffer.Record(msg)
+		advanceSequence(msg.Endpoint, msg.Seq)
+	}
+	// Sequence numbers of buffered endpoints are the cursor, and only advance with the messages synced, as the
+	// active instance may have numbered messages it hasn't buffered yet. They catch up when promoted.
+	for endpoint, seq := range state.Sequences {
+		if !replayBuffer.Enabled(endpoint) {
+			advanceSequence(endpoint, seq)
+		}
+	}
+	standbyState.Lock()
+	standbyState.sequences = state.Sequences
+	standbyState.Unlock()
+}
+
+// promote makes a standby the active instance, taking hooks and clients
+func promote(reason string) bool {
+	if !isStandby() {
+		return false
+	}
+	// Sequence numbers catch up before hooks are taken, so that new messages aren't numbered like old ones
+	standbyState.Lock()
+	for endpoint, seq := range standbyState.sequences {
+		advanceSequence(endpoint, seq)
+	}
+	standbyState.Unlock()
+	if !atomic.CompareAndSwapInt32(&standbyActive, 1, 0) {
+		return false
+	}
+	log.WithField("reason", reason).Warnln("Promoted standby to active")
+	publishEvent("standby_promoted", map[string]interface{}{"reason": reason, "active": standbyOf})
+	return true
+}
+
+// standbyStatus returns the standby state of the instance
+func standbyStatus() StandbyStatus {
+	status := StandbyStatus{Standby: isStandby()}
+	if standbyOf == "" {
+		return status
+	}
+	status.Active = standbyOf
+	standbyState.Lock()
+	defer standbyState.Unlock()
+	if !standbyState.lastSync.IsZero() {
+		status.LastSync = standbyState.lastSync.UTC().Format(time.RFC3339Nano)
+	}
+	if standbyState.err != nil {
+		status.Error = standbyState.err.Error()
+	}
+	return status
+}
+
+// handleStandby serves the standby API below /admin/standby: the state standbys sync on the active instance,
+// the standby state and promoting a standby
+func handleStandby(w http.ResponseWriter, r *http.Request, path string) {
+	switch path {
+	case "":
+		allowMethod(w, r, "GET", func() { writeJSON(w, standbyStatus()) })
+	case "/sync":
+		allowMethod(w, r, "POST", func() {
+			if isStandby() {
+				http.Error(w, "this instance is a standby", 409)
+				return
+			}
+			var req StandbySyncRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), 400)
+				return
+			}
+			state := StandbySync{
+				Instance:  instanceID,
+				Endpoints: []string{},
+				Sequences: syncedSequences(),
+				Messages:  replayBuffer.After(req.Sequences),
+			}
+			declarations.RLock()
+			for endpoint, by := range declarations.endpoints {
+				if by == declaredByAdmin {
+					state.Endpoints = append(state.Endpoints, endpoint)
+				}
+			}
+			declarations.RUnlock()
+			writeJSON(w, state)
+		})
+	case "/promote":
+		allowMethod(w, r, "POST", func() {
+			if !promote("promoted through the admin API") {
+				http.Error(w, "this instance isn't a standby", 409)
+				return
+			}
+			writeJSON(w, standbyStatus())
+		})
+	default:
+		http.Error(w, "unknown standby route", 404)
+	}
+}
@@ -0,0 +1,43 @@
+package sockethook
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplayBufferAfter(t *testing.T) {
+	b, err := newReplayBuffer([]string{"3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(1); seq <= 4; seq++ {
+		b.Record(Message{ID: fmt.Sprintf("a%d", seq), Endpoint: "/a", Seq: seq})
+	}
+	b.Record(Message{ID: "b1", Endpoint: "/b", Seq: 1})
+
+	tests := []struct {
+		name      string
+		sequences map[string]uint64
+		expected  []string
+	}{
+		{"nothing synced", nil, []string{"a2", "a3", "a4", "b1"}},
+		{"partly synced", map[string]uint64{"/a": 3, "/b": 1}, []string{"a4"}},
+		{"synced before the oldest buffered message", map[string]uint64{"/a": 1, "/b": 1}, []string{"a2", "a3", "a4"}},
+		{"all synced", map[string]uint64{"/a": 4, "/b": 1}, nil},
+	}
+	for _, test := range tests {
+		var ids []string
+		for _, msg := range b.After(test.sequences) {
+			ids = append(ids, msg.ID)
+		}
+		// Endpoints are in no particular order, messages of each endpoint oldest first
+		if len(ids) > 0 && ids[0] == "b1" {
+			ids = append(ids[1:], "b1")
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: After = %v, expected %v", test.name, ids, test.expected)
+		}
+	}
+}
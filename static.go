@@ -0,0 +1,84 @@
+package sockethook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Small responses served at fixed paths, such as the files providers ask for to verify a domain, given on the
+// command line
+var staticResponses = make(map[string]staticResponse)
+
+// Maximum size of a static response
+var maxStaticResponse = 64 << 10
+
+// Prefixes of the routes of Sockethook, which static responses can't be served at as the router matches them first
+var routePrefixes = []string{"/hook", "/socket", "/sse", "/inspect", "/history", "/chaos", "/metrics", "/maintenance", "/logging", "/admin", "/healthz", "/readyz"}
+
+// staticResponse is the content served at a path
+type staticResponse struct {
+	contentType string
+	body        []byte
+}
+
+// parseStaticResponses parses static responses of the form /path=content or /path=@file, the content type being
+// guessed from the extension of the path or file, or from the content
+func parseStaticResponses(rules []string) (map[string]staticResponse, error) {
+	responses := make(map[string]staticResponse)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		path := strings.TrimRight(parts[0], "/")
+		if len(parts) != 2 || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid static response %q, expected /path=content or /path=@file", rule)
+		}
+		for _, prefix := range routePrefixes {
+			if strings.HasPrefix(path, prefix) {
+				return nil, fmt.Errorf("invalid static response %q, %s is a route of Sockethook", rule, prefix)
+			}
+		}
+
+		body, source := []byte(parts[1]), path
+		if strings.HasPrefix(parts[1], "@") {
+			var err error
+			if source = parts[1][1:]; source == "" {
+				return nil, fmt.Errorf("invalid static response %q, expected a file after @", rule)
+			}
+			if body, err = ioutil.ReadFile(source); err != nil {
+				return nil, fmt.Errorf("invalid static response %q: %v", rule, err)
+			}
+		}
+		if len(body) > maxStaticResponse {
+			return nil, fmt.Errorf("invalid static response %q, content is larger than %d bytes", rule, maxStaticResponse)
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(source))
+		}
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		responses[path] = staticResponse{contentType: contentType, body: body}
+	}
+	return responses, nil
+}
+
+// serve answers GET and HEAD requests with the static response
+func (s staticResponse) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(405)
+		return
+	}
+	w.Header().Set("Content-Type", s.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.body)))
+	w.WriteHeader(200)
+	if r.Method == "GET" {
+		w.Write(s.body)
+	}
+}
@@ -0,0 +1,106 @@
+package sockethook
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Minimum delay and maximum added jitter suggested to clients for reconnecting after shutdown
+var reconnectDelay = time.Second
+var reconnectJitter = 5 * time.Second
+
+// Addresses of other instances suggested to clients for reconnecting when this one shuts down
+var migrationTargets []string
+
+// Accept rate limiting during the recovery period after startup, the burst defaulting to one second's worth
+var recoveryPeriod time.Duration
+var recoveryRate = 50.0
+var recoveryBurst int
+
+// Token bucket limiting the rate of accepted connections during recovery
+var recovery = struct {
+	mu      sync.Mutex
+	until   time.Time
+	limiter *rateLimiter
+}{}
+
+// startRecovery begins the recovery period in which accepted connections are rate limited
+func startRecovery() {
+	if recoveryPeriod <= 0 || recoveryRate <= 0 {
+		return
+	}
+
+	recovery.mu.Lock()
+	defer recovery.mu.Unlock()
+
+	limit := newRateLimit(recoveryRate, recoveryBurst)
+	recovery.until = time.Now().Add(recoveryPeriod)
+	recovery.limiter = newRateLimiter(limit.rate, limit.burst)
+}
+
+// allowAccept checks if a new connection may be accepted, consuming a token during recovery
+func allowAccept() bool {
+	recovery.mu.Lock()
+	defer recovery.mu.Unlock()
+
+	if recovery.limiter == nil || time.Now().After(recovery.until) {
+		return true
+	}
+	ok, _ := recovery.limiter.Allow()
+	return ok
+}
+
+// reconnectHint returns a randomized delay after which a client should try to reconnect
+func reconnectHint() time.Duration {
+	hint := reconnectDelay
+	if reconnectJitter > 0 {
+		hint += time.Duration(rand.Int63n(int64(reconnectJitter)))
+	}
+	return hint
+}
+
+// retryAfter formats a reconnect hint as a Retry-After header value in whole seconds
+func retryAfter() string {
+	return strconv.Itoa(int((reconnectHint() + time.Second - 1) / time.Second))
+}
+
+// closeAllClients sends a close frame to every client which includes a jittered reconnect delay, waiting until
+// the deadline for their writers to flush what's already queued
+func closeAllClients(deadline time.Time) {
+	closing := []*client{}
+
+	hub.mu.Lock()
+	for _, conns := range hub.clients {
+		for _, c := range conns {
+			// Clients subscribed to several endpoints are only closed once
+			if c.closed {
+				continue
+			}
+			c.closed = true
+
+			hint := int64(reconnectHint() / time.Millisecond)
+			reason := fmt.Sprintf(`{"reconnect_after_ms":%d}`, hint)
+			msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, reason)
+			c.queue(ShutdownNotice{Type: frameShutdownNotice, ReconnectAfterMs: hint, Alternatives: migrationTargets})
+			c.queue(closeFrame{data: msg, deadline: deadline})
+			closing = append(closing, c)
+		}
+	}
+	hub.clients = make(map[string][]*client)
+	hub.patterns = newMatcher()
+	hub.mu.Unlock()
+
+	for _, c := range closing {
+		select {
+		case <-c.stopped:
+		case <-time.After(time.Until(deadline)):
+		}
+		close(c.done)
+		c.conn.Close()
+	}
+}
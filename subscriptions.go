@@ -0,0 +1,105 @@
+package sockethook
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of endpoints a single connection may be subscribed to, 0 for unlimited
+var maxSubscriptions int
+
+// handleSubscriptionFrame subscribes or unsubscribes a client from an endpoint, replying with an ack or error frame
+func handleSubscriptionFrame(c *client, frame clientFrame) {
+	endpoint := strings.TrimRight(frame.Endpoint, "/")
+	fail := func(code string, message string) {
+		c.queue(ErrorFrame{Type: frameError, ID: frame.ID, Endpoint: frame.Endpoint, Code: code, Message: message})
+	}
+
+	if !strings.HasPrefix(endpoint, "/") {
+		fail(errorInvalidEndpoint, "endpoint must start with /")
+		return
+	}
+	if !validPattern(endpoint) {
+		fail(errorInvalidEndpoint, "** may only be the last segment of a pattern")
+		return
+	}
+	endpoint = c.namespace + endpoint
+
+	var f *filter
+	if frame.Type == frameSubscribe && frame.Filter != "" {
+		var err error
+		if f, err = parseFilter(frame.Filter); err != nil {
+			fail(errorInvalidFilter, err.Error())
+			return
+		}
+	}
+
+	if frame.Type == frameSubscribe && temporaryExpired(endpoint) {
+		fail(errorEndpointExpired, endpoint+" has expired")
+		return
+	}
+	if !authorized(c.token, endpoint) {
+		alertDetector.ObserveAuthFailure(endpoint)
+		fail(errorPermissionDenied, "token doesn't grant access to "+endpoint)
+		return
+	}
+	if frame.Type == frameSubscribe && !originAllowed(c.origin, c.host, endpoint) {
+		fail(errorPermissionDenied, "origin isn't allowed to access "+endpoint)
+		return
+	}
+	if frame.Type == frameSubscribe && !declared(endpoint) {
+		fail(errorPermissionDenied, endpoint+" isn't declared")
+		return
+	}
+	if frame.Type == frameSubscribe && archiveOf(endpoint) != nil {
+		fail(errorEndpointArchived, endpoint+" is archived")
+		return
+	}
+
+	hub.mu.Lock()
+	switch {
+	case c.closed:
+		hub.mu.Unlock()
+		return
+	case frame.Type == frameSubscribe && c.subscriptions[endpoint]:
+		hub.mu.Unlock()
+		fail(errorAlreadySubscribed, "already subscribed to "+endpoint)
+		return
+	case frame.Type == frameSubscribe && maxSubscriptions > 0 && len(c.subscriptions) >= maxSubscriptions:
+		hub.mu.Unlock()
+		fail(errorTooManySubscriptions, "connections may subscribe to at most "+strconv.Itoa(maxSubscriptions)+" endpoints")
+		return
+	case frame.Type == frameSubscribe && maxClients > 0 && len(hub.clients[endpoint])+reserved[endpoint] >= maxClients:
+		hub.mu.Unlock()
+		fail(errorEndpointFull, endpoint+" has reached its client limit")
+		return
+	case frame.Type == frameUnsubscribe && !c.subscriptions[endpoint]:
+		hub.mu.Unlock()
+		fail(errorNotSubscribed, "not subscribed to "+endpoint)
+		return
+	case frame.Type == frameSubscribe:
+		hub.attach(c, endpoint)
+		if f != nil {
+			c.filters[endpoint] = f
+		}
+		if !isPattern(endpoint) {
+			c.setCursor(endpoint, currentSequence(endpoint))
+		}
+	default:
+		hub.detach(c, endpoint)
+		notifySlotFreed()
+	}
+	hub.mu.Unlock()
+
+	log.WithFields(log.Fields{"id": c.id, "endpoint": endpoint, "action": frame.Type}).Infoln("Subscription changed")
+	c.queue(SubscriptionAck{
+		Type:     frameSubscriptionAck,
+		ID:       frame.ID,
+		Action:   frame.Type,
+		Endpoint: endpoint,
+		Seq:      currentSequence(endpoint),
+		Filter:   frame.Filter,
+	})
+}
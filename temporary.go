@@ -0,0 +1,291 @@
+package sockethook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Endpoint below which temporary endpoints are created
+var temporaryPrefix = "/temporary"
+
+// How long temporary endpoints last unless asked otherwise, and the longest they may last
+var temporaryTTL = time.Hour
+var maxTemporaryTTL = 24 * time.Hour
+
+// Number of temporary endpoints which may exist at the same time
+var maxTemporaryEndpoints = 1000
+
+// How long expired temporary endpoints answer with 410 before they're forgotten and answer like any unknown
+// endpoint
+var expiredRetention = 24 * time.Hour
+
+// Where temporary endpoints are declared
+const declaredByTemporary = "temporary"
+
+// TemporaryEndpoint is a short-lived endpoint created through the admin API, for a one-off test or a demo. Its
+// clients need its own token, which no other token grants access to, and it's dropped with all its messages once
+// it expires.
+type TemporaryEndpoint struct {
+	ID        string `json:"id"`
+	Endpoint  string `json:"endpoint"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	// Set if the endpoint has expired
+	ExpiredAt   string `json:"expired_at,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// TemporaryEndpointGrant is the answer to creating a temporary endpoint, the only time its token is shown
+type TemporaryEndpointGrant struct {
+	TemporaryEndpoint
+	Token     string `json:"token"`
+	HookURL   string `json:"hook_url"`
+	SocketURL string `json:"socket_url"`
+	SSEURL    string `json:"sse_url"`
+}
+
+// TemporaryRequest is the optional body of a request creating a temporary endpoint
+type TemporaryRequest struct {
+	// How long the endpoint lasts, such as 30m, --temporary-ttl if empty
+	TTL         string `json:"ttl"`
+	Description string `json:"description"`
+}
+
+// Temporary endpoints by endpoint, with the timers expiring them. Expired ones are kept for expiredRetention so
+// that their publishers and clients learn they're gone.
+var temporaries = struct {
+	sync.RWMutex
+	endpoints map[string]*temporaryEndpoint
+}{endpoints: make(map[string]*temporaryEndpoint)}
+
+type temporaryEndpoint struct {
+	info TemporaryEndpoint
+	// Key of the token, see hashToken
+	token string
+	timer *time.Timer
+}
+
+// setTemporaryPrefix sets the endpoint below which temporary endpoints are created
+func setTemporaryPrefix(prefix string) error {
+	prefix = strings.TrimRight(prefix, "/")
+	if !strings.HasPrefix(prefix, "/") || isPattern(prefix) || isReserved(prefix) {
+		return fmt.Errorf("invalid temporary prefix %q, expected an endpoint such as /temporary", prefix)
+	}
+	temporaryPrefix = prefix
+	return nil
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// temporaryOf returns the temporary endpoint an endpoint is, nil if it isn't one
+func temporaryOf(endpoint string) *TemporaryEndpoint {
+	temporaries.RLock()
+	defer temporaries.RUnlock()
+	if t, ok := temporaries.endpoints[endpoint]; ok {
+		info := t.info
+		return &info
+	}
+	return nil
+}
+
+// temporaryExpired checks if an endpoint is a temporary endpoint which has expired
+func temporaryExpired(endpoint string) bool {
+	t := temporaryOf(endpoint)
+	return t != nil && t.ExpiredAt != ""
+}
+
+// temporaryAuthorized checks if a token is the one of a temporary endpoint
+func temporaryAuthorized(token string, endpoint string) bool {
+	temporaries.RLock()
+	defer temporaries.RUnlock()
+	t, ok := temporaries.endpoints[endpoint]
+	return ok && t.info.ExpiredAt == "" && token != "" && t.token == hashToken(token)
+}
+
+// createTemporary creates a temporary endpoint with a random name and token below the prefix, declaring it
+// until it expires
+func createTemporary(ttl time.Duration, description string) (TemporaryEndpointGrant, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return TemporaryEndpointGrant{}, err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return TemporaryEndpointGrant{}, err
+	}
+	endpoint := temporaryPrefix + "/" + id
+	now := time.Now()
+	info := TemporaryEndpoint{
+		ID:          id,
+		Endpoint:    endpoint,
+		CreatedAt:   now.UTC().Format(time.RFC3339Nano),
+		ExpiresAt:   now.Add(ttl).UTC().Format(time.RFC3339Nano),
+		Description: description,
+	}
+
+	temporaries.Lock()
+	active := 0
+	for _, t := range temporaries.endpoints {
+		if t.info.ExpiredAt == "" {
+			active++
+		}
+	}
+	if active >= maxTemporaryEndpoints {
+		temporaries.Unlock()
+		return TemporaryEndpointGrant{}, errTooManyTemporaries
+	}
+	temporaries.endpoints[endpoint] = &temporaryEndpoint{
+		info:  info,
+		token: hashToken(token),
+		timer: time.AfterFunc(ttl, func() { expireTemporary(endpoint) }),
+	}
+	temporaries.Unlock()
+
+	declarations.Lock()
+	declarations.endpoints[endpoint] = declaredByTemporary
+	declarations.Unlock()
+
+	log.WithField("endpoint", endpoint).WithField("expires_at", info.ExpiresAt).Infoln("Temporary endpoint created")
+	publishEvent("endpoint_created", map[string]interface{}{"endpoint": endpoint, "by": declaredByTemporary, "expires_at": info.ExpiresAt})
+	return TemporaryEndpointGrant{TemporaryEndpoint: info, Token: token}, nil
+}
+
+var errTooManyTemporaries = errors.New("too many temporary endpoints")
+
+// expireTemporary drops a temporary endpoint, disconnecting its clients and purging its messages. It answers
+// with 410 until expiredRetention has passed. Returns false if it doesn't exist or has already expired.
+func expireTemporary(endpoint string) bool {
+	now := time.Now()
+	temporaries.Lock()
+	t, ok := temporaries.endpoints[endpoint]
+	if !ok || t.info.ExpiredAt != "" {
+		temporaries.Unlock()
+		return false
+	}
+	t.timer.Stop()
+	t.info.ExpiredAt = now.UTC().Format(time.RFC3339Nano)
+	t.timer = time.AfterFunc(expiredRetention, func() { forgetTemporary(endpoint) })
+	temporaries.Unlock()
+
+	declarations.Lock()
+	if declarations.endpoints[endpoint] == declaredByTemporary {
+		delete(declarations.endpoints, endpoint)
+	}
+	declarations.Unlock()
+	disconnected := disconnectEndpoint(endpoint)
+	purged := purgeMessages(endpoint)
+
+	log.WithFields(log.Fields{
+		"endpoint":     endpoint,
+		"disconnected": disconnected,
+		"purged":       purged,
+	}).Infoln("Temporary endpoint expired")
+	publishEvent("endpoint_expired", map[string]interface{}{"endpoint": endpoint})
+	return true
+}
+
+// forgetTemporary forgets an expired temporary endpoint, after which it's like any unknown endpoint
+func forgetTemporary(endpoint string) {
+	temporaries.Lock()
+	if t, ok := temporaries.endpoints[endpoint]; ok && t.info.ExpiredAt != "" {
+		delete(temporaries.endpoints, endpoint)
+	}
+	temporaries.Unlock()
+}
+
+// temporaryEndpoints returns the temporary endpoints, including expired ones which haven't been forgotten yet,
+// sorted by creation
+func temporaryEndpoints() []TemporaryEndpoint {
+	temporaries.RLock()
+	list := make([]TemporaryEndpoint, 0, len(temporaries.endpoints))
+	for _, t := range temporaries.endpoints {
+		list = append(list, t.info)
+	}
+	temporaries.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt < list[j].CreatedAt })
+	return list
+}
+
+// readTemporaryRequest reads the optional body of a request creating a temporary endpoint
+func readTemporaryRequest(r *http.Request) (TemporaryRequest, time.Duration, error) {
+	var req TemporaryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, 0, fmt.Errorf("invalid body: %v", err)
+	}
+	ttl := temporaryTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return req, 0, fmt.Errorf("invalid ttl %q, expected a duration such as 30m", req.TTL)
+		}
+	}
+	if ttl > maxTemporaryTTL {
+		return req, 0, fmt.Errorf("invalid ttl %s, temporary endpoints last at most %s", ttl, maxTemporaryTTL)
+	}
+	return req, ttl, nil
+}
+
+// handleTemporary serves temporary endpoints below /admin/temporary: listing them, creating them and expiring
+// them before their time
+func handleTemporary(w http.ResponseWriter, r *http.Request, path string) {
+	if path != "" {
+		allowMethod(w, r, "DELETE", func() {
+			if !expireTemporary(temporaryPrefix + "/" + strings.TrimPrefix(path, "/")) {
+				http.Error(w, "no active temporary endpoint with that ID", 404)
+				return
+			}
+			w.WriteHeader(204)
+		})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, temporaryEndpoints())
+	case "POST":
+		req, ttl, err := readTemporaryRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		grant, err := createTemporary(ttl, req.Description)
+		if err == errTooManyTemporaries {
+			http.Error(w, fmt.Sprintf("at most %d temporary endpoints may exist at the same time", maxTemporaryEndpoints), 409)
+			return
+		}
+		if err != nil {
+			log.Errorln("Failed to create temporary endpoint:", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		hookBase, socketBase, sseBase := publicURLs(r)
+		grant.HookURL = hookBase + grant.Endpoint
+		grant.SocketURL = socketBase + grant.Endpoint + "?token=" + grant.Token
+		grant.SSEURL = sseBase + grant.Endpoint + "?token=" + grant.Token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(grant)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,23 @@
+package sockethook
+
+import (
+	"time"
+)
+
+// Whether time sync frames are sent to clients
+var timeSyncEnabled bool
+
+// TimeSync is a control frame sent periodically to clients so they can estimate clock skew
+type TimeSync struct {
+	Type       string `json:"type"`
+	ServerTime string `json:"server_time"`
+}
+
+// sendTimeSync sends a time sync frame to every connected client at the given interval
+func sendTimeSync(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, c := range hub.all() {
+			c.queue(TimeSync{Type: frameTimeSync, ServerTime: time.Now().UTC().Format(time.RFC3339Nano)})
+		}
+	}
+}
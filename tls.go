@@ -0,0 +1,108 @@
+package sockethook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig builds the TLS configuration of the listeners from certificate and key files, paired in the order
+// given, or from certificates obtained from Let's Encrypt for the autocert domains. Returns nil if TLS isn't
+// enabled. With several certificates the one matching the SNI of the client is served.
+func tlsConfig(certFiles, keyFiles, autocertDomains []string, autocertCache, autocertEmail string) (*tls.Config, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d TLS certificates but %d keys, expected one key per certificate", len(certFiles), len(keyFiles))
+	}
+	if len(certFiles) > 0 && len(autocertDomains) > 0 {
+		return nil, fmt.Errorf("TLS certificates and autocert domains can't be combined")
+	}
+
+	if len(autocertDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(autocertDomains...),
+			Cache:      autocert.DirCache(autocertCache),
+			Email:      autocertEmail,
+		}
+		// Certificates are requested through TLS-ALPN challenges, which require listening on port 443
+		return manager.TLSConfig(), nil
+	}
+
+	if len(certFiles) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	config.BuildNameToCertificate()
+	return config, nil
+}
+
+// checkHostCertificates checks that every routed hostname has a certificate of its own, as tenants would otherwise
+// be served the certificate of another one
+func checkHostCertificates(config *tls.Config, autocertDomains []string) error {
+	if config == nil {
+		return nil
+	}
+	for host := range hostNamespaces {
+		if host == "*" {
+			continue
+		}
+		covered := false
+		for _, domain := range autocertDomains {
+			covered = covered || strings.EqualFold(domain, host)
+		}
+		for _, cert := range config.Certificates {
+			if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && leaf.VerifyHostname(host) == nil {
+				covered = true
+			}
+		}
+		if !covered {
+			return fmt.Errorf("no TLS certificate for routed host %s", host)
+		}
+	}
+	return nil
+}
+
+// sniMismatch checks if a request over TLS is for another routed hostname than the one its connection was
+// established for, such as when a client reuses a connection for several hostnames covered by one certificate
+func sniMismatch(r *http.Request) bool {
+	if r.TLS == nil || r.TLS.ServerName == "" || len(hostNamespaces) == 0 {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return !strings.EqualFold(host, r.TLS.ServerName)
+}
+
+// listenAndServe serves over TLS if the server has a TLS configuration, ignoring the error of a graceful shutdown.
+// The server counts as listening for readiness once its address is bound.
+func listenAndServe(server *http.Server) {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listening.Store(server, true)
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package sockethook
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSNIMismatch(t *testing.T) {
+	defer func(namespaces map[string]string) { hostNamespaces = namespaces }(hostNamespaces)
+
+	tests := []struct {
+		name       string
+		routed     bool
+		host       string
+		serverName string
+		tls        bool
+		mismatch   bool
+	}{
+		{"plain HTTP", true, "hooks.customer-b.com", "", false, false},
+		{"matching server name", true, "hooks.customer-a.com", "hooks.customer-a.com", true, false},
+		{"matching server name with port", true, "hooks.customer-a.com:443", "hooks.customer-a.com", true, false},
+		{"server name in another case", true, "Hooks.Customer-A.com", "hooks.customer-a.com", true, false},
+		{"other routed host", true, "hooks.customer-b.com", "hooks.customer-a.com", true, true},
+		{"without server name", true, "hooks.customer-b.com", "", true, false},
+		{"without host routing", false, "hooks.customer-b.com", "hooks.customer-a.com", true, false},
+	}
+	for _, test := range tests {
+		hostNamespaces = map[string]string{}
+		if test.routed {
+			hostNamespaces = map[string]string{"hooks.customer-a.com": "/a", "hooks.customer-b.com": "/b"}
+		}
+		r := httptest.NewRequest("POST", "/hook/x", nil)
+		r.Host = test.host
+		if test.tls {
+			r.TLS = &tls.ConnectionState{ServerName: test.serverName}
+		}
+		if mismatch := sniMismatch(r); mismatch != test.mismatch {
+			t.Errorf("%s: sniMismatch = %v, expected %v", test.name, mismatch, test.mismatch)
+		}
+	}
+}
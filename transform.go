@@ -0,0 +1,303 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Kinds of transformations
+const (
+	transformTemplate = "template"
+	transformJQ       = "jq"
+)
+
+// Transformations of endpoints or patterns given on the command line
+var transforms = make(map[string]*transformer)
+
+// transformer reshapes the data of JSON messages, either with a Go template whose output is parsed as JSON, or
+// with a jq-like expression
+type transformer struct {
+	source string
+	tmpl   *template.Template
+	expr   filterNode
+}
+
+// Functions available to transformation templates
+var transformFuncs = template.FuncMap{
+	// json encodes a value as JSON, so that strings are quoted and numbers aren't written in exponent notation
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// parseTransforms parses transformations of the form /endpoint=template:... or /endpoint=jq:..., where the
+// endpoint may be a pattern
+func parseTransforms(rules []string) (map[string]*transformer, error) {
+	parsed := make(map[string]*transformer)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid transformation %q, expected /endpoint=template:... or /endpoint=jq:...", rule)
+		}
+		t, err := parseTransform(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		parsed[strings.TrimRight(parts[0], "/")] = t
+	}
+	return parsed, nil
+}
+
+// parseTransform parses a transformation of the form template:... or jq:...
+func parseTransform(spec string) (*transformer, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid transformation %q, expected template:... or jq:...", spec)
+	}
+
+	t := &transformer{source: spec}
+	switch parts[0] {
+	case transformTemplate:
+		tmpl, err := template.New("transform").Funcs(transformFuncs).Option("missingkey=zero").Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid transformation template: %v", err)
+		}
+		t.tmpl = tmpl
+	case transformJQ:
+		expr, err := parseJQ(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid transformation expression: %v", err)
+		}
+		t.expr = expr
+	default:
+		return nil, fmt.Errorf("invalid transformation kind %q, expected template or jq", parts[0])
+	}
+	return t, nil
+}
+
+// transformFor returns the transformation of an endpoint, nil if it has none. The configuration file takes
+// precedence over options, and exact endpoints over patterns.
+func transformFor(endpoint string) *transformer {
+	if settings := settingsFor(endpoint); settings != nil && settings.transform != nil {
+		return settings.transform
+	}
+	if t, ok := transforms[endpoint]; ok {
+		return t
+	}
+	for pattern, t := range transforms {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Transform replaces the data of a JSON message with the result of the transformation. Template output which
+// isn't JSON becomes a string.
+func (t *transformer) Transform(msg *Message) error {
+	if msg.Encoding != "" {
+		return nil
+	}
+	if t.expr != nil {
+		msg.Data = t.expr.eval(msg.Data)
+		return nil
+	}
+
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, msg.Data); err != nil {
+		return err
+	}
+	var data interface{}
+	if err := json.Unmarshal(out.Bytes(), &data); err != nil {
+		data = out.String()
+	}
+	msg.Data = data
+	return nil
+}
+
+// parseJQ parses a jq-like expression: paths such as .pull_request.title, .labels[0] or .["key"], objects such
+// as {title: .title, number} (short for {number: .number}), arrays, literals, and pipes feeding the result of
+// one expression into the next
+func parseJQ(source string) (filterNode, error) {
+	if len(source) > maxFilterLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxFilterLength)
+	}
+	tokens, err := tokenizeFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &jqParser{filterParser{tokens: tokens}}
+	expr, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+// jqParser is a recursive descent parser for jq-like expressions, sharing the tokens of filters
+type jqParser struct {
+	filterParser
+}
+
+func (p *jqParser) parsePipe() (filterNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("|") {
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = pipeNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *jqParser) parseTerm() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch {
+	case p.accept("."):
+		return p.parsePath()
+	case p.accept("{"):
+		return p.parseObject()
+	case p.accept("["):
+		return p.parseArray()
+	}
+	// Literals are parsed like filter operands, which are paths if they aren't literals
+	token := p.tokens[p.pos]
+	if token.kind == tokenOperator {
+		return nil, fmt.Errorf("unexpected %q in expression", token.text)
+	}
+	if token.kind == tokenIdent && token.text != "true" && token.text != "false" && token.text != "null" {
+		return nil, fmt.Errorf("unexpected %q in expression, paths start with .", token.text)
+	}
+	return p.parseOperand()
+}
+
+// parsePath parses the keys and indices of a path after its leading ., which on its own is the input itself
+func (p *jqParser) parsePath() (filterNode, error) {
+	path := pathNode{}
+	// The first key directly follows the leading .
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenIdent {
+		path = append(path, p.tokens[p.pos].text)
+		p.pos++
+	}
+	for {
+		switch {
+		case p.accept("."):
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenIdent {
+				return nil, fmt.Errorf("expected a key after . in expression")
+			}
+			path = append(path, p.tokens[p.pos].text)
+			p.pos++
+		case p.accept("["):
+			if p.pos >= len(p.tokens) || (p.tokens[p.pos].kind != tokenString && p.tokens[p.pos].kind != tokenNumber) {
+				return nil, fmt.Errorf("expected a key or index after [ in expression")
+			}
+			path = append(path, p.tokens[p.pos].text)
+			p.pos++
+			if !p.accept("]") {
+				return nil, fmt.Errorf("missing ] in expression")
+			}
+		default:
+			return path, nil
+		}
+	}
+}
+
+func (p *jqParser) parseObject() (filterNode, error) {
+	object := objectNode{}
+	if p.accept("}") {
+		return object, nil
+	}
+	for {
+		if p.pos >= len(p.tokens) || (p.tokens[p.pos].kind != tokenIdent && p.tokens[p.pos].kind != tokenString) {
+			return nil, fmt.Errorf("expected a key in object")
+		}
+		key := p.tokens[p.pos].text
+		p.pos++
+
+		var value filterNode = pathNode{key}
+		if p.accept(":") {
+			var err error
+			if value, err = p.parseTerm(); err != nil {
+				return nil, err
+			}
+		}
+		object = append(object, objectField{key, value})
+
+		if p.accept("}") {
+			return object, nil
+		}
+		if !p.accept(",") {
+			return nil, fmt.Errorf("missing } in object")
+		}
+	}
+}
+
+func (p *jqParser) parseArray() (filterNode, error) {
+	array := arrayNode{}
+	if p.accept("]") {
+		return array, nil
+	}
+	for {
+		value, err := p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+
+		if p.accept("]") {
+			return array, nil
+		}
+		if !p.accept(",") {
+			return nil, fmt.Errorf("missing ] in array")
+		}
+	}
+}
+
+// pipeNode evaluates its right expression on the result of its left one
+type pipeNode struct {
+	left, right filterNode
+}
+
+func (n pipeNode) eval(doc interface{}) interface{} {
+	return n.right.eval(n.left.eval(doc))
+}
+
+// objectNode builds an object from the results of its fields
+type objectNode []objectField
+
+type objectField struct {
+	key   string
+	value filterNode
+}
+
+func (n objectNode) eval(doc interface{}) interface{} {
+	object := make(map[string]interface{}, len(n))
+	for _, field := range n {
+		object[field.key] = field.value.eval(doc)
+	}
+	return object
+}
+
+// arrayNode builds an array from the results of its elements
+type arrayNode []filterNode
+
+func (n arrayNode) eval(doc interface{}) interface{} {
+	array := make([]interface{}, len(n))
+	for i, element := range n {
+		array[i] = element.eval(doc)
+	}
+	return array
+}
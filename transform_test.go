@@ -0,0 +1,95 @@
+package sockethook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`{
+		"pull_request": {"title": "Fix", "number": 7, "user": {"login": "octo"}},
+		"labels": ["bug", "ui"],
+		"a key": "spaced",
+		"alert": {"summary": "Disk \"full\"", "severity": 2}
+	}`), &data)
+
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{"jq:.", `{"pull_request": {"title": "Fix", "number": 7, "user": {"login": "octo"}}, "labels": ["bug", "ui"], "a key": "spaced", "alert": {"summary": "Disk \"full\"", "severity": 2}}`},
+		{"jq:.pull_request.title", `"Fix"`},
+		{"jq:.labels[1]", `"ui"`},
+		{`jq:.["a key"]`, `"spaced"`},
+		{"jq:.missing.key", `null`},
+		{"jq:.labels[5]", `null`},
+		{"jq:.pull_request | {title, number, author: .user.login}", `{"title": "Fix", "number": 7, "author": "octo"}`},
+		{`jq:{"kind": "pr", draft: false, n: 1}`, `{"kind": "pr", "draft": false, "n": 1}`},
+		{"jq:[.labels[0], .pull_request.number]", `["bug", 7]`},
+		{"jq:{labels} | .labels | [.[1]]", `["ui"]`},
+		{"jq:{}", `{}`},
+		{`template:{"text": {{json .alert.summary}}, "level": {{json .alert.severity}}}`, `{"text": "Disk \"full\"", "level": 2}`},
+		{"template:{{.pull_request.title}} #{{.pull_request.number}}", `"Fix #7"`},
+		// Missing keys are empty rather than failing the template
+		{"template:[{{json .missing}}]", `[null]`},
+	}
+	for _, test := range tests {
+		transformer, err := parseTransform(test.spec)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		msg := Message{Data: data}
+		if err := transformer.Transform(&msg); err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		var expected interface{}
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(msg.Data, expected) {
+			t.Errorf("%s = %#v, expected %s", test.spec, msg.Data, test.expected)
+		}
+	}
+
+	// Binary messages keep their data
+	transformer, _ := parseTransform("jq:.pull_request")
+	msg := Message{Data: "AAEC", Encoding: "base64"}
+	if err := transformer.Transform(&msg); err != nil || msg.Data != "AAEC" {
+		t.Errorf("transformed binary message into %#v, %v", msg.Data, err)
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	for _, spec := range []string{
+		"jq", "sed:s/a/b/", "jq:", "jq:title", "jq:.a.", "jq:.a[", "jq:.a[0", "jq:.a[b]",
+		"jq:{a", "jq:{a: .b", "jq:{.a}", "jq:[.a", "jq:.a |", "jq:.a == 1", "template:{{.a",
+	} {
+		if _, err := parseTransform(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+	for _, rules := range [][]string{{"orders=jq:."}, {"/orders"}, {"/orders=jq:title"}} {
+		if _, err := parseTransforms(rules); err == nil {
+			t.Errorf("expected %q to be invalid", rules)
+		}
+	}
+}
+
+func TestTransformFor(t *testing.T) {
+	parsed, err := parseTransforms([]string{"/orders/=jq:.id", "/orders/*=jq:.number"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous map[string]*transformer) { transforms = previous }(transforms)
+	transforms = parsed
+
+	// Exact endpoints take precedence over the patterns covering them
+	for endpoint, expected := range map[string]string{"/orders": "jq:.id", "/orders/eu": "jq:.number", "/invoices": ""} {
+		transformer := transformFor(endpoint)
+		if (transformer == nil && expected != "") || (transformer != nil && transformer.source != expected) {
+			t.Errorf("transformFor(%s) = %+v, expected %q", endpoint, transformer, expected)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package sockethook
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers which describe the original connection and shouldn't be replayed
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// tunnelMessage is a Message as received by a client, with its data left undecoded
+type tunnelMessage struct {
+	Type     string            `json:"type"`
+	ID       string            `json:"id"`
+	Headers  map[string]string `json:"headers"`
+	Endpoint string            `json:"endpoint"`
+	Data     json.RawMessage   `json:"data"`
+}
+
+// runTunnel implements the tunnel command which replays every hook received on an endpoint against a local URL
+func runTunnel(args []string) {
+	flags := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	server := flags.String("server", "ws://localhost:1234", "URL of the Sockethook server, including any base path.")
+	token := flags.String("token", "", "Token to authenticate with, if the server requires one.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sockethook tunnel [options] <endpoint> <local-url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	endpoint := "/" + strings.Trim(flags.Arg(0), "/")
+	target := flags.Arg(1)
+	socketURL := strings.TrimRight(*server, "/") + "/socket" + endpoint
+
+	// Keep reconnecting with exponential backoff for as long as the command runs
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := tunnel(socketURL, *token, target)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+
+		log.WithField("server", socketURL).Warnf("Tunnel disconnected: %v, reconnecting in %s", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// tunnel subscribes to a socket URL and replays messages against the target until the connection fails
+func tunnel(socketURL string, token string, target string) error {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.WithFields(log.Fields{"server": socketURL, "target": target}).Infoln("Tunnel connected ✅")
+
+	for {
+		var msg tunnelMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+
+		// Only data frames carry hooks, all others are control frames
+		if msg.Type != frameData {
+			continue
+		}
+
+		resp, duration, err := replayMessage(msg, target)
+		logEntry := log.WithFields(log.Fields{"id": msg.ID, "endpoint": msg.Endpoint, "duration": duration})
+		if err != nil {
+			logEntry.Warnln("Local target failed:", err)
+			resp = HookResponse{Status: 502}
+		} else {
+			logEntry.WithField("status", resp.Status).Infoln("Hook replayed")
+		}
+
+		// Relay the local response, which is served as the hook response on endpoints with --respond
+		resp.Type = frameResponse
+		resp.ID = msg.ID
+		if err := conn.WriteJSON(resp); err != nil {
+			return err
+		}
+
+		// Hooks which the local target failed on aren't acknowledged, so they're sent again on endpoints with --ack
+		if err == nil {
+			if err := conn.WriteJSON(AckFrame{Type: frameAck, ID: msg.ID}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replayMessage rebuilds the original request from a message and POSTs it to the target, returning its response
+func replayMessage(msg tunnelMessage, target string) (HookResponse, time.Duration, error) {
+	body, err := messageBody(msg)
+	if err != nil {
+		return HookResponse{}, 0, err
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return HookResponse{}, 0, err
+	}
+	for name, value := range msg.Headers {
+		if !hopHeaders[name] {
+			req.Header.Set(name, value)
+		}
+	}
+
+	start := time.Now()
+	resp, err := replayClient.Do(req)
+	if err != nil {
+		return HookResponse{}, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	result := HookResponse{Status: resp.StatusCode, Headers: make(map[string]string)}
+	for name := range resp.Header {
+		result.Headers[name] = resp.Header.Get(name)
+	}
+	result.Body, err = ioutil.ReadAll(resp.Body)
+
+	return result, time.Since(start), err
+}
+
+// messageBody returns the original request body of a message. JSON bodies are sent as is, others as base64.
+func messageBody(msg tunnelMessage) ([]byte, error) {
+	if msg.Headers["Content-Type"] == "application/json" {
+		return msg.Data, nil
+	}
+
+	var encoded string
+	if err := json.Unmarshal(msg.Data, &encoded); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
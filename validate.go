@@ -0,0 +1,118 @@
+package sockethook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validate the configuration and exit instead of starting the server
+var validateOnly bool
+
+// Errors found in the configuration, collected when validating so that all of them are reported at once
+var configErrors []error
+
+// How long validation waits when checking that a backend is reachable
+var reachableTimeout = 5 * time.Second
+
+// configError reports an invalid configuration, exiting right away unless the configuration is being validated
+func configError(err error) {
+	if !validateOnly {
+		log.Fatal(err)
+	}
+	configErrors = append(configErrors, err)
+}
+
+// validateEnvironment checks what can only be verified against the environment rather than by parsing: that
+// listen addresses resolve, directories are writable and backends such as alert sinks can be reached
+func validateEnvironment(listenAddresses []string, dirs []string, backends []string) {
+	for _, address := range listenAddresses {
+		if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			configError(fmt.Errorf("invalid listen address %s: %v", address, err))
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := checkWritable(dir); err != nil {
+			configError(fmt.Errorf("directory %s isn't writable: %v", dir, err))
+		}
+	}
+
+	for _, backend := range backends {
+		if err := checkReachable(backend); err != nil {
+			configError(fmt.Errorf("%s isn't reachable: %v", backend, err))
+		}
+	}
+}
+
+// checkWritable checks that files can be created in a directory, or in the closest parent if it doesn't exist
+// yet, without creating it
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		return checkWritable(filepath.Dir(dir))
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+
+	file, err := ioutil.TempFile(dir, ".sockethook-validate")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkReachable opens a TCP connection to the host of a URL
+func checkReachable(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			port = "443"
+		} else if u.Scheme == "redis" || u.Scheme == "rediss" {
+			port = "6379"
+		} else if u.Scheme == "nats" || u.Scheme == "tls" {
+			port = "4222"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, reachableTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// reportConfig logs every configuration error found while validating and exits, non-zero if there were any
+func reportConfig() {
+	if len(configErrors) == 0 {
+		log.Infoln("Configuration is valid ✅")
+		os.Exit(0)
+	}
+
+	for _, err := range configErrors {
+		log.Errorln(err)
+	}
+	log.WithField("errors", len(configErrors)).Errorln("Configuration is invalid")
+	os.Exit(1)
+}
@@ -0,0 +1,121 @@
+package sockethook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// URLs hooks are POSTed to for validation before they're broadcasted, per endpoint
+var validationURLs = make(map[string]string)
+
+// How long validators have to answer, after which hooks are rejected
+var validationTimeout = 5 * time.Second
+
+// Maximum size of validator responses relayed to publishers
+var maxValidationResponse int64 = 64 << 10
+
+var validationClient = &http.Client{}
+
+// parseValidationURLs parses validation URLs of the form /endpoint=URL
+func parseValidationURLs(rules []string) (map[string]string, error) {
+	urls := make(map[string]string)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid validation URL %q, expected /endpoint=URL", rule)
+		}
+		if err := checkValidationURL(parts[1]); err != nil {
+			return nil, err
+		}
+		urls[strings.TrimRight(parts[0], "/")] = parts[1]
+	}
+	return urls, nil
+}
+
+// checkValidationURL checks that a validation URL is an absolute http:// or https:// URL
+func checkValidationURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid validation URL %q, expected an http:// or https:// URL", rawURL)
+	}
+	return nil
+}
+
+// validationURL returns the URL hooks to an endpoint are validated with, empty if they aren't. The
+// configuration file takes precedence over options.
+func validationURL(endpoint string) string {
+	if settings := settingsFor(endpoint); settings != nil && settings.validationURL != "" {
+		return settings.validationURL
+	}
+	return validationURLs[endpoint]
+}
+
+// validateHook POSTs a hook with its original headers and body to the endpoint's validator, returning true if it
+// answered with 2xx. Otherwise the publisher is answered with the validator's status and body if it rejected the
+// hook with 4xx, or with 502 if it failed, timed out or couldn't be reached.
+func validateHook(ctx context.Context, w http.ResponseWriter, r *http.Request, msg Message, body []byte, logEntry *log.Entry) bool {
+	target := validationURL(msg.Endpoint)
+	if target == "" {
+		return true
+	}
+	logEntry = logEntry.WithField("validator", target)
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		logEntry.Errorln("Failed to create validation request:", err)
+		w.WriteHeader(502)
+		return false
+	}
+	req = req.WithContext(ctx)
+	for name, values := range r.Header {
+		if !hopHeaders[name] {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("X-Sockethook-Endpoint", msg.Endpoint)
+	req.Header.Set("X-Sockethook-Id", msg.ID)
+
+	client := *validationClient
+	client.Timeout = validationTimeout
+	start := time.Now()
+	resp, err := client.Do(req)
+	if abandoned(ctx, "validation", logEntry) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return false
+	}
+	if err != nil {
+		logEntry.Warnln("Rejected hook, validator failed:", err)
+		w.WriteHeader(502)
+		return false
+	}
+	defer resp.Body.Close()
+	logEntry = logEntry.WithField("status", resp.StatusCode).WithField("duration", time.Since(start))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		logEntry.Debugln("Hook validated")
+		return true
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		logEntry.Infoln("Rejected hook, refused by validator")
+		reason, _ := ioutil.ReadAll(http.MaxBytesReader(w, resp.Body, maxValidationResponse))
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(reason)
+	default:
+		logEntry.Warnln("Rejected hook, validator failed")
+		w.WriteHeader(502)
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package sockethook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How old a Stripe signature timestamp may be before the hook is considered replayed
+var stripeTolerance = 5 * time.Minute
+
+// verifier checks that a hook was sent by the provider holding the secret
+type verifier struct {
+	provider string
+	// Start of the SHA-256 of the secret, identifying it without revealing it
+	keyID string
+	check func(r *http.Request, body []byte) bool
+}
+
+// Verification is the outcome of checking the signature of a hook, added to the messages of endpoints which
+// verify signatures
+type Verification struct {
+	Verified bool `json:"verified"`
+	// Provider and ID of the secret whose check passed, for verified hooks
+	Provider string `json:"provider,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+	// Who the provider says sent the hook, such as the GitHub repository or Stripe account, if it says
+	Signer string `json:"signer,omitempty"`
+}
+
+// Signature verifiers configured per endpoint, a hook is accepted if any of them passes
+var endpointVerifiers = make(map[string][]verifier)
+
+// Endpoints with signature verification which accept hooks failing it, marked as unverified
+var unverifiedEndpoints = make(map[string]bool)
+
+// Headers holding plain secrets per endpoint, which are removed before broadcasting
+var secretHeaders = make(map[string][]string)
+
+// setVerifiers parses rules of the form "/endpoint=provider:secret", or "/endpoint=hmac:Header:secret" for
+// generic HMAC signatures
+func setVerifiers(rules []string) error {
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return fmt.Errorf("invalid verification %q, expected /endpoint=provider:secret", rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+
+		v, secretHeader, err := parseVerifier(parts[1])
+		if err != nil {
+			return err
+		}
+		endpointVerifiers[endpoint] = append(endpointVerifiers[endpoint], v)
+		if secretHeader != "" {
+			secretHeaders[endpoint] = append(secretHeaders[endpoint], secretHeader)
+		}
+	}
+	return nil
+}
+
+// parseVerifier parses a verifier of the form "provider:secret" or "hmac:Header:secret", also returning the
+// header holding the plain secret for providers which send one
+func parseVerifier(spec string) (verifier, string, error) {
+	provider := strings.SplitN(spec, ":", 2)
+	if len(provider) != 2 || provider[1] == "" {
+		return verifier{}, "", fmt.Errorf("invalid verification %q, expected provider:secret", spec)
+	}
+	secret := []byte(provider[1])
+	v := verifier{provider: provider[0]}
+
+	secretHeader := ""
+	switch provider[0] {
+	case "github":
+		v.check = hmacVerifier("X-Hub-Signature-256", secret)
+	case "stripe":
+		v.check = stripeVerifier(secret)
+	case "gitlab":
+		v.check = tokenVerifier("X-Gitlab-Token", secret)
+		secretHeader = "X-Gitlab-Token"
+	case "hmac":
+		header := strings.SplitN(provider[1], ":", 2)
+		if len(header) != 2 || header[0] == "" || header[1] == "" {
+			return verifier{}, "", fmt.Errorf("invalid verification %q, expected hmac:Header:secret", spec)
+		}
+		secret = []byte(header[1])
+		v.check = hmacVerifier(header[0], secret)
+	default:
+		return verifier{}, "", fmt.Errorf("unknown verification provider %q, expected github, stripe, gitlab or hmac", provider[0])
+	}
+	fingerprint := sha256.Sum256(secret)
+	v.keyID = hex.EncodeToString(fingerprint[:4])
+	return v, secretHeader, nil
+}
+
+// setUnverifiedEndpoints sets the endpoints accepting hooks which fail signature verification
+func setUnverifiedEndpoints(endpoints []string) {
+	for _, endpoint := range endpoints {
+		unverifiedEndpoints[strings.TrimRight(endpoint, "/")] = true
+	}
+}
+
+// verifiersFor returns the verifiers of an endpoint given as options and in the configuration file, or those of
+// its rotated secret once it has been rotated through the admin API
+func verifiersFor(endpoint string) []verifier {
+	if verifiers, ok := rotatedVerifiers(endpoint); ok {
+		return verifiers
+	}
+	verifiers := endpointVerifiers[endpoint]
+	if settings := settingsFor(endpoint); settings != nil {
+		verifiers = append(verifiers[:len(verifiers):len(verifiers)], settings.verifiers...)
+	}
+	return verifiers
+}
+
+// verifySignature checks a hook against the verifiers of its endpoint and returns the outcome, nil for endpoints
+// without any. Hooks failing verification are only accepted on endpoints allowing unverified hooks.
+func verifySignature(r *http.Request, endpoint string, body []byte) (*Verification, bool) {
+	verifiers := verifiersFor(endpoint)
+	if len(verifiers) == 0 {
+		return nil, true
+	}
+	for _, v := range verifiers {
+		if v.check(r, body) {
+			return &Verification{Verified: true, Provider: v.provider, KeyID: v.keyID, Signer: signerOf(v.provider, r, body)}, true
+		}
+	}
+
+	allowed := unverifiedEndpoints[endpoint]
+	if settings := settingsFor(endpoint); settings != nil && settings.unverifiedOK {
+		allowed = true
+	}
+	return &Verification{Verified: false}, allowed
+}
+
+// signerOf returns who the provider of a verified hook says sent it, empty if it doesn't say
+func signerOf(provider string, r *http.Request, body []byte) string {
+	switch provider {
+	case "github":
+		// The repository, organization or app the hook was configured on
+		kind, id := r.Header.Get("X-GitHub-Hook-Installation-Target-Type"), r.Header.Get("X-GitHub-Hook-Installation-Target-ID")
+		if kind != "" && id != "" {
+			return kind + "/" + id
+		}
+	case "gitlab":
+		return r.Header.Get("X-Gitlab-Instance")
+	case "stripe":
+		// Events of connected accounts name the account
+		var event struct {
+			Account string `json:"account"`
+		}
+		json.Unmarshal(body, &event)
+		return event.Account
+	}
+	return ""
+}
+
+// secretHeadersFor returns the headers holding plain secrets of an endpoint, given as options, in the
+// configuration file and by rotating its secret
+func secretHeadersFor(endpoint string) []string {
+	if headers := rotatedSecretHeaders(endpoint); headers != nil {
+		return headers
+	}
+	headers := secretHeaders[endpoint]
+	if settings := settingsFor(endpoint); settings != nil {
+		headers = append(headers[:len(headers):len(headers)], settings.secretHeaders...)
+	}
+	return headers
+}
+
+// stripSecretHeaders removes headers holding plain secrets from a message, so they aren't sent to clients
+func stripSecretHeaders(msg *Message) {
+	for _, header := range secretHeadersFor(msg.Endpoint) {
+		delete(msg.Headers, header)
+		delete(msg.HeaderValues, header)
+	}
+}
+
+// hmacVerifier checks a header holding the HMAC-SHA256 of the body, hex or base64 encoded with an optional
+// "sha256=" prefix
+func hmacVerifier(header string, secret []byte) func(r *http.Request, body []byte) bool {
+	return func(r *http.Request, body []byte) bool {
+		signature := strings.TrimPrefix(r.Header.Get(header), "sha256=")
+		if signature == "" {
+			return false
+		}
+		expected := computeHMAC(secret, body)
+		if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+			return true
+		}
+		decoded, err := base64.StdEncoding.DecodeString(signature)
+		return err == nil && hmac.Equal(decoded, expected)
+	}
+}
+
+// stripeVerifier checks the Stripe-Signature header, which signs the timestamp and body and may hold several
+// v1 signatures while secrets are being rolled
+func stripeVerifier(secret []byte) func(r *http.Request, body []byte) bool {
+	return func(r *http.Request, body []byte) bool {
+		var timestamp string
+		var signatures [][]byte
+		for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				timestamp = kv[1]
+			case "v1":
+				if decoded, err := hex.DecodeString(kv[1]); err == nil {
+					signatures = append(signatures, decoded)
+				}
+			}
+		}
+
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age > stripeTolerance || age < -stripeTolerance {
+			return false
+		}
+
+		expected := computeHMAC(secret, append([]byte(timestamp+"."), body...))
+		for _, signature := range signatures {
+			if hmac.Equal(signature, expected) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// tokenVerifier checks a header holding the secret itself, as sent by GitLab
+func tokenVerifier(header string, secret []byte) func(r *http.Request, body []byte) bool {
+	return func(r *http.Request, body []byte) bool {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(header)), secret) == 1
+	}
+}
+
+// computeHMAC returns the HMAC-SHA256 of data
+func computeHMAC(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
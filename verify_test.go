@@ -0,0 +1,108 @@
+package sockethook
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifiers(t *testing.T) {
+	body := `{"id": 42}`
+	sign := func(secret string, data string) []byte { return computeHMAC([]byte(secret), []byte(data)) }
+	stripeHeader := func(secret string, at time.Time, signed string) string {
+		timestamp := fmt.Sprint(at.Unix())
+		return "t=" + timestamp + ",v1=" + hex.EncodeToString(sign(secret, timestamp+"."+signed))
+	}
+
+	tests := []struct {
+		name   string
+		spec   string
+		header string
+		value  string
+		body   string
+		valid  bool
+	}{
+		{"github", "github:s3cr3t", "X-Hub-Signature-256", "sha256=" + hex.EncodeToString(sign("s3cr3t", body)), body, true},
+		{"github tampered body", "github:s3cr3t", "X-Hub-Signature-256", "sha256=" + hex.EncodeToString(sign("s3cr3t", body)), `{"id": 43}`, false},
+		{"github wrong secret", "github:s3cr3t", "X-Hub-Signature-256", "sha256=" + hex.EncodeToString(sign("other", body)), body, false},
+		{"github missing signature", "github:s3cr3t", "X-Hub-Signature-256", "", body, false},
+		{"hmac base64", "hmac:X-Signature:s3cr3t", "X-Signature", base64.StdEncoding.EncodeToString(sign("s3cr3t", body)), body, true},
+		{"hmac other header", "hmac:X-Signature:s3cr3t", "X-Hub-Signature-256", hex.EncodeToString(sign("s3cr3t", body)), body, false},
+		{"stripe", "stripe:whsec", "Stripe-Signature", stripeHeader("whsec", time.Now(), body), body, true},
+		{"stripe rolled secret", "stripe:whsec", "Stripe-Signature", stripeHeader("whsec", time.Now(), body) + ",v1=" + hex.EncodeToString(sign("old", body)), body, true},
+		{"stripe tampered body", "stripe:whsec", "Stripe-Signature", stripeHeader("whsec", time.Now(), body), `{"id": 43}`, false},
+		{"stripe wrong secret", "stripe:whsec", "Stripe-Signature", stripeHeader("other", time.Now(), body), body, false},
+		{"stripe stale timestamp", "stripe:whsec", "Stripe-Signature", stripeHeader("whsec", time.Now().Add(-stripeTolerance-time.Minute), body), body, false},
+		{"stripe future timestamp", "stripe:whsec", "Stripe-Signature", stripeHeader("whsec", time.Now().Add(stripeTolerance+time.Minute), body), body, false},
+		{"stripe without timestamp", "stripe:whsec", "Stripe-Signature", "v1=" + hex.EncodeToString(sign("whsec", "."+body)), body, false},
+		{"gitlab", "gitlab:t0ken", "X-Gitlab-Token", "t0ken", body, true},
+		{"gitlab wrong token", "gitlab:t0ken", "X-Gitlab-Token", "t0ken!", body, false},
+	}
+	for _, test := range tests {
+		v, _, err := parseVerifier(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		r := httptest.NewRequest("POST", "/hook/orders", strings.NewReader(test.body))
+		if test.value != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if valid := v.check(r, []byte(test.body)); valid != test.valid {
+			t.Errorf("%s: valid = %v, expected %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestParseVerifier(t *testing.T) {
+	for _, spec := range []string{"github", "github:", "unknown:secret", "hmac:secret", "hmac::secret", "hmac:X-Signature:"} {
+		if _, _, err := parseVerifier(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+	v, secretHeader, err := parseVerifier("gitlab:t0ken")
+	if err != nil || secretHeader != "X-Gitlab-Token" || len(v.keyID) != 8 {
+		t.Errorf("gitlab verifier %+v with secret header %q: %v", v, secretHeader, err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const endpoint = "/test/verify"
+	const unverified = "/test/verify/unverified"
+	if err := setVerifiers([]string{endpoint + "=github:old", endpoint + "=github:new", unverified + "=gitlab:t0ken"}); err != nil {
+		t.Fatal(err)
+	}
+	setUnverifiedEndpoints([]string{unverified})
+	defer func() {
+		delete(endpointVerifiers, endpoint)
+		delete(endpointVerifiers, unverified)
+		delete(secretHeaders, unverified)
+		delete(unverifiedEndpoints, unverified)
+	}()
+
+	body := []byte(`{"id": 42}`)
+	r := httptest.NewRequest("POST", "/hook"+endpoint, nil)
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(computeHMAC([]byte("new"), body)))
+	verification, accepted := verifySignature(r, endpoint, body)
+	if !accepted || !verification.Verified || verification.Provider != "github" {
+		t.Errorf("hook signed with the second secret: %+v, accepted %v", verification, accepted)
+	}
+	// The key ID tells which of the secrets the hook was signed with
+	if v, _, _ := parseVerifier("github:new"); verification.KeyID != v.keyID {
+		t.Errorf("key ID %q, expected %q", verification.KeyID, v.keyID)
+	}
+
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(computeHMAC([]byte("new"), []byte("tampered"))))
+	if verification, accepted := verifySignature(r, endpoint, body); accepted || verification.Verified {
+		t.Errorf("tampered hook accepted: %+v", verification)
+	}
+	if verification, accepted := verifySignature(httptest.NewRequest("POST", "/hook"+unverified, nil), unverified, body); !accepted || verification.Verified {
+		t.Errorf("unverified hook on an endpoint accepting them: %+v, accepted %v", verification, accepted)
+	}
+	if verification, accepted := verifySignature(r, "/test/verify/none", body); !accepted || verification != nil {
+		t.Errorf("hook to an endpoint without verification: %+v, accepted %v", verification, accepted)
+	}
+}
@@ -0,0 +1,86 @@
+package sockethook
+
+import "time"
+
+// Maximum number of clients per endpoint, 0 means unlimited
+var maxClients int
+
+// How long connections are held waiting for a free slot when an endpoint is full, 0 rejects them immediately
+var waitlistTimeout time.Duration
+
+// Maximum number of connections waiting for a slot per endpoint
+var waitlistSize = 100
+
+// Slots taken by connections which are being upgraded but aren't registered yet, guarded by hub.mu
+var reserved = make(map[string]int)
+
+// Number of connections currently waiting for a slot per endpoint
+var waiting = make(map[string]int)
+
+// Closed and replaced every time a client leaves, waking up all waiting connections
+var slotFreed = make(chan struct{})
+
+// acquireSlot reserves a client slot on an endpoint, waiting in the waitlist if the endpoint is full.
+// Returns false if no slot could be reserved.
+func acquireSlot(endpoint string) bool {
+	if maxClients <= 0 {
+		return true
+	}
+
+	deadline := time.Now().Add(waitlistTimeout)
+	queued := false
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for {
+		if len(hub.clients[endpoint])+reserved[endpoint] < maxClients {
+			reserved[endpoint]++
+			if queued {
+				waiting[endpoint]--
+			}
+			return true
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || (!queued && waiting[endpoint] >= waitlistSize) {
+			if queued {
+				waiting[endpoint]--
+			}
+			return false
+		}
+
+		if !queued {
+			waiting[endpoint]++
+			queued = true
+		}
+
+		// Wait for any client to leave or the deadline to pass, then check again
+		freed := slotFreed
+		hub.mu.Unlock()
+		select {
+		case <-freed:
+		case <-time.After(remaining):
+		}
+		hub.mu.Lock()
+	}
+}
+
+// releaseSlot gives back a reserved slot, must be called with hub.mu held
+func releaseSlot(endpoint string) {
+	if maxClients <= 0 {
+		return
+	}
+
+	reserved[endpoint]--
+	if reserved[endpoint] <= 0 {
+		delete(reserved, endpoint)
+	}
+	notifySlotFreed()
+}
+
+// notifySlotFreed wakes up all connections in the waitlist, must be called with hub.mu held
+func notifySlotFreed() {
+	close(slotFreed)
+	slotFreed = make(chan struct{})
+}
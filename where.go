@@ -0,0 +1,201 @@
+package sockethook
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of where conditions a client may give
+var maxWhereConditions = 32
+
+// where is a set of equality conditions given when connecting as ?where=path:value, which the messages of the
+// endpoint the client connected to must meet. Unlike filters, conditions are checked against the message as is,
+// without encoding it as JSON, which makes them cheap enough for routing on busy endpoints. A message meets
+// the conditions if for every path it has one of the values given for that path.
+type where struct {
+	conditions []whereCondition
+}
+
+// whereCondition is a path into the message and the values it may have
+type whereCondition struct {
+	path   []string
+	source string
+	values map[string]bool
+}
+
+// parseWhere parses conditions given as path:value, such as data.region:eu-west or headers.X-Github-Event:push
+func parseWhere(rules []string) (*where, error) {
+	if len(rules) > maxWhereConditions {
+		return nil, fmt.Errorf("more than %d where conditions", maxWhereConditions)
+	}
+
+	w := &where{}
+	byPath := make(map[string]int)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid where condition %q, expected path:value", rule)
+		}
+		path := strings.Split(parts[0], ".")
+		switch path[0] {
+		case "data", "metadata", "query":
+		case "headers":
+			if len(path) != 2 {
+				return nil, fmt.Errorf("invalid where condition %q, expected headers.Name", rule)
+			}
+			path[1] = http.CanonicalHeaderKey(path[1])
+		case "endpoint", "method":
+			if len(path) != 1 {
+				return nil, fmt.Errorf("invalid where condition %q, %s has no fields", rule, path[0])
+			}
+		default:
+			return nil, fmt.Errorf("invalid where condition %q, unknown field %s", rule, path[0])
+		}
+		for _, key := range path {
+			if key == "" {
+				return nil, fmt.Errorf("invalid where condition %q, empty key in path", rule)
+			}
+		}
+
+		i, ok := byPath[parts[0]]
+		if !ok {
+			i = len(w.conditions)
+			byPath[parts[0]] = i
+			w.conditions = append(w.conditions, whereCondition{path: path, source: parts[0], values: make(map[string]bool)})
+		}
+		w.conditions[i].values[parts[1]] = true
+	}
+	return w, nil
+}
+
+// connectWhere parses the conditions given when connecting in where query parameters, rejecting the request
+// with 400 if they're invalid
+func connectWhere(w http.ResponseWriter, r *http.Request, logEntry *log.Entry) (*where, bool) {
+	rules := r.URL.Query()["where"]
+	if len(rules) == 0 {
+		return nil, true
+	}
+	conditions, err := parseWhere(rules)
+	if err != nil {
+		logEntry.Warnln("Rejected client, invalid where condition:", err)
+		rejectClient(w, 400, "invalid_where", err.Error())
+		return nil, false
+	}
+	return conditions, true
+}
+
+// Match checks if a message meets all conditions
+func (w *where) Match(msg Message) bool {
+	for _, c := range w.conditions {
+		if !c.match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c whereCondition) match(msg Message) bool {
+	switch c.path[0] {
+	case "endpoint":
+		return c.values[msg.Endpoint]
+	case "method":
+		return c.values[msg.Method]
+	case "headers":
+		value, ok := msg.Headers[c.path[1]]
+		return ok && c.values[value]
+	case "query":
+		if len(c.path) != 2 {
+			return false
+		}
+		for _, value := range msg.Query[c.path[1]] {
+			if c.values[value] {
+				return true
+			}
+		}
+		return false
+	case "metadata":
+		return c.matchValue(lookupPath(map[string]interface{}(msg.Metadata), c.path[1:]))
+	default:
+		return c.matchValue(lookupPath(msg.Data, c.path[1:]))
+	}
+}
+
+// matchValue checks a decoded JSON value against the values of the condition, numbers, booleans and null being
+// compared in their JSON form
+func (c whereCondition) matchValue(value interface{}, ok bool) bool {
+	if !ok {
+		return false
+	}
+	switch v := value.(type) {
+	case string:
+		return c.values[v]
+	case float64:
+		return c.values[strconv.FormatFloat(v, 'f', -1, 64)]
+	case bool:
+		return c.values[strconv.FormatBool(v)]
+	case nil:
+		return c.values["null"]
+	}
+	return false
+}
+
+// lookupPath looks up a value in decoded JSON by object keys and array indices
+func lookupPath(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// rules returns the conditions as they were given, sorted
+func (w *where) rules() []string {
+	rules := []string{}
+	for _, c := range w.conditions {
+		for value := range c.values {
+			rules = append(rules, c.source+":"+value)
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// wheresFor returns the conditions of the clients which receive a message on an endpoint only through the
+// endpoint they connected to, which is the subscription their conditions apply to. Must be called with h.mu held.
+func (h *Hub) wheresFor(conns []*client, endpoint string) map[*client]*where {
+	wheres := make(map[*client]*where)
+	for _, c := range conns {
+		if c.where == nil || !c.subscriptions[c.endpoint] {
+			continue
+		}
+		other := false
+		for subscription := range c.subscriptions {
+			if subscription != c.endpoint && (subscription == endpoint || (isPattern(subscription) && patternCovers(subscription, endpoint))) {
+				other = true
+				break
+			}
+		}
+		if !other {
+			wheres[c] = c.where
+		}
+	}
+	return wheres
+}
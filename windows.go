@@ -0,0 +1,306 @@
+package sockethook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of messages held per endpoint outside its delivery window before the oldest are dead-lettered
+var windowBufferSize = 10000
+
+// Delivery windows of endpoints given on the command line
+var deliveryWindows = newWindowHolder(nil)
+
+// Names of weekdays in delivery windows, in the order of time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// timeWindow is the time of day, on some days of the week in a timezone, during which an endpoint's
+// messages are delivered. Windows ending before they start run past midnight, into the next day.
+type timeWindow struct {
+	spec     string
+	days     [7]bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+// windowHolder holds back the messages of endpoints outside their delivery window, delivering them in order
+// once the window opens
+type windowHolder struct {
+	windows map[string]timeWindow
+
+	mu     sync.Mutex
+	states map[string]*windowState
+}
+
+// windowState holds the messages of an endpoint waiting for its window to open
+type windowState struct {
+	window timeWindow
+	timer  *time.Timer
+	held   []Message
+}
+
+func newWindowHolder(windows map[string]timeWindow) *windowHolder {
+	return &windowHolder{windows: windows, states: make(map[string]*windowState)}
+}
+
+// parseDeliveryWindows parses delivery windows of the form /endpoint=[days ]HH:MM-HH:MM[ timezone], such as
+// "/reports=mon-fri 08:00-20:00 Europe/Stockholm". Days are names like mon, separated by commas or as ranges,
+// every day if they're left out, and the timezone defaults to the local one.
+func parseDeliveryWindows(rules []string) (map[string]timeWindow, error) {
+	windows := make(map[string]timeWindow)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !validPattern(parts[0]) {
+			return nil, fmt.Errorf("invalid delivery window %q, expected /endpoint=[days ]HH:MM-HH:MM[ timezone]", rule)
+		}
+		endpoint := strings.TrimRight(parts[0], "/")
+		if isReserved(endpoint) {
+			return nil, fmt.Errorf("invalid delivery window %q, endpoint is reserved", rule)
+		}
+		window, err := parseDeliveryWindow(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		windows[endpoint] = window
+	}
+	return windows, nil
+}
+
+// parseDeliveryWindow parses a window as [days ]HH:MM-HH:MM[ timezone]
+func parseDeliveryWindow(spec string) (timeWindow, error) {
+	window := timeWindow{spec: spec, location: time.Local}
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		if err := parseWeekdays(fields[0], &window.days); err != nil {
+			return timeWindow{}, fmt.Errorf("invalid delivery window %q: %v", spec, err)
+		}
+		fields = fields[1:]
+	} else {
+		for day := range window.days {
+			window.days[day] = true
+		}
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q, expected [days ]HH:MM-HH:MM[ timezone]", spec)
+	}
+
+	times := strings.SplitN(fields[0], "-", 2)
+	var err error
+	if len(times) != 2 {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q, expected HH:MM-HH:MM", spec)
+	}
+	if window.start, err = parseTimeOfDay(times[0]); err != nil {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q: %v", spec, err)
+	}
+	if window.end, err = parseTimeOfDay(times[1]); err != nil {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q: %v", spec, err)
+	}
+	if window.start == 24*60 {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q, it can't start at 24:00", spec)
+	}
+	if window.start == window.end {
+		return timeWindow{}, fmt.Errorf("invalid delivery window %q, it starts when it ends", spec)
+	}
+	if len(fields) == 2 {
+		if window.location, err = time.LoadLocation(fields[1]); err != nil {
+			return timeWindow{}, fmt.Errorf("invalid delivery window %q, unknown timezone %q", spec, fields[1])
+		}
+	}
+	return window, nil
+}
+
+// parseWeekdays parses days of the week such as mon-fri or sat,sun, ranges wrapping around the end of the week
+func parseWeekdays(value string, days *[7]bool) error {
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdayIndex(bounds[0])
+		if !ok {
+			return fmt.Errorf("unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdayIndex(bounds[1]); !ok {
+				return fmt.Errorf("unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func weekdayIndex(name string) (int, bool) {
+	for i, weekday := range weekdayNames {
+		if name == weekday {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight, accepting 24:00 as the end of the day
+func parseTimeOfDay(value string) (int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// open checks if the window is open at a time
+func (w timeWindow) open(t time.Time) bool {
+	t = t.In(w.location)
+	day, minute := int(t.Weekday()), t.Hour()*60+t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// Windows past midnight belong to the day they start on
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// next returns when the window opens next after a time
+func (w timeWindow) next(t time.Time) time.Time {
+	t = t.In(w.location)
+	for i := 0; i <= 7; i++ {
+		day := t.AddDate(0, 0, i)
+		opens := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.location)
+		if w.days[int(opens.Weekday())] && opens.After(t) {
+			return opens
+		}
+	}
+	return t.Add(24 * time.Hour)
+}
+
+// window returns the delivery window of an endpoint, an exact window taking precedence over patterns
+func (h *windowHolder) window(endpoint string) (timeWindow, bool) {
+	if window, ok := h.windows[endpoint]; ok {
+		return window, true
+	}
+	for pattern, window := range h.windows {
+		if isPattern(pattern) && patternCovers(pattern, endpoint) {
+			return window, true
+		}
+	}
+	return timeWindow{}, false
+}
+
+// Hold checks if a message is held back until its endpoint's delivery window opens, returning false if it's to
+// be delivered right away. Messages arriving while held ones are still being delivered queue up behind them, so
+// that the order of an endpoint's messages is kept.
+func (h *windowHolder) Hold(msg Message) bool {
+	if len(h.windows) == 0 || isReserved(msg.Endpoint) {
+		return false
+	}
+	window, ok := h.window(msg.Endpoint)
+	if !ok {
+		return false
+	}
+	endpoint := msg.Endpoint
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.states[endpoint]
+	if !ok {
+		now := time.Now()
+		if window.open(now) {
+			return false
+		}
+		opens := window.next(now)
+		s = &windowState{window: window}
+		s.timer = time.AfterFunc(time.Until(opens), func() { h.release(endpoint) })
+		h.states[endpoint] = s
+		log.WithField("endpoint", endpoint).WithField("opens", opens.Format(time.RFC3339)).Infoln("Holding messages until the delivery window opens")
+	}
+
+	s.held = append(s.held, msg)
+	metrics.windowed.Inc("held")
+	if len(s.held) > windowBufferSize {
+		dropped := s.held[0]
+		s.held = s.held[1:]
+		metrics.windowed.Inc("dropped")
+		postDeadLetter(DeadLetter{Endpoint: endpoint, Reason: "delivery window buffer full", Message: dropped})
+	}
+	return true
+}
+
+// release delivers the held messages of an endpoint in order once its window opened, as fast as its dispatch
+// queue takes them. Messages still held when the window closes again wait for it to open next.
+func (h *windowHolder) release(endpoint string) {
+	released := 0
+	for {
+		h.mu.Lock()
+		s, ok := h.states[endpoint]
+		if !ok {
+			h.mu.Unlock()
+			break
+		}
+		if len(s.held) == 0 {
+			delete(h.states, endpoint)
+			h.mu.Unlock()
+			break
+		}
+		if now := time.Now(); !s.window.open(now) {
+			s.timer = time.AfterFunc(time.Until(s.window.next(now)), func() { h.release(endpoint) })
+			h.mu.Unlock()
+			break
+		}
+		msg := s.held[0]
+		s.held = s.held[1:]
+		h.mu.Unlock()
+
+		// Wait for room in the dispatch queue, which would drop messages released faster than they're delivered
+		for queueLength(endpoint) >= endpointQueueSize {
+			time.Sleep(10 * time.Millisecond)
+		}
+		msg.windowed = true
+		// Holding back is deliberate, so latency budgets count from the release
+		msg.received = time.Now()
+		metrics.windowed.Inc("released")
+		hub.Broadcast(msg)
+		released++
+	}
+
+	if released > 0 {
+		log.WithField("endpoint", endpoint).WithField("messages", released).Infoln("Delivered messages held until the delivery window opened")
+	}
+}
+
+// DeadLetterAll dead-letters all held messages instead of delivering them outside their window, such as when
+// shutting down
+func (h *windowHolder) DeadLetterAll() {
+	h.mu.Lock()
+	states := h.states
+	h.states = make(map[string]*windowState)
+	h.mu.Unlock()
+
+	for endpoint, s := range states {
+		s.timer.Stop()
+		if len(s.held) == 0 {
+			continue
+		}
+		log.WithField("endpoint", endpoint).WithField("messages", len(s.held)).Warnln("Dead-lettering messages held until the delivery window opens")
+		for _, msg := range s.held {
+			metrics.windowed.Inc("dropped")
+			postDeadLetter(DeadLetter{Endpoint: endpoint, Reason: "shut down outside delivery window", Message: msg})
+		}
+	}
+}
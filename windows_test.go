@@ -0,0 +1,116 @@
+package sockethook
+
+import (
+	"testing"
+	"time"
+)
+
+// testLocation loads a timezone, skipping the test if the timezone database isn't installed
+func testLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s unavailable: %v", name, err)
+	}
+	return location
+}
+
+func TestTimeWindowPastMidnight(t *testing.T) {
+	window, err := parseDeliveryWindow("mon-fri 22:00-02:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2026-10-12 is a Monday
+	at := func(day, hour, minute int) time.Time { return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		t    time.Time
+		open bool
+		next time.Time
+	}{
+		{"monday before the start", at(12, 21, 59), false, at(12, 22, 0)},
+		{"monday at the start", at(12, 22, 0), true, at(13, 22, 0)},
+		{"monday night", at(12, 23, 30), true, at(13, 22, 0)},
+		{"tuesday past midnight", at(13, 1, 59), true, at(13, 22, 0)},
+		{"tuesday at the end", at(13, 2, 0), false, at(13, 22, 0)},
+		// The small hours of Monday belong to Sunday's window, which isn't one of the days
+		{"monday past midnight", at(12, 1, 0), false, at(12, 22, 0)},
+		{"saturday past midnight", at(17, 1, 0), true, at(19, 22, 0)},
+		{"saturday night", at(17, 23, 0), false, at(19, 22, 0)},
+		{"sunday past midnight", at(18, 1, 0), false, at(19, 22, 0)},
+	}
+	for _, test := range tests {
+		if open := window.open(test.t); open != test.open {
+			t.Errorf("%s: open = %v, expected %v", test.name, open, test.open)
+		}
+		if next := window.next(test.t); !next.Equal(test.next) {
+			t.Errorf("%s: next = %v, expected %v", test.name, next, test.next)
+		}
+	}
+
+	// Times are compared in the window's timezone
+	east := time.FixedZone("east", 3*3600)
+	if window.open(time.Date(2026, 10, 12, 23, 30, 0, 0, east)) || !window.open(time.Date(2026, 10, 13, 1, 30, 0, 0, east)) {
+		t.Error("window not open from 22:00 UTC given three hours east")
+	}
+}
+
+func TestTimeWindowAcrossDST(t *testing.T) {
+	stockholm := testLocation(t, "Europe/Stockholm")
+	window, err := parseDeliveryWindow("08:00-09:00 Europe/Stockholm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clocks go forward an hour on 2026-03-29 and back an hour on 2026-10-25, so the window opens 23 and 25
+	// hours after it opened the day before
+	for _, test := range []struct {
+		day   time.Time
+		hours time.Duration
+	}{
+		{time.Date(2026, 3, 28, 8, 0, 0, 0, stockholm), 23},
+		{time.Date(2026, 10, 24, 8, 0, 0, 0, stockholm), 25},
+	} {
+		next := window.next(test.day)
+		if expected := test.day.AddDate(0, 0, 1); !next.Equal(expected) || next.Sub(test.day) != test.hours*time.Hour {
+			t.Errorf("next after %v = %v, expected %v", test.day, next, expected)
+		}
+		if !window.open(next) || !window.open(next.Add(59*time.Minute)) || window.open(next.Add(time.Hour)) {
+			t.Errorf("window not open from 08:00 to 09:00 on %v", next)
+		}
+	}
+
+	// A window starting in the hour skipped when clocks go forward opens once they did
+	skipped, err := parseDeliveryWindow("02:30-04:00 Europe/Stockholm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Date(2026, 3, 29, 1, 0, 0, 0, stockholm)
+	next := skipped.next(before)
+	if !next.After(before) || next.Sub(before) > 3*time.Hour || !skipped.open(next) {
+		t.Errorf("next after %v = %v, expected a time on the same morning the window is open", before, next)
+	}
+	if skipped.open(time.Date(2026, 3, 29, 1, 59, 0, 0, stockholm)) || !skipped.open(time.Date(2026, 3, 29, 3, 0, 0, 0, stockholm)) {
+		t.Error("window not opened by clocks going forward from 02:00 to 03:00")
+	}
+}
+
+func TestParseDeliveryWindow(t *testing.T) {
+	window, err := parseDeliveryWindow("sat,sun,wed-mon 00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window.days != [7]bool{true, true, false, true, true, true, true} || window.start != 0 || window.end != 24*60 || window.location != time.Local {
+		t.Errorf("unexpected window %+v", window)
+	}
+
+	for _, spec := range []string{
+		"", "mon-fri", "08:00", "8-20", "08:00-20", "08:60-20:00", "25:00-26:00", "24:00-08:00", "08:00-08:00",
+		"funday 08:00-20:00", "mon-someday 08:00-20:00", "08:00-20:00 Mars/Olympus", "mon 08:00-20:00 UTC extra",
+	} {
+		if _, err := parseDeliveryWindow(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}